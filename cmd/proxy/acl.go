@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"os"
+	"strings"
+)
+
+var errACLDenied = errors.New("destination denied by the ACL")
+
+// aclRule allows or denies the destinations matching its pattern, matchHost
+// is nil for IP and CIDR patterns and matchIP for host name patterns
+type aclRule struct {
+	allow     bool
+	matchHost func(host string) bool
+	matchIP   func(ip net.IP) bool
+}
+
+// acl is a list of rules read from an ACL file. IP and CIDR rules apply to
+// the addresses a host name resolves to, so a name can't bypass them: Allow
+// allows a name when one of its addresses is allowed and Dial and PacketDial
+// only connect to allowed addresses.
+type acl struct {
+	rules []aclRule
+	// resolver looks up the addresses of host names, net.DefaultResolver if
+	// nil
+	resolver statute.Resolver
+}
+
+// loadACL reads the ACL file at path, see parseACL
+func loadACL(path string) (*acl, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	a, err := parseACL(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+// parseACL reads one "allow <pattern>" or "deny <pattern>" rule per line,
+// blank lines and lines starting with # are ignored. A pattern is an IP, a
+// CIDR, a host name, "*.domain" matching the subdomains of domain, or "*"
+// matching everything. The first rule matching the destination applies,
+// destinations no rule matches are allowed so an allowlist ends with
+// "deny *". Host names are resolved to match IP and CIDR rules.
+func parseACL(r io.Reader) (*acl, error) {
+	a := &acl{}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want \"allow|deny <pattern>\", got %q", line, text)
+		}
+		rule := matcher(fields[1])
+		switch fields[0] {
+		case "allow":
+			rule.allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("line %d: unknown action %q", line, fields[0])
+		}
+		a.rules = append(a.rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Allow is the statute.ACL of a, a host name is allowed when one of its
+// addresses is. An unresolvable name is only matched against the host name
+// rules, dialing it fails anyway.
+func (a *acl) Allow(ctx context.Context, _ string, host string, _ int) bool {
+	if ip := net.ParseIP(host); ip != nil {
+		return a.decide("", ip)
+	}
+	ips, err := a.lookup(ctx, host)
+	if err != nil || len(ips) == 0 {
+		return a.decide(host, nil)
+	}
+	for _, ip := range ips {
+		if a.decide(host, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Dial wraps dial so it only connects to the allowed addresses of the
+// destination, a host name is resolved and its allowed addresses are tried
+// in order. This closes the gap between the check of a name by Allow and
+// the resolution of the dial, which could return other addresses.
+func (a *acl) Dial(dial statute.ProxyDialFunc) statute.ProxyDialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip != nil {
+			if !a.decide("", ip) {
+				return nil, fmt.Errorf("%w: %s", errACLDenied, address)
+			}
+			return dial(ctx, network, address)
+		}
+		ips, err := a.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		dialErr := fmt.Errorf("%w: %s", errACLDenied, address)
+		for _, ip := range ips {
+			if !a.decide(host, ip) {
+				continue
+			}
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
+
+// PacketDial wraps dial so it refuses the addresses the rules deny, the
+// socks5 server resolves the targets of datagrams before dialing them
+func (a *acl) PacketDial(dial statute.ProxyPacketDialFunc) statute.ProxyPacketDialFunc {
+	return func(ctx context.Context, network, address string) (net.PacketConn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if ip := net.ParseIP(host); ip == nil || !a.decide("", ip) {
+			return nil, fmt.Errorf("%w: %s", errACLDenied, address)
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// decide returns the action of the first rule matching host or ip, either
+// may be empty
+func (a *acl) decide(host string, ip net.IP) bool {
+	for _, rule := range a.rules {
+		if ip != nil && rule.matchIP != nil && rule.matchIP(ip) {
+			return rule.allow
+		}
+		if host != "" && rule.matchHost != nil && rule.matchHost(host) {
+			return rule.allow
+		}
+	}
+	return true
+}
+
+// lookup resolves host with the resolver of a
+func (a *acl) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	resolver := a.resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return resolver.LookupIP(ctx, "ip", host)
+}
+
+// matcher returns the rule of an ACL pattern, without its action
+func matcher(pattern string) aclRule {
+	if pattern == "*" {
+		return aclRule{
+			matchHost: func(string) bool { return true },
+			matchIP:   func(net.IP) bool { return true },
+		}
+	}
+	if _, network, err := net.ParseCIDR(pattern); err == nil {
+		return aclRule{matchIP: network.Contains}
+	}
+	if ip := net.ParseIP(pattern); ip != nil {
+		return aclRule{matchIP: ip.Equal}
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok && strings.HasPrefix(suffix, ".") {
+		return aclRule{matchHost: func(host string) bool {
+			return len(host) > len(suffix) && strings.HasSuffix(strings.ToLower(host), strings.ToLower(suffix))
+		}}
+	}
+	return aclRule{matchHost: func(host string) bool {
+		return strings.EqualFold(strings.TrimSuffix(host, "."), strings.TrimSuffix(pattern, "."))
+	}}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeResolver maps host names to their addresses, other names don't exist
+type fakeResolver map[string][]net.IP
+
+func (r fakeResolver) LookupIP(_ context.Context, _ string, host string) ([]net.IP, error) {
+	ips, ok := r[host]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+// mustParseACL parses input and resolves names with resolver
+func mustParseACL(t testing.TB, input string, resolver fakeResolver) *acl {
+	t.Helper()
+	a, err := parseACL(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.resolver = resolver
+	return a
+}
+
+func TestParseACL(t *testing.T) {
+	a := mustParseACL(t, `
+# internal networks
+deny 10.0.0.0/8
+deny 192.168.1.1
+allow intranet.example.com
+deny *.example.com
+deny blocked.test
+`, fakeResolver{
+		"intranet.example.com": {net.IPv4(172, 16, 0, 1)},
+		"internal.test":        {net.IPv4(10, 1, 2, 3)},
+		"router.test":          {net.IPv4(192, 168, 1, 1)},
+		"mixed.test":           {net.IPv4(10, 1, 2, 3), net.IPv4(11, 1, 2, 3)},
+		"public.test":          {net.IPv4(11, 1, 2, 3)},
+	})
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"10.1.2.3", false},
+		{"11.1.2.3", true},
+		{"192.168.1.1", false},
+		{"192.168.1.2", true},
+		{"intranet.example.com", true},
+		{"www.example.com", false},
+		{"WWW.Example.COM", false},
+		{"example.com", true},
+		{"blocked.test", false},
+		{"Blocked.Test.", false},
+		{"notblocked.test", true},
+		{"other.org", true},
+		// names are resolved for the IP and CIDR rules
+		{"internal.test", false},
+		{"router.test", false},
+		{"public.test", true},
+		// allowed since one address is, see TestACLDial
+		{"mixed.test", true},
+	}
+	for _, tt := range tests {
+		if got := a.Allow(context.Background(), "tcp", tt.host, 443); got != tt.want {
+			t.Errorf("Allow(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestParseACLAllowlist(t *testing.T) {
+	a := mustParseACL(t, "allow 127.0.0.1\ndeny *\n", fakeResolver{
+		"localhost": {net.IPv4(127, 0, 0, 1)},
+		"elsewhere": {net.IPv4(127, 0, 0, 2)},
+	})
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"localhost", true},
+		{"127.0.0.2", false},
+		{"elsewhere", false},
+		{"unresolvable", false},
+	}
+	for _, tt := range tests {
+		if got := a.Allow(context.Background(), "tcp", tt.host, 80); got != tt.want {
+			t.Errorf("Allow(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestACLDial(t *testing.T) {
+	a := mustParseACL(t, "deny 10.0.0.0/8\n", fakeResolver{
+		"internal.test": {net.IPv4(10, 1, 2, 3)},
+		"mixed.test":    {net.IPv4(10, 1, 2, 3), net.IPv4(11, 1, 2, 3)},
+	})
+	var dialed []string
+	dial := a.Dial(func(_ context.Context, _, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		return nil, errors.New("not connected")
+	})
+
+	tests := []struct {
+		address    string
+		wantDialed []string
+	}{
+		{"10.1.2.3:80", nil},
+		{"internal.test:80", nil},
+		// only the allowed address of the name is dialed
+		{"mixed.test:80", []string{"11.1.2.3:80"}},
+		{"11.1.2.3:80", []string{"11.1.2.3:80"}},
+	}
+	for _, tt := range tests {
+		dialed = nil
+		_, err := dial(context.Background(), "tcp", tt.address)
+		if tt.wantDialed == nil && !errors.Is(err, errACLDenied) {
+			t.Errorf("dial(%q) = %v, want %v", tt.address, err, errACLDenied)
+		}
+		if strings.Join(dialed, ",") != strings.Join(tt.wantDialed, ",") {
+			t.Errorf("dial(%q) dialed %v, want %v", tt.address, dialed, tt.wantDialed)
+		}
+	}
+
+	packetDial := a.PacketDial(func(context.Context, string, string) (net.PacketConn, error) {
+		return nil, errors.New("not listening")
+	})
+	if _, err := packetDial(context.Background(), "udp4", "10.1.2.3:53"); !errors.Is(err, errACLDenied) {
+		t.Errorf("packet dial to a denied address = %v, want %v", err, errACLDenied)
+	}
+	if _, err := packetDial(context.Background(), "udp4", "11.1.2.3:53"); errors.Is(err, errACLDenied) {
+		t.Errorf("packet dial to an allowed address was denied")
+	}
+}
+
+func TestParseACLErrors(t *testing.T) {
+	tests := []string{
+		"allow",
+		"permit 10.0.0.0/8",
+		"deny 10.0.0.0/8 extra",
+	}
+	for _, input := range tests {
+		if _, err := parseACL(strings.NewReader(input)); err == nil {
+			t.Errorf("parseACL(%q) succeeded, want an error", input)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"flag"
+	"github.com/bepass-org/proxy/pkg/http"
+	"github.com/bepass-org/proxy/pkg/mixed"
+	"github.com/bepass-org/proxy/pkg/proxy"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// envSOCKSUser and envSOCKSPass provide the credentials when the flags
+	// are not set, which keeps the password out of the process list
+	envSOCKSUser = "PROXY_SOCKS_USER"
+	envSOCKSPass = "PROXY_SOCKS_PASS"
+)
+
+var (
+	errPartialCredentials = errors.New("-socks-user and -socks-pass must be set together")
+	errTwoPasswords       = errors.New("-socks-pass and -socks-pass-file are exclusive")
+)
+
+// config is the command line of the proxy
+type config struct {
+	bind      string
+	socksUser string
+	socksPass string
+	passFile  string
+	httpRealm string
+	aclFile   string
+}
+
+// parseFlags parses args, the command line without the program name, reads
+// the password file and falls back to getenv for the credentials. Usage and errors are written to
+// output, -help returns flag.ErrHelp.
+func parseFlags(args []string, getenv func(string) string, output io.Writer) (*config, error) {
+	cfg := &config{}
+	flags := flag.NewFlagSet("proxy", flag.ContinueOnError)
+	flags.SetOutput(output)
+	flags.StringVar(&cfg.bind, "bind", statute.DefaultBindAddress, "address to listen on")
+	flags.StringVar(&cfg.socksUser, "socks-user", "", "username required from SOCKS5 and HTTP clients, $"+envSOCKSUser+" if unset; SOCKS4 is disabled with credentials")
+	flags.StringVar(&cfg.socksPass, "socks-pass", "", "password of -socks-user, $"+envSOCKSPass+" if unset")
+	flags.StringVar(&cfg.passFile, "socks-pass-file", "", "file holding the password of -socks-user, which keeps it out of the process list and the environment")
+	flags.StringVar(&cfg.httpRealm, "http-realm", http.DefaultRealm, "realm of the HTTP Basic challenge")
+	flags.StringVar(&cfg.aclFile, "acl-file", "", "file of destination rules, one \"allow|deny <IP, CIDR, host, *.domain or *>\" per line, the first match applies, host names are resolved for the IP and CIDR rules")
+	if err := flags.Parse(args); err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return nil, errors.New("unexpected arguments: " + flags.Arg(0))
+	}
+
+	if cfg.socksUser == "" {
+		cfg.socksUser = getenv(envSOCKSUser)
+	}
+	if cfg.passFile != "" {
+		if cfg.socksPass != "" {
+			return nil, errTwoPasswords
+		}
+		password, err := os.ReadFile(cfg.passFile)
+		if err != nil {
+			return nil, err
+		}
+		// editors end the file with a newline
+		cfg.socksPass = strings.TrimRight(string(password), "\r\n")
+	}
+	if cfg.socksPass == "" {
+		cfg.socksPass = getenv(envSOCKSPass)
+	}
+	if (cfg.socksUser == "") != (cfg.socksPass == "") {
+		return nil, errPartialCredentials
+	}
+	return cfg, nil
+}
+
+// proxyConfig builds the configuration and the options of the proxy, it
+// reads the ACL file
+func (c *config) proxyConfig() (proxy.Config, []mixed.Option, error) {
+	config := proxy.Config{Bind: c.bind}
+	var options []mixed.Option
+	if c.aclFile != "" {
+		acl, err := loadACL(c.aclFile)
+		if err != nil {
+			return proxy.Config{}, nil, err
+		}
+		// the dials enforce the rules on the resolved addresses too
+		config.ACL = acl.Allow
+		config.Dial = acl.Dial(statute.DefaultProxyDial())
+		options = append(options, mixed.WithUserPacketDialFunc(acl.PacketDial(statute.DefaultProxyPacketDial())))
+	}
+	if c.socksUser != "" {
+		// SOCKS4 has no passwords, it would bypass the credentials
+		config.DisableSOCKS4 = true
+		config.Authenticator = credentials(c.socksUser, c.socksPass)
+		config.HTTPRealm = c.httpRealm
+	}
+	return config, options, nil
+}
+
+// credentials accepts username and password only
+func credentials(username, password string) statute.UserPassAuthenticator {
+	return func(_ context.Context, u, p string) bool {
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		return userOK && passOK
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	passFile := filepath.Join(t.TempDir(), "pass.txt")
+	if err := os.WriteFile(passFile, []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	missingFile := filepath.Join(t.TempDir(), "missing.txt")
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		want    config
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: config{bind: "127.0.0.1:1080", httpRealm: "proxy"},
+		},
+		{
+			name: "flags",
+			args: []string{"-bind", "0.0.0.0:8080", "-socks-user", "alice", "-socks-pass", "secret", "-http-realm", "corp", "-acl-file", "acl.txt"},
+			want: config{bind: "0.0.0.0:8080", socksUser: "alice", socksPass: "secret", httpRealm: "corp", aclFile: "acl.txt"},
+		},
+		{
+			name: "credentials from the environment",
+			env:  map[string]string{envSOCKSUser: "bob", envSOCKSPass: "hunter2"},
+			want: config{bind: "127.0.0.1:1080", socksUser: "bob", socksPass: "hunter2", httpRealm: "proxy"},
+		},
+		{
+			name: "flags override the environment",
+			args: []string{"-socks-user", "alice", "-socks-pass", "secret"},
+			env:  map[string]string{envSOCKSUser: "bob", envSOCKSPass: "hunter2"},
+			want: config{bind: "127.0.0.1:1080", socksUser: "alice", socksPass: "secret", httpRealm: "proxy"},
+		},
+		{
+			name: "password from the environment",
+			args: []string{"-socks-user", "alice"},
+			env:  map[string]string{envSOCKSPass: "secret"},
+			want: config{bind: "127.0.0.1:1080", socksUser: "alice", socksPass: "secret", httpRealm: "proxy"},
+		},
+		{
+			name: "password from a file",
+			args: []string{"-socks-user", "alice", "-socks-pass-file", passFile},
+			env:  map[string]string{envSOCKSPass: "hunter2"},
+			want: config{bind: "127.0.0.1:1080", socksUser: "alice", socksPass: "from file", passFile: passFile, httpRealm: "proxy"},
+		},
+		{
+			name:    "password and password file",
+			args:    []string{"-socks-user", "alice", "-socks-pass", "secret", "-socks-pass-file", passFile},
+			wantErr: true,
+		},
+		{
+			name:    "missing password file",
+			args:    []string{"-socks-user", "alice", "-socks-pass-file", missingFile},
+			wantErr: true,
+		},
+		{
+			name:    "user without password",
+			args:    []string{"-socks-user", "alice"},
+			wantErr: true,
+		},
+		{
+			name:    "unknown flag",
+			args:    []string{"-port", "1080"},
+			wantErr: true,
+		},
+		{
+			name:    "extra argument",
+			args:    []string{"-bind", "127.0.0.1:1080", "serve"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			getenv := func(key string) string {
+				return tt.env[key]
+			}
+			got, err := parseFlags(tt.args, getenv, io.Discard)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseFlags() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseFlags() = %v", err)
+			}
+			if *got != tt.want {
+				t.Fatalf("parseFlags() = %+v, want %+v", *got, tt.want)
+			}
+		})
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	aclFile := filepath.Join(t.TempDir(), "acl.txt")
+	if err := os.WriteFile(aclFile, []byte("deny 10.0.0.0/8\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{bind: "127.0.0.1:0", socksUser: "alice", socksPass: "secret", httpRealm: "proxy", aclFile: aclFile}
+	config, options, err := cfg.proxyConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Bind != cfg.bind {
+		t.Fatalf("bind = %q, want %q", config.Bind, cfg.bind)
+	}
+	if !config.DisableSOCKS4 {
+		t.Fatal("SOCKS4 is enabled along with credentials")
+	}
+	if config.ACL == nil || config.ACL(context.Background(), "tcp", "10.1.2.3", 80) {
+		t.Fatal("the ACL file is not applied")
+	}
+	if err := config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if config.Dial == nil {
+		t.Fatal("the dials don't enforce the ACL file")
+	}
+	if config.Authenticator == nil || !config.Authenticator(context.Background(), "alice", "secret") {
+		t.Fatal("the credentials are not required")
+	}
+	if config.HTTPRealm != cfg.httpRealm {
+		t.Fatalf("realm = %q, want %q", config.HTTPRealm, cfg.httpRealm)
+	}
+	// the ACL packet dial
+	if len(options) != 1 {
+		t.Fatalf("got %d options, want 1", len(options))
+	}
+
+	cfg.aclFile = filepath.Join(t.TempDir(), "missing.txt")
+	if _, _, err := cfg.proxyConfig(); err == nil {
+		t.Fatal("proxyConfig() with a missing ACL file succeeded")
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	check := credentials("alice", "secret")
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		if got := check(context.Background(), tt.username, tt.password); got != tt.want {
+			t.Errorf("credentials(%q, %q) = %v, want %v", tt.username, tt.password, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+// Command proxy runs a mixed SOCKS5, SOCKS4 and HTTP proxy configured by
+// flags and the environment, see -help.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"github.com/bepass-org/proxy/pkg/proxy"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+func main() {
+	cfg, err := parseFlags(os.Args[1:], os.Getenv, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Exit(2)
+	}
+	config, options, err := cfg.proxyConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	server, err := proxy.New(config, options...)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	log.Printf("serving on %s", config.Bind)
+	if err := server.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -1,69 +1,37 @@
 package main
 
 import (
-	"encoding/binary"
 	"fmt"
-	"io"
-	"net"
-	"strconv"
+	"github.com/bepass-org/proxy/pkg/socks5"
+	"time"
 )
 
 func main() {
 	proxyAddr := "127.0.0.1:1080"
 	targetAddr := "<YOUR Netcat ip address>:4444"
 
-	// Connect to SOCKS5 proxy
-	conn, err := net.Dial("tcp", proxyAddr)
+	// Ask the SOCKS5 proxy for a UDP association
+	client, err := socks5.NewUDPClient(proxyAddr)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
+	defer client.Close()
 
-	// Send greeting to SOCKS5 proxy
-	conn.Write([]byte{0x05, 0x01, 0x00})
+	// Print the relay address
+	fmt.Printf("Relay address: %s\n", client.RelayAddr())
 
-	// Read greeting response
-	response := make([]byte, 2)
-	io.ReadFull(conn, response)
-
-	// Send UDP ASSOCIATE request
-	conn.Write([]byte{0x05, 0x03, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
-
-	// Read UDP ASSOCIATE response
-	response = make([]byte, 10)
-	io.ReadFull(conn, response)
-
-	// Extract the bind address and port
-	bindIP := net.IP(response[4:8])
-	bindPort := binary.BigEndian.Uint16(response[8:10])
-
-	// Print the bind address
-	fmt.Printf("Bind address: %s:%d\n", bindIP, bindPort)
-
-	// Create UDP connection
-	udpConn, err := net.Dial("udp", fmt.Sprintf("%s:%d", bindIP, bindPort))
+	// Send the UDP packet, the client adds the SOCKS5 header
+	_, err = client.WriteTo([]byte("Hello, UDP through SOCKS5!"), targetAddr)
 	if err != nil {
 		panic(err)
 	}
-	defer udpConn.Close()
-
-	// Extract target IP and port
-	dstIP, dstPortStr, _ := net.SplitHostPort(targetAddr)
-	dstPort, _ := strconv.Atoi(dstPortStr)
-
-	// Construct the UDP packet with the target address and message
-	packet := make([]byte, 0)
-	packet = append(packet, 0x00, 0x00, 0x00) // RSV and FRAG
-	packet = append(packet, 0x01)             // ATYP for IPv4
-	packet = append(packet, net.ParseIP(dstIP).To4()...)
-	packet = append(packet, byte(dstPort>>8), byte(dstPort&0xFF))
-	packet = append(packet, []byte("Hello, UDP through SOCKS5!")...)
-
-	// Send the UDP packet
-	udpConn.Write(packet)
 
 	// Read the response
+	_ = client.SetReadDeadline(time.Now().Add(10 * time.Second))
 	buffer := make([]byte, 1024)
-	n, _ := udpConn.Read(buffer)
-	fmt.Println("Received:", string(buffer[10:n]))
+	n, from, err := client.ReadFrom(buffer)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println("Received from", from+":", string(buffer[:n]))
 }
@@ -1,19 +1,54 @@
 package http
 
 import (
-	"bytes"
+	"bufio"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
 	"io"
 	"net"
 	"net/http"
+	"strings"
 	"sync"
+	"time"
 )
 
-// copyBuffer is a helper function to copy data between two net.Conn objects.
-func copyBuffer(dst, src net.Conn, buf []byte) (int64, error) {
-	return io.CopyBuffer(dst, src, buf)
+var (
+	errHeaderTooLarge = errors.New("request header too large")
+	errMissingHost    = errors.New("request has no target host")
+	errTargetIsProxy  = errors.New("request targets the proxy itself")
+	errAuthRequired   = errors.New("proxy authentication required")
+	errNoOriginalDst  = errors.New("original destination is not available")
+	errNoResponse     = errors.New("no response from the target")
+)
+
+// DefaultRealm is the realm of the Basic challenge when Server.Realm is empty
+const DefaultRealm = "proxy"
+
+const (
+	// unreadDrainTimeout and unreadDrainBytes bound how much of an unread
+	// request closeUnread discards
+	unreadDrainTimeout = 500 * time.Millisecond
+	unreadDrainBytes   = 256 << 10
+)
+
+// closeUnread closes conn after an error response while the client may
+// still be sending its request. Closing with unread data resets the
+// connection, which can discard the response before the client reads it,
+// so the write side is closed first and the rest of the request discarded
+// for a while.
+func closeUnread(conn net.Conn) {
+	if statute.CloseWrite(conn) == nil {
+		_ = conn.SetReadDeadline(time.Now().Add(unreadDrainTimeout))
+		_, _ = io.CopyN(io.Discard, conn, unreadDrainBytes)
+	}
+	_ = conn.Close()
 }
 
+// defaultHeaderBufferSize is the bufio.Reader size used for reading requests
+const defaultHeaderBufferSize = 4096
+
 type responseWriter struct {
 	conn    net.Conn
 	headers http.Header
@@ -40,6 +75,8 @@ func (rw *responseWriter) WriteHeader(statusCode int) {
 	rw.status = statusCode
 	rw.written = true
 
+	statute.RecordAccessStatus(rw.conn, statusCode)
+
 	statusText := http.StatusText(statusCode)
 	if statusText == "" {
 		statusText = fmt.Sprintf("status code %d", statusCode)
@@ -56,30 +93,198 @@ func (rw *responseWriter) Write(data []byte) (int, error) {
 	return rw.conn.Write(data)
 }
 
+// bufferedConn is a net.Conn that reads through the bufio.Reader the request
+// was parsed with, so bytes buffered past the headers are not lost
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// statute.CloseWrite
+func (c *bufferedConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
+// WriteTo writes the buffered bytes to w, then lets the wrapped connection
+// copy the rest, see statute.WriteTo
+func (c *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	return c.reader.WriteTo(w)
+}
+
+// ReadFrom lets the wrapped connection copy from r, see statute.ReadFrom
+func (c *bufferedConn) ReadFrom(r io.Reader) (int64, error) {
+	return statute.ReadFrom(c.Conn, r)
+}
+
+// customConn wraps the client connection of a non-CONNECT request handed to a
+// user handler. The request was already consumed from the connection while
+// parsing, so Read first emits the serialized original request, including
+// its body which is streamed rather than buffered, and then continues with
+// the remaining bytes of the connection. This gives handlers the full
+// original request transparently.
 type customConn struct {
 	net.Conn
-	req         *http.Request
-	initialData []byte
-	once        sync.Once
-}
-
-func (c *customConn) Read(p []byte) (n int, err error) {
-	c.once.Do(func() {
-		buf := &bytes.Buffer{}
-		err = c.req.Write(buf)
-		if err != nil {
-			n = 0
-			return
+	req      *http.Request
+	replay   *io.PipeReader
+	replayed bool
+	once     sync.Once
+}
+
+func (c *customConn) Read(p []byte) (int, error) {
+	c.once.Do(c.startReplay)
+
+	if !c.replayed {
+		n, err := c.replay.Read(p)
+		if err != io.EOF {
+			return n, err
 		}
-		c.initialData = buf.Bytes()
-	})
+		c.replayed = true
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	return c.Conn.Read(p)
+}
+
+// startReplay serializes the request into a pipe read by Read
+func (c *customConn) startReplay() {
+	pr, pw := io.Pipe()
+	go func() {
+		_ = pw.CloseWithError(c.req.Write(pw))
+	}()
+	c.replay = pr
+}
 
-	if len(c.initialData) > 0 {
-		copy(p, c.initialData)
-		n = len(p)
-		c.initialData = nil
+// Close closes the connection and stops a pending replay
+func (c *customConn) Close() error {
+	c.once.Do(func() {})
+	if c.replay != nil {
+		_ = c.replay.Close()
+	}
+	return c.Conn.Close()
+}
+
+// NetConn returns the wrapped connection
+func (c *customConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// headerLimitReader is an io.Reader that fails with errHeaderTooLarge once n
+// bytes are consumed
+type headerLimitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *headerLimitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errHeaderTooLarge
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// parseProxyAuthorization parses the credentials of a Basic
+// Proxy-Authorization header value
+func parseProxyAuthorization(auth string) (string, string, bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	return username, password, ok
+}
+
+// hopByHopHeaders are the headers meaningful only for a single connection,
+// they are not forwarded
+var hopByHopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopByHopHeaders removes the hop-by-hop headers from h, including the
+// ones listed in its Connection header
+func removeHopByHopHeaders(h http.Header) {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopByHopHeaders {
+		h.Del(name)
+	}
+}
+
+// upgradeType returns the protocol requested by the Upgrade header of h, or
+// an empty string if h does not request an upgrade
+func upgradeType(h http.Header) string {
+	for _, value := range h.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), "upgrade") {
+				return h.Get("Upgrade")
+			}
+		}
+	}
+	return ""
+}
+
+// ErrorResponder writes an error response with status for err to w, the
+// Connection header of w may already be set
+type ErrorResponder func(w http.ResponseWriter, status int, err error)
+
+// DefaultErrorResponder replies with the status text only, err is not
+// revealed to the client since it may carry internal addresses
+func DefaultErrorResponder(w http.ResponseWriter, status int, _ error) {
+	http.Error(w, http.StatusText(status), status)
+}
+
+// respondError writes the error response for err with the ErrorResponder
+func (s *Server) respondError(w http.ResponseWriter, status int, err error) {
+	if rw, ok := w.(*responseWriter); ok {
+		done := statute.ReplyDeadline(rw.conn, s.ReplyTimeout)
+		defer func() {
+			_ = done(nil)
+		}()
+	}
+	if s.ErrorResponder != nil {
+		s.ErrorResponder(w, status, err)
 		return
 	}
+	DefaultErrorResponder(w, status, err)
+}
 
-	return c.Conn.Read(p)
+// writeConnectEstablished answers a CONNECT request with 200 within the
+// reply timeout
+func (s *Server) writeConnectEstablished(conn net.Conn) error {
+	done := statute.ReplyDeadline(conn, s.ReplyTimeout)
+	_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	return done(err)
 }
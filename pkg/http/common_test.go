@@ -0,0 +1,71 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCustomConnReplaysRequest(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/upload", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &customConn{Conn: server, req: req}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the client keeps sending after the request
+	go func() {
+		_, _ = io.WriteString(client, "NEXT")
+	}()
+
+	// small reads see the whole request, then the rest of the connection
+	reader := bufio.NewReaderSize(conn, 16)
+	replayed, err := http.ReadRequest(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed.Method != http.MethodPost || replayed.Host != "example.com" || replayed.URL.Path != "/upload" {
+		t.Fatalf("replayed %s %s%s, want POST example.com/upload", replayed.Method, replayed.Host, replayed.URL.Path)
+	}
+	got, err := io.ReadAll(replayed.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Fatalf("replayed a %d byte body, want %d bytes", len(got), len(body))
+	}
+	next := make([]byte, 4)
+	if _, err := io.ReadFull(reader, next); err != nil || string(next) != "NEXT" {
+		t.Fatalf("read %q, %v after the request, want %q", next, err, "NEXT")
+	}
+}
+
+func TestCustomConnCloseStopsReplay(t *testing.T) {
+	// a body which never ends, Close must not leave the replay blocked
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	req, err := http.NewRequest(http.MethodPost, "http://example.com/", pr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := &customConn{Conn: server, req: req}
+	if _, err := conn.Read(make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Read(make([]byte, 8)); err == nil {
+		t.Fatal("Read after Close succeeded")
+	}
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// ConnectProxyDial returns a dial function tunneling through the upstream
+// HTTP proxy at proxyURL with CONNECT, proxyURL.User adds Basic
+// Proxy-Authorization credentials. The upstream is dialed with dial, or
+// directly when nil. Used as the ProxyDial of a Server it chains the two
+// proxies, CONNECT requests are then tunneled through the upstream.
+func ConnectProxyDial(proxyURL *url.URL, dial statute.ProxyDialFunc) statute.ProxyDialFunc {
+	if dial == nil {
+		dial = statute.DefaultProxyDial()
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, "tcp", proxyURL.Host)
+		if err != nil {
+			return nil, err
+		}
+		// abort the handshake when ctx is done
+		stop := context.AfterFunc(ctx, func() {
+			_ = conn.Close()
+		})
+
+		tunnel, err := connectTunnel(conn, proxyURL, address)
+		if !stop() {
+			_ = conn.Close()
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tunnel, nil
+	}
+}
+
+// connectTunnel asks the proxy on conn to tunnel to address
+func connectTunnel(conn net.Conn, proxyURL *url.URL, address string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		req.SetBasicAuth(proxyURL.User.Username(), password)
+		req.Header["Proxy-Authorization"] = req.Header["Authorization"]
+		req.Header.Del("Authorization")
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream proxy refused CONNECT to %s: %s", address, resp.Status)
+	}
+	// the upstream may send tunneled bytes right after its reply
+	return &bufferedConn{
+		Conn:   conn,
+		reader: reader,
+	}, nil
+}
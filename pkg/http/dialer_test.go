@@ -0,0 +1,82 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectProxyDialChainsServers(t *testing.T) {
+	authenticate := func(_ context.Context, username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+	upstream := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithAuthenticator(authenticate)))
+	upstreamURL := &url.URL{Scheme: "http", User: url.UserPassword("user", "secret"), Host: upstream}
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithProxyDial(ConnectProxyDial(upstreamURL, nil))))
+
+	conn, reader := connect(t, proxy, tcpEcho(t))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil || string(got) != "ping" {
+		t.Fatalf("echo = %q, %v, want %q", got, err, "ping")
+	}
+
+	// the upstream refuses wrong credentials
+	upstreamURL.User = url.UserPassword("user", "wrong")
+	_, err := ConnectProxyDial(upstreamURL, nil)(context.Background(), "tcp", "192.0.2.1:443")
+	if err == nil || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("dial error %v, want a 407 refusal", err)
+	}
+}
+
+func TestConnectProxyDialKeepsEarlyTunnelBytes(t *testing.T) {
+	upstream := serveTarget(t, func(conn net.Conn) {
+		buf := make([]byte, 1024)
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+		// the reply and the first tunneled bytes in a single write
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\nhello")
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	conn, err := ConnectProxyDial(&url.URL{Host: upstream}, nil)(context.Background(), "tcp", "192.0.2.1:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != "hello" {
+		t.Fatalf("read %q, %v, want %q", got, err, "hello")
+	}
+}
+
+func TestConnectProxyDialContextDone(t *testing.T) {
+	// an upstream which never replies
+	upstream := serveTarget(t, func(conn net.Conn) {
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := ConnectProxyDial(&url.URL{Host: upstream}, nil)(ctx, "tcp", "192.0.2.1:443")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("dial error %v, want %v", err, context.DeadlineExceeded)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial still waiting for the upstream after the context was done")
+	}
+}
@@ -0,0 +1,85 @@
+package http
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultUpstreamIdleTimeout is how long pooled upstream connections stay
+// idle when Server.UpstreamIdleTimeout is zero
+const DefaultUpstreamIdleTimeout = 90 * time.Second
+
+// upstreamPool keeps idle keep-alive upstream connections by destination,
+// the zero value is ready to use
+type upstreamPool struct {
+	mu   sync.Mutex
+	idle map[string][]*idleUpstream
+}
+
+// idleUpstream is a pooled connection, timer closes it once it was idle for
+// the idle timeout
+type idleUpstream struct {
+	conn  net.Conn
+	timer *time.Timer
+}
+
+// get returns the most recently pooled connection to addr or nil
+func (p *upstreamPool) get(addr string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conns := p.idle[addr]; len(conns) > 0; conns = p.idle[addr] {
+		u := conns[len(conns)-1]
+		p.remove(addr, u)
+		// a fired timer is closing the connection
+		if u.timer.Stop() {
+			return u.conn
+		}
+	}
+	return nil
+}
+
+// put pools conn to addr for up to idleTimeout, the oldest connection to
+// addr is closed when size connections are pooled already
+func (p *upstreamPool) put(addr string, conn net.Conn, size int, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		idleTimeout = DefaultUpstreamIdleTimeout
+	}
+	u := &idleUpstream{conn: conn}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.idle == nil {
+		p.idle = make(map[string][]*idleUpstream)
+	}
+	if conns := p.idle[addr]; len(conns) >= size {
+		oldest := conns[0]
+		p.remove(addr, oldest)
+		if oldest.timer.Stop() {
+			_ = oldest.conn.Close()
+		}
+	}
+	u.timer = time.AfterFunc(idleTimeout, func() {
+		p.mu.Lock()
+		p.remove(addr, u)
+		p.mu.Unlock()
+		_ = conn.Close()
+	})
+	p.idle[addr] = append(p.idle[addr], u)
+}
+
+// remove drops u from the connections pooled to addr, p.mu must be held
+func (p *upstreamPool) remove(addr string, u *idleUpstream) {
+	conns := p.idle[addr]
+	for i, c := range conns {
+		if c == u {
+			conns = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(p.idle, addr)
+		return
+	}
+	p.idle[addr] = conns
+}
@@ -3,11 +3,16 @@ package http
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/bepass-org/proxy/pkg/statute"
 	"io"
+	"math"
 	"net"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Server struct {
@@ -16,28 +21,133 @@ type Server struct {
 	// ProxyDial specifies the optional proxyDial function for
 	// establishing the transport connection.
 	ProxyDial statute.ProxyDialFunc
+	// DialLocalAddr is the local address of the default ProxyDial, it is
+	// ignored when ProxyDial is set
+	DialLocalAddr *net.TCPAddr
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
-	// Logger error log
+	// Router selects the handler of TCP CONNECT requests by destination
+	Router *statute.Router
+	// Logger error log, WithLogger serializes it with a statute.SyncLogger,
+	// assign the field directly to opt out
 	Logger statute.Logger
 	// Context is default context
 	Context context.Context
-	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer,
+	// statute.DefaultBytesPool is used when it is nil
 	BytesPool statute.BytesPool
+	// DestinationRewriter rewrites the destination of TCP CONNECT requests
+	DestinationRewriter statute.DestinationRewriter
+	// ACL denies requests to destinations it does not allow
+	ACL statute.ACL
+	// Middleware wraps the connect handler, the user handler or, when there
+	// is none, the embedded one. Changes it makes to the request are not
+	// seen by the embedded handler.
+	Middleware statute.Middleware
+	// AllowedPorts and DeniedPorts restrict the destination ports of TCP
+	// requests before the ACL is consulted, see statute.PortAllowed. Empty
+	// lists allow every port.
+	AllowedPorts []int
+	DeniedPorts  []int
+	// AccessLog writes a record for every served connection
+	AccessLog *statute.AccessLog
+	// RequireHandler denies requests without a user handler instead of
+	// falling back to the embedded direct dial
+	RequireHandler bool
+	// MaxHeaderBytes limits the size of the request line and headers,
+	// zero means no limit
+	MaxHeaderBytes int
+	// Authenticator requires Basic Proxy-Authorization credentials it
+	// accepts, requests without them get 407 before anything is dialed
+	Authenticator statute.UserPassAuthenticator
+	// Realm is the realm of the Basic challenge sent with 407 responses,
+	// DefaultRealm if empty
+	Realm string
+	// AuthFailureDelay delays the 407 reply to rejected credentials to slow
+	// down brute-forcing, requests without credentials are answered at once
+	// since clients send them first to get the challenge. Zero means no
+	// delay.
+	AuthFailureDelay time.Duration
+	// TransparentMode serves origin-form requests redirected to the proxy,
+	// such as by an iptables REDIRECT rule, by dialing their original
+	// destination. It is read from SO_ORIGINAL_DST on linux, the Host header
+	// is used when it is not available.
+	TransparentMode bool
+	// OriginFormRequests serves origin-form requests ("GET /path
+	// HTTP/1.0"), sent by some legacy clients, by dialing the target of
+	// their Host header unless it is the proxy itself. They are answered
+	// 400 otherwise.
+	OriginFormRequests bool
+	// ErrorHandler observes the errors serving connections, they are logged
+	// when it is nil
+	ErrorHandler statute.ErrorHandler
+	// VerboseDestinations logs the destinations dialed by the embedded
+	// handlers and the outcome at debug level
+	VerboseDestinations bool
+	// ReplyTimeout bounds the time to write an error or a connection
+	// established status to a client, so one not reading can't block the
+	// server, zero means no limit. NewServer sets it to
+	// statute.DefaultReplyTimeout.
+	ReplyTimeout time.Duration
+	// MaxConnectionLifetime ends connections this long after they were
+	// accepted with statute.ErrMaxLifetime, zero means no limit
+	MaxConnectionLifetime time.Duration
+	// ConnectionByteLimit ends tunnels once they relayed this many bytes in
+	// both directions together with statute.ErrByteLimitExceeded, zero
+	// means no limit
+	ConnectionByteLimit int64
+	// TCPKeepAliveInterval enables TCP keepalive probes at this interval on
+	// both ends of CONNECT tunnels relayed by the embedded handlers, so idle
+	// tunnels survive NAT and firewalls. Zero leaves the sockets unchanged.
+	TCPKeepAliveInterval time.Duration
+	// UpstreamPoolSize is the number of idle keep-alive upstream connections
+	// kept per destination for forwarded non-CONNECT requests, zero disables
+	// pooling and every request dials its own connection
+	UpstreamPoolSize int
+	// UpstreamIdleTimeout closes pooled upstream connections idle for this
+	// long, DefaultUpstreamIdleTimeout if zero
+	UpstreamIdleTimeout time.Duration
+	// ViaName adds a "Via: <version> ViaName" header to forwarded
+	// non-CONNECT requests, along with X-Forwarded-For carrying the client
+	// IP appended to any it already has. Empty adds neither.
+	ViaName string
+	// DisableXForwardedFor omits the X-Forwarded-For header added along
+	// with Via, so origins don't learn the client IP
+	DisableXForwardedFor bool
+	// CloseOnHandlerError closes the client connection when the connect
+	// handler returns an error, otherwise closing it is left to the handler
+	// and the caller of ServeConn
+	CloseOnHandlerError bool
+	// ErrorResponder writes the error responses sent to clients, such as
+	// 503 when the destination can't be dialed. DefaultErrorResponder, which
+	// doesn't reveal the error, is used when it is nil.
+	ErrorResponder ErrorResponder
+	// HalfCloseRequests closes the write side of the upstream connection
+	// once a forwarded non-CONNECT request and its body were sent, for
+	// origins answering only after they read EOF. The upstream connection
+	// is then not reused, upgrade requests are not half-closed.
+	HalfCloseRequests bool
+	// upstreams are the pooled upstream connections
+	upstreams upstreamPool
 }
 
 func NewServer(options ...ServerOption) *Server {
 	s := &Server{
-		Bind:      statute.DefaultBindAddress,
-		ProxyDial: statute.DefaultProxyDial(),
-		Logger:    statute.DefaultLogger{},
-		Context:   statute.DefaultContext(),
+		Bind:         statute.DefaultBindAddress,
+		Logger:       statute.NewSyncLogger(statute.DefaultLogger{}),
+		Context:      statute.DefaultContext(),
+		ReplyTimeout: statute.DefaultReplyTimeout,
 	}
 
 	for _, option := range options {
 		option(s)
 	}
 
+	// the local addresses only apply to the default dial functions
+	if s.ProxyDial == nil {
+		s.ProxyDial = statute.LocalAddrProxyDial(s.DialLocalAddr)
+	}
+
 	return s
 }
 
@@ -69,7 +179,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
-				s.Logger.Error(err)
+				if !statute.IsBenignCloseError(err) {
+					s.Logger.Error(err)
+				}
 				continue
 			}
 
@@ -77,7 +189,7 @@ func (s *Server) ListenAndServe() error {
 			// This way, the server can handle multiple connections concurrently
 			go func() {
 				err := s.ServeConn(conn)
-				if err != nil {
+				if err != nil && s.ErrorHandler == nil && !statute.IsBenignCloseError(err) {
 					s.Logger.Error(err) // Log errors from ServeConn
 				}
 			}()
@@ -87,7 +199,7 @@ func (s *Server) ListenAndServe() error {
 
 func WithLogger(logger statute.Logger) ServerOption {
 	return func(s *Server) {
-		s.Logger = logger
+		s.Logger = statute.NewSyncLogger(logger)
 	}
 }
 
@@ -103,12 +215,68 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+func WithRouter(router *statute.Router) ServerOption {
+	return func(s *Server) {
+		s.Router = router
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
 	}
 }
 
+func WithDestinationRewriter(rewriter statute.DestinationRewriter) ServerOption {
+	return func(s *Server) {
+		s.DestinationRewriter = rewriter
+	}
+}
+
+func WithAllowedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.AllowedPorts = ports
+	}
+}
+
+func WithDeniedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.DeniedPorts = ports
+	}
+}
+
+// WithMiddleware wraps the connect handler with middlewares, the first one
+// is the outermost, see statute.Chain
+func WithMiddleware(middlewares ...statute.Middleware) ServerOption {
+	return func(s *Server) {
+		s.Middleware = statute.Chain(middlewares...)
+	}
+}
+
+func WithACL(acl statute.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = acl
+	}
+}
+
+func WithAccessLog(accessLog *statute.AccessLog) ServerOption {
+	return func(s *Server) {
+		s.AccessLog = accessLog
+	}
+}
+
+func WithRequireHandler() ServerOption {
+	return func(s *Server) {
+		s.RequireHandler = true
+	}
+}
+
+func WithDialLocalAddr(addr *net.TCPAddr) ServerOption {
+	return func(s *Server) {
+		s.DialLocalAddr = addr
+	}
+}
+
 func WithContext(ctx context.Context) ServerOption {
 	return func(s *Server) {
 		s.Context = ctx
@@ -121,74 +289,441 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 	}
 }
 
+func WithAuthenticator(authenticator statute.UserPassAuthenticator) ServerOption {
+	return func(s *Server) {
+		s.Authenticator = authenticator
+	}
+}
+
+// WithRealm sets Server.Realm
+func WithRealm(realm string) ServerOption {
+	return func(s *Server) {
+		s.Realm = realm
+	}
+}
+
+// WithAuthFailureDelay sets Server.AuthFailureDelay
+func WithAuthFailureDelay(delay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.AuthFailureDelay = delay
+	}
+}
+
+// WithTCPKeepAliveProbes sets Server.TCPKeepAliveInterval
+func WithTCPKeepAliveProbes(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TCPKeepAliveInterval = interval
+	}
+}
+
+func WithConnectionByteLimit(n int64) ServerOption {
+	return func(s *Server) {
+		s.ConnectionByteLimit = n
+	}
+}
+
+// WithUpstreamPool reuses keep-alive upstream connections across forwarded
+// requests, keeping up to size idle connections per destination for up to
+// idleTimeout
+func WithUpstreamPool(size int, idleTimeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.UpstreamPoolSize = size
+		s.UpstreamIdleTimeout = idleTimeout
+	}
+}
+
+func WithCloseOnHandlerError() ServerOption {
+	return func(s *Server) {
+		s.CloseOnHandlerError = true
+	}
+}
+
+// WithForwardedHeaders adds Via and X-Forwarded-For headers naming the
+// proxy as proxyName to forwarded requests, see Server.ViaName
+func WithForwardedHeaders(proxyName string) ServerOption {
+	return func(s *Server) {
+		s.ViaName = proxyName
+	}
+}
+
+func WithDisableXForwardedFor() ServerOption {
+	return func(s *Server) {
+		s.DisableXForwardedFor = true
+	}
+}
+
+func WithErrorResponder(responder ErrorResponder) ServerOption {
+	return func(s *Server) {
+		s.ErrorResponder = responder
+	}
+}
+
+// WithHalfCloseRequests half-closes the upstream connection after each
+// forwarded non-CONNECT request, see Server.HalfCloseRequests
+func WithHalfCloseRequests() ServerOption {
+	return func(s *Server) {
+		s.HalfCloseRequests = true
+	}
+}
+
+// WithReplyTimeout sets Server.ReplyTimeout. Without it the timeout is
+// statute.DefaultReplyTimeout, a reply the client doesn't read within it
+// fails with statute.ErrReplyTimeout. Zero disables the timeout, writes then
+// block for as long as the client doesn't read.
+func WithReplyTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ReplyTimeout = timeout
+	}
+}
+
+func WithMaxConnectionLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnectionLifetime = lifetime
+	}
+}
+
+func WithVerboseDestinations(verbose bool) ServerOption {
+	return func(s *Server) {
+		s.VerboseDestinations = verbose
+	}
+}
+
+func WithErrorHandler(errorHandler statute.ErrorHandler) ServerOption {
+	return func(s *Server) {
+		s.ErrorHandler = errorHandler
+	}
+}
+
+func WithTransparentMode() ServerOption {
+	return func(s *Server) {
+		s.TransparentMode = true
+	}
+}
+
+func WithOriginFormRequests() ServerOption {
+	return func(s *Server) {
+		s.OriginFormRequests = true
+	}
+}
+
+func WithMaxHeaderBytes(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxHeaderBytes = n
+	}
+}
+
 func (s *Server) ServeConn(conn net.Conn) error {
-	reader := bufio.NewReader(conn)
+	return s.ServeConnContext(s.Context, conn)
+}
+
+// ServeConnContext serves conn using ctx as the context of the connection.
+// conn carries a single request: forwarded requests are answered with
+// Connection: close, so clients reconnect for their next request.
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) (err error) {
+	defer func() {
+		statute.ReportError(ctx, s.ErrorHandler, "http", conn, err)
+		statute.TraceClose(ctx, err)
+	}()
+	defer statute.RecoverPanic(statute.ConnLogger(ctx, s.Logger), conn, &err)
+
+	ctx, cancel := statute.WithMaxLifetime(ctx, s.MaxConnectionLifetime)
+	defer cancel()
+	// unblock the handlers using conn once ctx is done, such as on shutdown
+	defer statute.CloseOnDone(ctx, conn)()
+
+	if s.AccessLog != nil {
+		accessConn := statute.NewAccessConn(conn, "http")
+		conn = accessConn
+		defer func() {
+			_ = s.AccessLog.Log(accessConn)
+		}()
+	}
+
+	statute.TraceHandshakeStart(ctx)
+	var reader *bufio.Reader
+	limiter := &headerLimitReader{r: conn, n: math.MaxInt64}
+	if s.MaxHeaderBytes > 0 {
+		limiter.n = int64(s.MaxHeaderBytes)
+		reader = bufio.NewReaderSize(limiter, min(s.MaxHeaderBytes, defaultHeaderBufferSize))
+	} else {
+		reader = bufio.NewReader(limiter)
+	}
+
 	req, err := http.ReadRequest(reader)
 	if err != nil {
+		if errors.Is(err, errHeaderTooLarge) {
+			rw := NewHTTPResponseWriter(conn)
+			rw.Header().Set("Connection", "close")
+			s.respondError(rw, http.StatusRequestHeaderFieldsTooLarge, err)
+			closeUnread(conn)
+		}
 		return err
 	}
+	// headers are read, lift the limit so the body can be consumed
+	limiter.n = math.MaxInt64
+	req = req.WithContext(ctx)
 
-	return s.handleHTTP(conn, req, req.Method == http.MethodConnect)
-}
+	// origin-form requests ("GET /path HTTP/1.0") carry the target in the
+	// Host header rather than in the request URI
+	if req.URL.Host == "" && s.TransparentMode {
+		dst, err := originalDestination(conn)
+		switch {
+		case err != nil:
+			statute.ConnLogger(ctx, s.Logger).Debug("transparent mode falls back to the Host header: " + err.Error())
+		case isOwnAddress(ctx, conn, dst):
+			// a connection that was not redirected reports the address it
+			// was accepted on when conntrack is loaded
+			statute.ConnLogger(ctx, s.Logger).Debug("transparent mode falls back to the Host header: connection was not redirected")
+		default:
+			req.URL.Host = dst
+		}
+	}
+	if req.URL.Host == "" && req.Host != "" && (s.OriginFormRequests || s.TransparentMode) {
+		if isOwnAddress(ctx, conn, req.Host) {
+			rw := NewHTTPResponseWriter(conn)
+			rw.Header().Set("Connection", "close")
+			s.respondError(rw, http.StatusBadRequest, errTargetIsProxy)
+			_ = conn.Close()
+			return errTargetIsProxy
+		}
+		req.URL.Host = req.Host
+	}
+	if req.URL.Host == "" {
+		rw := NewHTTPResponseWriter(conn)
+		rw.Header().Set("Connection", "close")
+		s.respondError(rw, http.StatusBadRequest, errMissingHost)
+		_ = conn.Close()
+		return errMissingHost
+	}
 
-func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleHTTP(conn, req, isConnectMethod)
+	// authenticate before anything is dialed or a tunnel is established
+	username, err := s.authenticate(conn, req)
+	if err != nil {
+		return err
 	}
 
-	if isConnectMethod {
-		_, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	// the reader may hold the request body or pipelined data beyond the
+	// headers, keep reading through it so nothing is dropped
+	bConn := &bufferedConn{
+		Conn:   conn,
+		reader: reader,
+	}
+	statute.RecordAccessRequest(conn, req.Method, req.URL.Host, username)
+	return s.handleHTTP(bConn, req, req.Method == http.MethodConnect)
+}
+
+// isOwnAddress reports whether host, the Host header of an origin-form
+// request, names the address conn was accepted on, following it would make
+// the proxy dial itself
+func isOwnAddress(ctx context.Context, conn net.Conn, host string) bool {
+	local, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	name, port, err := net.SplitHostPort(host)
+	if err != nil {
+		name, port = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), "80"
+	}
+	if port != strconv.Itoa(local.Port) {
+		return false
+	}
+	ips := []net.IP{net.ParseIP(name)}
+	if ips[0] == nil {
+		ips, err = net.DefaultResolver.LookupIP(ctx, "ip", name)
 		if err != nil {
-			return err
+			return false
 		}
-	} else {
-		cConn := &customConn{
-			Conn: conn,
-			req:  req,
+	}
+	interfaceAddrs, _ := net.InterfaceAddrs()
+	for _, ip := range ips {
+		if ip.IsLoopback() || ip.IsUnspecified() || ip.Equal(local.IP) {
+			return true
+		}
+		for _, addr := range interfaceAddrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return true
+			}
 		}
-		conn = cConn
 	}
+	return false
+}
 
-	targetAddr := req.URL.Host
-	host, portStr, err := net.SplitHostPort(targetAddr)
-	if err != nil {
-		host = targetAddr
-		if req.URL.Scheme == "https" || isConnectMethod {
-			portStr = "443"
-		} else {
-			portStr = "80"
+// authenticate checks the Proxy-Authorization credentials of req when an
+// Authenticator is set, replying 407 and closing conn if they are missing or
+// invalid. The header is removed so it is not forwarded to the target.
+func (s *Server) authenticate(conn net.Conn, req *http.Request) (string, error) {
+	authenticator := statute.PolicyAuthenticator(req.Context(), s.Authenticator)
+	if authenticator == nil {
+		statute.RecordAccessAuth(conn, statute.AuthMethodNone, "", true)
+		statute.TraceAuthDone(req.Context(), statute.AuthMethodNone, "", true)
+		return "", nil
+	}
+	username, password, ok := parseProxyAuthorization(req.Header.Get("Proxy-Authorization"))
+	req.Header.Del("Proxy-Authorization")
+	if ok && authenticator(req.Context(), username, password) {
+		statute.RecordAccessAuth(conn, statute.AuthMethodBasic, username, true)
+		statute.TraceAuthDone(req.Context(), statute.AuthMethodBasic, username, true)
+		return username, nil
+	}
+	statute.RecordAccessAuth(conn, statute.AuthMethodBasic, username, false)
+	statute.TraceAuthDone(req.Context(), statute.AuthMethodBasic, username, false)
+
+	if ok {
+		if err := statute.AuthFailureDelay(req.Context(), s.AuthFailureDelay); err != nil {
+			_ = conn.Close()
+			return "", statute.WithPhase(statute.PhaseAuth, req.URL.Host, err)
 		}
-		targetAddr = net.JoinHostPort(host, portStr)
 	}
+	rw := NewHTTPResponseWriter(conn)
+	realm := s.Realm
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	rw.Header().Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(realm))
+	rw.Header().Set("Connection", "close")
+	s.respondError(rw, http.StatusProxyAuthRequired, errAuthRequired)
+	_ = conn.Close()
+	return "", statute.WithPhase(statute.PhaseAuth, req.URL.Host, errAuthRequired)
+}
 
+func (s *Server) handleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
+	targetAddr, host, portStr := targetAddress(req, isConnectMethod)
 	portInt, err := strconv.Atoi(portStr)
 	if err != nil {
 		return err // Handle the error if the port string is not a valid integer.
 	}
+
+	if s.DestinationRewriter != nil {
+		host, portInt, err = s.DestinationRewriter(req.Context(), "tcp", host, portInt)
+		if err != nil {
+			defer func() {
+				_ = conn.Close()
+			}()
+			s.respondError(NewHTTPResponseWriter(conn), http.StatusForbidden, err)
+			return fmt.Errorf("rewrite destination %s failed: %w", targetAddr, err)
+		}
+		// the Host header keeps the original destination
+		targetAddr = net.JoinHostPort(host, strconv.Itoa(portInt))
+		req.URL.Host = targetAddr
+	}
 	port := int32(portInt)
 
+	acl := statute.PolicyACL(req.Context(), s.ACL)
+	if !statute.PortAllowed(portInt, s.AllowedPorts, s.DeniedPorts) ||
+		acl != nil && !acl(req.Context(), "tcp", host, portInt) {
+		defer func() {
+			_ = conn.Close()
+		}()
+		err := fmt.Errorf("%s to %s denied by ACL", req.Method, targetAddr)
+		s.respondError(NewHTTPResponseWriter(conn), http.StatusForbidden, err)
+		return err
+	}
+
+	if s.UserConnectHandle == nil && s.Router == nil && s.Middleware == nil {
+		return s.embedHandleHTTP(conn, req, isConnectMethod)
+	}
+
 	proxyReq := &statute.ProxyRequest{
-		Conn:        conn,
-		Reader:      io.Reader(conn),
-		Writer:      io.Writer(conn),
 		Network:     "tcp",
 		Destination: targetAddr,
 		DestHost:    host,
 		DestPort:    port,
+		ClientAddr:  conn.RemoteAddr(),
+		Context:     req.Context(),
 	}
+	proxyReq.ConnID, _ = statute.ConnID(req.Context())
 
-	return s.UserConnectHandle(proxyReq)
-}
+	handler := s.connectHandler(proxyReq)
+	if handler == nil {
+		return s.embedHandleHTTPMiddleware(conn, req, isConnectMethod, proxyReq)
+	}
+	if s.Middleware != nil {
+		handler = s.Middleware(handler)
+	}
 
-func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
-	defer func() {
+	if isConnectMethod {
+		statute.RecordAccessStatus(conn, http.StatusOK)
+		if err := s.writeConnectEstablished(conn); err != nil {
+			return err
+		}
+	} else {
+		cConn := &customConn{
+			Conn: conn,
+			req:  req,
+		}
+		conn = cConn
+	}
+
+	proxyReq.Conn = conn
+	proxyReq.Reader = io.Reader(conn)
+	proxyReq.Writer = io.Writer(conn)
+
+	err = handler(proxyReq)
+	if err != nil && s.CloseOnHandlerError {
 		_ = conn.Close()
-	}()
+	}
+	return statute.WithPhase(statute.PhaseTunnel, targetAddr, err)
+}
+
+// addForwardedHeaders adds the Via and X-Forwarded-For headers to req
+// forwarded from conn when ViaName is set
+func (s *Server) addForwardedHeaders(conn net.Conn, req *http.Request) {
+	if s.ViaName == "" {
+		return
+	}
+	req.Header.Add("Via", fmt.Sprintf("%d.%d %s", req.ProtoMajor, req.ProtoMinor, s.ViaName))
+	if s.DisableXForwardedFor {
+		return
+	}
+	clientIP, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return
+	}
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		clientIP = strings.Join(prior, ", ") + ", " + clientIP
+	}
+	req.Header.Set("X-Forwarded-For", clientIP)
+}
 
+// connectHandler picks the handler for proxyReq, routes take precedence over
+// UserConnectHandle
+func (s *Server) connectHandler(proxyReq *statute.ProxyRequest) statute.UserConnectHandler {
+	if s.Router != nil {
+		if handler := s.Router.Route(proxyReq.Context, proxyReq); handler != nil {
+			return handler
+		}
+	}
+	return s.UserConnectHandle
+}
+
+// logDestination logs the destination of an embedded handler and the outcome
+// of dialing it when VerboseDestinations is set
+func (s *Server) logDestination(ctx context.Context, command, destination string, err error) {
+	if !s.VerboseDestinations {
+		return
+	}
+	logger := statute.ConnLogger(ctx, s.Logger)
+	logger = statute.WithField(logger, "protocol", "http")
+	logger = statute.WithField(logger, "destination", destination)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("%s %s failed: %v", command, destination, err))
+		return
+	}
+	logger.Debug(command + " " + destination + " succeeded")
+}
+
+// targetAddress returns the dial address, host and port requested by req,
+// the port defaults to the one of the scheme
+func targetAddress(req *http.Request, isConnectMethod bool) (string, string, string) {
 	targetAddr := req.URL.Host
 	host, portStr, err := net.SplitHostPort(targetAddr)
 	if err != nil {
+		// a bracketed IPv6 literal without a port, JoinHostPort adds the
+		// brackets back
 		host = targetAddr
+		if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+			host = host[1 : len(host)-1]
+		}
 		if req.URL.Scheme == "https" || isConnectMethod {
 			portStr = "443"
 		} else {
@@ -196,43 +731,206 @@ func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMeth
 		}
 		targetAddr = net.JoinHostPort(host, portStr)
 	}
+	return targetAddr, host, portStr
+}
 
-	target, err := s.ProxyDial(s.Context, "tcp", targetAddr)
-	if err != nil {
-		http.Error(
-			NewHTTPResponseWriter(conn),
-			err.Error(),
-			http.StatusServiceUnavailable,
-		)
-		return err
+// embedHandleHTTPMiddleware runs the embedded handler through the
+// Middleware, a request rejected by the middleware gets a 403 response
+func (s *Server) embedHandleHTTPMiddleware(conn net.Conn, req *http.Request, isConnectMethod bool, proxyReq *statute.ProxyRequest) error {
+	if s.Middleware == nil {
+		return s.embedHandleHTTP(conn, req, isConnectMethod)
+	}
+	proxyReq.Conn = conn
+	proxyReq.Reader = io.Reader(conn)
+	proxyReq.Writer = io.Writer(conn)
+	embedded := false
+	handler := s.Middleware(func(*statute.ProxyRequest) error {
+		embedded = true
+		return s.embedHandleHTTP(conn, req, isConnectMethod)
+	})
+	err := handler(proxyReq)
+	if err != nil && !embedded {
+		defer func() {
+			_ = conn.Close()
+		}()
+		s.respondError(NewHTTPResponseWriter(conn), http.StatusForbidden, err)
 	}
+	return err
+}
+
+func (s *Server) embedHandleHTTP(conn net.Conn, req *http.Request, isConnectMethod bool) error {
 	defer func() {
-		_ = target.Close()
+		_ = conn.Close()
 	}()
 
-	if isConnectMethod {
-		_, err = conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	if s.RequireHandler {
+		s.respondError(NewHTTPResponseWriter(conn), http.StatusForbidden, statute.ErrHandlerRequired)
+		return statute.ErrHandlerRequired
+	}
+
+	targetAddr, _, _ := targetAddress(req, isConnectMethod)
+
+	pooled := !isConnectMethod && s.UpstreamPoolSize > 0
+	var target net.Conn
+	if pooled {
+		target = s.upstreams.get(targetAddr)
+	}
+	reused := target != nil
+	if !reused {
+		var err error
+		target, err = s.dialTarget(conn, req, targetAddr)
 		if err != nil {
 			return err
 		}
+	}
+
+	if !isConnectMethod {
+		keepAlive, err := s.forwardHTTP(conn, target, req, pooled)
+		if reused && errors.Is(err, errNoResponse) && (req.Body == nil || req.Body == http.NoBody) {
+			// the pooled connection was closed by the target meanwhile,
+			// nothing reached the client yet so retry on a fresh one
+			_ = target.Close()
+			target, err = s.dialTarget(conn, req, targetAddr)
+			if err != nil {
+				return err
+			}
+			keepAlive, err = s.forwardHTTP(conn, target, req, pooled)
+		}
+		if keepAlive {
+			s.upstreams.put(targetAddr, target, s.UpstreamPoolSize, s.UpstreamIdleTimeout)
+		} else {
+			_ = target.Close()
+		}
+		return statute.WithPhase(statute.PhaseTunnel, targetAddr, err)
+	}
+	defer func() {
+		_ = target.Close()
+	}()
+
+	statute.RecordAccessStatus(conn, http.StatusOK)
+	if err := s.writeConnectEstablished(conn); err != nil {
+		return err
+	}
+
+	_, _, err := statute.Relay(req.Context(), conn, target, statute.RelayOptions{
+		BytesPool:         s.BytesPool,
+		ByteLimit:         s.ConnectionByteLimit,
+		KeepAliveInterval: s.TCPKeepAliveInterval,
+	})
+	return statute.WithPhase(statute.PhaseTunnel, targetAddr, err)
+}
+
+// dialTarget dials the target of req, replying 503 to conn on failure
+func (s *Server) dialTarget(conn net.Conn, req *http.Request, targetAddr string) (net.Conn, error) {
+	target, err := statute.TraceDial(req.Context(), s.ProxyDial, "tcp", targetAddr)
+	s.logDestination(req.Context(), req.Method, targetAddr, err)
+	if err != nil {
+		s.respondError(NewHTTPResponseWriter(conn), http.StatusServiceUnavailable, err)
+		return nil, statute.WithPhase(statute.PhaseDial, targetAddr, err)
+	}
+	return target, nil
+}
+
+// forwardHTTP sends req to target and its response back to conn. A
+// successful upgrade, such as a WebSocket handshake answered with 101
+// Switching Protocols, turns the connection into a raw tunnel, any other
+// response ends it. The client side is not kept alive, the response is sent
+// with Connection: close since the caller closes conn after a single request,
+// which also keeps every request subject to authentication and the ACL of
+// its own destination. With keepAlive the target connection is asked to stay
+// open, and it reports whether the target connection can be reused for
+// another request. An error wrapping errNoResponse means nothing was written
+// to conn.
+func (s *Server) forwardHTTP(conn, target net.Conn, req *http.Request, keepAlive bool) (bool, error) {
+	upgrade := upgradeType(req.Header)
+	halfClose := s.HalfCloseRequests && upgrade == ""
+	if halfClose {
+		// a half-closed connection can't carry another request
+		keepAlive = false
+	}
+	removeHopByHopHeaders(req.Header)
+	s.addForwardedHeaders(conn, req)
+	if upgrade != "" {
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", upgrade)
 	} else {
-		err = req.Write(target)
+		req.Close = !keepAlive
+	}
+
+	// the request body is written concurrently so interim responses, such as
+	// 100 Continue, reach the client while it waits to send the body
+	writeErr := make(chan error, 1)
+	go func() {
+		err := req.Write(target)
+		if err == nil && halfClose {
+			// signal the end of the request, the response direction
+			// stays open. Targets that can't half-close only miss the
+			// signal.
+			if closeErr := statute.CloseWrite(target); !errors.Is(closeErr, errors.ErrUnsupported) {
+				err = closeErr
+			}
+		}
+		writeErr <- err
+	}()
+
+	reader := bufio.NewReader(target)
+	var resp *http.Response
+	for interim := false; ; interim = true {
+		var err error
+		resp, err = http.ReadResponse(reader, req)
 		if err != nil {
-			return err
+			if !interim {
+				// wait for the writer so req can be sent again
+				_ = target.Close()
+				<-writeErr
+				err = fmt.Errorf("%w: %w", errNoResponse, err)
+			}
+			return false, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode >= 200 || resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if err := resp.Write(conn); err != nil {
+			return false, err
 		}
 	}
+	statute.RecordAccessStatus(conn, resp.StatusCode)
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
+	if resp.StatusCode != http.StatusSwitchingProtocols || upgrade == "" {
 		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
+			_ = resp.Body.Close()
 		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+		reusable := keepAlive && !resp.Close
+		removeHopByHopHeaders(resp.Header)
+		resp.Close = true
+		if err := resp.Write(conn); err != nil {
+			return false, err
+		}
+		// the body was read to its end, anything buffered beyond it leaves
+		// the connection in an unknown state. A target that answered before
+		// the request body was fully written is not reused either, rather
+		// than waiting for a client that may never finish sending it.
+		if !reusable || reader.Buffered() != 0 {
+			return false, nil
+		}
+		select {
+		case err := <-writeErr:
+			return err == nil, nil
+		default:
+			return false, nil
+		}
+	}
+
+	if err := resp.Write(conn); err != nil {
+		return false, err
+	}
+	if err := <-writeErr; err != nil {
+		return false, err
 	}
-	return statute.Tunnel(s.Context, target, conn, buf1, buf2)
+	// the reader may already hold data the target sent after the response
+	_, _, err := statute.Relay(req.Context(), conn, &bufferedConn{Conn: target, reader: reader}, statute.RelayOptions{
+		BytesPool: s.BytesPool,
+		ByteLimit: s.ConnectionByteLimit,
+	})
+	return false, err
 }
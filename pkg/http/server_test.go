@@ -0,0 +1,966 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve starts s on a loopback listener closed at the end of the test, it
+// returns the address of the listener
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = s.ServeConn(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// serveTarget starts a loopback TCP server running handle on every
+// connection, it returns the address of the server
+func serveTarget(t testing.TB, handle func(conn net.Conn)) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dial connects to the proxy at addr, the connection is closed at the end of
+// the test and times out after five seconds
+func dial(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func TestForwardEarlyResponseDoesNotWaitForBody(t *testing.T) {
+	// the target answers without reading the body
+	target := serveTarget(t, func(conn net.Conn) {
+		if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 413 Request Entity Too Large\r\nContent-Length: 0\r\n\r\n")
+		// stay open so only the proxy can end the exchange
+		_, _ = io.Copy(io.Discard, conn)
+	})
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithUpstreamPool(4, time.Minute))
+	conn := dial(t, serve(t, s))
+
+	// the client stalls after a part of the announced body
+	_, err := io.WriteString(conn, "POST http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\nContent-Length: 1000\r\n\r\npartial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusRequestEntityTooLarge)
+	}
+	if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after response = %v, want EOF", err)
+	}
+}
+
+// echoTarget answers every request with its body
+func echoTarget(t testing.TB) string {
+	t.Helper()
+	return serveTarget(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(reader)
+			if err != nil {
+				return
+			}
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return
+			}
+			_, err = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+			if err != nil {
+				return
+			}
+		}
+	})
+}
+
+func TestForwardLargeBody(t *testing.T) {
+	target := echoTarget(t)
+	s := NewServer(WithLogger(statute.DefaultLogger{}))
+	addr := serve(t, s)
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16)
+
+	tests := []struct {
+		name          string
+		contentLength int64
+	}{
+		{"content-length", int64(len(body))},
+		{"chunked", -1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, addr)
+			req, err := http.NewRequest(http.MethodPost, "http://"+target+"/", io.NopCloser(bytes.NewReader(body)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.ContentLength = tt.contentLength
+			written := make(chan error, 1)
+			go func() {
+				written <- req.WriteProxy(conn)
+			}()
+
+			resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+			}
+			echoed, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(echoed, body) {
+				t.Fatalf("echoed %d bytes, want %d", len(echoed), len(body))
+			}
+			if err := <-written; err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// pathTarget answers every request with its path
+func pathTarget(t testing.TB) string {
+	return serveTarget(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(req.URL.Path), req.URL.Path)
+	})
+}
+
+func TestRequestForms(t *testing.T) {
+	target := pathTarget(t)
+	plain := serve(t, NewServer(WithLogger(statute.DefaultLogger{})))
+	originForm := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithOriginFormRequests()))
+
+	tests := []struct {
+		name    string
+		proxy   string
+		request string
+		status  int
+		body    string
+	}{
+		{
+			name:    "absolute-form",
+			proxy:   plain,
+			request: "GET http://" + target + "/absolute HTTP/1.1\r\nHost: " + target + "\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "/absolute",
+		},
+		{
+			name:    "origin-form",
+			proxy:   originForm,
+			request: "GET /origin HTTP/1.0\r\nHost: " + target + "\r\n\r\n",
+			status:  http.StatusOK,
+			body:    "/origin",
+		},
+		{
+			name:    "origin-form disabled",
+			proxy:   plain,
+			request: "GET /origin HTTP/1.0\r\nHost: " + target + "\r\n\r\n",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "missing host",
+			proxy:   originForm,
+			request: "GET /origin HTTP/1.0\r\n\r\n",
+			status:  http.StatusBadRequest,
+		},
+		{
+			name:    "host is the proxy",
+			proxy:   originForm,
+			request: "GET /loop HTTP/1.0\r\nHost: " + originForm + "\r\n\r\n",
+			status:  http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, tt.proxy)
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.body != "" && string(body) != tt.body {
+				t.Fatalf("body = %q, want %q", body, tt.body)
+			}
+			// one request per client connection
+			if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after response = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestTransparentModeFallsBackToHost(t *testing.T) {
+	target := pathTarget(t)
+	var (
+		mu     sync.Mutex
+		dialed []string
+	)
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithTransparentMode(),
+		WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, address)
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		}),
+	)
+	proxy := serve(t, s)
+
+	tests := []struct {
+		name   string
+		host   string
+		status int
+		dialed []string
+	}{
+		{"host", target, http.StatusOK, []string{target}},
+		{"host is the proxy", proxy, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mu.Lock()
+			dialed = nil
+			mu.Unlock()
+
+			// the connection is not redirected, its original destination is
+			// the proxy itself
+			conn := dial(t, proxy)
+			if _, err := io.WriteString(conn, "GET /transparent HTTP/1.0\r\nHost: "+tt.host+"\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.status == http.StatusOK && string(body) != "/transparent" {
+				t.Fatalf("body = %q, want %q", body, "/transparent")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(dialed) != fmt.Sprint(tt.dialed) {
+				t.Fatalf("dialed %v, want %v", dialed, tt.dialed)
+			}
+		})
+	}
+}
+
+// countingPool is a statute.BytesPool counting the buffers taken and
+// returned
+type countingPool struct {
+	statute.BytesPool
+	gets, puts atomic.Int64
+}
+
+func newCountingPool() *countingPool {
+	return &countingPool{BytesPool: statute.NewBytesPool(0)}
+}
+
+func (p *countingPool) Get() []byte {
+	p.gets.Add(1)
+	return p.BytesPool.Get()
+}
+
+func (p *countingPool) Put(b []byte) {
+	p.puts.Add(1)
+	p.BytesPool.Put(b)
+}
+
+// tcpEcho starts a loopback TCP server sending everything back, it returns
+// its address
+func tcpEcho(t testing.TB) string {
+	return serveTarget(t, func(conn net.Conn) {
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// connect opens a CONNECT tunnel to target through the proxy at addr, the
+// returned reader holds any tunnel data read along with the response
+func connect(t testing.TB, addr, target string) (net.Conn, io.Reader) {
+	t.Helper()
+	conn := dial(t, addr)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	return conn, reader
+}
+
+func TestConnectUsesBytesPool(t *testing.T) {
+	pool := newCountingPool()
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithBytesPool(pool)))
+	conn, reader := connect(t, proxy, tcpEcho(t))
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echoed %q, want %q", got, "ping")
+	}
+	if gets := pool.gets.Load(); gets != 2 {
+		t.Fatalf("tunnel took %d buffers from the pool, want one per direction", gets)
+	}
+	_ = conn.Close()
+	// the buffers are returned once the tunnel ends
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.puts.Load() != pool.gets.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d buffers returned to the pool, want %d", pool.puts.Load(), pool.gets.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// BenchmarkConnect measures CONNECT tunnels carrying one echoed message,
+// the copy buffers come from the pool so they don't show in the
+// allocations
+func BenchmarkConnect(b *testing.B) {
+	proxy := serve(b, NewServer(WithLogger(statute.DefaultLogger{}), WithBytesPool(statute.NewBytesPool(0))))
+	echo := tcpEcho(b)
+	payload := bytes.Repeat([]byte("x"), 1024)
+	got := make([]byte, len(payload))
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, reader := connect(b, proxy, echo)
+		if _, err := conn.Write(payload); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.ReadFull(reader, got); err != nil {
+			b.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+}
+
+func TestAuthenticateRealm(t *testing.T) {
+	deny := func(context.Context, string, string) bool { return false }
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    string
+	}{
+		{"default", nil, `Basic realm="proxy"`},
+		{"configured", []ServerOption{WithRealm("corp")}, `Basic realm="corp"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]ServerOption{WithLogger(statute.DefaultLogger{}), WithAuthenticator(deny)}, tt.options...)
+			conn := dial(t, serve(t, NewServer(options...)))
+			if _, err := io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+			}
+			if got := resp.Header.Get("Proxy-Authenticate"); got != tt.want {
+				t.Fatalf("Proxy-Authenticate = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	target := pathTarget(t)
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithMaxHeaderBytes(1024)))
+
+	tests := []struct {
+		name   string
+		header string
+		status int
+	}{
+		{"within the limit", strings.Repeat("a", 100), http.StatusOK},
+		{"oversized", strings.Repeat("a", 4096), http.StatusRequestHeaderFieldsTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dial(t, proxy)
+			_, err := io.WriteString(conn, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\nX-Padding: "+tt.header+"\r\n\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+				t.Fatal(err)
+			}
+			// the connection is closed after the response
+			if _, err := reader.ReadByte(); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after response = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestConnectPortLists(t *testing.T) {
+	target := tcpEcho(t)
+	_, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    int
+	}{
+		{"no lists", nil, http.StatusOK},
+		{"allowed port", []ServerOption{WithAllowedPorts([]int{port})}, http.StatusOK},
+		{"port not allowed", []ServerOption{WithAllowedPorts([]int{port + 1})}, http.StatusForbidden},
+		{"denied port", []ServerOption{WithDeniedPorts([]int{port})}, http.StatusForbidden},
+		{"denied over allowed", []ServerOption{WithAllowedPorts([]int{port}), WithDeniedPorts([]int{port})}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dial(t, serve(t, s))
+			if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectRequiresAuthentication(t *testing.T) {
+	authenticate := func(_ context.Context, username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+	target := tcpEcho(t)
+	var dials, handled atomic.Int64
+	tests := []struct {
+		name    string
+		options []ServerOption
+	}{
+		{"embedded", []ServerOption{WithProxyDial(func(ctx context.Context, network, address string) (net.Conn, error) {
+			dials.Add(1)
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		})}},
+		{"handler", []ServerOption{WithConnectHandle(func(req *statute.ProxyRequest) error {
+			handled.Add(1)
+			return errors.New("not tunnelled")
+		})}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dials.Store(0)
+			handled.Store(0)
+			options := append([]ServerOption{WithLogger(statute.DefaultLogger{}), WithAuthenticator(authenticate)}, tt.options...)
+			conn := dial(t, serve(t, NewServer(options...)))
+			if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+				t.Fatal(err)
+			}
+			reader := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+			}
+			_, _ = io.Copy(io.Discard, resp.Body)
+			// no tunnel: the proxy neither dials nor echoes anything back
+			_, _ = io.WriteString(conn, "ping")
+			_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			if b, err := reader.ReadByte(); err == nil {
+				t.Fatalf("read %q after 407, want no tunnel", b)
+			}
+			if n := dials.Load() + handled.Load(); n != 0 {
+				t.Fatalf("request reached the dialer or handler %d times, want none", n)
+			}
+		})
+	}
+
+	// the same request with credentials is tunnelled
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithAuthenticator(authenticate), tests[0].options[0]))
+	conn := dial(t, proxy)
+	credentials := base64.StdEncoding.EncodeToString([]byte("user:secret"))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\nProxy-Authorization: Basic %s\r\n\r\n", target, target, credentials); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || dials.Load() != 1 {
+		t.Fatalf("status = %d after %d dials, want %d after one", resp.StatusCode, dials.Load(), http.StatusOK)
+	}
+}
+
+func TestServeConnRecoversHandlerPanic(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(func(*statute.ProxyRequest) error {
+		panic("broken handler")
+	}))
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, _ = io.WriteString(client, "CONNECT 192.0.2.1:80 HTTP/1.1\r\nHost: 192.0.2.1:80\r\n\r\n")
+	}()
+	// the connection is closed once the panic is recovered
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("reading until close = %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, statute.ErrHandlerPanic) {
+			t.Fatalf("ServeConn() = %v, want %v", err, statute.ErrHandlerPanic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn blocked")
+	}
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	deny := func(context.Context, string, string) bool { return false }
+	tests := []struct {
+		name      string
+		header    string
+		wantDelay bool
+	}{
+		// clients send no credentials first to get the challenge
+		{"no credentials", "", false},
+		{"rejected credentials", "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong")) + "\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithAuthenticator(deny), WithAuthFailureDelay(delay))
+			conn := dial(t, serve(t, s))
+			start := time.Now()
+			if _, err := io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"+tt.header+"\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			took := time.Since(start)
+			if resp.StatusCode != http.StatusProxyAuthRequired {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, http.StatusProxyAuthRequired)
+			}
+			if tt.wantDelay && took < delay {
+				t.Fatalf("407 after %v, want at least %v", took, delay)
+			}
+			if !tt.wantDelay && took >= delay {
+				t.Fatalf("407 after %v, want no delay", took)
+			}
+		})
+	}
+}
+
+// headerTarget answers every request with its Via and X-Forwarded-For
+// headers, separated by a pipe
+func headerTarget(t testing.TB) string {
+	return serveTarget(t, func(conn net.Conn) {
+		req, err := http.ReadRequest(bufio.NewReader(conn))
+		if err != nil {
+			return
+		}
+		body := req.Header.Get("Via") + "|" + strings.Join(req.Header.Values("X-Forwarded-For"), ",")
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	})
+}
+
+func TestForwardedHeaders(t *testing.T) {
+	target := headerTarget(t)
+	tests := []struct {
+		name    string
+		options []ServerOption
+		header  string
+		want    string
+	}{
+		{"disabled", nil, "", "|"},
+		{"added", []ServerOption{WithForwardedHeaders("edge")}, "", "1.1 edge|127.0.0.1"},
+		{"appended", []ServerOption{WithForwardedHeaders("edge")}, "X-Forwarded-For: 10.0.0.1\r\n", "1.1 edge|10.0.0.1, 127.0.0.1"},
+		{"without X-Forwarded-For", []ServerOption{WithForwardedHeaders("edge"), WithDisableXForwardedFor()}, "", "1.1 edge|"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dial(t, serve(t, s))
+			_, err := io.WriteString(conn, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\n"+tt.header+"\r\n")
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Fatalf("target got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestHalfCloseRequests(t *testing.T) {
+	// the target answers only once it read EOF after the request
+	target := serveTarget(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(io.Discard, reader); err != nil {
+			return
+		}
+		_, _ = fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+	})
+	tests := []struct {
+		name     string
+		options  []ServerOption
+		wantBody bool
+	}{
+		{"half-closed", []ServerOption{WithHalfCloseRequests()}, true},
+		{"kept open", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dial(t, serve(t, s))
+			_, err := io.WriteString(conn, "POST http://"+target+"/ HTTP/1.1\r\nHost: "+target+"\r\nContent-Length: 5\r\n\r\nhello")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if !tt.wantBody {
+				if err == nil {
+					t.Fatalf("status %d without half-closing, want no response", resp.StatusCode)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the response direction stayed open for the whole body
+			body, err := io.ReadAll(resp.Body)
+			if err != nil || string(body) != "hello" {
+				t.Fatalf("response body %q, %v, want %q", body, err, "hello")
+			}
+		})
+	}
+}
+
+func TestTargetAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		url      string
+		connect  bool
+		wantAddr string
+		wantHost string
+		wantPort string
+	}{
+		{"host and port", "http://example.com:8080/", false, "example.com:8080", "example.com", "8080"},
+		{"http default port", "http://example.com/", false, "example.com:80", "example.com", "80"},
+		{"https default port", "https://example.com/", false, "example.com:443", "example.com", "443"},
+		{"connect default port", "//example.com", true, "example.com:443", "example.com", "443"},
+		{"IPv6 with port", "http://[2001:db8::1]:8080/", false, "[2001:db8::1]:8080", "2001:db8::1", "8080"},
+		{"IPv6 without port", "http://[2001:db8::1]/", false, "[2001:db8::1]:80", "2001:db8::1", "80"},
+		{"IPv6 connect without port", "//[2001:db8::1]", true, "[2001:db8::1]:443", "2001:db8::1", "443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, tt.url, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, host, port := targetAddress(req, tt.connect)
+			if addr != tt.wantAddr || host != tt.wantHost || port != tt.wantPort {
+				t.Fatalf("targetAddress() = %q, %q, %q, want %q, %q, %q", addr, host, port, tt.wantAddr, tt.wantHost, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestForwardClosesClientConnection(t *testing.T) {
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{})))
+	target := echoTarget(t)
+	conn := dial(t, proxy)
+	// a keep-alive client pipelining a second request
+	request := "POST http://" + target + "/ HTTP/1.1\r\nHost: " + target + "\r\nConnection: keep-alive\r\nContent-Length: 4\r\n\r\nping"
+	if _, err := io.WriteString(conn, request+request); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil || string(body) != "ping" {
+		t.Fatalf("body = %q, %v, want %q", body, err, "ping")
+	}
+	if !resp.Close {
+		t.Fatal("response without Connection: close")
+	}
+	// the second request is not answered, the client reconnects for it
+	if _, err := http.ReadResponse(reader, nil); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("second response read = %v, want the connection closed", err)
+	}
+}
+
+// websocketTarget starts a target completing a WebSocket handshake, then
+// echoing the raw bytes, it reports the Connection and Upgrade headers it got
+func websocketTarget(t testing.TB, headers chan<- string) string {
+	return serveTarget(t, func(conn net.Conn) {
+		reader := bufio.NewReader(conn)
+		req, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		headers <- req.Header.Get("Connection") + "|" + req.Header.Get("Upgrade")
+		_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n"+
+			"Sec-WebSocket-Accept: "+req.Header.Get("Sec-WebSocket-Key")+"\r\n\r\n")
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, reader)
+	})
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	headers := make(chan string, 1)
+	target := websocketTarget(t, headers)
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{})))
+	conn := dial(t, proxy)
+	_, err := io.WriteString(conn, "GET http://"+target+"/chat HTTP/1.1\r\nHost: "+target+"\r\n"+
+		"Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Upgrade") != "websocket" {
+		t.Fatalf("status = %d, Upgrade = %q, want 101 and websocket", resp.StatusCode, resp.Header.Get("Upgrade"))
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "dGhlIHNhbXBsZSBub25jZQ==" {
+		t.Fatalf("Sec-WebSocket-Accept = %q, want it forwarded", got)
+	}
+	if got := <-headers; got != "Upgrade|websocket" {
+		t.Fatalf("target got Connection|Upgrade %q, want %q", got, "Upgrade|websocket")
+	}
+
+	// the connection is now a raw tunnel, a masked text frame is echoed
+	frame := []byte{0x81, 0x84, 1, 2, 3, 4, 'p' ^ 1, 'i' ^ 2, 'n' ^ 3, 'g' ^ 4}
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(frame))
+	if _, err := io.ReadFull(reader, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, frame) {
+		t.Fatalf("echoed frame %x, want %x", got, frame)
+	}
+}
+
+func TestErrorResponder(t *testing.T) {
+	failingDial := WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("dial tcp 10.1.2.3:8080: connection refused")
+	})
+	jsonResponder := WithErrorResponder(func(w http.ResponseWriter, status int, err error) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_, _ = fmt.Fprintf(w, `{"status":%d,"error":%q}`, status, err.Error())
+	})
+	tests := []struct {
+		name    string
+		options []ServerOption
+		status  int
+		body    string
+		header  string
+	}{
+		{"default hides the error", []ServerOption{failingDial}, http.StatusServiceUnavailable, "Service Unavailable\n", ""},
+		{"custom", []ServerOption{failingDial, jsonResponder}, http.StatusServiceUnavailable, `{"status":503,"error":"dial tcp 10.1.2.3:8080: connection refused"}`, ""},
+		{"custom keeps the challenge", []ServerOption{jsonResponder, WithAuthenticator(func(context.Context, string, string) bool { return false })},
+			http.StatusProxyAuthRequired, `{"status":407,"error":"proxy authentication required"}`, `Basic realm="proxy"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)
+			conn := dial(t, serve(t, NewServer(options...)))
+			if _, err := io.WriteString(conn, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status || string(body) != tt.body {
+				t.Fatalf("got %d %q, want %d %q", resp.StatusCode, body, tt.status, tt.body)
+			}
+			if got := resp.Header.Get("Proxy-Authenticate"); got != tt.header {
+				t.Fatalf("Proxy-Authenticate = %q, want %q", got, tt.header)
+			}
+		})
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	if got := NewServer().ReplyTimeout; got != statute.DefaultReplyTimeout {
+		t.Fatalf("default ReplyTimeout = %v, want %v", got, statute.DefaultReplyTimeout)
+	}
+
+	// the client sends a CONNECT request but never reads the response
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithReplyTimeout(50*time.Millisecond),
+		WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+			target, _ := net.Pipe()
+			return target, nil
+		}),
+	)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+	_ = client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(client, "CONNECT 192.0.2.1:443 HTTP/1.1\r\nHost: 192.0.2.1:443\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, statute.ErrReplyTimeout) {
+			t.Fatalf("ServeConn() = %v, want %v", err, statute.ErrReplyTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn blocked")
+	}
+}
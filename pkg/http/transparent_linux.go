@@ -0,0 +1,79 @@
+//go:build linux
+
+package http
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST and IP6T_SO_ORIGINAL_DST of netfilter
+const soOriginalDst = 80
+
+// originalDestination returns the destination of conn before it was
+// redirected by netfilter, such as with an iptables REDIRECT rule
+func originalDestination(conn net.Conn) (string, error) {
+	tcpConn, ok := unwrapTCPConn(conn)
+	if !ok {
+		return "", errNoOriginalDst
+	}
+	local, ok := tcpConn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return "", errNoOriginalDst
+	}
+	rawConn, err := tcpConn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		ip      net.IP
+		port    uint16
+		sockErr error
+	)
+	err = rawConn.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// the sockaddr_in fits in the 16 bytes of an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst)
+			if sockErr != nil {
+				return
+			}
+			port = binary.BigEndian.Uint16(mreq.Multiaddr[2:4])
+			ip = net.IP(mreq.Multiaddr[4:8])
+			return
+		}
+		// the sockaddr_in6 is the first field of an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst)
+		if sockErr != nil {
+			return
+		}
+		port = binary.BigEndian.Uint16(binary.NativeEndian.AppendUint16(nil, info.Addr.Port))
+		ip = net.IP(info.Addr.Addr[:])
+	})
+	if err != nil {
+		return "", err
+	}
+	if sockErr != nil {
+		return "", sockErr
+	}
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port))), nil
+}
+
+// unwrapTCPConn returns the *net.TCPConn conn wraps, unwrapping connections
+// that expose the connection they wrap through NetConn
+func unwrapTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,52 @@
+//go:build linux
+
+package http
+
+import (
+	"net"
+	"testing"
+)
+
+// netConnWrapper wraps a connection and exposes it through NetConn
+type netConnWrapper struct {
+	net.Conn
+}
+
+func (c netConnWrapper) NetConn() net.Conn {
+	return c.Conn
+}
+
+func TestUnwrapTCPConn(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	pipe, other := net.Pipe()
+	defer pipe.Close()
+	defer other.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		want net.Conn
+	}{
+		{"tcp", conn, conn},
+		{"wrapped", netConnWrapper{netConnWrapper{conn}}, conn},
+		{"pipe", pipe, nil},
+		{"wrapped pipe", netConnWrapper{pipe}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := unwrapTCPConn(tt.conn)
+			if ok != (tt.want != nil) || ok && got != tt.want {
+				t.Fatalf("unwrapTCPConn() = %v, %v, want %v", got, ok, tt.want)
+			}
+		})
+	}
+}
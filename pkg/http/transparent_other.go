@@ -0,0 +1,11 @@
+//go:build !linux
+
+package http
+
+import "net"
+
+// originalDestination is only supported on linux, the Host header is used
+// elsewhere
+func originalDestination(net.Conn) (string, error) {
+	return "", errNoOriginalDst
+}
@@ -0,0 +1,40 @@
+package http
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestOriginalDestination(t *testing.T) {
+	// only TCP connections have an original destination
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if _, err := originalDestination(client); !errors.Is(err, errNoOriginalDst) {
+		t.Fatalf("originalDestination(pipe) = %v, want %v", err, errNoOriginalDst)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer accepted.Close()
+
+	// a connection that was not redirected has no original destination
+	// other than the address it was accepted on
+	dst, err := originalDestination(accepted)
+	if err == nil && dst != accepted.LocalAddr().String() {
+		t.Fatalf("originalDestination() = %s, want %s or an error", dst, accepted.LocalAddr())
+	}
+}
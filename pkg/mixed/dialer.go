@@ -0,0 +1,35 @@
+package mixed
+
+import (
+	"context"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+)
+
+// Dialer returns a dial function connecting to the proxy in-process, without
+// a listener. Every call creates an in-memory connection whose far end is
+// served by ServeConn, the network and address arguments are ignored.
+//
+// It is a testing and embedding aid, for example an http.Client can use the
+// proxy with a transport whose DialContext is the returned function and
+// whose Proxy points at any socks5:// or http:// URL.
+func (p *Proxy) Dialer() statute.ProxyDialFunc {
+	return func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+		if p.inShutdown.Load() {
+			return nil, ErrProxyClosed
+		}
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		client, server := net.Pipe()
+		go func() {
+			err := p.ServeConn(server)
+			if err != nil && p.errorHandler == nil && !statute.IsBenignCloseError(err) {
+				p.logger.Error(err)
+			}
+			_ = server.Close()
+		}()
+		return client, nil
+	}
+}
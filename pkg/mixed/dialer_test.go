@@ -0,0 +1,76 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestDialer(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.URL.Path)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewUnstartedServer(handler)
+	secure.Config.ErrorLog = log.New(io.Discard, "", 0)
+	secure.StartTLS()
+	defer secure.Close()
+
+	p := NewProxy(WithLogger(statute.DefaultLogger{}))
+	// newClient returns a client reaching the proxy of scheme through Dialer,
+	// the host of the proxy URL is never dialed
+	newClient := func(scheme string) *http.Client {
+		transport := secure.Client().Transport.(*http.Transport).Clone()
+		transport.Proxy = http.ProxyURL(&url.URL{Scheme: scheme, Host: "proxy.invalid:1080"})
+		transport.DialContext = p.Dialer()
+		transport.DisableKeepAlives = true
+		return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	}
+
+	tests := []struct {
+		name   string
+		scheme string
+		target string
+	}{
+		{"http get", "http", plain.URL},
+		{"http connect", "http", secure.URL},
+		{"socks5", "socks5", plain.URL},
+		{"socks5 tls", "socks5", secure.URL},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := newClient(tt.scheme).Get(tt.target + "/dialer")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusOK || string(body) != "/dialer" {
+				t.Fatalf("got %d %q, want 200 %q", resp.StatusCode, body, "/dialer")
+			}
+		})
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+	if _, err := p.Dialer()(context.Background(), "tcp", "proxy.invalid:1080"); !errors.Is(err, ErrProxyClosed) {
+		t.Fatalf("dial after Shutdown = %v, want %v", err, ErrProxyClosed)
+	}
+	if _, err := newClient("http").Get(plain.URL); !errors.Is(err, ErrProxyClosed) {
+		t.Fatalf("request after Shutdown = %v, want %v", err, ErrProxyClosed)
+	}
+}
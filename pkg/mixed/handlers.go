@@ -2,7 +2,12 @@ package mixed
 
 import (
 	"context"
+	"github.com/bepass-org/proxy/pkg/http"
+	"github.com/bepass-org/proxy/pkg/socks5"
 	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"time"
 )
 
 func WithBindAddress(binAddress string) Option {
@@ -14,7 +19,243 @@ func WithBindAddress(binAddress string) Option {
 	}
 }
 
+func WithDisableSOCKS5() Option {
+	return func(p *Proxy) {
+		p.disableSOCKS5 = true
+	}
+}
+
+// WithDisableUDP rejects SOCKS5 UDP ASSOCIATE requests, see
+// socks5.Server.DisableUDP
+func WithDisableUDP() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DisableUDP = true
+	}
+}
+
+// WithUDPSink makes SOCKS5 UDP ASSOCIATE sessions consume the datagrams of
+// clients without relaying them, see socks5.Server.UDPSink
+func WithUDPSink() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.UDPSink = true
+	}
+}
+
+// WithProtocolDetector serves connections whose first bytes satisfy match
+// with handler, extending the proxy with protocols told by their first
+// bytes. match gets the bytes received so far, at least one, and handler
+// the connection with nothing consumed, it is closed once handler returns.
+// Detectors are tried in the order they are registered and before the
+// built-in protocols, the first one matching wins.
+func WithProtocolDetector(match func(peek []byte) bool, handler func(conn net.Conn) error) Option {
+	return func(p *Proxy) {
+		p.detectors = append(p.detectors, protocolDetector{match: match, handler: handler})
+	}
+}
+
+func WithDisableSOCKS4() Option {
+	return func(p *Proxy) {
+		p.disableSOCKS4 = true
+	}
+}
+
+func WithDisableHTTP() Option {
+	return func(p *Proxy) {
+		p.disableHTTP = true
+	}
+}
+
+// WithListenConfig sets the net.ListenConfig used by ListenAndServe, giving
+// full control over the listening socket. Its Control function runs after
+// the socket is created and before it is bound, which is where options like
+// SO_REUSEPORT have to be set.
+func WithListenConfig(listenConfig *net.ListenConfig) Option {
+	return func(p *Proxy) {
+		p.listenConfig = listenConfig
+	}
+}
+
+// WithListener makes ListenAndServe serve ln instead of listening on the bind
+// address, which allows custom transports. ln is closed when serving stops,
+// including by Shutdown.
+func WithListener(ln net.Listener) Option {
+	return func(p *Proxy) {
+		p.userListener = ln
+	}
+}
+
+// WithListenerSpecs makes ListenAndServe listen on the address of every spec
+// instead of the bind address, the connections each listener accepts use
+// its TLS config, authenticator and ACL, for example a loopback listener
+// without authentication for local tools next to a public one requiring it.
+// The authenticator applies to SOCKS5 and HTTP.
+func WithListenerSpecs(specs ...ListenerSpec) Option {
+	return func(p *Proxy) {
+		p.listenerSpecs = specs
+	}
+}
+
+// WithDialRetry makes the embedded handlers try a dial up to attempts times
+// when it fails with a transient error, such as a refused connection while
+// the upstream restarts. The wait between attempts starts at backoff and
+// doubles, see statute.RetryProxyDial.
+func WithDialRetry(attempts int, backoff time.Duration) Option {
+	return func(p *Proxy) {
+		p.dialRetryAttempts = attempts
+		p.dialRetryBackoff = backoff
+	}
+}
+
+// WithMaxConnections bounds the connections served at once to n, further
+// connections are closed unless a queue timeout is set, see WithQueueTimeout.
+// Zero means no limit.
+func WithMaxConnections(n int) Option {
+	return func(p *Proxy) {
+		p.maxConnections = n
+	}
+}
+
+// WithMaxConnectionsPerIP bounds the connections served at once from one
+// client IP to n, so a single client can't take all the connections of the
+// proxy. Further connections from it are closed. Zero means no limit.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(p *Proxy) {
+		p.maxConnectionsPerIP = n
+	}
+}
+
+// WithQueueTimeout lets connections over the WithMaxConnections limit wait up
+// to timeout for a slot instead of closing them at once, smoothing bursts.
+// See Proxy.QueueDepth.
+func WithQueueTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.queueTimeout = timeout
+	}
+}
+
+// WithUpstreamHealthCache remembers the dial failures of upstreams for ttl,
+// dials to an upstream which failed within ttl fail at once with the same
+// reply instead of waiting for the dial timeout. A retried dial, see
+// WithDialRetry, is remembered once all its attempts failed.
+func WithUpstreamHealthCache(ttl time.Duration) Option {
+	return func(p *Proxy) {
+		if ttl <= 0 {
+			p.upstreamHealth = nil
+			return
+		}
+		p.upstreamHealth = statute.NewUpstreamHealthCache(ttl)
+	}
+}
+
+// WithReadBufferSize sets the SO_RCVBUF size of the client connections and of
+// the upstream connections, when they are TCP connections. The operating
+// system may clamp the size, on Linux to net.core.rmem_max.
+func WithReadBufferSize(size int) Option {
+	return func(p *Proxy) {
+		p.readBufferSize = size
+	}
+}
+
+// WithWriteBufferSize sets the SO_SNDBUF size of the client connections and
+// of the upstream connections, when they are TCP connections. The operating
+// system may clamp the size, on Linux to net.core.wmem_max.
+func WithWriteBufferSize(size int) Option {
+	return func(p *Proxy) {
+		p.writeBufferSize = size
+	}
+}
+
 func WithLogger(logger statute.Logger) Option {
+	return WithUnsyncedLogger(statute.NewSyncLogger(logger))
+}
+
+// WithErrorHandler sets the handler observing the errors serving
+// connections, they are no longer logged
+func WithErrorHandler(errorHandler statute.ErrorHandler) Option {
+	return func(p *Proxy) {
+		p.errorHandler = errorHandler
+		p.socks5Proxy.ErrorHandler = errorHandler
+		p.socks4Proxy.ErrorHandler = errorHandler
+		p.httpProxy.ErrorHandler = errorHandler
+	}
+}
+
+// WithConnTrace makes the servers call the hooks of trace for every
+// connection, for example to break down its latency by phase, see
+// statute.ConnTrace
+func WithConnTrace(trace *statute.ConnTrace) Option {
+	return func(p *Proxy) {
+		p.connTrace = trace
+	}
+}
+
+// WithHandshakeTimeout bounds the time socks clients take to send their
+// handshake and request, see socks5.Server.HandshakeTimeout. The protocol
+// detection of every connection is bounded by it as well.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.handshakeTimeout = timeout
+		p.socks5Proxy.HandshakeTimeout = timeout
+		p.socks4Proxy.HandshakeTimeout = timeout
+	}
+}
+
+// WithTCPKeepAliveProbes enables TCP keepalive probes at interval on both
+// ends of the CONNECT tunnels relayed by the embedded handlers, so idle
+// tunnels, such as SSH sessions, are not dropped by NAT and firewalls.
+// Unlike an idle timeout it keeps idle connections open.
+func WithTCPKeepAliveProbes(interval time.Duration) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.TCPKeepAliveInterval = interval
+		p.socks4Proxy.TCPKeepAliveInterval = interval
+		p.httpProxy.TCPKeepAliveInterval = interval
+	}
+}
+
+// WithReplyTimeout bounds the time to write socks replies and HTTP status
+// responses to clients, see socks5.Server.ReplyTimeout. It defaults to
+// statute.DefaultReplyTimeout, so a client not reading its reply for that
+// long is disconnected. Zero disables it.
+func WithReplyTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ReplyTimeout = timeout
+		p.socks4Proxy.ReplyTimeout = timeout
+		p.httpProxy.ReplyTimeout = timeout
+	}
+}
+
+// WithMaxConnectionLifetime ends connections lifetime after they were
+// accepted, regardless of their activity
+func WithMaxConnectionLifetime(lifetime time.Duration) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.MaxConnectionLifetime = lifetime
+		p.socks4Proxy.MaxConnectionLifetime = lifetime
+		p.httpProxy.MaxConnectionLifetime = lifetime
+	}
+}
+
+// WithConnectionByteLimit ends tunnels once they relayed n bytes in both
+// directions together, as a hard quota rather than a rate limit
+func WithConnectionByteLimit(n int64) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ConnectionByteLimit = n
+		p.socks4Proxy.ConnectionByteLimit = n
+		p.httpProxy.ConnectionByteLimit = n
+	}
+}
+
+// WithVerboseDestinations logs the destinations dialed by the embedded
+// handlers and the outcome at debug level
+func WithVerboseDestinations(verbose bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.VerboseDestinations = verbose
+		p.socks4Proxy.VerboseDestinations = verbose
+		p.httpProxy.VerboseDestinations = verbose
+	}
+}
+
+// WithUnsyncedLogger sets logger as is, without serializing its calls
+func WithUnsyncedLogger(logger statute.Logger) Option {
 	return func(p *Proxy) {
 		p.logger = logger
 		p.socks5Proxy.Logger = logger
@@ -49,6 +290,15 @@ func WithUserUDPHandler(handler userHandler) Option {
 	}
 }
 
+func WithRouter(router *statute.Router) Option {
+	return func(p *Proxy) {
+		p.router = router
+		p.socks5Proxy.Router = router
+		p.socks4Proxy.Router = router
+		p.httpProxy.Router = router
+	}
+}
+
 func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 	return func(p *Proxy) {
 		p.userDialFunc = proxyDial
@@ -58,18 +308,186 @@ func WithUserDialFunc(proxyDial statute.ProxyDialFunc) Option {
 	}
 }
 
+// WithResolverCache resolves destination host names through a
+// statute.CachingResolver of size hosts before dialing them
+func WithResolverCache(size int, minTTL, maxTTL time.Duration) Option {
+	return func(p *Proxy) {
+		p.resolverCache = statute.NewCachingResolver(net.DefaultResolver, size, minTTL, maxTTL)
+	}
+}
+
+// WithDialLocalAddr sets the local address outbound TCP connections are
+// dialed from, it is ignored when WithUserDialFunc is used
+func WithDialLocalAddr(addr *net.TCPAddr) Option {
+	return func(p *Proxy) {
+		p.dialLocalAddr = addr
+	}
+}
+
+// WithPacketLocalAddr sets the local address of the socket relaying UDP to
+// targets, only its IP is used and every socket gets an ephemeral port. It
+// is ignored when WithUserPacketDialFunc is used.
+func WithPacketLocalAddr(addr *net.UDPAddr) Option {
+	return func(p *Proxy) {
+		p.packetLocalAddr = addr
+	}
+}
+
 func WithUserListenPacketFunc(proxyListenPacket statute.ProxyListenPacket) Option {
 	return func(p *Proxy) {
 		p.socks5Proxy.ProxyListenPacket = proxyListenPacket
 	}
 }
 
+func WithUserPacketDialFunc(proxyPacketDial statute.ProxyPacketDialFunc) Option {
+	return func(p *Proxy) {
+		p.userPacketDial = true
+		p.socks5Proxy.ProxyPacketDial = proxyPacketDial
+	}
+}
+
+func WithMaxUDPPacketSize(n int) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.MaxUDPPacketSize = n
+	}
+}
+
+func WithUDPByteLimit(n int64) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.UDPByteLimit = n
+	}
+}
+
+// WithUDPIdleTimeout ends UDP ASSOCIATE sessions idle for timeout
+func WithUDPIdleTimeout(timeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.UDPIdleTimeout = timeout
+	}
+}
+
+// WithUDPLooseSourceCheck accepts UDP ASSOCIATE datagrams from any port of
+// the client IP, see socks5.Server.UDPLooseSourceCheck for the tradeoff
+func WithUDPLooseSourceCheck(loose bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.UDPLooseSourceCheck = loose
+	}
+}
+
+// WithSOCKS5LenientParsing tolerates malformed SOCKS5 command headers, see
+// socks5.Server.LenientParsing
+func WithSOCKS5LenientParsing(lenient bool) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.LenientParsing = lenient
+	}
+}
+
+// WithSTUNForwardAddress sends the external address of the UDP ASSOCIATE
+// relay, discovered with stunServer, to clients, see
+// socks5.STUNForwardAddress
+func WithSTUNForwardAddress(stunServer string) Option {
+	return WithUserForwardAddressFunc(socks5.STUNForwardAddress(stunServer))
+}
+
+// WithUserForwardAddressFunc sets the function reporting the relay endpoint
+// sent to clients in the UDP ASSOCIATE reply, see socks5.WithPacketForwardAddress
 func WithUserForwardAddressFunc(packetForwardAddress statute.PacketForwardAddress) Option {
 	return func(p *Proxy) {
 		p.socks5Proxy.PacketForwardAddress = packetForwardAddress
 	}
 }
 
+// WithUserForwardHostFunc sets the function reporting the relay endpoint,
+// which may be a domain name, see socks5.WithPacketForwardHost
+func WithUserForwardHostFunc(packetForwardHost statute.PacketForwardHost) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.PacketForwardHost = packetForwardHost
+	}
+}
+
+func WithDestinationRewriter(rewriter statute.DestinationRewriter) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DestinationRewriter = rewriter
+		p.socks4Proxy.DestinationRewriter = rewriter
+		p.httpProxy.DestinationRewriter = rewriter
+	}
+}
+
+// WithAllowedPorts restricts the destination ports of TCP requests to ports
+// in all servers, an empty list allows every port
+func WithAllowedPorts(ports []int) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.AllowedPorts = ports
+		p.socks4Proxy.AllowedPorts = ports
+		p.httpProxy.AllowedPorts = ports
+	}
+}
+
+// WithDeniedPorts rejects TCP requests to ports in all servers, such as 25 to
+// keep an open proxy from relaying spam
+func WithDeniedPorts(ports []int) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DeniedPorts = ports
+		p.socks4Proxy.DeniedPorts = ports
+		p.httpProxy.DeniedPorts = ports
+	}
+}
+
+// WithMiddleware wraps the connect handlers of all servers, user or
+// embedded, with middlewares, the first one is the outermost
+func WithMiddleware(middlewares ...statute.Middleware) Option {
+	return func(p *Proxy) {
+		mw := statute.Chain(middlewares...)
+		p.socks5Proxy.Middleware = mw
+		p.socks4Proxy.Middleware = mw
+		p.httpProxy.Middleware = mw
+	}
+}
+
+func WithACL(acl statute.ACL) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.ACL = acl
+		p.socks4Proxy.ACL = acl
+		p.httpProxy.ACL = acl
+	}
+}
+
+func WithAccessLog(w io.Writer, format string) Option {
+	return func(p *Proxy) {
+		accessLog := statute.NewAccessLog(w, format)
+		p.socks5Proxy.AccessLog = accessLog
+		p.socks4Proxy.AccessLog = accessLog
+		p.httpProxy.AccessLog = accessLog
+	}
+}
+
+func WithRequireHandler() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.RequireHandler = true
+		p.socks4Proxy.RequireHandler = true
+		p.httpProxy.RequireHandler = true
+	}
+}
+
+// WithCloseOnHandlerError closes the client connections whose connect
+// handler returns an error, a socks client whose reply is deferred gets the
+// failure reply first, see WithDeferConnectReply
+func WithCloseOnHandlerError() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.CloseOnHandlerError = true
+		p.socks4Proxy.CloseOnHandlerError = true
+		p.httpProxy.CloseOnHandlerError = true
+	}
+}
+
+// WithDeferConnectReply leaves the socks CONNECT replies to the user
+// handlers, see statute.ProxyRequest.Reply
+func WithDeferConnectReply() Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.DeferConnectReply = true
+		p.socks4Proxy.DeferConnectReply = true
+	}
+}
+
 func WithContext(ctx context.Context) Option {
 	return func(p *Proxy) {
 		p.ctx = ctx
@@ -86,3 +504,132 @@ func WithBytesPool(bytesPool statute.BytesPool) Option {
 		p.httpProxy.BytesPool = bytesPool
 	}
 }
+
+// WithCopyChunkSize sizes the relay buffers to n bytes, small buffers such as
+// 4KB suit interactive protocols and save memory with many connections
+func WithCopyChunkSize(n int) Option {
+	return WithBytesPool(statute.NewBytesPool(n))
+}
+
+// WithSOCKS5Authenticator requires SOCKS5 clients to authenticate with
+// username/password credentials accepted by authenticator
+func WithSOCKS5Authenticator(authenticator statute.UserPassAuthenticator) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.Authenticator = authenticator
+	}
+}
+
+// WithAuthFailureDelay delays the replies to rejected SOCKS5 and HTTP
+// credentials by delay to slow down brute-forcing, see
+// statute.AuthFailureDelay
+func WithAuthFailureDelay(delay time.Duration) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.AuthFailureDelay = delay
+		p.httpProxy.AuthFailureDelay = delay
+	}
+}
+
+// WithSOCKS5PreConnect runs preConnect before socks5 CONNECT requests are
+// dialed or handed to a handler, see socks5.Server.PreConnect
+func WithSOCKS5PreConnect(preConnect statute.PreConnectFunc) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.PreConnect = preConnect
+	}
+}
+
+// WithSOCKS5CredentialChecker requires SOCKS5 clients to authenticate with
+// username/password credentials checked by checker, see
+// socks5.WithCredentialChecker
+func WithSOCKS5CredentialChecker(checker statute.CredentialChecker) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.CredentialChecker = checker
+	}
+}
+
+// WithSOCKS5AuthMethods sets the SOCKS5 authentication methods in preference
+// order, see socks5.Server.AuthMethods
+func WithSOCKS5AuthMethods(methods ...socks5.AuthMethod) Option {
+	return func(p *Proxy) {
+		p.socks5Proxy.AuthMethods = methods
+	}
+}
+
+// WithHTTPAuthenticator requires HTTP proxy clients to authenticate with
+// Basic Proxy-Authorization credentials accepted by authenticator
+func WithHTTPAuthenticator(authenticator statute.UserPassAuthenticator) Option {
+	return func(p *Proxy) {
+		p.httpProxy.Authenticator = authenticator
+	}
+}
+
+// WithHTTPRealm sets the realm of the Basic challenge sent to HTTP proxy
+// clients without valid credentials, see http.Server.Realm
+func WithHTTPRealm(realm string) Option {
+	return func(p *Proxy) {
+		p.httpProxy.Realm = realm
+	}
+}
+
+// WithHTTPUpstreamPool reuses keep-alive upstream connections across
+// forwarded HTTP requests, see http.WithUpstreamPool
+func WithHTTPUpstreamPool(size int, idleTimeout time.Duration) Option {
+	return func(p *Proxy) {
+		p.httpProxy.UpstreamPoolSize = size
+		p.httpProxy.UpstreamIdleTimeout = idleTimeout
+	}
+}
+
+// WithHTTPForwardedHeaders adds Via and X-Forwarded-For headers naming the
+// proxy as proxyName to forwarded HTTP requests, see http.Server.ViaName
+func WithHTTPForwardedHeaders(proxyName string) Option {
+	return func(p *Proxy) {
+		p.httpProxy.ViaName = proxyName
+	}
+}
+
+// WithHTTPDisableXForwardedFor omits the X-Forwarded-For header added by
+// WithHTTPForwardedHeaders
+func WithHTTPDisableXForwardedFor() Option {
+	return func(p *Proxy) {
+		p.httpProxy.DisableXForwardedFor = true
+	}
+}
+
+// WithHTTPErrorResponder writes the error responses of the HTTP proxy, see
+// http.Server.ErrorResponder
+func WithHTTPErrorResponder(responder http.ErrorResponder) Option {
+	return func(p *Proxy) {
+		p.httpProxy.ErrorResponder = responder
+	}
+}
+
+// WithHTTPHalfCloseRequests half-closes the upstream connection after each
+// forwarded HTTP request, see http.Server.HalfCloseRequests
+func WithHTTPHalfCloseRequests() Option {
+	return func(p *Proxy) {
+		p.httpProxy.HalfCloseRequests = true
+	}
+}
+
+// WithHTTPTransparentMode dials the original destination of redirected
+// origin-form HTTP requests, see http.Server.TransparentMode
+func WithHTTPTransparentMode() Option {
+	return func(p *Proxy) {
+		p.httpProxy.TransparentMode = true
+	}
+}
+
+// WithHTTPOriginFormRequests serves origin-form HTTP requests of legacy
+// clients by dialing the target of their Host header, see
+// http.Server.OriginFormRequests
+func WithHTTPOriginFormRequests() Option {
+	return func(p *Proxy) {
+		p.httpProxy.OriginFormRequests = true
+	}
+}
+
+func WithMaxHeaderBytes(n int) Option {
+	return func(p *Proxy) {
+		p.httpProxy.MaxHeaderBytes = n
+	}
+}
@@ -0,0 +1,469 @@
+package mixed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serveProxy starts p on a loopback listener closed at the end of the test,
+// it returns the address of the listener
+func serveProxy(t testing.TB, p *Proxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		_ = p.Serve(ln)
+	}()
+	return ln.Addr().String()
+}
+
+// tcpEcho starts a loopback TCP server sending everything back, it returns
+// its address
+func tcpEcho(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// udpEcho starts a loopback UDP server sending every datagram back, it
+// returns its address
+func udpEcho(t testing.TB) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// dialProxy connects to the proxy at addr, the connection is closed at the
+// end of the test and times out after five seconds
+func dialProxy(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// socks5Request sends a no-auth greeting and a request for the IPv4 address
+// addr, it returns the bound address of the reply
+func socks5Request(conn net.Conn, command byte, addr *net.UDPAddr) (*net.UDPAddr, error) {
+	if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+		return nil, err
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		return nil, err
+	}
+	if method[1] != 0 {
+		return nil, fmt.Errorf("method %d selected", method[1])
+	}
+
+	req := []byte{5, command, 0, 1}
+	req = append(req, addr.IP.To4()...)
+	req = binary.BigEndian.AppendUint16(req, uint16(addr.Port))
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0 {
+		return nil, fmt.Errorf("reply %d", reply[1])
+	}
+	if reply[3] != 1 {
+		return nil, fmt.Errorf("address type %d, want an IPv4 bound address", reply[3])
+	}
+	return &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(binary.BigEndian.Uint16(reply[8:10]))}, nil
+}
+
+// socks5Connect opens a SOCKS5 CONNECT tunnel to target on conn
+func socks5Connect(conn net.Conn, target string) (io.Reader, error) {
+	addr, err := net.ResolveUDPAddr("udp", target)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := socks5Request(conn, 1, addr); err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// socks4Connect opens a SOCKS4 CONNECT tunnel to target on conn
+func socks4Connect(conn net.Conn, target string) (io.Reader, error) {
+	addr, err := net.ResolveTCPAddr("tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	req := binary.BigEndian.AppendUint16([]byte{4, 1}, uint16(addr.Port))
+	req = append(req, addr.IP.To4()...)
+	req = append(req, 0)
+	if _, err := conn.Write(req); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 8)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return nil, err
+	}
+	if reply[1] != 0x5a {
+		return nil, fmt.Errorf("reply %d", reply[1])
+	}
+	return conn, nil
+}
+
+// httpConnect opens an HTTP CONNECT tunnel to target on conn, the returned
+// reader holds any tunnel data read along with the response
+func httpConnect(conn net.Conn, target string) (io.Reader, error) {
+	_, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	if err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	return reader, nil
+}
+
+func TestProxyConnectRoundTrip(t *testing.T) {
+	echo := tcpEcho(t)
+	proxy := serveProxy(t, NewProxy())
+
+	tests := []struct {
+		name    string
+		connect func(conn net.Conn, target string) (io.Reader, error)
+	}{
+		{"socks5", socks5Connect},
+		{"socks4", socks4Connect},
+		{"http", httpConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			reader, err := tt.connect(conn, echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// a few exchanges, the tunnel stays open between them
+			for i := 0; i < 3; i++ {
+				payload := []byte(fmt.Sprintf("%s payload %d", tt.name, i))
+				if _, err := conn.Write(payload); err != nil {
+					t.Fatal(err)
+				}
+				got := make([]byte, len(payload))
+				if _, err := io.ReadFull(reader, got); err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, payload) {
+					t.Fatalf("echoed %q, want %q", got, payload)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyDestinationRewriter(t *testing.T) {
+	echo := tcpEcho(t)
+	echoHost, echoPortStr, _ := net.SplitHostPort(echo)
+	echoPort, _ := strconv.Atoi(echoPortStr)
+	const sandboxed = "192.0.2.1:443"
+	rewrite := func(_ context.Context, network, host string, port int) (string, int, error) {
+		if network != "tcp" || net.JoinHostPort(host, strconv.Itoa(port)) != sandboxed {
+			return "", 0, fmt.Errorf("unexpected destination %s %s:%d", network, host, port)
+		}
+		return echoHost, echoPort, nil
+	}
+	proxy := serveProxy(t, NewProxy(WithDestinationRewriter(rewrite)))
+
+	tests := []struct {
+		name    string
+		connect func(conn net.Conn, target string) (io.Reader, error)
+	}{
+		{"socks5", socks5Connect},
+		{"socks4", socks4Connect},
+		{"http", httpConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := dialProxy(t, proxy)
+			reader, err := tt.connect(conn, sandboxed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the unroutable destination was redirected to the echo server
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(reader, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != "ping" {
+				t.Fatalf("echoed %q, want %q", got, "ping")
+			}
+		})
+	}
+}
+
+func TestProxyListenerSpecs(t *testing.T) {
+	echo := tcpEcho(t)
+	deny := func(context.Context, string, string) bool { return false }
+	p := NewProxy(WithListenerSpecs(
+		ListenerSpec{Addr: "127.0.0.1:0"},
+		ListenerSpec{Addr: "127.0.0.1:0", Authenticator: deny},
+	))
+	served := make(chan error, 1)
+	go func() {
+		served <- p.ListenAndServe()
+	}()
+	t.Cleanup(func() {
+		_ = p.Shutdown(context.Background())
+		<-served
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for len(p.Addrs()) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("listeners not bound")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	open, restricted := p.Addrs()[0].String(), p.Addrs()[1].String()
+
+	tests := []struct {
+		name    string
+		connect func(conn net.Conn, target string) (io.Reader, error)
+	}{
+		{"socks5", socks5Connect},
+		{"http", httpConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the listener without a spec authenticator keeps the proxy's
+			if _, err := tt.connect(dialProxy(t, open), echo); err != nil {
+				t.Fatalf("open listener: %v", err)
+			}
+			// the other one requires credentials no client has
+			if _, err := tt.connect(dialProxy(t, restricted), echo); err == nil {
+				t.Fatal("restricted listener served an unauthenticated client")
+			}
+		})
+	}
+}
+
+func TestProxyConnTrace(t *testing.T) {
+	echo := tcpEcho(t)
+	tests := []struct {
+		name    string
+		connect func(conn net.Conn, target string) (io.Reader, error)
+	}{
+		{"socks5", socks5Connect},
+		{"socks4", socks4Connect},
+		{"http", httpConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var events []string
+			record := func(event string) {
+				mu.Lock()
+				defer mu.Unlock()
+				events = append(events, event)
+			}
+			closed := make(chan struct{})
+			trace := &statute.ConnTrace{
+				HandshakeStart: func() { record("handshake") },
+				AuthDone:       func(string, string, bool) { record("auth") },
+				DialStart:      func(string, string) { record("dial start") },
+				DialDone:       func(string, string, error) { record("dial done") },
+				FirstByte:      func() { record("first byte") },
+				Close: func(error) {
+					record("close")
+					close(closed)
+				},
+			}
+			proxy := serveProxy(t, NewProxy(WithConnTrace(trace)))
+
+			conn := dialProxy(t, proxy)
+			reader, err := tt.connect(conn, echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := io.ReadFull(reader, make([]byte, 4)); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.Close()
+			select {
+			case <-closed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("Close hook not called")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			want := []string{"handshake", "auth", "dial start", "dial done", "first byte", "close"}
+			if strings.Join(events, ", ") != strings.Join(want, ", ") {
+				t.Fatalf("hooks called in order %q, want %q", events, want)
+			}
+		})
+	}
+}
+
+func TestProxyServeConnPipe(t *testing.T) {
+	echo := tcpEcho(t)
+	p := NewProxy()
+
+	tests := []struct {
+		name    string
+		connect func(conn net.Conn, target string) (io.Reader, error)
+	}{
+		{"socks5", socks5Connect},
+		{"socks4", socks4Connect},
+		{"http", httpConnect},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			served := make(chan error, 1)
+			go func() {
+				served <- p.ServeConn(server)
+			}()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			reader, err := tt.connect(client, echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			payload := []byte(tt.name + " payload")
+			if _, err := client.Write(payload); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(payload))
+			if _, err := io.ReadFull(reader, got); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("echoed %q, want %q", got, payload)
+			}
+
+			_ = client.Close()
+			select {
+			case err := <-served:
+				if err != nil {
+					t.Fatalf("ServeConn() = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ServeConn did not return after the client closed")
+			}
+		})
+	}
+}
+
+func TestProxyAssociateRoundTrip(t *testing.T) {
+	echo := udpEcho(t)
+	proxy := serveProxy(t, NewProxy())
+
+	conn := dialProxy(t, proxy)
+	relay, err := socks5Request(conn, 3, &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if relay.IP.IsUnspecified() {
+		relay.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	_ = udpConn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	addr, err := net.ResolveUDPAddr("udp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := []byte{0, 0, 0, 1}
+	header = append(header, addr.IP.To4()...)
+	header = binary.BigEndian.AppendUint16(header, uint16(addr.Port))
+	payload := []byte("hello through the relay")
+	if _, err := udpConn.WriteTo(append(header, payload...), relay); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 2048)
+	n, from, err := udpConn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != relay.String() {
+		t.Fatalf("reply from %v, want the relay %v", from, relay)
+	}
+	// the reply carries the header of the echo server
+	if n < len(header) || !bytes.Equal(buf[:len(header)], header) {
+		t.Fatalf("reply header %x, want %x", buf[:min(n, len(header))], header)
+	}
+	if got := buf[len(header):n]; !bytes.Equal(got, payload) {
+		t.Fatalf("echoed %q, want %q", got, payload)
+	}
+}
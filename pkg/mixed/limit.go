@@ -0,0 +1,107 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var (
+	errTooManyConnections      = errors.New("too many connections")
+	errTooManyConnectionsPerIP = errors.New("too many connections from the client address")
+)
+
+// acquireConnSlot takes one of the maxConnections slots, waiting for up to
+// queueTimeout when they are all taken. It reports false if no slot became
+// free in time, the connection is then closed by the caller.
+func (p *Proxy) acquireConnSlot(ctx context.Context) bool {
+	if p.connSlots == nil {
+		return true
+	}
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	default:
+	}
+	if p.queueTimeout <= 0 {
+		return false
+	}
+
+	p.queued.Add(1)
+	defer p.queued.Add(-1)
+	timer := time.NewTimer(p.queueTimeout)
+	defer timer.Stop()
+	select {
+	case p.connSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// releaseConnSlot frees the slot taken by acquireConnSlot
+func (p *Proxy) releaseConnSlot() {
+	if p.connSlots != nil {
+		<-p.connSlots
+	}
+}
+
+// QueueDepth returns the number of connections waiting for a slot, see
+// WithMaxConnections and WithQueueTimeout
+func (p *Proxy) QueueDepth() int {
+	return int(p.queued.Load())
+}
+
+// acquireIPSlot counts conn against the maxConnectionsPerIP connections of
+// its client IP, it returns the IP to pass to releaseIPSlot and reports
+// false if the client has too many connections already. Connections without
+// an IP, such as the ones of Dialer, are not limited.
+func (p *Proxy) acquireIPSlot(conn net.Conn) (string, bool) {
+	if p.maxConnectionsPerIP <= 0 {
+		return "", true
+	}
+	ip := clientIP(conn.RemoteAddr())
+	if ip == "" {
+		return "", true
+	}
+	p.perIPMu.Lock()
+	defer p.perIPMu.Unlock()
+	if p.connsPerIP[ip] >= p.maxConnectionsPerIP {
+		return "", false
+	}
+	p.connsPerIP[ip]++
+	return ip, true
+}
+
+// releaseIPSlot undoes acquireIPSlot, the entry of ip is dropped once it has
+// no connection left
+func (p *Proxy) releaseIPSlot(ip string) {
+	if ip == "" {
+		return
+	}
+	p.perIPMu.Lock()
+	defer p.perIPMu.Unlock()
+	if p.connsPerIP[ip] <= 1 {
+		delete(p.connsPerIP, ip)
+		return
+	}
+	p.connsPerIP[ip]--
+}
+
+// clientIP returns the IP of addr or an empty string if it has none
+func clientIP(addr net.Addr) string {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP.String()
+	case nil:
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil || net.ParseIP(host) == nil {
+		return ""
+	}
+	return host
+}
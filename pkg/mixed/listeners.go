@@ -0,0 +1,87 @@
+package mixed
+
+import (
+	"crypto/tls"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+)
+
+// ListenerSpec is a socket bound by ListenAndServe with its own policy, the
+// connections it accepts are served by the shared handlers of the proxy
+type ListenerSpec struct {
+	// Addr is the address to listen on
+	Addr string
+	// TLSConfig, when set, makes the listener accept TLS connections
+	TLSConfig *tls.Config
+	// Authenticator replaces the SOCKS5 and HTTP authenticator for the
+	// connections of the listener, nil keeps the one of the proxy
+	Authenticator statute.UserPassAuthenticator
+	// ACL replaces the ACL for the connections of the listener, nil keeps the
+	// one of the proxy
+	ACL statute.ACL
+}
+
+// policy returns the policy of the connections accepted by the listener of
+// the spec, nil when it keeps the settings of the proxy
+func (spec ListenerSpec) policy() *statute.ConnPolicy {
+	if spec.Authenticator == nil && spec.ACL == nil {
+		return nil
+	}
+	return &statute.ConnPolicy{
+		Authenticator: spec.Authenticator,
+		ACL:           spec.ACL,
+	}
+}
+
+// listenSpecs binds the listeners of specs, the ones already bound are
+// closed when one fails
+func (p *Proxy) listenSpecs(specs []ListenerSpec) ([]net.Listener, error) {
+	listeners := make([]net.Listener, 0, len(specs))
+	for _, spec := range specs {
+		ln, err := p.listenConfig.Listen(p.ctx, "tcp", spec.Addr)
+		if err != nil {
+			for _, l := range listeners {
+				_ = l.Close()
+			}
+			return nil, err
+		}
+		if spec.TLSConfig != nil {
+			ln = tls.NewListener(ln, spec.TLSConfig)
+		}
+		listeners = append(listeners, ln)
+	}
+	return listeners, nil
+}
+
+// serveSpecs serves the listeners of specs until one of them fails, the
+// others are then closed and its error is returned
+func (p *Proxy) serveSpecs(specs []ListenerSpec) error {
+	listeners, err := p.listenSpecs(specs)
+	if err != nil {
+		p.logger.Error("Error listening, " + err.Error())
+		return err
+	}
+	if !p.addListeners(listeners...) {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+		return ErrProxyClosed
+	}
+	defer p.removeListeners(listeners...)
+
+	errs := make(chan error, len(listeners))
+	for i, ln := range listeners {
+		p.logger.Debug("Serving on " + ln.Addr().String() + " ...")
+		go func(ln net.Listener, policy *statute.ConnPolicy) {
+			errs <- p.serve(ln, policy)
+		}(ln, specs[i].policy())
+	}
+	err = <-errs
+	for _, ln := range listeners {
+		_ = ln.Close()
+	}
+	for range listeners[1:] {
+		<-errs
+	}
+	return err
+}
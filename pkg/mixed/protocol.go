@@ -0,0 +1,120 @@
+package mixed
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// Protocol is a protocol served by the mixed Proxy
+type Protocol int
+
+const (
+	ProtocolUnknown Protocol = iota
+	ProtocolSOCKS4
+	ProtocolSOCKS5
+	ProtocolHTTP
+)
+
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolSOCKS4:
+		return "socks4"
+	case ProtocolSOCKS5:
+		return "socks5"
+	case ProtocolHTTP:
+		return "http"
+	default:
+		return "unknown"
+	}
+}
+
+// httpMethods are the request methods recognized as HTTP
+var httpMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodPut,
+	http.MethodPatch,
+	http.MethodDelete,
+	http.MethodConnect,
+	http.MethodOptions,
+	http.MethodTrace,
+}
+
+// maxMethodPeek bounds the bytes DetectProtocol peeks, the longest method
+// and the space following it
+const maxMethodPeek = len(http.MethodConnect) + 1
+
+// DetectProtocol peeks at the start of a connection read through r and
+// returns its protocol without consuming anything. SOCKS is told by the
+// version byte, HTTP by a known request method followed by a space, up to 8
+// bytes are peeked for it. Anything else is ProtocolUnknown, and peeking
+// stops as soon as the bytes can't start a known method. An error is
+// returned if r fails before the protocol is known.
+func DetectProtocol(r *bufio.Reader) (Protocol, error) {
+	first, err := r.Peek(1)
+	if err != nil {
+		return ProtocolUnknown, err
+	}
+	switch first[0] {
+	case 5:
+		return ProtocolSOCKS5, nil
+	case 4:
+		return ProtocolSOCKS4, nil
+	}
+
+	for n := 1; n <= maxMethodPeek; n++ {
+		start, err := r.Peek(n)
+		if err != nil {
+			return ProtocolUnknown, err
+		}
+		token := string(start)
+		for _, method := range httpMethods {
+			if token == method+" " {
+				return ProtocolHTTP, nil
+			}
+		}
+		if !isMethodPrefix(token) {
+			return ProtocolUnknown, nil
+		}
+	}
+	return ProtocolUnknown, nil
+}
+
+// isMethodPrefix reports whether token starts a known method followed by a
+// space
+func isMethodPrefix(token string) bool {
+	for _, method := range httpMethods {
+		if strings.HasPrefix(method+" ", token) {
+			return true
+		}
+	}
+	return false
+}
+
+// protocolDetector is a protocol registered with WithProtocolDetector
+type protocolDetector struct {
+	match   func(peek []byte) bool
+	handler func(conn net.Conn) error
+}
+
+// matchDetector returns the handler of the first registered detector
+// matching the bytes buffered by r, or nil when none does. It waits for the
+// first byte, nothing is consumed.
+func (p *Proxy) matchDetector(r *bufio.Reader) (func(conn net.Conn) error, error) {
+	if len(p.detectors) == 0 {
+		return nil, nil
+	}
+	if _, err := r.Peek(1); err != nil {
+		return nil, err
+	}
+	peek, _ := r.Peek(r.Buffered())
+	for _, detector := range p.detectors {
+		if detector.match(peek) {
+			return detector.handler, nil
+		}
+	}
+	return nil, nil
+}
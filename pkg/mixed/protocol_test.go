@@ -0,0 +1,213 @@
+package mixed
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDisabledProtocolRefused(t *testing.T) {
+	socks5Greeting := []byte{5, 1, 0}
+	socks4Request := []byte{4, 1, 0, 80, 127, 0, 0, 1, 0}
+	httpRequest := []byte("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	tests := []struct {
+		name    string
+		option  Option
+		request []byte
+	}{
+		{"socks5", WithDisableSOCKS5(), socks5Greeting},
+		{"socks4", WithDisableSOCKS4(), socks4Request},
+		{"http", WithDisableHTTP(), httpRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			p := NewProxy(tt.option)
+			served := make(chan error, 1)
+			go func() {
+				served <- p.ServeConn(server)
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			go func() {
+				_, _ = client.Write(tt.request)
+			}()
+			// nothing is answered, the connection is closed
+			n, err := client.Read(make([]byte, 64))
+			if n != 0 || !errors.Is(err, io.EOF) {
+				t.Fatalf("read %d bytes and %v, want EOF", n, err)
+			}
+			if err := <-served; !errors.Is(err, errProtocolDisabled) {
+				t.Fatalf("ServeConn() = %v, want %v", err, errProtocolDisabled)
+			}
+		})
+	}
+}
+
+func TestEnabledProtocolServedNextToDisabled(t *testing.T) {
+	echo := tcpEcho(t)
+	proxy := serveProxy(t, NewProxy(WithDisableSOCKS4(), WithDisableHTTP()))
+
+	conn := dialProxy(t, proxy)
+	if _, err := socks5Connect(conn, echo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echoed %q, want %q", got, "ping")
+	}
+
+	conn = dialProxy(t, proxy)
+	if _, err := socks4Connect(conn, echo); err == nil {
+		t.Fatal("socks4 connect succeeded with socks4 disabled")
+	}
+}
+
+func TestDetectProtocol(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    Protocol
+		wantErr error
+	}{
+		{"socks5", "\x05\x01\x00", ProtocolSOCKS5, nil},
+		{"socks4", "\x04\x01\x00\x50\x7f\x00\x00\x01\x00", ProtocolSOCKS4, nil},
+		{"get", "GET / HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"post", "POST / HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"put", "PUT / HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"head", "HEAD / HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"options", "OPTIONS * HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"connect", "CONNECT example.com:443 HTTP/1.1\r\n\r\n", ProtocolHTTP, nil},
+		{"tls", "\x16\x03\x01\x02\x00\x01\x00\x01", ProtocolUnknown, nil},
+		{"ssh", "SSH-2.0-OpenSSH\r\n", ProtocolUnknown, nil},
+		{"lower case method", "get / HTTP/1.1\r\n\r\n", ProtocolUnknown, nil},
+		{"method without space", "GETS / HTTP/1.1\r\n\r\n", ProtocolUnknown, nil},
+		{"truncated method", "CONNE", ProtocolUnknown, io.EOF},
+		{"empty", "", ProtocolUnknown, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReader(strings.NewReader(tt.input))
+			got, err := DetectProtocol(r)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DetectProtocol() = %v, %v, want %v, %v", got, err, tt.want, tt.wantErr)
+			}
+			// nothing is consumed
+			rest, _ := io.ReadAll(r)
+			if string(rest) != tt.input {
+				t.Fatalf("left %q, want %q", rest, tt.input)
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeoutClosesConnection(t *testing.T) {
+	tests := []struct {
+		name    string
+		request []byte
+	}{
+		{"silent", nil},
+		{"trickling", []byte("GET http://example.com/ HTTP/1.1\r\n")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			p := NewProxy(WithHandshakeTimeout(200 * time.Millisecond))
+			served := make(chan error, 1)
+			go func() {
+				served <- p.ServeConn(server)
+			}()
+
+			// one byte every 100ms never completes the detection in time
+			go func(request []byte) {
+				for _, b := range request {
+					time.Sleep(100 * time.Millisecond)
+					if _, err := client.Write([]byte{b}); err != nil {
+						return
+					}
+				}
+			}(tt.request)
+			select {
+			case err := <-served:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("ServeConn() = %v, want %v", err, os.ErrDeadlineExceeded)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("ServeConn did not return after the handshake timeout")
+			}
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after the timeout = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestProtocolDetector(t *testing.T) {
+	errCustom := errors.New("custom protocol done")
+	isMagic := func(peek []byte) bool {
+		return peek[0] == 'M'
+	}
+	errs := make(chan error, 4)
+	p := NewProxy(
+		WithLogger(statute.DefaultLogger{}),
+		WithErrorHandler(func(_ context.Context, info statute.ErrorInfo) {
+			errs <- info.Err
+		}),
+		// the handler gets the connection with nothing consumed
+		WithProtocolDetector(isMagic, func(conn net.Conn) error {
+			magic := make([]byte, 5)
+			if _, err := io.ReadFull(conn, magic); err != nil {
+				return err
+			}
+			if _, err := conn.Write(magic); err != nil {
+				return err
+			}
+			return errCustom
+		}),
+		// a later detector matching the same bytes is not used
+		WithProtocolDetector(isMagic, func(conn net.Conn) error {
+			return errors.New("second detector used")
+		}),
+	)
+	proxy := serveProxy(t, p)
+
+	conn := dialProxy(t, proxy)
+	if _, err := conn.Write([]byte("MAGIC")); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "MAGIC" {
+		t.Fatalf("read %q, %v until close, want %q", got, err, "MAGIC")
+	}
+	select {
+	case err := <-errs:
+		if !errors.Is(err, errCustom) {
+			t.Fatalf("reported error %v, want %v", err, errCustom)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the handler error was not reported")
+	}
+
+	// the built-in protocols are still served
+	conn = dialProxy(t, proxy)
+	if _, err := httpConnect(conn, tcpEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -3,11 +3,22 @@ package mixed
 import (
 	"bufio"
 	"context"
+	"errors"
+	"fmt"
 	"github.com/bepass-org/proxy/pkg/http"
 	"github.com/bepass-org/proxy/pkg/socks4"
 	"github.com/bepass-org/proxy/pkg/socks5"
 	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errProtocolDisabled     = errors.New("protocol is disabled")
+	errUnrecognizedProtocol = errors.New("unrecognized protocol, neither SOCKS nor HTTP")
 )
 
 type userHandler func(request *statute.ProxyRequest) error
@@ -27,12 +38,84 @@ type Proxy struct {
 	userTCPHandler userHandler
 	// if user doesnt set userHandler, it can specify userUDPHandler for manual handling of udp requests
 	userUDPHandler userHandler
+	// router selects the user handler by destination, falls back to the handlers above
+	router *statute.Router
 	// overwrite dial functions of http, socks4, socks5
 	userDialFunc statute.ProxyDialFunc
+	// resolverCache resolves the destinations before they are dialed
+	resolverCache *statute.CachingResolver
+	// userPacketDial is set when the user overwrites the socks5 packet dial function
+	userPacketDial bool
+	// dialLocalAddr and packetLocalAddr are the local addresses of the default
+	// dial functions
+	dialLocalAddr   *net.TCPAddr
+	packetLocalAddr *net.UDPAddr
+	// detectors serve the protocols registered with WithProtocolDetector,
+	// they are tried in order before the built-in protocols
+	detectors []protocolDetector
+	// disableSOCKS5, disableSOCKS4 and disableHTTP reject connections of the
+	// corresponding protocol
+	disableSOCKS5 bool
+	disableSOCKS4 bool
+	disableHTTP   bool
+	// listenConfig creates the listener of ListenAndServe
+	listenConfig *net.ListenConfig
+	// dialRetryAttempts and dialRetryBackoff retry transient dial failures,
+	// see statute.RetryProxyDial
+	dialRetryAttempts int
+	dialRetryBackoff  time.Duration
+	// upstreamHealth fails dials to recently failed upstreams at once
+	upstreamHealth *statute.UpstreamHealthCache
+	// handshakeTimeout bounds the protocol detection
+	handshakeTimeout time.Duration
+	// readBufferSize and writeBufferSize are the socket buffer sizes of the
+	// client and upstream connections, zero keeps the system default
+	readBufferSize  int
+	writeBufferSize int
+	// userListener is served by ListenAndServe instead of listening on bind
+	userListener net.Listener
+	// listenerSpecs are bound by ListenAndServe instead of bind, each with
+	// its own policy
+	listenerSpecs []ListenerSpec
+	// connTrace is carried by the context of every connection
+	connTrace *statute.ConnTrace
+	// errorHandler observes the errors serving connections, they are logged
+	// when it is nil
+	errorHandler statute.ErrorHandler
 	// logger error log
 	logger statute.Logger
 	// ctx is default context
 	ctx context.Context
+	// mu guards listeners and activeConns
+	mu sync.Mutex
+	// listeners are the listeners being served, closed by Shutdown
+	listeners []net.Listener
+	// activeConns are the connections being served, closed by Shutdown once
+	// its context is done
+	activeConns map[net.Conn]struct{}
+	// inShutdown is set by Shutdown
+	inShutdown atomic.Bool
+	// paused is set by Pause and cleared by Resume
+	paused atomic.Bool
+	// stats are the counters reported by Stats
+	stats proxyStats
+	// maxConnections bounds the connections served at once, connSlots holds
+	// a token per served connection when it is set
+	maxConnections int
+	connSlots      chan struct{}
+	// queueTimeout is how long connections over maxConnections wait for a
+	// slot, queued counts the waiting ones
+	queueTimeout time.Duration
+	queued       atomic.Int64
+	// maxConnectionsPerIP bounds the connections served at once per client
+	// IP, connsPerIP counts them guarded by perIPMu
+	maxConnectionsPerIP int
+	perIPMu             sync.Mutex
+	connsPerIP          map[string]int
+	// connCtx is the parent context of the connections, derived from ctx and
+	// cancelled by cancelConns when Shutdown closes them forcibly
+	connCtx     context.Context
+	cancelConns context.CancelCauseFunc
 }
 
 func NewProxy(options ...Option) *Proxy {
@@ -41,15 +124,56 @@ func NewProxy(options ...Option) *Proxy {
 		socks5Proxy:  socks5.NewServer(),
 		socks4Proxy:  socks4.NewServer(),
 		httpProxy:    http.NewServer(),
-		userDialFunc: statute.DefaultProxyDial(),
-		logger:       statute.DefaultLogger{},
+		listenConfig: &net.ListenConfig{},
+		logger:       statute.NewSyncLogger(statute.DefaultLogger{}),
 		ctx:          statute.DefaultContext(),
+		activeConns:  make(map[net.Conn]struct{}),
+		connsPerIP:   make(map[string]int),
 	}
 
 	for _, option := range options {
 		option(p)
 	}
 
+	// the local addresses only apply to the default dial functions
+	if p.userDialFunc == nil {
+		p.userDialFunc = statute.LocalAddrProxyDial(p.dialLocalAddr)
+		p.socks5Proxy.ProxyDial = p.userDialFunc
+		p.socks4Proxy.ProxyDial = p.userDialFunc
+		p.httpProxy.ProxyDial = p.userDialFunc
+	}
+	if p.dialRetryAttempts > 1 {
+		p.userDialFunc = statute.RetryProxyDial(p.dialRetryAttempts, p.dialRetryBackoff, p.userDialFunc)
+		p.socks5Proxy.ProxyDial = p.userDialFunc
+		p.socks4Proxy.ProxyDial = p.userDialFunc
+		p.httpProxy.ProxyDial = p.userDialFunc
+	}
+	if p.upstreamHealth != nil {
+		p.userDialFunc = statute.HealthCacheProxyDial(p.upstreamHealth, p.userDialFunc)
+		p.socks5Proxy.ProxyDial = p.userDialFunc
+		p.socks4Proxy.ProxyDial = p.userDialFunc
+		p.httpProxy.ProxyDial = p.userDialFunc
+	}
+	if p.readBufferSize > 0 || p.writeBufferSize > 0 {
+		p.userDialFunc = statute.SocketBufferProxyDial(p.readBufferSize, p.writeBufferSize, p.userDialFunc)
+		p.socks5Proxy.ProxyDial = p.userDialFunc
+		p.socks4Proxy.ProxyDial = p.userDialFunc
+		p.httpProxy.ProxyDial = p.userDialFunc
+	}
+	if p.resolverCache != nil {
+		dial := statute.ResolvingProxyDial(p.resolverCache, p.userDialFunc)
+		p.socks5Proxy.ProxyDial = dial
+		p.socks4Proxy.ProxyDial = dial
+		p.httpProxy.ProxyDial = dial
+	}
+	if p.packetLocalAddr != nil && !p.userPacketDial {
+		p.socks5Proxy.ProxyPacketDial = statute.LocalAddrProxyPacketDial(p.packetLocalAddr)
+	}
+	if p.maxConnections > 0 {
+		p.connSlots = make(chan struct{}, p.maxConnections)
+	}
+	p.connCtx, p.cancelConns = context.WithCancelCause(p.ctx)
+
 	return p
 }
 
@@ -74,15 +198,92 @@ func (c *SwitchConn) Read(p []byte) (n int, err error) {
 	return c.reader.Read(p)
 }
 
+// NetConn returns the wrapped connection
+func (c *SwitchConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// statute.CloseWrite
+func (c *SwitchConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
+// WriteTo writes the buffered bytes to w, then lets the wrapped connection
+// copy the rest, see statute.WriteTo
+func (c *SwitchConn) WriteTo(w io.Writer) (int64, error) {
+	return c.reader.WriteTo(w)
+}
+
+// ReadFrom lets the wrapped connection copy from r, see statute.ReadFrom
+func (c *SwitchConn) ReadFrom(r io.Reader) (int64, error) {
+	return statute.ReadFrom(c.Conn, r)
+}
+
 func (p *Proxy) ListenAndServe() error {
-	p.logger.Debug("Serving on " + p.bind + " ...")
-	// Create a new listener
-	ln, err := net.Listen("tcp", p.bind)
+	if p.userListener != nil {
+		p.logger.Debug("Serving on " + p.userListener.Addr().String() + " ...")
+		return p.Serve(p.userListener)
+	}
+	if len(p.listenerSpecs) > 0 {
+		return p.serveSpecs(p.listenerSpecs)
+	}
+
+	ln, err := p.Listen()
 	if err != nil {
 		p.logger.Error("Error listening on " + p.bind + ", " + err.Error())
 		return err // Return error if binding was unsuccessful
 	}
+	p.logger.Debug("Serving on " + ln.Addr().String() + " ...")
+
+	return p.Serve(ln)
+}
+
+// Listen creates the listener of the bind address without serving it, its
+// Addr is the concrete address, such as the port picked for port 0. Pass it
+// to Serve to start accepting connections.
+func (p *Proxy) Listen() (net.Listener, error) {
+	return p.listenConfig.Listen(p.ctx, "tcp", p.bind)
+}
+
+// Addr returns the address of the first listener being served, or nil
+// before ListenAndServe or Serve started, see Addrs
+func (p *Proxy) Addr() net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.listeners) == 0 {
+		return nil
+	}
+	return p.listeners[0].Addr()
+}
 
+// Addrs returns the addresses of the listeners being served, such as the
+// ones of WithListenerSpecs
+func (p *Proxy) Addrs() []net.Addr {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	addrs := make([]net.Addr, 0, len(p.listeners))
+	for _, ln := range p.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
+	return addrs
+}
+
+// Serve accepts connections on ln and serves them until ln fails, the
+// context of the proxy is done or Shutdown is called. ln is closed on return.
+func (p *Proxy) Serve(ln net.Listener) error {
+	if !p.addListeners(ln) {
+		_ = ln.Close()
+		return ErrProxyClosed
+	}
+	defer p.removeListeners(ln)
+	return p.serve(ln, nil)
+}
+
+// serve is Serve for a listener recorded already, policy overrides the
+// settings of the servers for the connections accepted on ln when it is not
+// nil
+func (p *Proxy) serve(ln net.Listener, policy *statute.ConnPolicy) error {
 	// ensure listener will be closed
 	defer func() {
 		_ = ln.Close()
@@ -93,6 +294,7 @@ func (p *Proxy) ListenAndServe() error {
 	defer cancel() // Ensure resources are cleaned up
 
 	// Start to accept connections and serve them
+	var tempDelay time.Duration // how long to sleep on accept failure
 	for {
 		select {
 		case <-ctx.Done():
@@ -100,47 +302,185 @@ func (p *Proxy) ListenAndServe() error {
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
-				p.logger.Error(err)
+				if p.inShutdown.Load() {
+					return ErrProxyClosed
+				}
+				if errors.Is(err, net.ErrClosed) {
+					// the listener was closed by its owner
+					return err
+				}
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					// back off like net/http, for example while out of file
+					// descriptors
+					if tempDelay == 0 {
+						tempDelay = 5 * time.Millisecond
+					} else {
+						tempDelay *= 2
+					}
+					if max := 1 * time.Second; tempDelay > max {
+						tempDelay = max
+					}
+					p.logger.Error(fmt.Errorf("accept error: %w; retrying in %v", err, tempDelay))
+					timer := time.NewTimer(tempDelay)
+					select {
+					case <-timer.C:
+					case <-ctx.Done():
+						timer.Stop()
+						return ctx.Err()
+					}
+					continue
+				}
+				return err
+			}
+			tempDelay = 0
+			if p.paused.Load() {
+				// see Pause
+				_ = conn.Close()
 				continue
 			}
 
 			// Start a new goroutine to handle each connection
 			// This way, the server can handle multiple connections concurrently
 			go func() {
-				err := p.handleConnection(conn)
-				if err != nil {
-					p.logger.Error(err) // Log errors from ServeConn
+				connCtx := statute.WithConnID(p.connCtx, statute.NewConnID())
+				if policy != nil {
+					connCtx = statute.WithConnPolicy(connCtx, policy)
+				}
+				if p.connTrace != nil {
+					connCtx = statute.WithConnTrace(connCtx, p.connTrace)
+				}
+				err := p.serveConn(connCtx, conn)
+				if err != nil && p.errorHandler == nil && !statute.IsBenignCloseError(err) {
+					if errors.Is(err, errTooManyConnectionsPerIP) {
+						// a client over its limit is routine, not a failure
+						statute.ConnLogger(connCtx, p.logger).Debug(err)
+					} else {
+						statute.ConnLogger(connCtx, p.logger).Error(err) // Log errors from ServeConn
+					}
 				}
 			}()
 		}
 	}
 }
 
-func (p *Proxy) handleConnection(conn net.Conn) error {
+// Pause makes Serve close new connections right after accepting them, the
+// listener and the connections being served stay open. It is softer than
+// Shutdown, for example for maintenance windows, see Resume.
+func (p *Proxy) Pause() {
+	p.paused.Store(true)
+}
+
+// Resume undoes Pause, new connections are served again
+func (p *Proxy) Resume() {
+	p.paused.Store(false)
+}
+
+// Paused reports whether the proxy is paused, see Pause
+func (p *Proxy) Paused() bool {
+	return p.paused.Load()
+}
+
+// ServeConn sniffs the protocol of conn and serves it with the matching
+// server, it can be used with connections accepted by a custom listener
+func (p *Proxy) ServeConn(conn net.Conn) error {
+	return p.serveConn(statute.WithConnID(p.connCtx, statute.NewConnID()), conn)
+}
+
+// serveConn serves conn, ctx carries the connection id
+func (p *Proxy) serveConn(ctx context.Context, conn net.Conn) (err error) {
+	p.stats.accepted.Add(1)
+	defer func() {
+		p.stats.recordError(err)
+	}()
+
+	ip, ok := p.acquireIPSlot(conn)
+	if !ok {
+		_ = conn.Close()
+		statute.ReportError(ctx, p.errorHandler, "mixed", conn, errTooManyConnectionsPerIP)
+		return errTooManyConnectionsPerIP
+	}
+	defer p.releaseIPSlot(ip)
+
+	if !p.acquireConnSlot(ctx) {
+		_ = conn.Close()
+		statute.ReportError(ctx, p.errorHandler, "mixed", conn, errTooManyConnections)
+		return errTooManyConnections
+	}
+	defer p.releaseConnSlot()
+
+	p.trackConn(conn, true)
+	defer p.trackConn(conn, false)
+
+	if err := statute.SetSocketBuffers(conn, p.readBufferSize, p.writeBufferSize); err != nil {
+		statute.ConnLogger(ctx, p.logger).Debug("setting socket buffers: " + err.Error())
+	}
+
 	// Create a SwitchConn
-	switchConn := NewSwitchConn(conn)
+	switchConn := NewSwitchConn(&statsConn{Conn: conn, stats: &p.stats})
 
-	// Read one byte to determine the protocol
-	buf := make([]byte, 1)
-	_, err := switchConn.Read(buf)
+	clearDeadline := statute.HandshakeDeadline(conn, p.handshakeTimeout)
+	handler, err := p.matchDetector(switchConn.reader)
+	protocol := ProtocolUnknown
+	if err == nil && handler == nil {
+		protocol, err = DetectProtocol(switchConn.reader)
+	}
+	clearDeadline()
 	if err != nil {
+		// a client silent or trickling past the handshake timeout, or one
+		// that can't be detected, leaves nothing to serve
+		_ = switchConn.Close()
+		statute.ReportError(ctx, p.errorHandler, "mixed", conn, err)
 		return err
 	}
-
-	// Unread the byte so it's available for the next read
-	err = switchConn.reader.UnreadByte()
-	if err != nil {
+	if handler != nil {
+		err = handler(switchConn)
+		_ = switchConn.Close()
+		statute.ReportError(ctx, p.errorHandler, "mixed", conn, err)
 		return err
 	}
+	p.stats.protocols[protocol].Add(1)
 
-	switch {
-	case buf[0] == 5:
-		err = p.socks5Proxy.ServeConn(switchConn)
-	case buf[0] == 4:
-		err = p.socks4Proxy.ServeConn(switchConn)
+	switch protocol {
+	case ProtocolSOCKS5:
+		if p.disableSOCKS5 {
+			return p.rejectConnection(ctx, switchConn, "socks5")
+		}
+		err = p.socks5Proxy.ServeConnContext(ctx, switchConn)
+	case ProtocolSOCKS4:
+		if p.disableSOCKS4 {
+			return p.rejectConnection(ctx, switchConn, "socks4")
+		}
+		err = p.socks4Proxy.ServeConnContext(ctx, switchConn)
+	case ProtocolHTTP:
+		if p.disableHTTP {
+			return p.rejectConnection(ctx, switchConn, "http")
+		}
+		err = p.httpProxy.ServeConnContext(ctx, switchConn)
 	default:
-		err = p.httpProxy.ServeConn(switchConn)
+		first, _ := switchConn.reader.Peek(1)
+		err = p.rejectUnrecognized(ctx, switchConn, first[0])
 	}
 
 	return err
 }
+
+// rejectConnection closes a connection of a disabled protocol
+func (p *Proxy) rejectConnection(ctx context.Context, conn net.Conn, protocol string) error {
+	err := fmt.Errorf("%w: rejecting %s connection from %s", errProtocolDisabled, protocol, conn.RemoteAddr())
+	statute.ReportError(ctx, p.errorHandler, "mixed", conn, err)
+	_ = conn.Close()
+	return err
+}
+
+// rejectUnrecognized closes a connection that is neither SOCKS nor HTTP
+func (p *Proxy) rejectUnrecognized(ctx context.Context, conn net.Conn, first byte) error {
+	err := fmt.Errorf("%w from %s: first byte 0x%02x", errUnrecognizedProtocol, conn.RemoteAddr(), first)
+	if first == 0x16 {
+		// a TLS handshake record, the client probably expects an HTTPS server
+		// or uses an https:// proxy URL
+		err = fmt.Errorf("%w, looks like a TLS handshake", err)
+	}
+	statute.ReportError(ctx, p.errorHandler, "mixed", conn, err)
+	_ = conn.Close()
+	return err
+}
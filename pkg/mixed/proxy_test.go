@@ -0,0 +1,383 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// temporaryError is an accept error worth retrying
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary accept error" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// failingListener fails its first accepts with temporary errors, then with
+// net.ErrClosed
+type failingListener struct {
+	net.Listener
+	failures int
+	accepts  []time.Time
+}
+
+func (l *failingListener) Accept() (net.Conn, error) {
+	l.accepts = append(l.accepts, time.Now())
+	if len(l.accepts) <= l.failures {
+		return nil, temporaryError{}
+	}
+	return nil, net.ErrClosed
+}
+
+func (l *failingListener) Close() error {
+	return nil
+}
+
+func TestServeReturnsWhenListenerClosed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := NewProxy()
+	served := make(chan error, 1)
+	go func() {
+		served <- p.Serve(ln)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_ = ln.Close()
+
+	select {
+	case err := <-served:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("Serve() = %v, want %v", err, net.ErrClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve did not return after the listener was closed")
+	}
+}
+
+func TestServeBacksOffOnTemporaryErrors(t *testing.T) {
+	ln := &failingListener{failures: 3}
+	err := NewProxy().Serve(ln)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Serve() = %v, want %v", err, net.ErrClosed)
+	}
+	if len(ln.accepts) != 4 {
+		t.Fatalf("Accept called %d times, want 4", len(ln.accepts))
+	}
+	// the delays are 5ms, 10ms and 20ms
+	for i, want := range []time.Duration{5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond} {
+		if got := ln.accepts[i+1].Sub(ln.accepts[i]); got < want {
+			t.Fatalf("retry %d after %v, want at least %v", i+1, got, want)
+		}
+	}
+}
+
+func TestSharedBytesPoolAndContext(t *testing.T) {
+	pool := statute.NewBytesPool(0)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p := NewProxy(WithBytesPool(pool), WithContext(ctx))
+
+	if p.socks5Proxy.BytesPool != pool || p.socks4Proxy.BytesPool != pool || p.httpProxy.BytesPool != pool {
+		t.Fatal("the bytes pool is not shared by the socks5, socks4 and http servers")
+	}
+	if p.socks5Proxy.Context != ctx || p.socks4Proxy.Context != ctx || p.httpProxy.Context != ctx {
+		t.Fatal("the context is not shared by the socks5, socks4 and http servers")
+	}
+}
+
+func TestShutdownClosesTunnelsAfterGracePeriod(t *testing.T) {
+	p := NewProxy(WithLogger(statute.DefaultLogger{}))
+	addr := serveProxy(t, p)
+	conn := dialProxy(t, addr)
+	if _, err := socks5Connect(conn, tcpEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+	// the tunnel is open and would stay open on its own
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Shutdown() = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if grace := time.Since(start); grace < 200*time.Millisecond {
+		t.Fatalf("Shutdown returned after %v, before the grace period", grace)
+	}
+	if _, err := conn.Read(make([]byte, 1)); err == nil || errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read after Shutdown = %v, want the tunnel closed", err)
+	}
+	// the listener is closed too
+	if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("dial after Shutdown succeeded")
+	}
+}
+
+func TestShutdownWithoutConnections(t *testing.T) {
+	p := NewProxy(WithLogger(statute.DefaultLogger{}))
+	serveProxy(t, p)
+	// nothing to drain, Shutdown returns before its context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+}
+
+// closeRecordingListener records whether it was closed
+type closeRecordingListener struct {
+	net.Listener
+	closed atomic.Bool
+}
+
+func (l *closeRecordingListener) Close() error {
+	l.closed.Store(true)
+	return l.Listener.Close()
+}
+
+func TestWithListener(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := &closeRecordingListener{Listener: inner}
+	// the bind address can't be listened on, ListenAndServe must not try
+	p := NewProxy(WithLogger(statute.DefaultLogger{}), WithBindAddress("192.0.2.1:1"), WithListener(ln))
+	served := make(chan error, 1)
+	go func() {
+		served <- p.ListenAndServe()
+	}()
+
+	conn := dialProxy(t, ln.Addr().String())
+	if _, err := socks5Connect(conn, tcpEcho(t)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() = %v, want nil", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, ErrProxyClosed) {
+			t.Fatalf("ListenAndServe() = %v, want %v", err, ErrProxyClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ListenAndServe still serving after Shutdown")
+	}
+	if !ln.closed.Load() {
+		t.Fatal("Shutdown did not close the listener")
+	}
+}
+
+func TestMaxConnectionsPerIP(t *testing.T) {
+	p := NewProxy(WithLogger(statute.DefaultLogger{}), WithMaxConnectionsPerIP(2))
+	addr := serveProxy(t, p)
+	echo := tcpEcho(t)
+
+	var tunnels []net.Conn
+	for i := 0; i < 2; i++ {
+		conn := dialProxy(t, addr)
+		if _, err := socks5Connect(conn, echo); err != nil {
+			t.Fatalf("tunnel %d: %v", i, err)
+		}
+		tunnels = append(tunnels, conn)
+	}
+	// a third connection from the same address is refused
+	extra := dialProxy(t, addr)
+	if _, err := socks5Connect(extra, echo); err == nil {
+		t.Fatal("connection over the limit was served")
+	}
+
+	// a slot is free again once a tunnel ends
+	_ = tunnels[0].Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err = socks5Connect(conn, echo)
+		_ = conn.Close()
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no slot after a tunnel ended: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the entry of the address is dropped once it has no connection
+	_ = tunnels[1].Close()
+	for {
+		p.perIPMu.Lock()
+		n := len(p.connsPerIP)
+		p.perIPMu.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d addresses tracked after every connection ended", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestStats(t *testing.T) {
+	p := NewProxy(WithLogger(statute.DefaultLogger{}))
+	addr := serveProxy(t, p)
+	echo := tcpEcho(t)
+	// a closed port, dialing it is refused
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	refused := ln.Addr().String()
+	_ = ln.Close()
+
+	for _, connect := range []func(conn net.Conn, target string) (io.Reader, error){socks5Connect, socks4Connect} {
+		conn := dialProxy(t, addr)
+		if _, err := connect(conn, echo); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	if _, err := socks5Connect(dialProxy(t, addr), refused); err == nil {
+		t.Fatal("CONNECT to a closed port succeeded")
+	}
+
+	// the counters are updated once the connections are done
+	var stats ProxyStats
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stats = p.Stats()
+		if stats.Active == 0 && stats.Errors[statute.PhaseDial] > 0 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats.Accepted != 3 || stats.Active != 0 {
+		t.Fatalf("%d accepted and %d active, want 3 and 0", stats.Accepted, stats.Active)
+	}
+	if stats.Protocols[ProtocolSOCKS5] != 2 || stats.Protocols[ProtocolSOCKS4] != 1 || stats.Protocols[ProtocolHTTP] != 0 {
+		t.Fatalf("protocols %v, want 2 socks5 and 1 socks4", stats.Protocols)
+	}
+	// both socks5 requests send a greeting and a request and get a method
+	// and a reply, the socks4 one sends a request and gets a reply, and each
+	// tunnel echoes a payload
+	if wantUp, wantDown := uint64(3+10+4+3+10+9+4), uint64(2+10+4+2+10+8+4); stats.BytesUp != wantUp || stats.BytesDown != wantDown {
+		t.Fatalf("%d bytes up and %d down, want %d and %d", stats.BytesUp, stats.BytesDown, wantUp, wantDown)
+	}
+	if stats.Errors[statute.PhaseDial] != 1 || stats.Errors[statute.PhaseHandshake] != 0 {
+		t.Fatalf("errors %v, want one dial error", stats.Errors)
+	}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	p := NewProxy(WithLogger(statute.DefaultLogger{}))
+	addr := serveProxy(t, p)
+	echo := tcpEcho(t)
+	tunnel := dialProxy(t, addr)
+	if _, err := socks5Connect(tunnel, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	p.Pause()
+	if !p.Paused() {
+		t.Fatal("Paused() = false after Pause")
+	}
+	// new connections are accepted and closed at once
+	if _, err := socks5Connect(dialProxy(t, addr), echo); err == nil {
+		t.Fatal("connection served while paused")
+	}
+	// the tunnel opened before keeps working
+	if _, err := tunnel.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(tunnel, make([]byte, 4)); err != nil {
+		t.Fatalf("tunnel after Pause: %v", err)
+	}
+
+	p.Resume()
+	if _, err := socks5Connect(dialProxy(t, addr), echo); err != nil {
+		t.Fatalf("connection after Resume: %v", err)
+	}
+}
+
+func TestQueueTimeout(t *testing.T) {
+	const timeout = 300 * time.Millisecond
+	p := NewProxy(WithLogger(statute.DefaultLogger{}), WithMaxConnections(1), WithQueueTimeout(timeout))
+	addr := serveProxy(t, p)
+	echo := tcpEcho(t)
+	tunnel := dialProxy(t, addr)
+	if _, err := socks5Connect(tunnel, echo); err != nil {
+		t.Fatal(err)
+	}
+
+	// queued connects wait in the background
+	queue := func() <-chan error {
+		conn := dialProxy(t, addr)
+		result := make(chan error, 1)
+		go func() {
+			_, err := socks5Connect(conn, echo)
+			result <- err
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for p.QueueDepth() != 1 {
+			if time.Now().After(deadline) {
+				t.Fatal("connection not queued")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		return result
+	}
+
+	// no slot frees up in time
+	start := time.Now()
+	if err := <-queue(); err == nil {
+		t.Fatal("queued connection served without a free slot")
+	}
+	if waited := time.Since(start); waited < timeout {
+		t.Fatalf("queued connection closed after %v, want the queue timeout %v", waited, timeout)
+	}
+	if depth := p.QueueDepth(); depth != 0 {
+		t.Fatalf("QueueDepth() = %d after the timeout, want 0", depth)
+	}
+
+	// the slot of the tunnel frees up while queued
+	result := queue()
+	_ = tunnel.Close()
+	if err := <-result; err != nil {
+		t.Fatalf("queued connection after a slot freed up: %v", err)
+	}
+}
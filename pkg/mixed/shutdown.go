@@ -0,0 +1,102 @@
+package mixed
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+// ErrProxyClosed is returned by ListenAndServe and Serve after a call to
+// Shutdown
+var ErrProxyClosed = errors.New("mixed: proxy closed")
+
+// shutdownPollInterval is how often Shutdown checks for remaining connections
+const shutdownPollInterval = 50 * time.Millisecond
+
+// addListeners records listeners being served, it reports false if the
+// proxy is already shut down
+func (p *Proxy) addListeners(listeners ...net.Listener) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inShutdown.Load() {
+		return false
+	}
+	p.listeners = append(p.listeners, listeners...)
+	return true
+}
+
+// removeListeners forgets listeners no longer served
+func (p *Proxy) removeListeners(listeners ...net.Listener) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ln := range listeners {
+		for i, l := range p.listeners {
+			if l == ln {
+				p.listeners = append(p.listeners[:i], p.listeners[i+1:]...)
+				break
+			}
+		}
+	}
+}
+
+// trackConn adds conn to or removes it from the active connections
+func (p *Proxy) trackConn(conn net.Conn, add bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if add {
+		p.activeConns[conn] = struct{}{}
+	} else {
+		delete(p.activeConns, conn)
+	}
+}
+
+// Shutdown stops accepting new connections and waits for the active ones to
+// drain. Once ctx is done the remaining connections are closed forcibly, the
+// context of their requests is cancelled with cause ErrProxyClosed so user
+// handlers can close their upstream connections too, and ctx.Err() is
+// returned.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.inShutdown.Store(true)
+
+	p.mu.Lock()
+	var err error
+	for _, ln := range p.listeners {
+		// serveSpecs closes the other listeners once one of them stops
+		if closeErr := ln.Close(); closeErr != nil && !errors.Is(closeErr, net.ErrClosed) && err == nil {
+			err = closeErr
+		}
+	}
+	p.mu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		if p.activeConnCount() == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			p.cancelConns(ErrProxyClosed)
+			p.closeActiveConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// activeConnCount returns the number of connections being served
+func (p *Proxy) activeConnCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.activeConns)
+}
+
+// closeActiveConns forcibly closes the connections being served
+func (p *Proxy) closeActiveConns() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conn := range p.activeConns {
+		_ = conn.Close()
+	}
+}
@@ -0,0 +1,127 @@
+package mixed
+
+import (
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// ProxyStats is a snapshot of the counters of a Proxy, see Proxy.Stats
+type ProxyStats struct {
+	// Accepted is the number of connections served so far, including
+	// rejected ones
+	Accepted uint64
+	// Active is the number of connections being served
+	Active int
+	// Protocols counts the served connections by detected protocol
+	Protocols map[Protocol]uint64
+	// BytesUp and BytesDown are the bytes read from and written to clients
+	BytesUp   uint64
+	BytesDown uint64
+	// Errors counts the connections which ended with an error by the phase
+	// it occurred in, benign close errors are not counted
+	Errors map[statute.ErrorPhase]uint64
+}
+
+// errorPhases are the phases counted by proxyStats
+var errorPhases = [...]statute.ErrorPhase{
+	statute.PhaseHandshake,
+	statute.PhaseAuth,
+	statute.PhaseDial,
+	statute.PhaseTunnel,
+}
+
+// proxyStats holds the counters of a Proxy, the zero value is ready to use
+type proxyStats struct {
+	accepted  atomic.Uint64
+	protocols [ProtocolHTTP + 1]atomic.Uint64
+	bytesUp   atomic.Uint64
+	bytesDown atomic.Uint64
+	errors    [len(errorPhases)]atomic.Uint64
+}
+
+// recordError counts err by its phase, errors without one are counted as
+// PhaseHandshake like statute.ReportError does
+func (s *proxyStats) recordError(err error) {
+	if err == nil || statute.IsBenignCloseError(err) {
+		return
+	}
+	phase := statute.PhaseHandshake
+	var phaseErr *statute.PhaseError
+	if errors.As(err, &phaseErr) {
+		phase = phaseErr.Phase
+	}
+	for i, p := range errorPhases {
+		if p == phase {
+			s.errors[i].Add(1)
+			return
+		}
+	}
+}
+
+// Stats returns a snapshot of the counters of the proxy, they cover the
+// connections served by Serve, ListenAndServe, ServeConn and Dialer
+func (p *Proxy) Stats() ProxyStats {
+	stats := ProxyStats{
+		Accepted:  p.stats.accepted.Load(),
+		Active:    p.activeConnCount(),
+		Protocols: make(map[Protocol]uint64, len(p.stats.protocols)),
+		BytesUp:   p.stats.bytesUp.Load(),
+		BytesDown: p.stats.bytesDown.Load(),
+		Errors:    make(map[statute.ErrorPhase]uint64, len(errorPhases)),
+	}
+	for protocol := range p.stats.protocols {
+		stats.Protocols[Protocol(protocol)] = p.stats.protocols[protocol].Load()
+	}
+	for i, phase := range errorPhases {
+		stats.Errors[phase] = p.stats.errors[i].Load()
+	}
+	return stats
+}
+
+// statsConn counts the bytes read from and written to a client connection
+type statsConn struct {
+	net.Conn
+	stats *proxyStats
+}
+
+func (c *statsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.stats.bytesUp.Add(uint64(n))
+	return n, err
+}
+
+func (c *statsConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.stats.bytesDown.Add(uint64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *statsConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// statute.CloseWrite
+func (c *statsConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
+// WriteTo lets the wrapped connection copy to w, see statute.WriteTo. The
+// bytes are counted once the copy ends.
+func (c *statsConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := statute.WriteTo(c.Conn, w)
+	c.stats.bytesUp.Add(uint64(n))
+	return n, err
+}
+
+// ReadFrom lets the wrapped connection copy from r, see statute.ReadFrom.
+// The bytes are counted once the copy ends.
+func (c *statsConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := statute.ReadFrom(c.Conn, r)
+	c.stats.bytesDown.Add(uint64(n))
+	return n, err
+}
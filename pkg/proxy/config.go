@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Config describes a proxy server. Its plain fields can be loaded from YAML,
+// JSON or the environment, the function fields have to be set in code.
+type Config struct {
+	// Bind is the address to listen on, statute.DefaultBindAddress if empty
+	Bind string `yaml:"bind" json:"bind"`
+	// DisableSOCKS5, DisableSOCKS4 and DisableHTTP turn off a protocol
+	DisableSOCKS5 bool `yaml:"disable_socks5" json:"disable_socks5"`
+	DisableSOCKS4 bool `yaml:"disable_socks4" json:"disable_socks4"`
+	DisableHTTP   bool `yaml:"disable_http" json:"disable_http"`
+	// DisableUDP rejects SOCKS5 UDP ASSOCIATE requests
+	DisableUDP bool `yaml:"disable_udp" json:"disable_udp"`
+	// HandshakeTimeout bounds the time clients take to send their handshake
+	// and request, including authentication, zero means no timeout
+	HandshakeTimeout time.Duration `yaml:"handshake_timeout" json:"handshake_timeout"`
+	// ReplyTimeout bounds the time to write replies to clients, zero means
+	// statute.DefaultReplyTimeout
+	ReplyTimeout time.Duration `yaml:"reply_timeout" json:"reply_timeout"`
+	// MaxConnectionLifetime ends connections this long after they were
+	// accepted whatever their activity, zero means no limit
+	MaxConnectionLifetime time.Duration `yaml:"max_connection_lifetime" json:"max_connection_lifetime"`
+	// UDPIdleTimeout ends UDP ASSOCIATE sessions idle for this long, zero
+	// means no timeout
+	UDPIdleTimeout time.Duration `yaml:"udp_idle_timeout" json:"udp_idle_timeout"`
+	// ShutdownTimeout is how long Run waits for active connections to drain
+	// once its context is done, zero closes them immediately
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" json:"shutdown_timeout"`
+	// MaxHeaderBytes limits the size of HTTP request headers, zero means no
+	// limit
+	MaxHeaderBytes int `yaml:"max_header_bytes" json:"max_header_bytes"`
+	// MaxUDPPacketSize is the largest datagram relayed by UDP ASSOCIATE, zero
+	// means the protocol maximum
+	MaxUDPPacketSize int `yaml:"max_udp_packet_size" json:"max_udp_packet_size"`
+	// UDPByteLimit caps the bytes relayed by a UDP ASSOCIATE session, zero
+	// means no limit
+	UDPByteLimit int64 `yaml:"udp_byte_limit" json:"udp_byte_limit"`
+	// HTTPRealm is the realm of the Basic challenge sent to HTTP clients
+	// without valid credentials, http.DefaultRealm if empty
+	HTTPRealm string `yaml:"http_realm" json:"http_realm"`
+	// Authenticator requires SOCKS5 and HTTP clients to authenticate with
+	// the username/password credentials it accepts. SOCKS4 has no passwords
+	// and must be disabled along with it.
+	Authenticator statute.UserPassAuthenticator `yaml:"-" json:"-"`
+	// ACL denies requests to destinations it does not allow
+	ACL statute.ACL `yaml:"-" json:"-"`
+	// Logger error log, statute.DefaultLogger if nil
+	Logger statute.Logger `yaml:"-" json:"-"`
+	// Dial establishes the outbound TCP connections, a direct dial if nil
+	Dial statute.ProxyDialFunc `yaml:"-" json:"-"`
+	// TLS serves the proxy over TLS when set
+	TLS *tls.Config `yaml:"-" json:"-"`
+}
+
+// Validate reports every invalid field of c
+func (c *Config) Validate() error {
+	var errs []error
+	if c.Bind != "" {
+		if _, _, err := net.SplitHostPort(c.Bind); err != nil {
+			errs = append(errs, fmt.Errorf("bind: %w", err))
+		}
+	}
+	if c.DisableSOCKS5 && c.DisableSOCKS4 && c.DisableHTTP {
+		errs = append(errs, errors.New("all protocols are disabled"))
+	}
+	if c.Authenticator != nil && !c.DisableSOCKS4 {
+		errs = append(errs, errors.New("socks4 would bypass the authenticator, disable it"))
+	}
+	if c.HTTPRealm != "" && c.Authenticator == nil {
+		errs = append(errs, errors.New("http_realm is set without an authenticator"))
+	}
+	if c.HandshakeTimeout < 0 {
+		errs = append(errs, errors.New("handshake_timeout is negative"))
+	}
+	if c.ReplyTimeout < 0 {
+		errs = append(errs, errors.New("reply_timeout is negative"))
+	}
+	if c.MaxConnectionLifetime < 0 {
+		errs = append(errs, errors.New("max_connection_lifetime is negative"))
+	}
+	if c.UDPIdleTimeout < 0 {
+		errs = append(errs, errors.New("udp_idle_timeout is negative"))
+	}
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, errors.New("shutdown_timeout is negative"))
+	}
+	if c.MaxHeaderBytes < 0 {
+		errs = append(errs, errors.New("max_header_bytes is negative"))
+	}
+	if c.MaxUDPPacketSize < 0 || c.MaxUDPPacketSize > 65535 {
+		errs = append(errs, fmt.Errorf("max_udp_packet_size %d is out of range", c.MaxUDPPacketSize))
+	}
+	if c.UDPByteLimit < 0 {
+		errs = append(errs, errors.New("udp_byte_limit is negative"))
+	}
+	if c.TLS != nil && len(c.TLS.Certificates) == 0 && c.TLS.GetCertificate == nil && c.TLS.GetConfigForClient == nil {
+		errs = append(errs, errors.New("tls: no certificate configured"))
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidate(t *testing.T) {
+	allowAll := func(context.Context, string, string) bool { return true }
+	tests := []struct {
+		name   string
+		config Config
+		// want are the substrings of the error, none for a valid config
+		want []string
+	}{
+		{"zero value", Config{}, nil},
+		{"valid", Config{Bind: "127.0.0.1:1080", DisableHTTP: true, UDPIdleTimeout: time.Minute, MaxUDPPacketSize: 1500}, nil},
+		{"bind without port", Config{Bind: "127.0.0.1"}, []string{"bind"}},
+		{"all protocols disabled", Config{DisableSOCKS5: true, DisableSOCKS4: true, DisableHTTP: true}, []string{"all protocols are disabled"}},
+		{"negative durations", Config{UDPIdleTimeout: -1, ShutdownTimeout: -1}, []string{"udp_idle_timeout", "shutdown_timeout"}},
+		{"negative timeouts", Config{HandshakeTimeout: -1, ReplyTimeout: -1, MaxConnectionLifetime: -1}, []string{"handshake_timeout", "reply_timeout", "max_connection_lifetime"}},
+		{"authenticator", Config{Authenticator: allowAll, HTTPRealm: "corp", DisableSOCKS4: true}, nil},
+		{"authenticator with socks4", Config{Authenticator: allowAll}, []string{"socks4"}},
+		{"realm without authenticator", Config{HTTPRealm: "corp"}, []string{"http_realm"}},
+		{"negative sizes", Config{MaxHeaderBytes: -1, UDPByteLimit: -1}, []string{"max_header_bytes", "udp_byte_limit"}},
+		{"packet size out of range", Config{MaxUDPPacketSize: 65536}, []string{"max_udp_packet_size 65536"}},
+		{"tls without certificate", Config{TLS: &tls.Config{}}, []string{"tls: no certificate"}},
+		{"tls with certificate", Config{TLS: &tls.Config{Certificates: []tls.Certificate{{}}}}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Fatalf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Validate() = nil, want an error mentioning %q", tt.want)
+			}
+			// every invalid field is reported
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Fatalf("Validate() = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
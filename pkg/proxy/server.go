@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+
+	"github.com/bepass-org/proxy/pkg/mixed"
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// Server is a mixed proxy built from a Config
+type Server struct {
+	config Config
+	proxy  *mixed.Proxy
+}
+
+// New validates config and builds the server, options are applied after the
+// ones derived from config so they can extend or override it
+func New(config Config, options ...mixed.Option) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	if config.Bind == "" {
+		config.Bind = statute.DefaultBindAddress
+	}
+
+	opts := []mixed.Option{
+		mixed.WithBindAddress(config.Bind),
+		mixed.WithHandshakeTimeout(config.HandshakeTimeout),
+		mixed.WithMaxConnectionLifetime(config.MaxConnectionLifetime),
+		mixed.WithUDPIdleTimeout(config.UDPIdleTimeout),
+		mixed.WithMaxHeaderBytes(config.MaxHeaderBytes),
+		mixed.WithMaxUDPPacketSize(config.MaxUDPPacketSize),
+		mixed.WithUDPByteLimit(config.UDPByteLimit),
+	}
+	if config.ReplyTimeout != 0 {
+		opts = append(opts, mixed.WithReplyTimeout(config.ReplyTimeout))
+	}
+	if config.DisableSOCKS5 {
+		opts = append(opts, mixed.WithDisableSOCKS5())
+	}
+	if config.DisableSOCKS4 {
+		opts = append(opts, mixed.WithDisableSOCKS4())
+	}
+	if config.DisableHTTP {
+		opts = append(opts, mixed.WithDisableHTTP())
+	}
+	if config.DisableUDP {
+		opts = append(opts, mixed.WithDisableUDP())
+	}
+	if config.Authenticator != nil {
+		opts = append(opts,
+			mixed.WithSOCKS5Authenticator(config.Authenticator),
+			mixed.WithHTTPAuthenticator(config.Authenticator),
+		)
+	}
+	if config.HTTPRealm != "" {
+		opts = append(opts, mixed.WithHTTPRealm(config.HTTPRealm))
+	}
+	if config.ACL != nil {
+		opts = append(opts, mixed.WithACL(config.ACL))
+	}
+	if config.Logger != nil {
+		opts = append(opts, mixed.WithLogger(config.Logger))
+	}
+	if config.Dial != nil {
+		opts = append(opts, mixed.WithUserDialFunc(config.Dial))
+	}
+
+	return &Server{
+		config: config,
+		proxy:  mixed.NewProxy(append(opts, options...)...),
+	}, nil
+}
+
+// Proxy returns the underlying mixed proxy
+func (s *Server) Proxy() *mixed.Proxy {
+	return s.proxy
+}
+
+// Run listens on the configured address and serves until ctx is done, it
+// then shuts the proxy down, waiting up to ShutdownTimeout for active
+// connections. It returns nil after a shutdown triggered by ctx.
+func (s *Server) Run(ctx context.Context) error {
+	var lc net.ListenConfig
+	ln, err := lc.Listen(ctx, "tcp", s.config.Bind)
+	if err != nil {
+		return err
+	}
+	if s.config.TLS != nil {
+		ln = tls.NewListener(ln, s.config.TLS)
+	}
+
+	shutdownDone := make(chan error, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-stop:
+			shutdownDone <- nil
+			return
+		}
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+		defer cancel()
+		err := s.proxy.Shutdown(shutdownCtx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the remaining connections were closed forcibly
+			err = nil
+		}
+		shutdownDone <- err
+	}()
+
+	err = s.proxy.Serve(ln)
+	if errors.Is(err, mixed.ErrProxyClosed) {
+		return <-shutdownDone
+	}
+	return err
+}
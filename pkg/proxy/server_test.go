@@ -0,0 +1,294 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/bepass-org/proxy/pkg/mixed"
+	"github.com/bepass-org/proxy/pkg/statute"
+)
+
+// tcpEcho starts a loopback TCP server sending everything back, it returns
+// its address
+func tcpEcho(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// httpConnect sends an HTTP CONNECT request for target to the proxy at addr,
+// it returns the response status or 0 when the proxy closes the connection
+// without one
+func httpConnect(t testing.TB, addr, target string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return 0
+	}
+	return resp.StatusCode
+}
+
+func TestNewRejectsInvalidConfig(t *testing.T) {
+	if _, err := New(Config{Bind: "no port"}); err == nil {
+		t.Fatal("New() with an invalid config succeeded")
+	}
+}
+
+func TestNewOptionPrecedence(t *testing.T) {
+	target := tcpEcho(t)
+	denyAll := func(context.Context, string, string, int) bool { return false }
+	allowAll := func(context.Context, string, string, int) bool { return true }
+	tests := []struct {
+		name    string
+		config  Config
+		options []mixed.Option
+		want    int
+	}{
+		{"config", Config{}, nil, http.StatusOK},
+		{"config ACL", Config{ACL: denyAll}, nil, http.StatusForbidden},
+		{"option overrides the config ACL", Config{ACL: denyAll}, []mixed.Option{mixed.WithACL(allowAll)}, http.StatusOK},
+		{"option extends the config", Config{}, []mixed.Option{mixed.WithDisableHTTP()}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := httpConnect(t, serveConfig(t, tt.config, tt.options...), target); got != tt.want {
+				t.Fatalf("CONNECT status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticator(t *testing.T) {
+	target := tcpEcho(t)
+	addr := serveConfig(t, Config{
+		DisableSOCKS4: true,
+		HTTPRealm:     "corp",
+		Authenticator: func(_ context.Context, username, password string) bool {
+			return username == "alice" && password == "secret"
+		},
+	})
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"no credentials", "", http.StatusProxyAuthRequired},
+		{"wrong credentials", "alice:wrong", http.StatusProxyAuthRequired},
+		{"credentials", "alice:secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			request := "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n"
+			if tt.authorization != "" {
+				request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(tt.authorization)) + "\r\n"
+			}
+			if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("CONNECT status = %d, want %d", resp.StatusCode, tt.want)
+			}
+			if want := `Basic realm="corp"`; tt.want == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") != want {
+				t.Fatalf("Proxy-Authenticate = %q, want %q", resp.Header.Get("Proxy-Authenticate"), want)
+			}
+		})
+	}
+
+	// SOCKS5 clients without credentials are refused as well
+	t.Run("socks5 without credentials", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte{5, 1, 0}); err != nil {
+			t.Fatal(err)
+		}
+		method := make([]byte, 2)
+		if _, err := io.ReadFull(conn, method); err != nil {
+			t.Fatal(err)
+		}
+		if method[1] != 0xff {
+			t.Fatalf("selected method %#x, want no acceptable method", method[1])
+		}
+	})
+}
+
+func TestNewTimeouts(t *testing.T) {
+	target := tcpEcho(t)
+	addr := serveConfig(t, Config{
+		HandshakeTimeout:      200 * time.Millisecond,
+		ReplyTimeout:          time.Second,
+		MaxConnectionLifetime: 500 * time.Millisecond,
+	})
+
+	tests := []struct {
+		name    string
+		request string
+	}{
+		// the client never sends its handshake
+		{"handshake timeout", ""},
+		// the tunnel is used but outlives its lifetime
+		{"max connection lifetime", "CONNECT " + target + " HTTP/1.1\r\nHost: " + target + "\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if _, err := io.WriteString(conn, tt.request); err != nil {
+				t.Fatal(err)
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.Copy(io.Discard, conn); err != nil {
+				t.Fatalf("connection not closed: %v", err)
+			}
+		})
+	}
+}
+
+// serveConfig serves a server built from config and options on a loopback
+// listener closed at the end of the test, it returns the address of the
+// listener
+func serveConfig(t testing.TB, config Config, options ...mixed.Option) string {
+	t.Helper()
+	config.Logger = statute.DefaultLogger{}
+	s, err := New(config, options...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		_ = s.Proxy().Serve(ln)
+	}()
+	return ln.Addr().String()
+}
+
+// freeAddress returns a loopback address with a port nothing listens on
+func freeAddress(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+func TestRunStopsWithContext(t *testing.T) {
+	for _, shutdownTimeout := range []time.Duration{0, 100 * time.Millisecond} {
+		t.Run(shutdownTimeout.String(), func(t *testing.T) {
+			bind := freeAddress(t)
+			s, err := New(Config{Bind: bind, Logger: statute.DefaultLogger{}, ShutdownTimeout: shutdownTimeout})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			done := make(chan error, 1)
+			go func() {
+				done <- s.Run(ctx)
+			}()
+
+			// Run returns nil even with a tunnel still open
+			var conn net.Conn
+			for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+				conn, err = net.Dial("tcp", bind)
+				if err == nil {
+					break
+				}
+				if time.Since(start) > 5*time.Second {
+					t.Fatalf("Run is not listening: %v", err)
+				}
+			}
+			defer conn.Close()
+			target := tcpEcho(t)
+			if _, err := fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target); err != nil {
+				t.Fatal(err)
+			}
+			if resp, err := http.ReadResponse(bufio.NewReader(conn), nil); err != nil || resp.StatusCode != http.StatusOK {
+				t.Fatalf("CONNECT = %v, want 200", err)
+			}
+
+			cancel()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatalf("Run() = %v, want nil", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run still serving after the context was cancelled")
+			}
+		})
+	}
+}
+
+func TestRunListenError(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	s, err := New(Config{Bind: ln.Addr().String(), Logger: statute.DefaultLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err == nil {
+		t.Fatal("Run() on an address in use = nil, want an error")
+	}
+}
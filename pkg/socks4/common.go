@@ -3,11 +3,17 @@ package socks4
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 	"net"
 	"strconv"
 )
 
+var (
+	errFieldTooLong  = errors.New("user id or hostname too long")
+	errEmptyHostname = errors.New("empty socks4a hostname")
+)
+
 var (
 	isSocks4a = []byte{0, 0, 0, 1}
 	isNone    = []byte{0, 0, 0, 0}
@@ -15,6 +21,8 @@ var (
 
 const (
 	socks4Version = 0x04
+	// defaultMaxFieldLength bounds the NUL terminated user id and hostname
+	defaultMaxFieldLength = 256
 )
 
 const (
@@ -90,31 +98,35 @@ type AddrAnfUser struct {
 	Username string
 }
 
-func readBytes(r io.Reader) ([]byte, error) {
+// readBytes reads a NUL terminated field of at most maxLen bytes
+func readBytes(r io.Reader, maxLen int) ([]byte, error) {
 	buf := []byte{}
 	var data [1]byte
 	for {
-		_, err := r.Read(data[:])
+		_, err := io.ReadFull(r, data[:])
 		if err != nil {
 			return nil, err
 		}
 		if data[0] == 0 {
 			return buf, nil
 		}
+		if len(buf) >= maxLen {
+			return nil, errFieldTooLong
+		}
 		buf = append(buf, data[0])
 	}
 }
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
 	return buf[0], nil
 }
 
-func readAddrAndUser(r io.Reader) (*AddrAnfUser, error) {
+func readAddrAndUser(r io.Reader, maxLen int) (*AddrAnfUser, error) {
 	address := &AddrAnfUser{}
 	var port [2]byte
 	if _, err := io.ReadFull(r, port[:]); err != nil {
@@ -127,16 +139,19 @@ func readAddrAndUser(r io.Reader) (*AddrAnfUser, error) {
 	}
 	socks4a := bytes.Equal(ip, isSocks4a)
 
-	username, err := readBytes(r)
+	username, err := readBytes(r, maxLen)
 	if err != nil {
 		return nil, err
 	}
 	address.Username = string(username)
 	if socks4a {
-		hostname, err := readBytes(r)
+		hostname, err := readBytes(r, maxLen)
 		if err != nil {
 			return nil, err
 		}
+		if len(hostname) == 0 {
+			return nil, errEmptyHostname
+		}
 		address.Name = string(hostname)
 	} else {
 		address.IP = ip
@@ -144,6 +159,26 @@ func readAddrAndUser(r io.Reader) (*AddrAnfUser, error) {
 	return address, nil
 }
 
+// bindAddress converts a bound address reported by a handler, socks4 only
+// carries IPv4 addresses so others are sent as all zeros
+func bindAddress(addr net.Addr) *address {
+	if addr == nil {
+		return nil
+	}
+	if a, ok := addr.(*net.TCPAddr); ok {
+		return &address{IP: a.IP, Port: a.Port}
+	}
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return nil
+	}
+	return &address{IP: net.ParseIP(host), Port: portNum}
+}
+
 func writeAddr(w io.Writer, addr *address) error {
 	var ip net.IP
 	var port uint16
@@ -0,0 +1,129 @@
+package socks4
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func FuzzReadAddrAndUser(f *testing.F) {
+	f.Add([]byte{0, 80, 127, 0, 0, 1, 0})
+	f.Add([]byte{0, 80, 127, 0, 0, 1, 'u', 's', 'e', 'r', 0})
+	f.Add([]byte{1, 187, 0, 0, 0, 1, 0, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0})
+	f.Add([]byte{1, 187, 0, 0, 0, 1, 0, 0})
+	f.Add([]byte{0, 80, 127, 0, 0})
+	f.Add([]byte{0, 80, 0, 0, 0, 1, 'u'})
+
+	const maxLen = 16
+	f.Fuzz(func(t *testing.T, data []byte) {
+		addr, err := readAddrAndUser(bytes.NewReader(data), maxLen)
+		if err != nil {
+			if addr != nil {
+				t.Fatalf("readAddrAndUser() = %+v with error %v", addr, err)
+			}
+			return
+		}
+		if addr.Port < 0 || addr.Port > 65535 {
+			t.Fatalf("port %d out of range", addr.Port)
+		}
+		if len(addr.Username) > maxLen || bytes.IndexByte([]byte(addr.Username), 0) >= 0 {
+			t.Fatalf("malformed user id %q", addr.Username)
+		}
+		if addr.IP == nil {
+			if addr.Name == "" || len(addr.Name) > maxLen || bytes.IndexByte([]byte(addr.Name), 0) >= 0 {
+				t.Fatalf("malformed hostname %q", addr.Name)
+			}
+			return
+		}
+		if len(addr.IP) != net.IPv4len || addr.Name != "" {
+			t.Fatalf("malformed address %+v", addr.address)
+		}
+	})
+}
+
+func TestReadersHonourDeadline(t *testing.T) {
+	const maxLen = 64
+	tests := []struct {
+		name string
+		data []byte
+		read func(r io.Reader) error
+	}{
+		{"readAddrAndUser", []byte{0, 80, 127, 0, 0, 1, 'u', 's', 'e', 'r', 0}, func(r io.Reader) error {
+			_, err := readAddrAndUser(r, maxLen)
+			return err
+		}},
+		{"readBytes", []byte("username\x00"), func(r io.Reader) error {
+			_, err := readBytes(r, maxLen)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			// one byte every 50ms delivers the field well past the deadline
+			go func() {
+				for _, b := range tt.data {
+					time.Sleep(50 * time.Millisecond)
+					if _, err := client.Write([]byte{b}); err != nil {
+						return
+					}
+				}
+			}()
+
+			start := time.Now()
+			_ = server.SetReadDeadline(start.Add(200 * time.Millisecond))
+			read := make(chan error, 1)
+			go func() {
+				read <- tt.read(server)
+			}()
+			select {
+			case err := <-read:
+				if !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("%s() = %v, want %v", tt.name, err, os.ErrDeadlineExceeded)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s blocked past the deadline", tt.name)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("%s returned after %v, want about the 200ms deadline", tt.name, elapsed)
+			}
+		})
+	}
+}
+
+// endlessReader reads an endless stream of b, counting the bytes read
+type endlessReader struct {
+	b    byte
+	read int
+}
+
+func (r *endlessReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = r.b
+	}
+	r.read += len(p)
+	return len(p), nil
+}
+
+func TestReadBytesBounded(t *testing.T) {
+	const maxLen = 256
+	r := &endlessReader{b: 'a'}
+	if _, err := readBytes(r, maxLen); !errors.Is(err, errFieldTooLong) {
+		t.Fatalf("readBytes() = %v, want %v", err, errFieldTooLong)
+	}
+	if r.read > maxLen+1 {
+		t.Fatalf("readBytes read %d bytes, want at most %d", r.read, maxLen+1)
+	}
+
+	// a field of exactly maxLen bytes is still accepted
+	field := append(bytes.Repeat([]byte{'a'}, maxLen), 0)
+	if got, err := readBytes(bytes.NewReader(field), maxLen); err != nil || len(got) != maxLen {
+		t.Fatalf("readBytes() = %d bytes, %v, want %d bytes", len(got), err, maxLen)
+	}
+}
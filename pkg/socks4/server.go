@@ -1,11 +1,14 @@
 package socks4
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/bepass-org/proxy/pkg/statute"
 	"io"
 	"net"
+	"sync"
+	"time"
 )
 
 // Server is accepting connections and handling the details of the SOCKS4 protocol
@@ -15,27 +18,92 @@ type Server struct {
 	// ProxyDial specifies the optional proxyDial function for
 	// establishing the transport connection.
 	ProxyDial statute.ProxyDialFunc
+	// DialLocalAddr is the local address of the default ProxyDial, it is
+	// ignored when ProxyDial is set
+	DialLocalAddr *net.TCPAddr
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
-	// Logger error log
+	// Router selects the handler of TCP CONNECT requests by destination
+	Router *statute.Router
+	// Logger error log, WithLogger serializes it with a statute.SyncLogger,
+	// assign the field directly to opt out
 	Logger statute.Logger
 	// Context is default context
 	Context context.Context
-	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer,
+	// statute.DefaultBytesPool is used when it is nil
 	BytesPool statute.BytesPool
+	// DestinationRewriter rewrites the destination of TCP CONNECT requests
+	DestinationRewriter statute.DestinationRewriter
+	// ACL denies requests to destinations it does not allow
+	ACL statute.ACL
+	// Middleware wraps the connect handler, the user handler or, when there
+	// is none, the embedded one. Changes it makes to the request are not
+	// seen by the embedded handler.
+	Middleware statute.Middleware
+	// AllowedPorts and DeniedPorts restrict the destination ports of TCP
+	// requests before the ACL is consulted, see statute.PortAllowed. Empty
+	// lists allow every port.
+	AllowedPorts []int
+	DeniedPorts  []int
+	// AccessLog writes a record for every served connection
+	AccessLog *statute.AccessLog
+	// RequireHandler denies requests without a user handler instead of
+	// falling back to the embedded direct dial
+	RequireHandler bool
+	// DeferConnectReply leaves the CONNECT reply to user handlers so they
+	// can report the real bound address, see statute.ProxyRequest.Reply
+	DeferConnectReply bool
+	// CloseOnHandlerError closes the client connection when the connect
+	// handler returns an error, after the failure reply if the reply was
+	// deferred and the handler did not reply. Otherwise closing it is left
+	// to the handler and the caller of ServeConn.
+	CloseOnHandlerError bool
+	// ErrorHandler observes the errors serving connections, they are logged
+	// when it is nil
+	ErrorHandler statute.ErrorHandler
+	// VerboseDestinations logs the destinations dialed by the embedded
+	// handlers and the outcome at debug level
+	VerboseDestinations bool
+	// HandshakeTimeout bounds the time to read the handshake and request of
+	// a client, including authentication, zero means no limit
+	HandshakeTimeout time.Duration
+	// ReplyTimeout bounds the time to write a reply to a client, so one not
+	// reading can't block the server, zero means no limit. NewServer sets
+	// it to statute.DefaultReplyTimeout.
+	ReplyTimeout time.Duration
+	// MaxConnectionLifetime ends connections this long after they were
+	// accepted with statute.ErrMaxLifetime, zero means no limit
+	MaxConnectionLifetime time.Duration
+	// ConnectionByteLimit ends tunnels once they relayed this many bytes in
+	// both directions together with statute.ErrByteLimitExceeded, zero
+	// means no limit
+	ConnectionByteLimit int64
+	// TCPKeepAliveInterval enables TCP keepalive probes at this interval on
+	// both ends of CONNECT tunnels relayed by the embedded handlers, so idle
+	// tunnels survive NAT and firewalls. Zero leaves the sockets unchanged.
+	TCPKeepAliveInterval time.Duration
+	// MaxFieldLength bounds the length of the user id and socks4a hostname,
+	// zero means 256 bytes
+	MaxFieldLength int
 }
 
 func NewServer(options ...ServerOption) *Server {
 	s := &Server{
-		ProxyDial: statute.DefaultProxyDial(),
-		Logger:    statute.DefaultLogger{},
-		Context:   statute.DefaultContext(),
+		Logger:       statute.NewSyncLogger(statute.DefaultLogger{}),
+		Context:      statute.DefaultContext(),
+		ReplyTimeout: statute.DefaultReplyTimeout,
 	}
 
 	for _, option := range options {
 		option(s)
 	}
 
+	// the local addresses only apply to the default dial functions
+	if s.ProxyDial == nil {
+		s.ProxyDial = statute.LocalAddrProxyDial(s.DialLocalAddr)
+	}
+
 	return s
 }
 
@@ -67,7 +135,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
-				s.Logger.Error(err)
+				if !statute.IsBenignCloseError(err) {
+					s.Logger.Error(err)
+				}
 				continue
 			}
 
@@ -75,7 +145,7 @@ func (s *Server) ListenAndServe() error {
 			// This way, the server can handle multiple connections concurrently
 			go func() {
 				err := s.ServeConn(conn)
-				if err != nil {
+				if err != nil && s.ErrorHandler == nil && !statute.IsBenignCloseError(err) {
 					s.Logger.Error(err) // Log errors from ServeConn
 				}
 			}()
@@ -85,7 +155,7 @@ func (s *Server) ListenAndServe() error {
 
 func WithLogger(logger statute.Logger) ServerOption {
 	return func(s *Server) {
-		s.Logger = logger
+		s.Logger = statute.NewSyncLogger(logger)
 	}
 }
 
@@ -101,12 +171,133 @@ func WithConnectHandle(handler statute.UserConnectHandler) ServerOption {
 	}
 }
 
+func WithRouter(router *statute.Router) ServerOption {
+	return func(s *Server) {
+		s.Router = router
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
 	}
 }
 
+func WithDestinationRewriter(rewriter statute.DestinationRewriter) ServerOption {
+	return func(s *Server) {
+		s.DestinationRewriter = rewriter
+	}
+}
+
+func WithAllowedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.AllowedPorts = ports
+	}
+}
+
+func WithDeniedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.DeniedPorts = ports
+	}
+}
+
+// WithMiddleware wraps the connect handler with middlewares, the first one
+// is the outermost, see statute.Chain
+func WithMiddleware(middlewares ...statute.Middleware) ServerOption {
+	return func(s *Server) {
+		s.Middleware = statute.Chain(middlewares...)
+	}
+}
+
+func WithACL(acl statute.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = acl
+	}
+}
+
+func WithAccessLog(accessLog *statute.AccessLog) ServerOption {
+	return func(s *Server) {
+		s.AccessLog = accessLog
+	}
+}
+
+func WithRequireHandler() ServerOption {
+	return func(s *Server) {
+		s.RequireHandler = true
+	}
+}
+
+func WithMaxFieldLength(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxFieldLength = n
+	}
+}
+
+// WithTCPKeepAliveProbes sets Server.TCPKeepAliveInterval
+func WithTCPKeepAliveProbes(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TCPKeepAliveInterval = interval
+	}
+}
+
+func WithConnectionByteLimit(n int64) ServerOption {
+	return func(s *Server) {
+		s.ConnectionByteLimit = n
+	}
+}
+
+// WithReplyTimeout sets Server.ReplyTimeout. Without it the timeout is
+// statute.DefaultReplyTimeout, a reply the client doesn't read within it
+// fails with statute.ErrReplyTimeout. Zero disables the timeout, writes then
+// block for as long as the client doesn't read.
+func WithReplyTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ReplyTimeout = timeout
+	}
+}
+
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HandshakeTimeout = timeout
+	}
+}
+
+func WithMaxConnectionLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnectionLifetime = lifetime
+	}
+}
+
+func WithVerboseDestinations(verbose bool) ServerOption {
+	return func(s *Server) {
+		s.VerboseDestinations = verbose
+	}
+}
+
+func WithErrorHandler(errorHandler statute.ErrorHandler) ServerOption {
+	return func(s *Server) {
+		s.ErrorHandler = errorHandler
+	}
+}
+
+func WithDeferConnectReply() ServerOption {
+	return func(s *Server) {
+		s.DeferConnectReply = true
+	}
+}
+
+func WithCloseOnHandlerError() ServerOption {
+	return func(s *Server) {
+		s.CloseOnHandlerError = true
+	}
+}
+
+func WithDialLocalAddr(addr *net.TCPAddr) ServerOption {
+	return func(s *Server) {
+		s.DialLocalAddr = addr
+	}
+}
+
 func WithContext(ctx context.Context) ServerOption {
 	return func(s *Server) {
 		s.Context = ctx
@@ -120,6 +311,40 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 }
 
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.ServeConnContext(s.Context, conn)
+}
+
+// ServeConnContext serves conn using ctx as the context of the connection
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) (err error) {
+	defer func() {
+		statute.ReportError(ctx, s.ErrorHandler, "socks4", conn, err)
+		statute.TraceClose(ctx, err)
+	}()
+	defer statute.RecoverPanic(statute.ConnLogger(ctx, s.Logger), conn, &err)
+
+	ctx, cancel := statute.WithMaxLifetime(ctx, s.MaxConnectionLifetime)
+	defer cancel()
+	// unblock the handlers using conn once ctx is done, such as on shutdown
+	defer statute.CloseOnDone(ctx, conn)()
+
+	if s.AccessLog != nil {
+		accessConn := statute.NewAccessConn(conn, "socks4")
+		conn = accessConn
+		defer func() {
+			_ = s.AccessLog.Log(accessConn)
+		}()
+	}
+
+	statute.TraceHandshakeStart(ctx)
+	clearDeadline := statute.HandshakeDeadline(conn, s.HandshakeTimeout)
+	handshaken := false
+	defer func() {
+		// a failed or timed out handshake leaves conn unusable
+		if !handshaken {
+			_ = conn.Close()
+		}
+	}()
+
 	version, err := readByte(conn)
 	if err != nil {
 		return err
@@ -130,6 +355,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	req := &request{
 		Version: socks4Version,
 		Conn:    conn,
+		ctx:     ctx,
 	}
 
 	cmd, err := readByte(conn)
@@ -138,38 +364,77 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 	req.Command = Command(cmd)
 
-	addr, err := readAddrAndUser(conn)
+	maxLen := s.MaxFieldLength
+	if maxLen <= 0 {
+		maxLen = defaultMaxFieldLength
+	}
+	addr, err := readAddrAndUser(conn, maxLen)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
 		return err
 	}
 	req.DestinationAddr = &addr.address
 	req.Username = addr.Username
+	if req.Username != "" {
+		// the user id is taken on trust, it is not checked with identd
+		statute.RecordAccessAuth(req.Conn, statute.AuthMethodIdent, req.Username, true)
+		statute.TraceAuthDone(ctx, statute.AuthMethodIdent, req.Username, true)
+	} else {
+		statute.RecordAccessAuth(req.Conn, statute.AuthMethodNone, "", true)
+		statute.TraceAuthDone(ctx, statute.AuthMethodNone, "", true)
+	}
+	clearDeadline()
+	handshaken = true
 	return s.handle(req)
 }
 
 func (s *Server) handle(req *request) error {
 	switch req.Command {
 	case ConnectCommand:
+		statute.RecordAccessRequest(req.Conn, "CONNECT", req.DestinationAddr.String(), req.Username)
 		return s.handleConnect(req)
 	default:
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
+		statute.RecordAccessRequest(req.Conn, req.Command.String(), req.DestinationAddr.String(), req.Username)
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		// the reply carries a zeroed bind address
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
 			return err
 		}
+		// send the reply ahead of the close so it is not lost to a reset
+		_ = statute.CloseWrite(req.Conn)
 		return fmt.Errorf("unsupported Command: %v", req.Command)
 	}
 }
 
 func (s *Server) handleConnect(req *request) error {
-	if s.UserConnectHandle == nil {
-		return s.embedHandleConnect(req)
+	if err := s.rewriteDestination(req); err != nil {
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("rewrite destination %v failed: %w", req.DestinationAddr, err)
+	}
+
+	if !s.allowed(req) {
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("connect to %v denied by ACL", req.DestinationAddr)
 	}
 
-	if err := sendReply(req.Conn, grantedReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	if s.UserConnectHandle == nil && s.Router == nil && s.Middleware == nil {
+		return s.embedHandleConnect(req)
 	}
+
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -183,53 +448,205 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		ClientAddr:  req.Conn.RemoteAddr(),
+		Context:     req.ctx,
+	}
+	proxyReq.ConnID, _ = statute.ConnID(req.ctx)
+
+	handler := s.connectHandler(proxyReq)
+	if handler == nil {
+		return s.embedHandleConnectMiddleware(req, proxyReq)
+	}
+	if s.Middleware != nil {
+		handler = s.Middleware(handler)
+	}
+
+	err := s.runConnectHandler(req, proxyReq, handler)
+	if err != nil && s.CloseOnHandlerError {
+		_ = req.Conn.Close()
+	}
+	return err
+}
+
+// runConnectHandler replies to the CONNECT request, unless the reply is
+// deferred to handler, and runs handler
+func (s *Server) runConnectHandler(req *request, proxyReq *statute.ProxyRequest, handler statute.UserConnectHandler) error {
+	if s.DeferConnectReply {
+		return s.handleDeferredConnect(req, proxyReq, handler)
+	}
+
+	if err := s.sendReply(req.Conn, grantedReply, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return statute.WithPhase(statute.PhaseTunnel, proxyReq.Destination, handler(proxyReq))
+}
+
+// embedHandleConnectMiddleware runs the embedded handler through the
+// Middleware, a request rejected by the middleware gets a failure reply
+func (s *Server) embedHandleConnectMiddleware(req *request, proxyReq *statute.ProxyRequest) error {
+	if s.Middleware == nil {
+		return s.embedHandleConnect(req)
+	}
+	embedded := false
+	handler := s.Middleware(func(*statute.ProxyRequest) error {
+		embedded = true
+		return s.embedHandleConnect(req)
+	})
+	err := handler(proxyReq)
+	if err != nil && !embedded {
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
 	}
+	return err
+}
+
+// handleDeferredConnect runs handler leaving the reply to it, see
+// statute.ProxyRequest.Reply
+func (s *Server) handleDeferredConnect(req *request, proxyReq *statute.ProxyRequest, handler statute.UserConnectHandler) error {
+	var (
+		once     sync.Once
+		replyErr error
+	)
+	proxyReq.Reply = func(bindAddr net.Addr, err error) error {
+		once.Do(func() {
+			code := grantedReply
+			if err != nil {
+				code = rejectedReply
+			}
+			replyErr = s.sendReply(req.Conn, code, bindAddress(bindAddr))
+		})
+		return replyErr
+	}
+
+	err := handler(proxyReq)
+	// a no-op if the handler already replied
+	_ = proxyReq.Reply(nil, err)
+	return statute.WithPhase(statute.PhaseTunnel, proxyReq.Destination, err)
+}
 
-	return s.UserConnectHandle(proxyReq)
+// connectHandler picks the handler for proxyReq, routes take precedence over
+// UserConnectHandle
+func (s *Server) connectHandler(proxyReq *statute.ProxyRequest) statute.UserConnectHandler {
+	if s.Router != nil {
+		if handler := s.Router.Route(proxyReq.Context, proxyReq); handler != nil {
+			return handler
+		}
+	}
+	return s.UserConnectHandle
+}
+
+// logDestination logs the destination of an embedded handler and the outcome
+// of dialing it when VerboseDestinations is set
+func (s *Server) logDestination(ctx context.Context, command, destination string, err error) {
+	if !s.VerboseDestinations {
+		return
+	}
+	logger := statute.ConnLogger(ctx, s.Logger)
+	logger = statute.WithField(logger, "protocol", "socks4")
+	logger = statute.WithField(logger, "destination", destination)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("%s %s failed: %v", command, destination, err))
+		return
+	}
+	logger.Debug(command + " " + destination + " succeeded")
+}
+
+// rewriteDestination applies the DestinationRewriter to the destination of
+// req
+func (s *Server) rewriteDestination(req *request) error {
+	if s.DestinationRewriter == nil {
+		return nil
+	}
+	host := req.DestinationAddr.Name
+	if host == "" {
+		host = req.DestinationAddr.IP.String()
+	}
+	host, port, err := s.DestinationRewriter(req.ctx, "tcp", host, req.DestinationAddr.Port)
+	if err != nil {
+		return err
+	}
+	dest := &address{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.Name = host
+	}
+	req.DestinationAddr = dest
+	return nil
 }
 
 func (s *Server) embedHandleConnect(req *request) error {
 	defer func() {
 		_ = req.Conn.Close()
 	}()
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+
+	if s.RequireHandler {
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return statute.ErrHandlerRequired
+	}
+
+	target, err := statute.TraceDial(req.ctx, s.ProxyDial, "tcp", req.DestinationAddr.Address())
+	s.logDestination(req.ctx, "CONNECT", req.DestinationAddr.String(), err)
 	if err != nil {
-		if err := sendReply(req.Conn, rejectedReply, nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(req.Conn, rejectedReply, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return statute.WithPhase(statute.PhaseDial, req.DestinationAddr.String(), fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 	defer func() {
 		_ = target.Close()
 	}()
 	local := target.LocalAddr().(*net.TCPAddr)
 	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, grantedReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	if err := s.sendReply(req.Conn, grantedReply, &bind); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
-		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
-		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+	_, _, err = statute.Relay(req.ctx, req.Conn, target, statute.RelayOptions{
+		BytesPool:         s.BytesPool,
+		ByteLimit:         s.ConnectionByteLimit,
+		KeepAliveInterval: s.TCPKeepAliveInterval,
+	})
+	return statute.WithPhase(statute.PhaseTunnel, req.DestinationAddr.String(), err)
+}
+
+// allowed reports whether the port lists and the ACL allow the destination
+// of req
+func (s *Server) allowed(req *request) bool {
+	if !statute.PortAllowed(req.DestinationAddr.Port, s.AllowedPorts, s.DeniedPorts) {
+		return false
+	}
+	acl := statute.PolicyACL(req.ctx, s.ACL)
+	if acl == nil {
+		return true
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
+	host := req.DestinationAddr.Name
+	if host == "" {
+		host = req.DestinationAddr.IP.String()
+	}
+	return acl(req.ctx, "tcp", host, req.DestinationAddr.Port)
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{0, byte(resp)})
-	if err != nil {
+func (s *Server) sendReply(w io.Writer, resp reply, addr *address) error {
+	statute.RecordAccessStatus(w, int(resp))
+	b := bytes.NewBuffer([]byte{0, byte(resp)})
+	if err := writeAddr(b, addr); err != nil {
 		return err
 	}
-	err = writeAddr(w, addr)
-	return err
+	return s.writeReply(w, b.Bytes())
+}
+
+// writeReply writes b to w within the reply timeout
+func (s *Server) writeReply(w io.Writer, b []byte) error {
+	done := statute.ReplyDeadline(w, s.ReplyTimeout)
+	_, err := w.Write(b)
+	return done(err)
 }
 
 type request struct {
@@ -238,4 +655,5 @@ type request struct {
 	DestinationAddr *address
 	Username        string
 	Conn            net.Conn
+	ctx             context.Context
 }
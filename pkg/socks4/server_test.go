@@ -0,0 +1,254 @@
+package socks4
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// serve starts s on a loopback listener closed at the end of the test, it
+// returns the address of the listener
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = s.ServeConn(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// tcpEcho starts a loopback TCP server sending everything back, it returns
+// its address
+func tcpEcho(t testing.TB) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+// sendConnect sends a CONNECT request for target to the proxy at addr, it
+// returns the connection, closed at the end of the test, and the reply code
+func sendConnect(t testing.TB, addr string, target *net.TCPAddr) (net.Conn, reply) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := binary.BigEndian.AppendUint16([]byte{socks4Version, byte(ConnectCommand)}, uint16(target.Port))
+	req = append(req, target.IP.To4()...)
+	req = append(req, 0)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	return conn, reply(resp[1])
+}
+
+// connect opens a CONNECT tunnel to target through the proxy at addr, the
+// connection is closed at the end of the test
+func connect(t testing.TB, addr string, target *net.TCPAddr) net.Conn {
+	t.Helper()
+	conn, code := sendConnect(t, addr, target)
+	if code != grantedReply {
+		t.Fatalf("reply %#x, want request granted", byte(code))
+	}
+	return conn
+}
+
+// countingPool is a statute.BytesPool counting the buffers taken and
+// returned
+type countingPool struct {
+	statute.BytesPool
+	gets, puts atomic.Int64
+}
+
+func (p *countingPool) Get() []byte {
+	p.gets.Add(1)
+	return p.BytesPool.Get()
+}
+
+func (p *countingPool) Put(b []byte) {
+	p.puts.Add(1)
+	p.BytesPool.Put(b)
+}
+
+func TestConnectUsesBytesPool(t *testing.T) {
+	pool := &countingPool{BytesPool: statute.NewBytesPool(0)}
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{}), WithBytesPool(pool)))
+	conn := connect(t, proxy, tcpEcho(t))
+
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "ping" {
+		t.Fatalf("echoed %q, want %q", got, "ping")
+	}
+	if gets := pool.gets.Load(); gets != 2 {
+		t.Fatalf("tunnel took %d buffers from the pool, want one per direction", gets)
+	}
+	_ = conn.Close()
+	// the buffers are returned once the tunnel ends
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.puts.Load() != pool.gets.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d buffers returned to the pool, want %d", pool.puts.Load(), pool.gets.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestConnectPortLists(t *testing.T) {
+	target := tcpEcho(t)
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    reply
+	}{
+		{"no lists", nil, grantedReply},
+		{"allowed port", []ServerOption{WithAllowedPorts([]int{target.Port})}, grantedReply},
+		{"port not allowed", []ServerOption{WithAllowedPorts([]int{target.Port + 1})}, rejectedReply},
+		{"denied port", []ServerOption{WithDeniedPorts([]int{target.Port})}, rejectedReply},
+		{"denied over allowed", []ServerOption{WithAllowedPorts([]int{target.Port}), WithDeniedPorts([]int{target.Port})}, rejectedReply},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			if _, code := sendConnect(t, serve(t, s), target); code != tt.want {
+				t.Fatalf("reply %#x, want %#x", byte(code), byte(tt.want))
+			}
+		})
+	}
+}
+
+func TestServeConnRecoversHandlerPanic(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(func(*statute.ProxyRequest) error {
+		panic("broken handler")
+	}))
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	go func() {
+		_, _ = client.Write([]byte{socks4Version, byte(ConnectCommand), 0, 80, 192, 0, 2, 1, 0})
+	}()
+	// the connection is closed once the panic is recovered
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("reading until close = %v", err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, statute.ErrHandlerPanic) {
+			t.Fatalf("ServeConn() = %v, want %v", err, statute.ErrHandlerPanic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn blocked")
+	}
+}
+
+func TestReplyTimeout(t *testing.T) {
+	if got := NewServer().ReplyTimeout; got != statute.DefaultReplyTimeout {
+		t.Fatalf("default ReplyTimeout = %v, want %v", got, statute.DefaultReplyTimeout)
+	}
+
+	// the client sends its request but never reads the reply
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithReplyTimeout(50*time.Millisecond),
+		WithACL(func(context.Context, string, string, int) bool { return false }),
+	)
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+	_ = client.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte{socks4Version, byte(ConnectCommand), 0, 80, 192, 0, 2, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-served:
+		if !errors.Is(err, statute.ErrReplyTimeout) {
+			t.Fatalf("ServeConn() = %v, want %v", err, statute.ErrReplyTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn blocked")
+	}
+}
+
+func TestUnknownCommandReply(t *testing.T) {
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{})))
+	conn, err := net.Dial("tcp", proxy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks4Version, 0x7f, 0, 80, 192, 0, 2, 1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	// the whole reply arrives before the close, with a zeroed bind address
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("reading the reply: %v", err)
+	}
+	want := []byte{0, byte(rejectedReply), 0, 0, 0, 0, 0, 0}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("reply %x, want %x", got, want)
+	}
+}
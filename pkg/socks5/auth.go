@@ -0,0 +1,156 @@
+package socks5
+
+import (
+	"context"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+	"time"
+)
+
+// AuthMethod is a SOCKS5 authentication method the server can select during
+// the method negotiation
+type AuthMethod interface {
+	// Code is the method byte advertised in the negotiation
+	Code() byte
+	// Authenticate runs the sub-negotiation of the method on conn once it is
+	// selected, it returns the authenticated user name, if any. Writes to
+	// conn are bounded by Server.ReplyTimeout.
+	Authenticate(ctx context.Context, conn net.Conn) (string, error)
+}
+
+// replyConn bounds every write to the wrapped connection to timeout, so an
+// authentication method answering a client that doesn't read can't block
+type replyConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c replyConn) Write(b []byte) (int, error) {
+	done := statute.ReplyDeadline(c.Conn, c.timeout)
+	n, err := c.Conn.Write(b)
+	return n, done(err)
+}
+
+// NetConn returns the wrapped connection
+func (c replyConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// NoAuth is the method requiring no authentication
+type NoAuth struct{}
+
+func (NoAuth) Code() byte { return byte(noAuth) }
+
+func (NoAuth) Authenticate(context.Context, net.Conn) (string, error) {
+	return "", nil
+}
+
+// UserPassAuth is the RFC 1929 username/password method, the credentials are
+// checked with Authenticator or, when it is nil, with CredentialChecker.
+// Rejected credentials are answered after FailureDelay, see
+// statute.AuthFailureDelay.
+type UserPassAuth struct {
+	Authenticator     statute.UserPassAuthenticator
+	CredentialChecker statute.CredentialChecker
+	FailureDelay      time.Duration
+}
+
+func (UserPassAuth) Code() byte { return byte(userPassAuth) }
+
+// Authenticate runs the RFC 1929 sub-negotiation, conn is closed after a
+// failure reply
+func (a UserPassAuth) Authenticate(ctx context.Context, conn net.Conn) (string, error) {
+	version, err := readByte(conn)
+	if err != nil {
+		return "", err
+	}
+	if version != userPassVersion {
+		_, _ = conn.Write([]byte{userPassVersion, userPassFailure})
+		_ = conn.Close()
+		return "", errUserPassVersion
+	}
+	username, err := readBytes(conn)
+	if err != nil {
+		return "", err
+	}
+	password, err := readBytes(conn)
+	if err != nil {
+		return "", err
+	}
+
+	ok, err := a.check(ctx, string(username), string(password))
+	if err != nil || !ok {
+		if delayErr := statute.AuthFailureDelay(ctx, a.FailureDelay); delayErr != nil {
+			_ = conn.Close()
+			return string(username), delayErr
+		}
+		_, _ = conn.Write([]byte{userPassVersion, userPassFailure})
+		_ = conn.Close()
+		if err != nil {
+			return string(username), fmt.Errorf("checking credentials: %w", err)
+		}
+		return string(username), errAuthFailed
+	}
+	_, err = conn.Write([]byte{userPassVersion, userPassSuccess})
+	return string(username), err
+}
+
+// check validates the credentials, rejecting them when no checker is set
+func (a UserPassAuth) check(ctx context.Context, username, password string) (bool, error) {
+	if a.Authenticator != nil {
+		return a.Authenticator(ctx, username, password), nil
+	}
+	if a.CredentialChecker != nil {
+		return a.CredentialChecker(ctx, username, password)
+	}
+	return false, nil
+}
+
+// authMethods returns the configured methods in preference order, by default
+// username/password when an Authenticator or a CredentialChecker is set and
+// no authentication otherwise
+func (s *Server) authMethods(ctx context.Context) []AuthMethod {
+	if policy := statute.ConnPolicyFromContext(ctx); policy != nil && policy.Authenticator != nil {
+		return []AuthMethod{UserPassAuth{
+			Authenticator: policy.Authenticator,
+			FailureDelay:  s.AuthFailureDelay,
+		}}
+	}
+	if s.AuthMethods != nil {
+		return s.AuthMethods
+	}
+	if s.Authenticator != nil || s.CredentialChecker != nil {
+		return []AuthMethod{UserPassAuth{
+			Authenticator:     s.Authenticator,
+			CredentialChecker: s.CredentialChecker,
+			FailureDelay:      s.AuthFailureDelay,
+		}}
+	}
+	return []AuthMethod{NoAuth{}}
+}
+
+// selectAuthMethod returns the first configured method the client offers
+func (s *Server) selectAuthMethod(ctx context.Context, offered []byte) AuthMethod {
+	for _, method := range s.authMethods(ctx) {
+		for _, code := range offered {
+			if code == method.Code() {
+				return method
+			}
+		}
+	}
+	return nil
+}
+
+// authMethodName names a method code for the access log
+func authMethodName(code byte) string {
+	switch authMethod(code) {
+	case noAuth:
+		return statute.AuthMethodNone
+	case userPassAuth:
+		return statute.AuthMethodUserPass
+	case gssapiAuth:
+		return statute.AuthMethodGSSAPI
+	}
+	return fmt.Sprintf("0x%02x", code)
+}
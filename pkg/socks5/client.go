@@ -0,0 +1,146 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+var errShortDatagram = errors.New("datagram shorter than its socks5 header")
+
+// UDPClient exchanges datagrams with targets through the UDP ASSOCIATE
+// command of a SOCKS5 server, such as to check a relay end to end. The
+// control connection of the association stays open until Close.
+type UDPClient struct {
+	control net.Conn
+	relay   net.Conn
+}
+
+// NewUDPClient connects to the SOCKS5 server at proxyAddr without
+// authentication and asks it for a UDP association. A wildcard relay
+// address in the reply is reached at the host of proxyAddr.
+func NewUDPClient(proxyAddr string) (*UDPClient, error) {
+	control, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	relayAddr, err := associate(control)
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	if relayAddr.IP != nil && relayAddr.IP.IsUnspecified() {
+		host, _, err := net.SplitHostPort(proxyAddr)
+		if err != nil {
+			_ = control.Close()
+			return nil, err
+		}
+		relayAddr = hostAddress(host, relayAddr.Port)
+	}
+	relay, err := net.Dial("udp", relayAddr.Address())
+	if err != nil {
+		_ = control.Close()
+		return nil, err
+	}
+	return &UDPClient{
+		control: control,
+		relay:   relay,
+	}, nil
+}
+
+// associate negotiates no authentication on conn and sends a UDP ASSOCIATE
+// request, it returns the relay address of the reply
+func associate(conn net.Conn) (*address, error) {
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	var method [2]byte
+	if _, err := io.ReadFull(reader, method[:]); err != nil {
+		return nil, err
+	}
+	if method[1] != byte(noAuth) {
+		return nil, errNoSupportedAuth
+	}
+
+	// the client does not know the address it will send from
+	request := []byte{socks5Version, byte(AssociateCommand), 0}
+	buf := bytes.NewBuffer(request)
+	if err := writeAddr(buf, nil); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	var header [3]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	if code := reply(header[1]); code != successReply {
+		return nil, fmt.Errorf("udp associate failed: %v", code)
+	}
+	return readAddr(reader)
+}
+
+// WriteTo sends b to target, a host:port address, through the relay
+func (c *UDPClient) WriteTo(b []byte, target string) (int, error) {
+	var buf bytes.Buffer
+	// RSV and FRAG, fragments are not supported
+	buf.Write([]byte{0, 0, 0})
+	if err := writeAddrWithStr(&buf, target); err != nil {
+		return 0, err
+	}
+	buf.Write(b)
+	if _, err := c.relay.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ReadFrom reads the payload of the next datagram relayed back into b, it
+// returns the host:port address of the target which sent it
+func (c *UDPClient) ReadFrom(b []byte) (int, string, error) {
+	buf := make([]byte, len(b)+maxDatagramHeader)
+	n, err := c.relay.Read(buf)
+	if err != nil {
+		return 0, "", err
+	}
+	if n < 3 {
+		return 0, "", errShortDatagram
+	}
+	reader := bytes.NewReader(buf[3:n])
+	from, err := readAddr(reader)
+	if err != nil {
+		return 0, "", err
+	}
+	return copy(b, buf[n-reader.Len():n]), from.Address(), nil
+}
+
+// maxDatagramHeader is the size of the longest SOCKS5 UDP request header,
+// the one of a 255 bytes domain name
+const maxDatagramHeader = 3 + 1 + 1 + 255 + 2
+
+// SetReadDeadline sets the deadline of ReadFrom
+func (c *UDPClient) SetReadDeadline(t time.Time) error {
+	return c.relay.SetReadDeadline(t)
+}
+
+// RelayAddr returns the address of the relay of the server
+func (c *UDPClient) RelayAddr() net.Addr {
+	return c.relay.RemoteAddr()
+}
+
+// Close ends the association, closing the relay socket and the control
+// connection
+func (c *UDPClient) Close() error {
+	err := c.relay.Close()
+	if controlErr := c.control.Close(); err == nil {
+		err = controlErr
+	}
+	return err
+}
@@ -0,0 +1,37 @@
+package socks5
+
+import (
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestUDPClientRoundTrip(t *testing.T) {
+	first, second := udpEcho(t), udpEcho(t)
+	proxy := serve(t, NewServer(WithLogger(statute.DefaultLogger{})))
+	client := newUDPClient(t, proxy)
+
+	relay, ok := client.RelayAddr().(*net.UDPAddr)
+	if !ok || !relay.IP.IsLoopback() {
+		t.Fatalf("relay address %v, want a loopback UDP address", client.RelayAddr())
+	}
+
+	tests := []struct {
+		name    string
+		target  string
+		payload string
+	}{
+		{"first target", first, "hello"},
+		{"second target", second, "hello again"},
+		{"large payload", first, strings.Repeat("x", 8<<10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// roundTrip checks the reply comes from the target
+			if got := roundTrip(t, client, tt.payload, tt.target); got != tt.payload {
+				t.Fatalf("echoed %d bytes, want %d", len(got), len(tt.payload))
+			}
+		})
+	}
+}
@@ -1,26 +1,44 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
 	"io"
 	"math"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 var (
-	errStringTooLong        = errors.New("string too long")
-	errNoSupportedAuth      = errors.New("no supported authentication mechanism")
-	errUnrecognizedAddrType = errors.New("unrecognized address type")
+	errNoFirstPacket         = errors.New("no datagram received on the udp associate relay")
+	errStringTooLong         = errors.New("string too long")
+	errNoSupportedAuth       = errors.New("no supported authentication mechanism")
+	errNoAuthMethods         = errors.New("no authentication methods offered")
+	errUnrecognizedAddrType  = errors.New("unrecognized address type")
+	errEmptyFQDN             = errors.New("empty domain name")
+	errUDPByteLimit          = errors.New("udp associate byte limit reached")
+	errUDPPortRangeExhausted = errors.New("no free udp port in range")
+	errUserPassVersion       = errors.New("unsupported username/password auth version")
+	errAuthFailed            = errors.New("username/password authentication failed")
 )
 
 const (
 	maxUdpPacket = math.MaxUint16 - 28
+	// maxAssociateTargets bounds the destinations of a UDP ASSOCIATE session
+	maxAssociateTargets = 256
+	// defaultFirstPacketTimeout bounds the wait for the first datagram of a
+	// UDP ASSOCIATE session handed to a user handler when UDPIdleTimeout is
+	// not set
+	defaultFirstPacketTimeout = 30 * time.Second
 )
 
 const (
@@ -30,6 +48,10 @@ const (
 const (
 	ConnectCommand   Command = 0x01
 	AssociateCommand Command = 0x03
+	// ResolveCommand and ResolvePTRCommand are Tor extensions resolving a
+	// name or an address without opening a tunnel
+	ResolveCommand    Command = 0xf0
+	ResolvePTRCommand Command = 0xf1
 )
 
 // Command is a SOCKS Command.
@@ -41,11 +63,23 @@ func (cmd Command) String() string {
 		return "socks connect"
 	case AssociateCommand:
 		return "socks associate"
+	case ResolveCommand:
+		return "socks resolve"
+	case ResolvePTRCommand:
+		return "socks resolve ptr"
 	default:
 		return "socks " + strconv.Itoa(int(cmd))
 	}
 }
 
+// network returns the transport network of cmd
+func (cmd Command) network() string {
+	if cmd == AssociateCommand {
+		return "udp"
+	}
+	return "tcp"
+}
+
 const (
 	successReply         reply = 0x00
 	serverFailure        reply = 0x01
@@ -58,10 +92,33 @@ const (
 	addrTypeNotSupported reply = 0x08
 )
 
+// errToReply maps the error of a failed request to its reply code, a timed
+// out dial is reported as TTL expired and a request denied by the rules of
+// the server as not allowed by ruleset
 func errToReply(err error) reply {
 	if err == nil {
 		return successReply
 	}
+	switch {
+	case errors.Is(err, statute.ErrHandlerRequired), errors.Is(err, statute.ErrRequestDenied):
+		return ruleFailure
+	case errors.Is(err, errUDPPortRangeExhausted):
+		return serverFailure
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return connectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return networkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return hostUnreachable
+	case errors.Is(err, context.DeadlineExceeded):
+		return ttlExpired
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ttlExpired
+	}
+
+	// errors of user dial functions may only carry the message
 	msg := err.Error()
 	resp := hostUnreachable
 	if strings.Contains(msg, "refused") {
@@ -111,6 +168,9 @@ const (
 type address struct {
 	Name string // fully-qualified domain name
 	IP   net.IP
+	// Zone is the IPv6 scope of IP, such as the interface of a link-local
+	// address. SOCKS5 has no field for it so it is not sent or received.
+	Zone string
 	Port int
 }
 
@@ -128,22 +188,80 @@ func (a *address) String() string {
 func (a address) Address() string {
 	port := strconv.Itoa(a.Port)
 	if 0 != len(a.IP) {
-		return net.JoinHostPort(a.IP.String(), port)
+		host := a.IP.String()
+		if a.Zone != "" {
+			host += "%" + a.Zone
+		}
+		return net.JoinHostPort(host, port)
 	}
 	return net.JoinHostPort(a.Name, port)
 }
 
+// hostAddress returns the address of host and port, host is an IP, which
+// may carry an IPv6 zone, or a domain name
+func hostAddress(host string, port int) *address {
+	ipStr, zone, _ := strings.Cut(host, "%")
+	if ip := net.ParseIP(ipStr); ip != nil && (zone == "" || ip.To4() == nil) {
+		return &address{IP: ip, Zone: zone, Port: port}
+	}
+	return &address{Name: host, Port: port}
+}
+
 // authMethod is a SOCKS authentication method.
 type authMethod byte
 
 const (
 	noAuth       authMethod = 0x00 // no authentication required
+	gssapiAuth   authMethod = 0x01 // GSS-API, RFC 1961
+	userPassAuth authMethod = 0x02 // username/password, RFC 1929
 	noAcceptable authMethod = 0xff // no acceptable authentication methods
 )
 
+const (
+	// userPassVersion is the version of the RFC 1929 sub-negotiation
+	userPassVersion = 0x01
+	// userPassSuccess and userPassFailure are the RFC 1929 statuses, any
+	// non-zero status is a failure
+	userPassSuccess = 0x00
+	userPassFailure = 0x01
+)
+
+// bufferedConn is a net.Conn reading through a bufio.Reader, so the small
+// reads of the handshake don't each cost a system call
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+// NetConn returns the wrapped connection
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// statute.CloseWrite
+func (c *bufferedConn) CloseWrite() error {
+	return statute.CloseWrite(c.Conn)
+}
+
+// WriteTo writes the buffered bytes to w, then lets the wrapped connection
+// copy the rest, see statute.WriteTo
+func (c *bufferedConn) WriteTo(w io.Writer) (int64, error) {
+	return c.reader.WriteTo(w)
+}
+
+// ReadFrom lets the wrapped connection copy from r, see statute.ReadFrom
+func (c *bufferedConn) ReadFrom(r io.Reader) (int64, error) {
+	return statute.ReadFrom(c.Conn, r)
+}
+
 func readBytes(r io.Reader) ([]byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return nil, err
 	}
@@ -166,7 +284,7 @@ func writeBytes(w io.Writer, b []byte) error {
 
 func readByte(r io.Reader) (byte, error) {
 	var buf [1]byte
-	_, err := r.Read(buf[:])
+	_, err := io.ReadFull(r, buf[:])
 	if err != nil {
 		return 0, err
 	}
@@ -177,7 +295,7 @@ func readAddr(r io.Reader) (*address, error) {
 	address := &address{}
 
 	var addrType [1]byte
-	if _, err := r.Read(addrType[:]); err != nil {
+	if _, err := io.ReadFull(r, addrType[:]); err != nil {
 		return nil, err
 	}
 
@@ -195,10 +313,13 @@ func readAddr(r io.Reader) (*address, error) {
 		}
 		address.IP = addr
 	case fqdnAddress:
-		if _, err := r.Read(addrType[:]); err != nil {
+		if _, err := io.ReadFull(r, addrType[:]); err != nil {
 			return nil, err
 		}
 		addrLen := int(addrType[0])
+		if addrLen == 0 {
+			return nil, errEmptyFQDN
+		}
 		fqdn := make([]byte, addrLen)
 		if _, err := io.ReadFull(r, fqdn); err != nil {
 			return nil, err
@@ -215,6 +336,7 @@ func readAddr(r io.Reader) (*address, error) {
 	return address, nil
 }
 
+// writeAddr writes addr in the SOCKS5 encoding, which drops its Zone
 func writeAddr(w io.Writer, addr *address) error {
 	if addr == nil {
 		_, err := w.Write([]byte{ipv4Address, 0, 0, 0, 0, 0, 0})
@@ -277,10 +399,25 @@ func writeAddrWithStr(w io.Writer, addr string) error {
 	if err != nil {
 		return err
 	}
-	if ip := net.ParseIP(host); ip != nil {
-		return writeAddr(w, &address{IP: ip, Port: port})
+	return writeAddr(w, hostAddress(host, port))
+}
+
+// bindAddress converts a bound address reported by a handler, unparsable
+// addresses are sent as all zeros
+func bindAddress(addr net.Addr) *address {
+	switch a := addr.(type) {
+	case nil:
+		return nil
+	case *net.TCPAddr:
+		return &address{IP: a.IP, Zone: a.Zone, Port: a.Port}
+	case *net.UDPAddr:
+		return &address{IP: a.IP, Zone: a.Zone, Port: a.Port}
+	}
+	host, port, err := splitHostPort(addr.String())
+	if err != nil {
+		return nil
 	}
-	return writeAddr(w, &address{Name: host, Port: port})
+	return hostAddress(host, port)
 }
 
 func splitHostPort(address string) (string, int, error) {
@@ -313,6 +450,9 @@ type udpCustomConn struct {
 	firstRead    sync.Once
 	frc          chan bool
 	packetQueue  chan *readStruct
+	// done is closed by Close, it releases the packet reader and Read
+	done      chan struct{}
+	closeOnce sync.Once
 }
 
 func (cc *udpCustomConn) RemoteAddr() net.Addr {
@@ -325,10 +465,7 @@ func (cc *udpCustomConn) asyncReadPackets() {
 			tempBuf := make([]byte, maxUdpPacket)
 			n, addr, err := cc.ReadFrom(tempBuf)
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
+				cc.fail(err)
 				break
 			}
 			if cc.sourceAddr == nil {
@@ -336,20 +473,14 @@ func (cc *udpCustomConn) asyncReadPackets() {
 			}
 			packetData := tempBuf[:n]
 			if len(packetData) < 3 {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
+				cc.fail(err)
 				break
 			}
 			reader := bytes.NewBuffer(packetData[3:])
 			targetAddr, err := readAddr(reader)
 
 			if err != nil {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  err,
-				}
+				cc.fail(err)
 				break
 			}
 			if cc.targetAddr == nil {
@@ -359,27 +490,77 @@ func (cc *udpCustomConn) asyncReadPackets() {
 				}
 			}
 			if targetAddr.String() != cc.targetAddr.String() {
-				cc.packetQueue <- &readStruct{
-					data: nil,
-					err:  fmt.Errorf("ignore non-target addresses %s", targetAddr.String()),
-				}
+				cc.fail(fmt.Errorf("ignore non-target addresses %s", targetAddr.String()))
 				break
 			}
 			cc.firstRead.Do(func() {
 				// ok we have source and destination address now user can handle new ProxyReq
 				cc.frc <- true
 			})
-			cc.packetQueue <- &readStruct{
+			select {
+			case cc.packetQueue <- &readStruct{
 				data: reader.Bytes(),
 				err:  nil,
+			}:
+			case <-cc.done:
+				return
 			}
 		}
 	}()
 }
 
+// fail ends the packet reader with err, before the first packet it closes frc
+// instead since no one reads the queue yet. It gives up once the connection
+// is closed, no Read may be waiting then.
+func (cc *udpCustomConn) fail(err error) {
+	first := false
+	cc.firstRead.Do(func() {
+		first = true
+		close(cc.frc)
+	})
+	if first {
+		return
+	}
+	select {
+	case cc.packetQueue <- &readStruct{
+		data: nil,
+		err:  err,
+	}:
+	case <-cc.done:
+	}
+}
+
+// waitFirstPacket waits until the first packet made the source and target
+// known, it fails if the reader failed, ctx is done or timeout elapsed
+func (cc *udpCustomConn) waitFirstPacket(ctx context.Context, timeout time.Duration) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case _, ok := <-cc.frc:
+		if !ok {
+			return errNoFirstPacket
+		}
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return errNoFirstPacket
+	}
+}
+
 func (cc *udpCustomConn) Read(b []byte) (int, error) {
-	// wait for packet data
-	read := <-cc.packetQueue
+	// wait for packet data, a closed connection has none
+	select {
+	case <-cc.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	var read *readStruct
+	select {
+	case read = <-cc.packetQueue:
+	case <-cc.done:
+		return 0, net.ErrClosed
+	}
 	if read.err != nil {
 		return 0, read.err
 	}
@@ -403,10 +584,14 @@ func (cc *udpCustomConn) Write(b []byte) (int, error) {
 	return len(b), err
 }
 
+// Close closes the relay socket and the control connection
 func (cc *udpCustomConn) Close() error {
 	cc.lock.Lock()
 	defer cc.lock.Unlock()
-	udpErr := cc.Close()
+	cc.closeOnce.Do(func() {
+		close(cc.done)
+	})
+	udpErr := cc.PacketConn.Close()
 	tcpErr := cc.assocTCPConn.Close()
 	if udpErr != nil {
 		return udpErr
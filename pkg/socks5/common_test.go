@@ -0,0 +1,254 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// datagram encapsulates payload to target in a SOCKS5 UDP request header
+func datagram(t testing.TB, target string, payload []byte) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer([]byte{0, 0, 0})
+	if err := writeAddrWithStr(buf, target); err != nil {
+		t.Fatal(err)
+	}
+	buf.Write(payload)
+	return buf.Bytes()
+}
+
+// within fails the test when f does not return within five seconds
+func within(t testing.TB, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s blocked", what)
+	}
+}
+
+func TestUDPCustomConnClose(t *testing.T) {
+	relay, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	control, peer := net.Pipe()
+	defer peer.Close()
+	cc := &udpCustomConn{
+		PacketConn:   relay,
+		assocTCPConn: control,
+		frc:          make(chan bool, 1),
+		packetQueue:  make(chan *readStruct),
+		done:         make(chan struct{}),
+	}
+	cc.asyncReadPackets()
+
+	client, err := net.Dial("udp", relay.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// the second datagram leaves the packet reader blocked on the queue,
+	// nothing reads it
+	for i := 0; i < 2; i++ {
+		if _, err := client.Write(datagram(t, "127.0.0.1:53", []byte("ping"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := cc.waitFirstPacket(context.Background(), 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	within(t, "Close", func() {
+		if err := cc.Close(); err != nil {
+			t.Errorf("Close() = %v", err)
+		}
+	})
+	within(t, "fail after Close", func() {
+		cc.fail(errors.New("late failure"))
+	})
+	within(t, "Read after Close", func() {
+		if _, err := cc.Read(make([]byte, 64)); !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Read() after Close = %v, want %v", err, net.ErrClosed)
+		}
+	})
+}
+
+func FuzzReadAddr(f *testing.F) {
+	f.Add([]byte{ipv4Address, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{ipv6Address, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 187})
+	f.Add([]byte{fqdnAddress, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 53})
+	f.Add([]byte{fqdnAddress, 0, 0, 53})
+	f.Add([]byte{fqdnAddress, 200, 'a'})
+	f.Add([]byte{ipv4Address, 127, 0})
+	f.Add([]byte{0x7f})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		addr, err := readAddr(bytes.NewReader(data))
+		if err != nil {
+			if addr != nil {
+				t.Fatalf("readAddr() = %+v with error %v", addr, err)
+			}
+			return
+		}
+		if addr.Port < 0 || addr.Port > 65535 {
+			t.Fatalf("port %d out of range", addr.Port)
+		}
+		switch {
+		case addr.IP != nil:
+			if (len(addr.IP) != net.IPv4len && len(addr.IP) != net.IPv6len) || addr.Name != "" {
+				t.Fatalf("malformed address %+v", addr)
+			}
+		case addr.Name == "" || len(addr.Name) > 255:
+			t.Fatalf("malformed domain name %q", addr.Name)
+		}
+
+		// a parsed address encodes back to one parsing the same
+		var buf bytes.Buffer
+		if err := writeAddr(&buf, addr); err != nil {
+			t.Fatalf("writeAddr(%+v) = %v", addr, err)
+		}
+		again, err := readAddr(&buf)
+		if err != nil {
+			t.Fatalf("readAddr(writeAddr(%+v)) = %v", addr, err)
+		}
+		if !again.IP.Equal(addr.IP) || again.Name != addr.Name || again.Port != addr.Port {
+			t.Fatalf("round trip of %+v gave %+v", addr, again)
+		}
+	})
+}
+
+// trickle writes data to conn one byte every interval, it stops at the first
+// failed write
+func trickle(conn net.Conn, data []byte, interval time.Duration) {
+	for _, b := range data {
+		time.Sleep(interval)
+		if _, err := conn.Write([]byte{b}); err != nil {
+			return
+		}
+	}
+}
+
+func TestReadersHonourDeadline(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		read func(r io.Reader) error
+	}{
+		{"readAddr", []byte{fqdnAddress, 11, 'e', 'x', 'a', 'm', 'p', 'l', 'e', '.', 'c', 'o', 'm', 0, 80}, func(r io.Reader) error {
+			_, err := readAddr(r)
+			return err
+		}},
+		{"readBytes", []byte{8, 'u', 's', 'e', 'r', 'n', 'a', 'm', 'e'}, func(r io.Reader) error {
+			_, err := readBytes(r)
+			return err
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			// one byte every 50ms delivers the field well past the deadline
+			go trickle(client, tt.data, 50*time.Millisecond)
+
+			start := time.Now()
+			_ = server.SetReadDeadline(start.Add(200 * time.Millisecond))
+			within(t, tt.name, func() {
+				if err := tt.read(server); !errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Errorf("%s() = %v, want %v", tt.name, err, os.ErrDeadlineExceeded)
+				}
+			})
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Fatalf("%s returned after %v, want about the 200ms deadline", tt.name, elapsed)
+			}
+		})
+	}
+}
+
+// timeoutError is a net.Error which timed out, such as the error of a dial
+// of a user dial function
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrToReply(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want reply
+	}{
+		{"success", nil, successReply},
+		{"handler required", statute.ErrHandlerRequired, ruleFailure},
+		{"request denied", fmt.Errorf("port 25: %w", statute.ErrRequestDenied), ruleFailure},
+		{"port range exhausted", errUDPPortRangeExhausted, serverFailure},
+		{"refused", &net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, connectionRefused},
+		{"network unreachable", &net.OpError{Op: "dial", Err: syscall.ENETUNREACH}, networkUnreachable},
+		{"host unreachable", &net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, hostUnreachable},
+		{"context deadline", fmt.Errorf("dial: %w", context.DeadlineExceeded), ttlExpired},
+		{"timeout", timeoutError{}, ttlExpired},
+		{"refused message", errors.New("upstream refused the connection"), connectionRefused},
+		{"unreachable message", errors.New("network is unreachable"), networkUnreachable},
+		{"other", errors.New("no such host"), hostUnreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errToReply(tt.err); got != tt.want {
+				t.Fatalf("errToReply(%v) = %v (%#x), want %v (%#x)", tt.err, got, byte(got), tt.want, byte(tt.want))
+			}
+		})
+	}
+}
+
+func TestAddressZone(t *testing.T) {
+	linkLocal := net.ParseIP("fe80::1")
+	addr := hostAddress("fe80::1%eth0", 53)
+	if !addr.IP.Equal(linkLocal) || addr.Zone != "eth0" || addr.Name != "" {
+		t.Fatalf("hostAddress() = %+v, want fe80::1 with zone eth0", addr)
+	}
+	if got := addr.Address(); got != "[fe80::1%eth0]:53" {
+		t.Fatalf("Address() = %q, want %q", got, "[fe80::1%eth0]:53")
+	}
+	// the zone survives the conversions of the relay address
+	for _, netAddr := range []net.Addr{
+		&net.UDPAddr{IP: linkLocal, Zone: "eth0", Port: 53},
+		&net.TCPAddr{IP: linkLocal, Zone: "eth0", Port: 53},
+	} {
+		if got := bindAddress(netAddr).Address(); got != "[fe80::1%eth0]:53" {
+			t.Fatalf("bindAddress(%v) = %q, want the zone kept", netAddr, got)
+		}
+	}
+
+	// the SOCKS5 encoding has no field for the zone
+	var buf bytes.Buffer
+	if err := writeAddr(&buf, addr); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readAddr(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !read.IP.Equal(linkLocal) || read.Port != 53 || read.Zone != "" {
+		t.Fatalf("readAddr() = %+v, want fe80::1 port 53 without a zone", read)
+	}
+
+	// IPv4 addresses have no zone, such a host is a name
+	if got := hostAddress("192.0.2.1%eth0", 53); got.IP != nil || got.Name != "192.0.2.1%eth0" {
+		t.Fatalf("hostAddress() = %+v, want a name", got)
+	}
+}
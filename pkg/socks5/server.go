@@ -1,12 +1,22 @@
 package socks5
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/bepass-org/proxy/pkg/statute"
 	"io"
+	"math/rand"
 	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 // Server is accepting connections and handling the details of the SOCKS5 protocol
@@ -16,37 +26,173 @@ type Server struct {
 	// ProxyDial specifies the optional proxyDial function for
 	// establishing the transport connection.
 	ProxyDial statute.ProxyDialFunc
+	// DialLocalAddr is the local address of the default ProxyDial, it is
+	// ignored when ProxyDial is set
+	DialLocalAddr *net.TCPAddr
+	// PacketLocalAddr is the local address of the default ProxyPacketDial,
+	// only its IP is used, see statute.LocalAddrProxyPacketDial. It is
+	// ignored when ProxyPacketDial is set.
+	PacketLocalAddr *net.UDPAddr
 	// ProxyListenPacket specifies the optional proxyListenPacket function for
 	// establishing the transport connection.
 	ProxyListenPacket statute.ProxyListenPacket
-	// PacketForwardAddress specifies the packet forwarding address
+	// ProxyPacketDial specifies the optional function creating the
+	// target-facing socket of the UDP ASSOCIATE relay.
+	ProxyPacketDial statute.ProxyPacketDialFunc
+	// PacketForwardAddress specifies the packet forwarding address sent in
+	// the UDP ASSOCIATE reply, defaults to the local address of the relay
 	PacketForwardAddress statute.PacketForwardAddress
+	// PacketForwardHost takes precedence over PacketForwardAddress and can
+	// report a domain name as the relay endpoint
+	PacketForwardHost statute.PacketForwardHost
 	// UserConnectHandle gives the user control to handle the TCP CONNECT requests
 	UserConnectHandle statute.UserConnectHandler
+	// Router selects the handler of TCP CONNECT requests by destination
+	Router *statute.Router
 	// UserAssociateHandle gives the user control to handle the UDP ASSOCIATE requests
 	UserAssociateHandle statute.UserAssociateHandler
-	// Logger error log
+	// Logger error log, WithLogger serializes it with a statute.SyncLogger,
+	// assign the field directly to opt out
 	Logger statute.Logger
 	// Context is default context
 	Context context.Context
-	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer
+	// BytesPool getting and returning temporary bytes for use by io.CopyBuffer,
+	// statute.DefaultBytesPool is used when it is nil
 	BytesPool statute.BytesPool
+	// MaxUDPPacketSize is the largest datagram relayed by UDP ASSOCIATE,
+	// larger datagrams are dropped
+	MaxUDPPacketSize int
+	// UDPByteLimit caps the bytes relayed by a UDP ASSOCIATE session in both
+	// directions, zero means no limit
+	UDPByteLimit int64
+	// UDPIdleTimeout ends a UDP ASSOCIATE session when the client sends
+	// nothing for this long, zero means no timeout
+	UDPIdleTimeout time.Duration
+	// UDPPortMin and UDPPortMax restrict the port of the UDP ASSOCIATE relay
+	// socket to a range, such as one opened in a firewall, ports in use are
+	// skipped. Zero uses an ephemeral port.
+	UDPPortMin int
+	UDPPortMax int
+	// UDPLooseSourceCheck relays the datagrams of any port of the client IP
+	// that sent the first datagram instead of that exact address, this helps
+	// clients whose source port changes but lets other processes on the
+	// client host, or behind the same NAT, use the association
+	UDPLooseSourceCheck bool
+	// LenientParsing is an interoperability aid for broken clients. It only
+	// tolerates a wrong version byte in the command header once the greeting
+	// had a valid one, the anomaly is logged. Everything else is parsed as
+	// strictly as without it.
+	LenientParsing bool
+	// Resolver is used by the RESOLVE and RESOLVE_PTR extensions
+	Resolver *net.Resolver
+	// TorResolveExtensions enables the non-standard RESOLVE and RESOLVE_PTR
+	// commands
+	TorResolveExtensions bool
+	// DisableUDP rejects UDP ASSOCIATE requests with a command not supported
+	// reply, no UDP socket is ever opened
+	DisableUDP bool
+	// UDPSink makes the embedded UDP ASSOCIATE handler validate and count
+	// the datagrams of clients without relaying them, for probing and
+	// testing clients, see DiscardedDatagrams
+	UDPSink bool
+	// DestinationRewriter rewrites the destination of TCP CONNECT requests
+	DestinationRewriter statute.DestinationRewriter
+	// PreConnect runs after DestinationRewriter for CONNECT requests, in both
+	// the embedded and the handler paths, and may change or reject the
+	// destination. A rejection is answered with the reply its error maps to,
+	// see statute.ErrRequestDenied.
+	PreConnect statute.PreConnectFunc
+	// ACL denies requests to destinations it does not allow
+	ACL statute.ACL
+	// Middleware wraps the connect handler, the user handler or, when there
+	// is none, the embedded one. Changes it makes to the request are not
+	// seen by the embedded handler.
+	Middleware statute.Middleware
+	// AllowedPorts and DeniedPorts restrict the destination ports of TCP
+	// requests before the ACL is consulted, see statute.PortAllowed. Empty
+	// lists allow every port.
+	AllowedPorts []int
+	DeniedPorts  []int
+	// AccessLog writes a record for every served connection
+	AccessLog *statute.AccessLog
+	// RequireHandler denies requests without a user handler instead of
+	// falling back to the embedded direct dial
+	RequireHandler bool
+	// DeferConnectReply leaves the CONNECT reply to user handlers so they
+	// can report the real bound address, see statute.ProxyRequest.Reply
+	DeferConnectReply bool
+	// CloseOnHandlerError closes the client connection when the connect
+	// handler returns an error, after the failure reply if the reply was
+	// deferred and the handler did not reply. Otherwise closing it is left
+	// to the handler and the caller of ServeConn.
+	CloseOnHandlerError bool
+	// ErrorHandler observes the errors serving connections, they are logged
+	// when it is nil
+	ErrorHandler statute.ErrorHandler
+	// Authenticator requires RFC 1929 username/password authentication with
+	// credentials it accepts, clients not offering it are rejected. It is
+	// ignored when AuthMethods is set.
+	Authenticator statute.UserPassAuthenticator
+	// CredentialChecker is like Authenticator but can fail to check the
+	// credentials, such as when its backing store is down, which rejects
+	// them. Authenticator takes precedence.
+	CredentialChecker statute.CredentialChecker
+	// AuthFailureDelay delays the reply to rejected credentials of
+	// Authenticator and CredentialChecker to slow down brute-forcing, zero
+	// means no delay
+	AuthFailureDelay time.Duration
+	// AuthMethods are the authentication methods offered in preference
+	// order, the first one the client also offers is selected
+	AuthMethods []AuthMethod
+	// VerboseDestinations logs the destinations dialed by the embedded
+	// handlers and the outcome at debug level
+	VerboseDestinations bool
+	// HandshakeTimeout bounds the time to read the handshake and request of
+	// a client, including authentication, zero means no limit
+	HandshakeTimeout time.Duration
+	// ReplyTimeout bounds the time to write a reply to a client, so one not
+	// reading can't block the server, zero means no limit. NewServer sets
+	// it to statute.DefaultReplyTimeout.
+	ReplyTimeout time.Duration
+	// MaxConnectionLifetime ends connections this long after they were
+	// accepted with statute.ErrMaxLifetime, zero means no limit
+	MaxConnectionLifetime time.Duration
+	// ConnectionByteLimit ends tunnels once they relayed this many bytes in
+	// both directions together with statute.ErrByteLimitExceeded, zero
+	// means no limit
+	ConnectionByteLimit int64
+	// TCPKeepAliveInterval enables TCP keepalive probes at this interval on
+	// both ends of CONNECT tunnels relayed by the embedded handlers, so idle
+	// tunnels survive NAT and firewalls. Zero leaves the sockets unchanged.
+	TCPKeepAliveInterval time.Duration
+	// discarded counts the datagrams consumed in UDPSink mode
+	discarded atomic.Uint64
 }
 
 func NewServer(options ...ServerOption) *Server {
 	s := &Server{
 		Bind:                 statute.DefaultBindAddress,
-		ProxyDial:            statute.DefaultProxyDial(),
 		ProxyListenPacket:    statute.DefaultProxyListenPacket(),
+		MaxUDPPacketSize:     maxUdpPacket,
+		Resolver:             net.DefaultResolver,
 		PacketForwardAddress: defaultReplyPacketForwardAddress,
-		Logger:               statute.DefaultLogger{},
+		Logger:               statute.NewSyncLogger(statute.DefaultLogger{}),
 		Context:              statute.DefaultContext(),
+		ReplyTimeout:         statute.DefaultReplyTimeout,
 	}
 
 	for _, option := range options {
 		option(s)
 	}
 
+	// the local addresses only apply to the default dial functions
+	if s.ProxyDial == nil {
+		s.ProxyDial = statute.LocalAddrProxyDial(s.DialLocalAddr)
+	}
+	if s.ProxyPacketDial == nil {
+		s.ProxyPacketDial = statute.LocalAddrProxyPacketDial(s.PacketLocalAddr)
+	}
+
 	return s
 }
 
@@ -78,7 +224,9 @@ func (s *Server) ListenAndServe() error {
 		default:
 			conn, err := ln.Accept()
 			if err != nil {
-				s.Logger.Error(err)
+				if !statute.IsBenignCloseError(err) {
+					s.Logger.Error(err)
+				}
 				continue
 			}
 
@@ -86,7 +234,7 @@ func (s *Server) ListenAndServe() error {
 			// This way, the server can handle multiple connections concurrently
 			go func() {
 				err := s.ServeConn(conn)
-				if err != nil {
+				if err != nil && s.ErrorHandler == nil && !statute.IsBenignCloseError(err) {
 					s.Logger.Error(err) // Log errors from ServeConn
 				}
 			}()
@@ -96,7 +244,7 @@ func (s *Server) ListenAndServe() error {
 
 func WithLogger(logger statute.Logger) ServerOption {
 	return func(s *Server) {
-		s.Logger = logger
+		s.Logger = statute.NewSyncLogger(logger)
 	}
 }
 
@@ -118,24 +266,268 @@ func WithAssociateHandle(handler statute.UserAssociateHandler) ServerOption {
 	}
 }
 
+func WithRouter(router *statute.Router) ServerOption {
+	return func(s *Server) {
+		s.Router = router
+	}
+}
+
 func WithProxyDial(proxyDial statute.ProxyDialFunc) ServerOption {
 	return func(s *Server) {
 		s.ProxyDial = proxyDial
 	}
 }
 
+// WithTCPKeepAliveProbes sets Server.TCPKeepAliveInterval
+func WithTCPKeepAliveProbes(interval time.Duration) ServerOption {
+	return func(s *Server) {
+		s.TCPKeepAliveInterval = interval
+	}
+}
+
+func WithConnectionByteLimit(n int64) ServerOption {
+	return func(s *Server) {
+		s.ConnectionByteLimit = n
+	}
+}
+
+// WithReplyTimeout sets Server.ReplyTimeout. Without it the timeout is
+// statute.DefaultReplyTimeout, a reply the client doesn't read within it
+// fails with statute.ErrReplyTimeout. Zero disables the timeout, writes then
+// block for as long as the client doesn't read.
+func WithReplyTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.ReplyTimeout = timeout
+	}
+}
+
+func WithHandshakeTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.HandshakeTimeout = timeout
+	}
+}
+
+func WithMaxConnectionLifetime(lifetime time.Duration) ServerOption {
+	return func(s *Server) {
+		s.MaxConnectionLifetime = lifetime
+	}
+}
+
+func WithVerboseDestinations(verbose bool) ServerOption {
+	return func(s *Server) {
+		s.VerboseDestinations = verbose
+	}
+}
+
+func WithAuthenticator(authenticator statute.UserPassAuthenticator) ServerOption {
+	return func(s *Server) {
+		s.Authenticator = authenticator
+	}
+}
+
+// WithCredentialChecker requires RFC 1929 username/password authentication
+// with credentials checked by checker, which gets the connection context
+func WithCredentialChecker(checker statute.CredentialChecker) ServerOption {
+	return func(s *Server) {
+		s.CredentialChecker = checker
+	}
+}
+
+// WithAuthFailureDelay sets Server.AuthFailureDelay
+func WithAuthFailureDelay(delay time.Duration) ServerOption {
+	return func(s *Server) {
+		s.AuthFailureDelay = delay
+	}
+}
+
+// WithAuthMethods sets the authentication methods in preference order, for
+// example UserPassAuth followed by NoAuth accepts credentials from clients
+// offering them and anonymous clients otherwise
+func WithAuthMethods(methods ...AuthMethod) ServerOption {
+	return func(s *Server) {
+		s.AuthMethods = methods
+	}
+}
+
+func WithErrorHandler(errorHandler statute.ErrorHandler) ServerOption {
+	return func(s *Server) {
+		s.ErrorHandler = errorHandler
+	}
+}
+
+func WithDeferConnectReply() ServerOption {
+	return func(s *Server) {
+		s.DeferConnectReply = true
+	}
+}
+
+func WithCloseOnHandlerError() ServerOption {
+	return func(s *Server) {
+		s.CloseOnHandlerError = true
+	}
+}
+
+func WithDialLocalAddr(addr *net.TCPAddr) ServerOption {
+	return func(s *Server) {
+		s.DialLocalAddr = addr
+	}
+}
+
+func WithPacketLocalAddr(addr *net.UDPAddr) ServerOption {
+	return func(s *Server) {
+		s.PacketLocalAddr = addr
+	}
+}
+
 func WithProxyListenPacket(proxyListenPacket statute.ProxyListenPacket) ServerOption {
 	return func(s *Server) {
 		s.ProxyListenPacket = proxyListenPacket
 	}
 }
 
+func WithProxyPacketDial(proxyPacketDial statute.ProxyPacketDialFunc) ServerOption {
+	return func(s *Server) {
+		s.ProxyPacketDial = proxyPacketDial
+	}
+}
+
+// WithPacketForwardAddress sets the function reporting the relay endpoint
+// sent to clients in the UDP ASSOCIATE reply
 func WithPacketForwardAddress(packetForwardAddress statute.PacketForwardAddress) ServerOption {
 	return func(s *Server) {
 		s.PacketForwardAddress = packetForwardAddress
 	}
 }
 
+// WithPacketForwardHost sets the function reporting the relay endpoint, which
+// may be a domain name, sent to clients in the UDP ASSOCIATE reply
+func WithPacketForwardHost(packetForwardHost statute.PacketForwardHost) ServerOption {
+	return func(s *Server) {
+		s.PacketForwardHost = packetForwardHost
+	}
+}
+
+func WithMaxUDPPacketSize(n int) ServerOption {
+	return func(s *Server) {
+		s.MaxUDPPacketSize = n
+	}
+}
+
+func WithUDPByteLimit(n int64) ServerOption {
+	return func(s *Server) {
+		s.UDPByteLimit = n
+	}
+}
+
+func WithUDPIdleTimeout(timeout time.Duration) ServerOption {
+	return func(s *Server) {
+		s.UDPIdleTimeout = timeout
+	}
+}
+
+// WithUDPPortRange binds the UDP ASSOCIATE relay sockets to a free port
+// between min and max inclusive, associations fail once every port of the
+// range is taken
+func WithUDPPortRange(min, max int) ServerOption {
+	return func(s *Server) {
+		s.UDPPortMin = min
+		s.UDPPortMax = max
+	}
+}
+
+func WithUDPLooseSourceCheck(loose bool) ServerOption {
+	return func(s *Server) {
+		s.UDPLooseSourceCheck = loose
+	}
+}
+
+func WithLenientParsing(lenient bool) ServerOption {
+	return func(s *Server) {
+		s.LenientParsing = lenient
+	}
+}
+
+func WithResolver(resolver *net.Resolver) ServerOption {
+	return func(s *Server) {
+		s.Resolver = resolver
+	}
+}
+
+func WithDisableUDP() ServerOption {
+	return func(s *Server) {
+		s.DisableUDP = true
+	}
+}
+
+// WithUDPSink sets Server.UDPSink
+func WithUDPSink() ServerOption {
+	return func(s *Server) {
+		s.UDPSink = true
+	}
+}
+
+// DiscardedDatagrams returns the number of datagrams consumed without being
+// relayed in UDPSink mode
+func (s *Server) DiscardedDatagrams() uint64 {
+	return s.discarded.Load()
+}
+
+func WithTorResolveExtensions() ServerOption {
+	return func(s *Server) {
+		s.TorResolveExtensions = true
+	}
+}
+
+func WithPreConnect(preConnect statute.PreConnectFunc) ServerOption {
+	return func(s *Server) {
+		s.PreConnect = preConnect
+	}
+}
+
+func WithDestinationRewriter(rewriter statute.DestinationRewriter) ServerOption {
+	return func(s *Server) {
+		s.DestinationRewriter = rewriter
+	}
+}
+
+func WithAllowedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.AllowedPorts = ports
+	}
+}
+
+func WithDeniedPorts(ports []int) ServerOption {
+	return func(s *Server) {
+		s.DeniedPorts = ports
+	}
+}
+
+// WithMiddleware wraps the connect handler with middlewares, the first one
+// is the outermost, see statute.Chain
+func WithMiddleware(middlewares ...statute.Middleware) ServerOption {
+	return func(s *Server) {
+		s.Middleware = statute.Chain(middlewares...)
+	}
+}
+
+func WithACL(acl statute.ACL) ServerOption {
+	return func(s *Server) {
+		s.ACL = acl
+	}
+}
+
+func WithAccessLog(accessLog *statute.AccessLog) ServerOption {
+	return func(s *Server) {
+		s.AccessLog = accessLog
+	}
+}
+
+func WithRequireHandler() ServerOption {
+	return func(s *Server) {
+		s.RequireHandler = true
+	}
+}
+
 func WithContext(ctx context.Context) ServerOption {
 	return func(s *Server) {
 		s.Context = ctx
@@ -149,6 +541,47 @@ func WithBytesPool(bytesPool statute.BytesPool) ServerOption {
 }
 
 func (s *Server) ServeConn(conn net.Conn) error {
+	return s.ServeConnContext(s.Context, conn)
+}
+
+// ServeConnContext serves conn using ctx as the context of the connection
+func (s *Server) ServeConnContext(ctx context.Context, conn net.Conn) (err error) {
+	defer func() {
+		statute.ReportError(ctx, s.ErrorHandler, "socks5", conn, err)
+		statute.TraceClose(ctx, err)
+	}()
+	defer statute.RecoverPanic(statute.ConnLogger(ctx, s.Logger), conn, &err)
+
+	ctx, cancel := statute.WithMaxLifetime(ctx, s.MaxConnectionLifetime)
+	defer cancel()
+	// unblock the handlers using conn once ctx is done, such as on shutdown
+	defer statute.CloseOnDone(ctx, conn)()
+
+	if s.AccessLog != nil {
+		accessConn := statute.NewAccessConn(conn, "socks5")
+		conn = accessConn
+		defer func() {
+			_ = s.AccessLog.Log(accessConn)
+		}()
+	}
+
+	// parse the handshake from buffered reads, the buffered bytes beyond it
+	// are read through the same reader later on
+	conn = &bufferedConn{
+		Conn:   conn,
+		reader: bufio.NewReader(conn),
+	}
+
+	statute.TraceHandshakeStart(ctx)
+	clearDeadline := statute.HandshakeDeadline(conn, s.HandshakeTimeout)
+	handshaken := false
+	defer func() {
+		// a failed or timed out handshake leaves conn unusable
+		if !handshaken {
+			_ = conn.Close()
+		}
+	}()
+
 	version, err := readByte(conn)
 	if err != nil {
 		return err
@@ -160,6 +593,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	req := &request{
 		Version: socks5Version,
 		Conn:    conn,
+		ctx:     ctx,
 	}
 
 	methods, err := readBytes(conn)
@@ -167,17 +601,31 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 
-	if bytes.IndexByte(methods, byte(noAuth)) != -1 {
-		_, err := conn.Write([]byte{socks5Version, byte(noAuth)})
+	if len(methods) == 0 {
+		err := s.writeReply(conn, []byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
 			return err
 		}
-	} else {
-		_, err := conn.Write([]byte{socks5Version, byte(noAcceptable)})
+		return statute.WithPhase(statute.PhaseAuth, "", errNoAuthMethods)
+	}
+
+	method := s.selectAuthMethod(ctx, methods)
+	if method == nil {
+		err := s.writeReply(conn, []byte{socks5Version, byte(noAcceptable)})
 		if err != nil {
 			return err
 		}
-		return errNoSupportedAuth
+		return statute.WithPhase(statute.PhaseAuth, "", errNoSupportedAuth)
+	}
+	err = s.writeReply(conn, []byte{socks5Version, method.Code()})
+	if err != nil {
+		return err
+	}
+	req.Username, err = method.Authenticate(ctx, replyConn{Conn: conn, timeout: s.ReplyTimeout})
+	statute.RecordAccessAuth(conn, authMethodName(method.Code()), req.Username, err == nil)
+	statute.TraceAuthDone(ctx, authMethodName(method.Code()), req.Username, err == nil)
+	if err != nil {
+		return statute.WithPhase(statute.PhaseAuth, "", err)
 	}
 
 	var header [3]byte
@@ -187,7 +635,10 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	}
 
 	if header[0] != socks5Version {
-		return fmt.Errorf("unsupported Command version: %d", header[0])
+		if !s.LenientParsing {
+			return fmt.Errorf("unsupported Command version: %d", header[0])
+		}
+		statute.ConnLogger(ctx, s.Logger).Debug(fmt.Sprintf("lenient parsing: ignoring command version %d", header[0]))
 	}
 
 	req.Command = Command(header[1])
@@ -195,7 +646,7 @@ func (s *Server) ServeConn(conn net.Conn) error {
 	dest, err := readAddr(conn)
 	if err != nil {
 		if err == errUnrecognizedAddrType {
-			err := sendReply(conn, addrTypeNotSupported, nil)
+			err := s.sendReply(conn, addrTypeNotSupported, nil)
 			if err != nil {
 				return err
 			}
@@ -203,6 +654,8 @@ func (s *Server) ServeConn(conn net.Conn) error {
 		return err
 	}
 	req.DestinationAddr = dest
+	clearDeadline()
+	handshaken = true
 	err = s.handle(req)
 	if err != nil {
 		return err
@@ -212,27 +665,115 @@ func (s *Server) ServeConn(conn net.Conn) error {
 }
 
 func (s *Server) handle(req *request) error {
+	if req.Command == ConnectCommand {
+		if err := s.rewriteDestination(req); err != nil {
+			defer func() {
+				_ = req.Conn.Close()
+			}()
+			if err := s.sendReply(req.Conn, ruleFailure, nil); err != nil {
+				return err
+			}
+			return fmt.Errorf("rewrite destination %v failed: %w", req.DestinationAddr, err)
+		}
+		if err := s.preConnect(req); err != nil {
+			defer func() {
+				_ = req.Conn.Close()
+			}()
+			if err := s.sendReply(req.Conn, errToReply(err), nil); err != nil {
+				return err
+			}
+			return fmt.Errorf("pre-connect of %v rejected: %w", req.DestinationAddr, err)
+		}
+	}
+
+	// the address of an ASSOCIATE request is the expected source of the
+	// client, often 0.0.0.0:0, the ACL is applied to each datagram instead
+	if req.Command == ConnectCommand && !s.allowed(req.ctx, req.Command.network(), req.DestinationAddr) {
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, ruleFailure, nil); err != nil {
+			return err
+		}
+		return fmt.Errorf("%v to %v denied by ACL", req.Command, req.DestinationAddr)
+	}
+
 	switch req.Command {
 	case ConnectCommand:
+		statute.RecordAccessRequest(req.Conn, "CONNECT", req.DestinationAddr.String(), req.Username)
 		return s.handleConnect(req)
 	case AssociateCommand:
+		if s.DisableUDP {
+			break
+		}
+		statute.RecordAccessRequest(req.Conn, "ASSOCIATE", req.DestinationAddr.String(), req.Username)
 		return s.handleAssociate(req)
-	default:
-		if err := sendReply(req.Conn, commandNotSupported, nil); err != nil {
-			return err
+	case ResolveCommand, ResolvePTRCommand:
+		if !s.TorResolveExtensions {
+			break
 		}
-		return fmt.Errorf("unsupported Command: %v", req.Command)
+		statute.RecordAccessRequest(req.Conn, "RESOLVE", req.DestinationAddr.String(), req.Username)
+		return s.handleResolve(req)
+	}
+
+	statute.RecordAccessRequest(req.Conn, req.Command.String(), req.DestinationAddr.String(), req.Username)
+	if err := s.sendReply(req.Conn, commandNotSupported, nil); err != nil {
+		return err
 	}
+	return fmt.Errorf("unsupported Command: %v", req.Command)
+}
+
+// handleResolve answers the RESOLVE and RESOLVE_PTR Tor extensions, the
+// result is sent in the BND fields of the reply and the connection is closed
+func (s *Server) handleResolve(req *request) error {
+	defer func() {
+		_ = req.Conn.Close()
+	}()
+
+	var (
+		bind address
+		err  error
+	)
+	if req.Command == ResolveCommand {
+		bind.IP = req.DestinationAddr.IP
+		if req.DestinationAddr.Name != "" {
+			var ips []net.IP
+			ips, err = s.Resolver.LookupIP(req.ctx, "ip", req.DestinationAddr.Name)
+			if err == nil {
+				bind.IP = ips[0]
+			}
+		}
+	} else {
+		bind.Name = req.DestinationAddr.Name
+		if len(req.DestinationAddr.IP) != 0 {
+			var names []string
+			names, err = s.Resolver.LookupAddr(req.ctx, req.DestinationAddr.IP.String())
+			if err == nil && len(names) == 0 {
+				err = fmt.Errorf("no names for %s", req.DestinationAddr.IP)
+			}
+			if err == nil {
+				bind.Name = strings.TrimSuffix(names[0], ".")
+			}
+		}
+	}
+	if err != nil {
+		if err := s.sendReply(req.Conn, hostUnreachable, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("resolve %v failed: %w", req.DestinationAddr, err)
+	}
+
+	if err := s.sendReply(req.Conn, successReply, &bind); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return nil
 }
 
 func (s *Server) handleConnect(req *request) error {
-	if s.UserConnectHandle == nil {
+	if s.UserConnectHandle == nil && s.Router == nil && s.Middleware == nil {
 		return s.embedHandleConnect(req)
 	}
 
-	if err := sendReply(req.Conn, successReply, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
-	}
 	host := req.DestinationAddr.IP.String()
 	if req.DestinationAddr.Name != "" {
 		host = req.DestinationAddr.Name
@@ -246,9 +787,95 @@ func (s *Server) handleConnect(req *request) error {
 		Destination: req.DestinationAddr.String(),
 		DestHost:    host,
 		DestPort:    int32(req.DestinationAddr.Port),
+		ClientAddr:  req.Conn.RemoteAddr(),
+		Context:     req.ctx,
+	}
+	proxyReq.ConnID, _ = statute.ConnID(req.ctx)
+
+	handler := s.connectHandler(proxyReq)
+	if handler == nil {
+		return s.embedHandleConnectMiddleware(req, proxyReq)
+	}
+	if s.Middleware != nil {
+		handler = s.Middleware(handler)
+	}
+
+	err := s.runConnectHandler(req, proxyReq, handler)
+	if err != nil && s.CloseOnHandlerError {
+		_ = req.Conn.Close()
+	}
+	return err
+}
+
+// runConnectHandler replies to the CONNECT request, unless the reply is
+// deferred to handler, and runs handler
+func (s *Server) runConnectHandler(req *request, proxyReq *statute.ProxyRequest, handler statute.UserConnectHandler) error {
+	if s.DeferConnectReply {
+		return s.handleDeferredConnect(req, proxyReq, handler)
+	}
+
+	if err := s.sendReply(req.Conn, successReply, nil); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
+	}
+	return statute.WithPhase(statute.PhaseTunnel, proxyReq.Destination, handler(proxyReq))
+}
+
+// embedHandleConnectMiddleware runs the embedded handler through the
+// Middleware, a request rejected by the middleware gets a failure reply
+func (s *Server) embedHandleConnectMiddleware(req *request, proxyReq *statute.ProxyRequest) error {
+	if s.Middleware == nil {
+		return s.embedHandleConnect(req)
+	}
+	embedded := false
+	handler := s.Middleware(func(*statute.ProxyRequest) error {
+		embedded = true
+		return s.embedHandleConnect(req)
+	})
+	err := handler(proxyReq)
+	if err != nil && !embedded {
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, errToReply(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+	}
+	return err
+}
+
+// handleDeferredConnect runs handler leaving the reply to it, see
+// statute.ProxyRequest.Reply
+func (s *Server) handleDeferredConnect(req *request, proxyReq *statute.ProxyRequest, handler statute.UserConnectHandler) error {
+	var (
+		once     sync.Once
+		replyErr error
+	)
+	proxyReq.Reply = func(bindAddr net.Addr, err error) error {
+		once.Do(func() {
+			code := successReply
+			if err != nil {
+				code = errToReply(err)
+			}
+			replyErr = s.sendReply(req.Conn, code, bindAddress(bindAddr))
+		})
+		return replyErr
 	}
 
-	return s.UserConnectHandle(proxyReq)
+	err := handler(proxyReq)
+	// a no-op if the handler already replied
+	_ = proxyReq.Reply(nil, err)
+	return statute.WithPhase(statute.PhaseTunnel, proxyReq.Destination, err)
+}
+
+// connectHandler picks the handler for proxyReq, routes take precedence over
+// UserConnectHandle
+func (s *Server) connectHandler(proxyReq *statute.ProxyRequest) statute.UserConnectHandler {
+	if s.Router != nil {
+		if handler := s.Router.Route(proxyReq.Context, proxyReq); handler != nil {
+			return handler
+		}
+	}
+	return s.UserConnectHandle
 }
 
 func (s *Server) embedHandleConnect(req *request) error {
@@ -256,12 +883,20 @@ func (s *Server) embedHandleConnect(req *request) error {
 		_ = req.Conn.Close()
 	}()
 
-	target, err := s.ProxyDial(s.Context, "tcp", req.DestinationAddr.Address())
+	if s.RequireHandler {
+		if err := s.sendReply(req.Conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return statute.ErrHandlerRequired
+	}
+
+	target, err := statute.TraceDial(req.ctx, s.ProxyDial, "tcp", req.DestinationAddr.Address())
+	s.logDestination(req.ctx, "CONNECT", req.DestinationAddr.String(), err)
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		if err := s.sendReply(req.Conn, errToReply(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return statute.WithPhase(statute.PhaseDial, req.DestinationAddr.String(), fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 	defer func() {
 		_ = target.Close()
@@ -272,60 +907,92 @@ func (s *Server) embedHandleConnect(req *request) error {
 	if !ok {
 		return fmt.Errorf("connect to %v failed: local address is %s://%s", req.DestinationAddr, localAddr.Network(), localAddr.String())
 	}
-	bind := address{IP: local.IP, Port: local.Port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	bind := address{IP: local.IP, Zone: local.Zone, Port: local.Port}
+	if err := s.sendReply(req.Conn, successReply, &bind); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
 	}
 
-	var buf1, buf2 []byte
-	if s.BytesPool != nil {
-		buf1 = s.BytesPool.Get()
-		buf2 = s.BytesPool.Get()
+	_, _, err = statute.Relay(req.ctx, req.Conn, target, statute.RelayOptions{
+		BytesPool:         s.BytesPool,
+		ByteLimit:         s.ConnectionByteLimit,
+		KeepAliveInterval: s.TCPKeepAliveInterval,
+	})
+	return statute.WithPhase(statute.PhaseTunnel, req.DestinationAddr.String(), err)
+}
+
+func (s *Server) handleAssociate(req *request) error {
+	if s.UserAssociateHandle == nil && s.RequireHandler {
 		defer func() {
-			s.BytesPool.Put(buf1)
-			s.BytesPool.Put(buf2)
+			_ = req.Conn.Close()
 		}()
-	} else {
-		buf1 = make([]byte, 32*1024)
-		buf2 = make([]byte, 32*1024)
+		if err := s.sendReply(req.Conn, ruleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return statute.ErrHandlerRequired
 	}
-	return statute.Tunnel(s.Context, target, req.Conn, buf1, buf2)
-}
 
-func (s *Server) handleAssociate(req *request) error {
 	destinationAddr := req.DestinationAddr.String()
-	udpConn, err := s.ProxyListenPacket(s.Context, "udp", destinationAddr)
+	udpConn, err := s.listenRelay(req.ctx, destinationAddr)
 	if err != nil {
-		if err := sendReply(req.Conn, errToReply(err), nil); err != nil {
-			return fmt.Errorf("failed to send reply: %v", err)
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, errToReply(err), nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
 		}
-		return fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err)
+		return statute.WithPhase(statute.PhaseDial, destinationAddr, fmt.Errorf("connect to %v failed: %w", req.DestinationAddr, err))
 	}
 
-	ip, port, err := s.PacketForwardAddress(s.Context, destinationAddr, udpConn, req.Conn)
+	bind, err := s.packetForwardAddress(req.ctx, destinationAddr, udpConn, req.Conn)
 	if err != nil {
-		return err
+		// no session uses the relay, the client must not wait for a reply
+		_ = udpConn.Close()
+		defer func() {
+			_ = req.Conn.Close()
+		}()
+		if err := s.sendReply(req.Conn, serverFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %w", err)
+		}
+		return fmt.Errorf("forward address of %v failed: %w", req.DestinationAddr, err)
 	}
-	bind := address{IP: ip, Port: port}
-	if err := sendReply(req.Conn, successReply, &bind); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+	if err := s.sendReply(req.Conn, successReply, bind); err != nil {
+		return fmt.Errorf("failed to send reply: %w", err)
 	}
 
 	if s.UserAssociateHandle == nil {
-		return s.embedHandleAssociate(req, udpConn)
+		return statute.WithPhase(statute.PhaseTunnel, destinationAddr, s.embedHandleAssociate(req, udpConn))
 	}
 
 	cConn := &udpCustomConn{
 		PacketConn:   udpConn,
 		assocTCPConn: req.Conn,
-		frc:          make(chan bool),
+		frc:          make(chan bool, 1),
 		packetQueue:  make(chan *readStruct),
+		done:         make(chan struct{}),
 	}
 
+	// the session ends with the control connection
+	go func() {
+		var buf [1]byte
+		for {
+			if _, err := req.Conn.Read(buf[:]); err != nil {
+				_ = udpConn.Close()
+				return
+			}
+		}
+	}()
 	cConn.asyncReadPackets()
 
 	// wait for first packet so that target sender and receiver get known
-	<-cConn.frc
+	timeout := s.UDPIdleTimeout
+	if timeout <= 0 {
+		timeout = defaultFirstPacketTimeout
+	}
+	if err := cConn.waitFirstPacket(req.ctx, timeout); err != nil {
+		_ = udpConn.Close()
+		_ = req.Conn.Close()
+		return statute.WithPhase(statute.PhaseTunnel, destinationAddr, err)
+	}
 
 	proxyReq := &statute.ProxyRequest{
 		Conn:        cConn,
@@ -335,14 +1002,28 @@ func (s *Server) handleAssociate(req *request) error {
 		Destination: cConn.targetAddr.String(),
 		DestHost:    cConn.targetAddr.(*net.UDPAddr).IP.String(),
 		DestPort:    int32(cConn.targetAddr.(*net.UDPAddr).Port),
+		ClientAddr:  req.Conn.RemoteAddr(),
+		Context:     req.ctx,
 	}
+	proxyReq.ConnID, _ = statute.ConnID(req.ctx)
 
-	return s.UserAssociateHandle(proxyReq)
+	return statute.WithPhase(statute.PhaseTunnel, proxyReq.Destination, s.UserAssociateHandle(proxyReq))
 }
 
+// embedHandleAssociate relays datagrams using udpConn, the client-facing
+// relay created by ProxyListenPacket which receives the encapsulated
+// datagrams of the client, and one target-facing socket per destination. The
+// target sockets are created by ProxyPacketDial when the first datagram to
+// their destination arrives and are used for sending to and receiving from
+// that destination only, so replies are encapsulated with the header of the
+// destination they came from.
 func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) error {
+	logger := statute.ConnLogger(req.ctx, s.Logger)
+	// closing the control connection ends the watcher below, closing the
+	// relay socket unblocks the relay loop, so either side ending stops both
 	defer func() {
 		_ = udpConn.Close()
+		_ = req.Conn.Close()
 	}()
 
 	go func() {
@@ -355,79 +1036,347 @@ func (s *Server) embedHandleAssociate(req *request, udpConn net.PacketConn) erro
 			}
 		}
 	}()
+	// the context ends the session too, such as at the maximum lifetime
+	stop := context.AfterFunc(req.ctx, func() {
+		_ = udpConn.Close()
+	})
+	defer stop()
 
 	var (
-		sourceAddr  net.Addr
-		wantSource  string
-		targetAddr  net.Addr
-		wantTarget  string
-		replyPrefix []byte
-		buf         [maxUdpPacket]byte
+		sourceAddr net.Addr
+		clientAddr atomic.Value
+		relayed    atomic.Int64
+		// targets is written by the relay loop and, to drop a failed
+		// target, by the goroutines relaying its replies
+		targetsMu sync.Mutex
+		targets   = make(map[string]*associateTarget)
 	)
+	// dropTarget closes a target whose socket failed, the next datagram to
+	// it opens a new one, the other targets are kept
+	dropTarget := func(key string, target *associateTarget, err error) {
+		targetsMu.Lock()
+		if targets[key] == target {
+			delete(targets, key)
+		}
+		targetsMu.Unlock()
+		_ = target.conn.Close()
+		if !errors.Is(err, net.ErrClosed) {
+			logger.Debug(fmt.Errorf("drop target %s: %w", key, err))
+		}
+	}
+	maxSize := s.MaxUDPPacketSize
+	if maxSize <= 0 {
+		maxSize = maxUdpPacket
+	}
+	var relayZone string
+	if local, ok := udpConn.LocalAddr().(*net.UDPAddr); ok {
+		relayZone = local.Zone
+	}
+	// one extra byte to tell oversized datagrams from those of exactly maxSize
+	buf := make([]byte, maxSize+1)
+	defer func() {
+		targetsMu.Lock()
+		defer targetsMu.Unlock()
+		for _, target := range targets {
+			_ = target.conn.Close()
+		}
+	}()
+
+	// only datagrams of the client extend the idle deadline, others can't
+	// keep the session alive
+	extendDeadline := func() error {
+		if s.UDPIdleTimeout <= 0 {
+			return nil
+		}
+		return udpConn.SetReadDeadline(time.Now().Add(s.UDPIdleTimeout))
+	}
+	if err := extendDeadline(); err != nil {
+		return err
+	}
 
 	for {
-		n, addr, err := udpConn.ReadFrom(buf[:])
+		n, addr, err := udpConn.ReadFrom(buf)
 		if err != nil {
+			if cause := context.Cause(req.ctx); cause != nil {
+				return cause
+			}
 			return err
 		}
 
 		if sourceAddr == nil {
 			sourceAddr = addr
-			wantSource = sourceAddr.String()
 		}
 
-		gotAddr := addr.String()
-		if wantSource == gotAddr {
-			if n < 3 {
+		if !s.matchSource(sourceAddr, addr) || n < 3 {
+			continue
+		}
+		if err := extendDeadline(); err != nil {
+			return err
+		}
+		// replies go to the latest source, which only differs from
+		// sourceAddr in loose mode
+		clientAddr.Store(addr)
+		if n > maxSize {
+			logger.Debug(fmt.Errorf("drop datagram from %s larger than %d bytes", addr, maxSize))
+			continue
+		}
+		reader := bytes.NewBuffer(buf[3:n])
+		dest, err := readAddr(reader)
+		if err != nil {
+			logger.Debug(err)
+			continue
+		}
+		if s.UDPSink {
+			s.discarded.Add(1)
+			continue
+		}
+		if dest.IP.IsLinkLocalUnicast() && dest.IP.To4() == nil {
+			// a link-local destination is only reachable on the interface
+			// the relay socket is bound to
+			dest.Zone = relayZone
+		}
+		if !s.allowed(req.ctx, "udp", dest) {
+			logger.Debug(fmt.Errorf("drop datagram to %s denied by ACL", dest))
+			continue
+		}
+		key := dest.String()
+		targetsMu.Lock()
+		target, ok := targets[key]
+		count := len(targets)
+		targetsMu.Unlock()
+		if !ok {
+			if count >= maxAssociateTargets {
+				logger.Debug(fmt.Errorf("drop datagram to %s, too many targets", dest))
 				continue
 			}
-			reader := bytes.NewBuffer(buf[3:n])
-			addr, err := readAddr(reader)
+			targetAddr, err := net.ResolveUDPAddr("udp", dest.Address())
 			if err != nil {
-				s.Logger.Debug(err)
+				logger.Debug(err)
 				continue
 			}
-			if targetAddr == nil {
-				targetAddr = &net.UDPAddr{
-					IP:   addr.IP,
-					Port: addr.Port,
-				}
-				wantTarget = targetAddr.String()
-			}
-			if addr.String() != wantTarget {
-				s.Logger.Debug(fmt.Errorf("ignore non-target addresses %s", addr))
-				continue
+			// the target socket must be of the family of the target,
+			// whatever the family of the control connection
+			network := "udp4"
+			if targetAddr.IP.To4() == nil {
+				network = "udp6"
 			}
-			_, err = udpConn.WriteTo(reader.Bytes(), targetAddr)
+			targetConn, err := s.ProxyPacketDial(req.ctx, network, targetAddr.String())
+			s.logDestination(req.ctx, "ASSOCIATE", dest.String(), err)
 			if err != nil {
-				return err
+				// only this destination is unreachable, the session goes on
+				logger.Debug(fmt.Errorf("drop datagram to %s, connect failed: %w", dest, err))
+				continue
 			}
-		} else if targetAddr != nil && wantTarget == gotAddr {
-			if replyPrefix == nil {
-				b := bytes.NewBuffer(make([]byte, 3, 16))
-				err = writeAddrWithStr(b, wantTarget)
-				if err != nil {
-					return err
+			target = &associateTarget{conn: targetConn, addr: targetAddr}
+			targetsMu.Lock()
+			targets[key] = target
+			targetsMu.Unlock()
+			go func(target *associateTarget) {
+				err := s.relayAssociateReplies(logger, udpConn, target, &clientAddr, maxSize, &relayed)
+				if errors.Is(err, errUDPByteLimit) {
+					// the limit is of the session, it ends
+					logger.Debug(err)
+					_ = udpConn.Close()
+					return
 				}
-				replyPrefix = b.Bytes()
-			}
-			copy(buf[len(replyPrefix):len(replyPrefix)+n], buf[:n])
-			copy(buf[:len(replyPrefix)], replyPrefix)
-			_, err = udpConn.WriteTo(buf[:len(replyPrefix)+n], sourceAddr)
-			if err != nil {
-				return err
-			}
+				dropTarget(key, target, err)
+			}(target)
+		}
+		written, err := target.conn.WriteTo(reader.Bytes(), target.addr)
+		if err != nil {
+			// only this destination failed, the session goes on
+			dropTarget(key, target, err)
+			continue
+		}
+		if s.UDPByteLimit > 0 && relayed.Add(int64(written)) > s.UDPByteLimit {
+			return errUDPByteLimit
 		}
 	}
 }
 
-func sendReply(w io.Writer, resp reply, addr *address) error {
-	_, err := w.Write([]byte{socks5Version, byte(resp), 0})
+// listenRelay creates the relay socket of a UDP ASSOCIATE request with
+// ProxyListenPacket, on a free port of the UDP port range when it is set
+func (s *Server) listenRelay(ctx context.Context, address string) (net.PacketConn, error) {
+	if s.UDPPortMin <= 0 || s.UDPPortMax < s.UDPPortMin {
+		return s.ProxyListenPacket(ctx, "udp", address)
+	}
+	host, _, err := net.SplitHostPort(address)
 	if err != nil {
+		return nil, err
+	}
+	// start at a random port so concurrent associations don't all probe the
+	// same ports
+	size := s.UDPPortMax - s.UDPPortMin + 1
+	start := rand.Intn(size)
+	for i := 0; i < size; i++ {
+		port := s.UDPPortMin + (start+i)%size
+		conn, err := s.ProxyListenPacket(ctx, "udp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err == nil {
+			return conn, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%w %d-%d", errUDPPortRangeExhausted, s.UDPPortMin, s.UDPPortMax)
+}
+
+// associateTarget is a destination of a UDP ASSOCIATE session and the socket
+// relaying to it
+type associateTarget struct {
+	conn net.PacketConn
+	addr net.Addr
+}
+
+// relayAssociateReplies encapsulates the datagrams of the target received on
+// its socket and sends them back to the client address stored in clientAddr
+// through the relay socket. It returns once the target socket fails or is
+// closed, a failure sending to the client only drops the datagram unless the
+// relay socket is closed.
+func (s *Server) relayAssociateReplies(logger statute.Logger, udpConn net.PacketConn, target *associateTarget, clientAddr *atomic.Value, maxSize int, relayed *atomic.Int64) error {
+	b := bytes.NewBuffer(make([]byte, 3, 16))
+	if err := writeAddrWithStr(b, target.addr.String()); err != nil {
 		return err
 	}
-	err = writeAddr(w, addr)
-	return err
+	replyPrefix := b.Bytes()
+
+	wantTarget := target.addr.String()
+	buf := make([]byte, len(replyPrefix)+maxSize+1)
+	copy(buf, replyPrefix)
+	for {
+		n, addr, err := target.conn.ReadFrom(buf[len(replyPrefix):])
+		if err != nil {
+			return err
+		}
+		if addr.String() != wantTarget {
+			continue
+		}
+		if n > maxSize {
+			logger.Debug(fmt.Errorf("drop datagram from %s larger than %d bytes", addr, maxSize))
+			continue
+		}
+		_, err = udpConn.WriteTo(buf[:len(replyPrefix)+n], clientAddr.Load().(net.Addr))
+		if errors.Is(err, net.ErrClosed) {
+			return err
+		}
+		if err != nil {
+			logger.Debug(fmt.Errorf("drop datagram from %s: %w", addr, err))
+			continue
+		}
+		if s.UDPByteLimit > 0 && relayed.Add(int64(n)) > s.UDPByteLimit {
+			return errUDPByteLimit
+		}
+	}
+}
+
+// matchSource reports whether a datagram from addr belongs to the client
+// whose first datagram came from sourceAddr
+func (s *Server) matchSource(sourceAddr, addr net.Addr) bool {
+	if !s.UDPLooseSourceCheck {
+		return sourceAddr.String() == addr.String()
+	}
+	want, ok1 := sourceAddr.(*net.UDPAddr)
+	got, ok2 := addr.(*net.UDPAddr)
+	if ok1 && ok2 {
+		return want.IP.Equal(got.IP)
+	}
+	wantHost, _, err1 := net.SplitHostPort(sourceAddr.String())
+	gotHost, _, err2 := net.SplitHostPort(addr.String())
+	return err1 == nil && err2 == nil && wantHost == gotHost
+}
+
+// logDestination logs the destination of an embedded handler and the outcome
+// of dialing it when VerboseDestinations is set
+func (s *Server) logDestination(ctx context.Context, command, destination string, err error) {
+	if !s.VerboseDestinations {
+		return
+	}
+	logger := statute.ConnLogger(ctx, s.Logger)
+	logger = statute.WithField(logger, "protocol", "socks5")
+	logger = statute.WithField(logger, "destination", destination)
+	if err != nil {
+		logger.Debug(fmt.Sprintf("%s %s failed: %v", command, destination, err))
+		return
+	}
+	logger.Debug(command + " " + destination + " succeeded")
+}
+
+// rewriteDestination applies the DestinationRewriter to the destination of
+// req
+func (s *Server) rewriteDestination(req *request) error {
+	if s.DestinationRewriter == nil {
+		return nil
+	}
+	host := req.DestinationAddr.Name
+	if host == "" {
+		host = req.DestinationAddr.IP.String()
+	}
+	host, port, err := s.DestinationRewriter(req.ctx, "tcp", host, req.DestinationAddr.Port)
+	if err != nil {
+		return err
+	}
+	req.DestinationAddr = hostAddress(host, port)
+	return nil
+}
+
+// preConnect runs the PreConnect hook for req and applies the destination it
+// sets
+func (s *Server) preConnect(req *request) error {
+	if s.PreConnect == nil {
+		return nil
+	}
+	host := req.DestinationAddr.Name
+	if host == "" {
+		host = req.DestinationAddr.IP.String()
+	}
+	proxyReq := &statute.ProxyRequest{
+		Network:     "tcp",
+		Destination: req.DestinationAddr.String(),
+		DestHost:    host,
+		DestPort:    int32(req.DestinationAddr.Port),
+		ClientAddr:  req.Conn.RemoteAddr(),
+		Context:     req.ctx,
+	}
+	proxyReq.ConnID, _ = statute.ConnID(req.ctx)
+	if err := s.PreConnect(req.ctx, proxyReq); err != nil {
+		return err
+	}
+	if proxyReq.DestHost != host || int(proxyReq.DestPort) != req.DestinationAddr.Port {
+		req.DestinationAddr = hostAddress(proxyReq.DestHost, int(proxyReq.DestPort))
+	}
+	return nil
+}
+
+// allowed reports whether the ACL allows dest over network
+func (s *Server) allowed(ctx context.Context, network string, dest *address) bool {
+	if network == "tcp" && !statute.PortAllowed(dest.Port, s.AllowedPorts, s.DeniedPorts) {
+		return false
+	}
+	acl := statute.PolicyACL(ctx, s.ACL)
+	if acl == nil {
+		return true
+	}
+	host := dest.Name
+	if host == "" {
+		host = dest.IP.String()
+	}
+	return acl(ctx, network, host, dest.Port)
+}
+
+func (s *Server) sendReply(w io.Writer, resp reply, addr *address) error {
+	statute.RecordAccessStatus(w, int(resp))
+	b := bytes.NewBuffer([]byte{socks5Version, byte(resp), 0})
+	if err := writeAddr(b, addr); err != nil {
+		return err
+	}
+	return s.writeReply(w, b.Bytes())
+}
+
+// writeReply writes b to w within the reply timeout
+func (s *Server) writeReply(w io.Writer, b []byte) error {
+	done := statute.ReplyDeadline(w, s.ReplyTimeout)
+	_, err := w.Write(b)
+	return done(err)
 }
 
 type request struct {
@@ -435,21 +1384,57 @@ type request struct {
 	Command         Command
 	DestinationAddr *address
 	Username        string
-	Password        string
 	Conn            net.Conn
+	ctx             context.Context
+}
+
+// packetForwardAddress returns the relay endpoint sent in the UDP ASSOCIATE
+// reply
+func (s *Server) packetForwardAddress(ctx context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (*address, error) {
+	if s.PacketForwardHost != nil {
+		host, port, err := s.PacketForwardHost(ctx, destinationAddr, packet, conn)
+		if err != nil {
+			return nil, err
+		}
+		return hostAddress(host, port), nil
+	}
+	ip, port, err := s.PacketForwardAddress(ctx, destinationAddr, packet, conn)
+	if err != nil {
+		return nil, err
+	}
+	return &address{IP: ip, Port: port}, nil
 }
 
 func defaultReplyPacketForwardAddress(_ context.Context, destinationAddr string, packet net.PacketConn, conn net.Conn) (net.IP, int, error) {
 	udpLocal := packet.LocalAddr()
-	udpLocalAddr, ok := udpLocal.(*net.UDPAddr)
+	_, udpPort, ok := addrIPPort(udpLocal)
 	if !ok {
 		return nil, 0, fmt.Errorf("connect to %v failed: local address is %s://%s", destinationAddr, udpLocal.Network(), udpLocal.String())
 	}
 
 	tcpLocal := conn.LocalAddr()
-	tcpLocalAddr, ok := tcpLocal.(*net.TCPAddr)
+	tcpIP, _, ok := addrIPPort(tcpLocal)
 	if !ok {
 		return nil, 0, fmt.Errorf("connect to %v failed: local address is %s://%s", destinationAddr, tcpLocal.Network(), tcpLocal.String())
 	}
-	return tcpLocalAddr.IP, udpLocalAddr.Port, nil
+	return tcpIP, udpPort, nil
+}
+
+// addrIPPort returns the IP and port of addr, addresses of other types than
+// *net.UDPAddr and *net.TCPAddr, such as those of custom packet conns, are
+// parsed from their string form
+func addrIPPort(addr net.Addr) (net.IP, int, bool) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, a.Port, true
+	case *net.TCPAddr:
+		return a.IP, a.Port, true
+	case nil:
+		return nil, 0, false
+	}
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return nil, 0, false
+	}
+	return net.IP(addrPort.Addr().Unmap().AsSlice()), int(addrPort.Port()), true
 }
@@ -0,0 +1,1773 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// serve starts s on a loopback listener closed at the end of the test, it
+// returns the address of the listener
+func serve(t testing.TB, s *Server) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_ = s.ServeConn(conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// udpEcho starts a loopback UDP server sending every datagram back, it
+// returns its address
+func udpEcho(t testing.TB) string {
+	t.Helper()
+	return udpEchoOn(t, "127.0.0.1:0")
+}
+
+// udpEchoOn is udpEcho listening on address, it skips the test when address
+// can't be listened on, such as an IPv6 one on a host without IPv6
+func udpEchoOn(t testing.TB, address string) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", address)
+	if err != nil {
+		t.Skipf("listening on %s: %v", address, err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// newUDPClient associates with the server at addr, the client is closed at
+// the end of the test
+func newUDPClient(t testing.TB, addr string) *UDPClient {
+	t.Helper()
+	client, err := NewUDPClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// roundTrip sends payload to target through client and returns the payload
+// of the reply, it fails the test when none arrives in time
+func roundTrip(t testing.TB, client *UDPClient, payload, target string) string {
+	t.Helper()
+	if _, err := client.WriteTo([]byte(payload), target); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 65535)
+	n, from, err := client.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no reply to %q from %s: %v", payload, target, err)
+	}
+	if from != target {
+		t.Fatalf("reply from %s, want %s", from, target)
+	}
+	return string(buf[:n])
+}
+
+// expectNoReply fails the test when client receives a datagram within wait
+func expectNoReply(t testing.TB, client *UDPClient, wait time.Duration) {
+	t.Helper()
+	_ = client.SetReadDeadline(time.Now().Add(wait))
+	buf := make([]byte, 65535)
+	n, from, err := client.ReadFrom(buf)
+	if err == nil {
+		t.Fatalf("unexpected reply %q from %s", buf[:n], from)
+	}
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("ReadFrom() = %v, want a timeout", err)
+	}
+}
+
+func TestAssociateFailedDialDropsDatagram(t *testing.T) {
+	echo := udpEcho(t)
+	// an unreachable destination, the dial to it fails
+	unreachable := "127.0.0.1:9"
+	dial := statute.LocalAddrProxyPacketDial(nil)
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithProxyPacketDial(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+			if address == unreachable {
+				return nil, errors.New("dial refused")
+			}
+			return dial(ctx, network, address)
+		}),
+	)
+	client := newUDPClient(t, serve(t, s))
+
+	if _, err := client.WriteTo([]byte("lost"), unreachable); err != nil {
+		t.Fatal(err)
+	}
+	expectNoReply(t, client, 100*time.Millisecond)
+	if got := roundTrip(t, client, "hello", echo); got != "hello" {
+		t.Fatalf("echoed %q, want %q", got, "hello")
+	}
+}
+
+func TestAssociateDropsOversizedDatagram(t *testing.T) {
+	echo := udpEcho(t)
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithMaxUDPPacketSize(512))
+	client := newUDPClient(t, serve(t, s))
+
+	tests := []struct {
+		name    string
+		size    int
+		relayed bool
+	}{
+		{"oversized", 1024, false},
+		{"fits", 256, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			payload := strings.Repeat("x", tt.size)
+			if !tt.relayed {
+				if _, err := client.WriteTo([]byte(payload), echo); err != nil {
+					t.Fatal(err)
+				}
+				expectNoReply(t, client, 100*time.Millisecond)
+				return
+			}
+			if got := roundTrip(t, client, payload, echo); got != payload {
+				t.Fatalf("echoed %d bytes, want %d", len(got), len(payload))
+			}
+		})
+	}
+}
+
+func TestAssociateACLDropsDeniedDatagram(t *testing.T) {
+	allowed, denied := udpEcho(t), udpEcho(t)
+	_, deniedPort, err := net.SplitHostPort(denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithACL(func(ctx context.Context, network, host string, port int) bool {
+			return network != "udp" || strconv.Itoa(port) != deniedPort
+		}),
+	)
+	client := newUDPClient(t, serve(t, s))
+
+	tests := []struct {
+		name    string
+		target  string
+		relayed bool
+	}{
+		{"denied", denied, false},
+		{"allowed", allowed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !tt.relayed {
+				if _, err := client.WriteTo([]byte("hello"), tt.target); err != nil {
+					t.Fatal(err)
+				}
+				expectNoReply(t, client, 100*time.Millisecond)
+				return
+			}
+			if got := roundTrip(t, client, "hello", tt.target); got != "hello" {
+				t.Fatalf("echoed %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestAssociateACLAllowlist(t *testing.T) {
+	allowed, denied := udpEcho(t), udpEcho(t)
+	_, allowedPort, err := net.SplitHostPort(allowed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// neither the 0.0.0.0:0 of the ASSOCIATE request nor the denied echo
+	// server is on the list
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithACL(func(ctx context.Context, network, host string, port int) bool {
+			return network == "udp" && host == "127.0.0.1" && strconv.Itoa(port) == allowedPort
+		}),
+	)
+	client := newUDPClient(t, serve(t, s))
+
+	if got := roundTrip(t, client, "hello", allowed); got != "hello" {
+		t.Fatalf("echoed %q, want %q", got, "hello")
+	}
+	if _, err := client.WriteTo([]byte("hello"), denied); err != nil {
+		t.Fatal(err)
+	}
+	expectNoReply(t, client, 100*time.Millisecond)
+}
+
+func TestAssociateIdleTimeoutIgnoresOtherSources(t *testing.T) {
+	echo := udpEcho(t)
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithUDPIdleTimeout(300*time.Millisecond))
+	client := newUDPClient(t, serve(t, s))
+	if got := roundTrip(t, client, "hello", echo); got != "hello" {
+		t.Fatalf("echoed %q, want %q", got, "hello")
+	}
+
+	// a stranger keeps sending to the relay, the session still times out
+	stranger, err := net.Dial("udp", client.RelayAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		ticker := time.NewTicker(50 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				_, _ = stranger.Write([]byte{0, 0, 0, 1, 127, 0, 0, 1, 0, 53})
+			}
+		}
+	}()
+
+	_ = client.control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.control.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("control connection read = %v, want EOF once idle", err)
+	}
+}
+
+func TestUDPLooseSourceCheck(t *testing.T) {
+	echo := udpEcho(t)
+	tests := []struct {
+		name    string
+		loose   bool
+		relayed bool
+	}{
+		{"strict", false, false},
+		{"loose", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithUDPLooseSourceCheck(tt.loose))
+			client := newUDPClient(t, serve(t, s))
+			if got := roundTrip(t, client, "hello", echo); got != "hello" {
+				t.Fatalf("echoed %q, want %q", got, "hello")
+			}
+
+			// the client continues from another port of the same IP
+			moved, err := net.Dial("udp", client.RelayAddr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer moved.Close()
+			if _, err := moved.Write(datagram(t, echo, []byte("moved"))); err != nil {
+				t.Fatal(err)
+			}
+			_ = moved.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			buf := make([]byte, 65535)
+			n, err := moved.Read(buf)
+			if !tt.relayed {
+				if err == nil {
+					t.Fatalf("unexpected reply %q to another port", buf[:n])
+				}
+				// the first source still is served
+				if got := roundTrip(t, client, "again", echo); got != "again" {
+					t.Fatalf("echoed %q, want %q", got, "again")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("no reply at the new port: %v", err)
+			}
+			if !bytes.HasSuffix(buf[:n], []byte("moved")) {
+				t.Fatalf("reply %q, want the echo of %q", buf[:n], "moved")
+			}
+		})
+	}
+}
+
+func TestAssociateEndsTogether(t *testing.T) {
+	relays := make(chan net.PacketConn, 1)
+	listen := WithProxyListenPacket(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+		conn, err := net.ListenPacket(network, address)
+		if err == nil {
+			relays <- conn
+		}
+		return conn, err
+	})
+
+	// the relay socket failing closes the control connection
+	s := NewServer(WithLogger(statute.DefaultLogger{}), listen)
+	client := newUDPClient(t, serve(t, s))
+	_ = (<-relays).Close()
+	_ = client.control.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.control.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("control connection read = %v, want EOF once the relay ended", err)
+	}
+
+	// the control connection closing closes the relay socket
+	client = newUDPClient(t, serve(t, s))
+	relay := <-relays
+	_ = client.control.Close()
+	within(t, "relay socket close", func() {
+		for {
+			if _, _, err := relay.ReadFrom(make([]byte, 1)); errors.Is(err, net.ErrClosed) {
+				return
+			}
+		}
+	})
+}
+
+func TestUDPPortRange(t *testing.T) {
+	tests := []struct {
+		name      string
+		taken     map[int]bool
+		want      reply
+		wantBound int
+	}{
+		{"free port", map[int]bool{40000: true, 40001: true, 40003: true}, successReply, 40002},
+		{"range exhausted", map[int]bool{40000: true, 40001: true, 40002: true, 40003: true}, serverFailure, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var tried []int
+			bound := 0
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				WithUDPPortRange(40000, 40003),
+				// the ports of the range are simulated, the relay socket
+				// itself is bound to an ephemeral port
+				WithProxyListenPacket(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+					_, portStr, _ := net.SplitHostPort(address)
+					port, _ := strconv.Atoi(portStr)
+					tried = append(tried, port)
+					if tt.taken[port] {
+						return nil, &net.OpError{Op: "listen", Net: network, Err: os.NewSyscallError("bind", syscall.EADDRINUSE)}
+					}
+					bound = port
+					return net.ListenPacket(network, "127.0.0.1:0")
+				}),
+			)
+			conn := dialServer(t, serve(t, s))
+			if code, _ := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0"); code != tt.want {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), tt.want, byte(tt.want))
+			}
+			if bound != tt.wantBound {
+				t.Fatalf("bound port %d, want %d", bound, tt.wantBound)
+			}
+			// every port is tried at most once and only ports of the range
+			seen := make(map[int]bool)
+			for _, port := range tried {
+				if port < 40000 || port > 40003 || seen[port] {
+					t.Fatalf("tried ports %v, want each port of 40000-40003 at most once", tried)
+				}
+				seen[port] = true
+			}
+			if tt.want == serverFailure && len(seen) != 4 {
+				t.Fatalf("tried ports %v before failing, want the whole range", tried)
+			}
+		})
+	}
+
+	// other listen errors are not retried
+	attempts := 0
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithUDPPortRange(40000, 40003),
+		WithProxyListenPacket(func(context.Context, string, string) (net.PacketConn, error) {
+			attempts++
+			return nil, errors.New("no sockets")
+		}),
+	)
+	conn := dialServer(t, serve(t, s))
+	if code, _ := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0"); code == successReply {
+		t.Fatal("ASSOCIATE succeeded without a relay socket")
+	}
+	if attempts != 1 {
+		t.Fatalf("%d listen attempts, want 1", attempts)
+	}
+}
+
+func TestUDPSink(t *testing.T) {
+	echo := udpEcho(t)
+	var dials atomic.Int32
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithUDPSink(),
+		WithMaxUDPPacketSize(512),
+		WithProxyPacketDial(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+			dials.Add(1)
+			return statute.DefaultProxyPacketDial()(ctx, network, address)
+		}),
+	)
+	client := newUDPClient(t, serve(t, s))
+	for i := 0; i < 5; i++ {
+		if _, err := client.WriteTo([]byte("probe"), echo); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// neither an oversized datagram nor one of another source is counted
+	if _, err := client.WriteTo([]byte(strings.Repeat("x", 1024)), echo); err != nil {
+		t.Fatal(err)
+	}
+	stranger, err := net.Dial("udp", client.RelayAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+	if _, err := stranger.Write(datagram(t, echo, []byte("stranger"))); err != nil {
+		t.Fatal(err)
+	}
+
+	expectNoReply(t, client, 200*time.Millisecond)
+	if n := s.DiscardedDatagrams(); n != 5 {
+		t.Fatalf("%d datagrams discarded, want 5", n)
+	}
+	if n := dials.Load(); n != 0 {
+		t.Fatalf("%d target sockets dialed, want none", n)
+	}
+}
+
+// fakeResolver returns a resolver answering from hosts, mapping a name to its
+// IPv4 address, and ptrs, mapping a reverse name to its name, other names do
+// not exist
+func fakeResolver(t testing.TB, hosts map[string]net.IP, ptrs map[string]string) *net.Resolver {
+	t.Helper()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveDNS(server, hosts, ptrs)
+			return client, nil
+		},
+	}
+}
+
+// serveDNS answers the length-prefixed queries read from conn
+func serveDNS(conn net.Conn, hosts map[string]net.IP, ptrs map[string]string) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		query := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, query); err != nil || len(query) < 12 {
+			return
+		}
+		// the question follows the header, it is a sequence of labels and
+		// the type and class
+		var labels []string
+		i := 12
+		for i < len(query) && query[i] != 0 {
+			labels = append(labels, string(query[i+1:i+1+int(query[i])]))
+			i += 1 + int(query[i])
+		}
+		question := query[12 : i+5]
+		name := strings.Join(labels, ".") + "."
+		qtype := binary.BigEndian.Uint16(query[i+1:])
+
+		var rcode byte
+		var answers [][]byte
+		switch {
+		case qtype == 1 && hosts[name] != nil:
+			answers = append(answers, dnsRecord(1, hosts[name].To4()))
+		case qtype == 12 && ptrs[name] != "":
+			var rdata []byte
+			for _, label := range strings.Split(ptrs[name], ".") {
+				rdata = append(append(rdata, byte(len(label))), label...)
+			}
+			answers = append(answers, dnsRecord(12, append(rdata, 0)))
+		case hosts[name] == nil && ptrs[name] == "":
+			rcode = 3 // NXDOMAIN
+		}
+
+		resp := []byte{query[0], query[1], 0x81, 0x80 | rcode, 0, 1, 0, byte(len(answers)), 0, 0, 0, 0}
+		resp = append(resp, question...)
+		for _, answer := range answers {
+			resp = append(resp, answer...)
+		}
+		binary.BigEndian.PutUint16(size[:], uint16(len(resp)))
+		if _, err := conn.Write(append(size[:], resp...)); err != nil {
+			return
+		}
+	}
+}
+
+// dnsRecord encodes an answer of type rtype for the name of the question
+func dnsRecord(rtype uint16, rdata []byte) []byte {
+	record := []byte{0xc0, 12} // a pointer to the question name
+	record = binary.BigEndian.AppendUint16(record, rtype)
+	record = append(record, 0, 1, 0, 0, 0, 60) // class IN, ttl
+	record = binary.BigEndian.AppendUint16(record, uint16(len(rdata)))
+	return append(record, rdata...)
+}
+
+func TestTorResolveExtensions(t *testing.T) {
+	ip := net.IPv4(192, 0, 2, 7)
+	resolver := fakeResolver(t,
+		map[string]net.IP{"tor.example.": ip},
+		map[string]string{"7.2.0.192.in-addr.arpa.": "tor.example"},
+	)
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithTorResolveExtensions(), WithResolver(resolver))
+
+	tests := []struct {
+		name      string
+		command   Command
+		dest      *address
+		wantReply reply
+		wantBind  *address
+	}{
+		{"resolve", ResolveCommand, &address{Name: "tor.example"}, successReply, &address{IP: ip.To4()}},
+		{"resolve ptr", ResolvePTRCommand, &address{IP: ip}, successReply, &address{Name: "tor.example"}},
+		{"unknown name", ResolveCommand, &address{Name: "missing.example"}, hostUnreachable, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			go func() {
+				_ = s.ServeConn(server)
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			request := bytes.NewBuffer([]byte{socks5Version, 1, byte(noAuth)})
+			request.Write([]byte{socks5Version, byte(tt.command), 0})
+			if err := writeAddr(request, tt.dest); err != nil {
+				t.Fatal(err)
+			}
+			go func() {
+				_, _ = client.Write(request.Bytes())
+			}()
+			header := make([]byte, 5)
+			if _, err := io.ReadFull(client, header); err != nil {
+				t.Fatal(err)
+			}
+			if reply(header[3]) != tt.wantReply {
+				t.Fatalf("reply %v, want %v", reply(header[3]), tt.wantReply)
+			}
+			bind, err := readAddr(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantBind != nil && (!bind.IP.Equal(tt.wantBind.IP) || bind.Name != tt.wantBind.Name) {
+				t.Fatalf("bound %v, want %v", bind, tt.wantBind)
+			}
+			// no tunnel is opened, the connection is closed
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after reply = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestHandshakeRejectsMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		handshake []byte
+		wantErr   error
+	}{
+		{"no methods", []byte{socks5Version, 0}, errNoAuthMethods},
+		{"unsupported method", []byte{socks5Version, 1, 0x80}, errNoSupportedAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			s := NewServer(WithLogger(statute.DefaultLogger{}))
+			served := make(chan error, 1)
+			go func() {
+				served <- s.ServeConn(server)
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := client.Write(tt.handshake); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[0] != socks5Version || authMethod(reply[1]) != noAcceptable {
+				t.Fatalf("reply %x, want no acceptable methods", reply)
+			}
+			// the connection is closed after the rejection
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after rejection = %v, want EOF", err)
+			}
+			within(t, "ServeConn", func() {
+				if err := <-served; !errors.Is(err, tt.wantErr) {
+					t.Errorf("ServeConn() = %v, want %v", err, tt.wantErr)
+				}
+			})
+		})
+	}
+}
+
+// userPassHandshake serves a pipe with s under ctx, negotiates
+// username/password authentication and sends auth, the sub-negotiation
+// request. It returns the status reply, the client end of the pipe and the
+// result of ServeConnContext.
+func userPassHandshake(t testing.TB, ctx context.Context, s *Server, auth []byte) ([]byte, net.Conn, <-chan error) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConnContext(ctx, server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte{socks5Version, 1, byte(userPassAuth)}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(client, method); err != nil {
+		t.Fatal(err)
+	}
+	if authMethod(method[1]) != userPassAuth {
+		t.Fatalf("method %#x, want username/password", method[1])
+	}
+	if _, err := client.Write(auth); err != nil {
+		t.Fatal(err)
+	}
+	status := make([]byte, 2)
+	if _, err := io.ReadFull(client, status); err != nil {
+		t.Fatal(err)
+	}
+	return status, client, served
+}
+
+func TestUserPassAuthReplies(t *testing.T) {
+	authenticate := func(_ context.Context, username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+	tests := []struct {
+		name      string
+		auth      []byte
+		want      []byte
+		wantClose bool
+	}{
+		{"valid", []byte("\x01\x04user\x06secret"), []byte{userPassVersion, userPassSuccess}, false},
+		{"wrong password", []byte("\x01\x04user\x05wrong"), []byte{userPassVersion, userPassFailure}, true},
+		{"wrong version", []byte("\x05\x04user\x06secret"), []byte{userPassVersion, userPassFailure}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithAuthenticator(authenticate))
+			got, client, _ := userPassHandshake(t, context.Background(), s, tt.auth)
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("status %x, want %x", got, tt.want)
+			}
+			if !tt.wantClose {
+				return
+			}
+			// the connection is closed after a failure
+			if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+				t.Fatalf("read after failure = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestAuthFailureDelay(t *testing.T) {
+	const delay = 200 * time.Millisecond
+	authenticate := func(_ context.Context, username, password string) bool {
+		return username == "user" && password == "secret"
+	}
+	tests := []struct {
+		name      string
+		auth      []byte
+		want      byte
+		wantDelay bool
+	}{
+		{"valid", []byte("\x01\x04user\x06secret"), userPassSuccess, false},
+		{"rejected", []byte("\x01\x04user\x05wrong"), userPassFailure, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithAuthenticator(authenticate), WithAuthFailureDelay(delay))
+			start := time.Now()
+			got, _, _ := userPassHandshake(t, context.Background(), s, tt.auth)
+			took := time.Since(start)
+			if got[1] != tt.want {
+				t.Fatalf("status %x, want %#x", got, tt.want)
+			}
+			if tt.wantDelay && took < delay {
+				t.Fatalf("failure answered after %v, want at least %v", took, delay)
+			}
+			if !tt.wantDelay && took >= delay {
+				t.Fatalf("success answered after %v, want no delay", took)
+			}
+		})
+	}
+}
+
+func TestCredentialChecker(t *testing.T) {
+	type ctxKey struct{}
+	errStore := errors.New("credential store unavailable")
+	check := func(ctx context.Context, username, password string) (bool, error) {
+		if ctx.Value(ctxKey{}) != "conn" {
+			return false, errors.New("checker did not get the connection context")
+		}
+		if username == "broken" {
+			return false, errStore
+		}
+		return username == "user" && password == "secret", nil
+	}
+	tests := []struct {
+		name    string
+		auth    []byte
+		want    byte
+		wantErr error
+	}{
+		{"accepted", []byte("\x01\x04user\x06secret"), userPassSuccess, nil},
+		{"rejected", []byte("\x01\x04user\x05wrong"), userPassFailure, errAuthFailed},
+		{"checker error", []byte("\x01\x06broken\x06secret"), userPassFailure, errStore},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithCredentialChecker(check))
+			ctx := context.WithValue(context.Background(), ctxKey{}, "conn")
+			got, client, served := userPassHandshake(t, ctx, s, tt.auth)
+			if got[1] != tt.want {
+				t.Fatalf("status %x, want %#x", got, tt.want)
+			}
+			if tt.wantErr == nil {
+				return
+			}
+			_ = client.Close()
+			within(t, "ServeConnContext", func() {
+				if err := <-served; !errors.Is(err, tt.wantErr) {
+					t.Errorf("ServeConnContext() = %v, want %v", err, tt.wantErr)
+				}
+			})
+		})
+	}
+}
+
+// privateAuth is a private authentication method accepting every client
+type privateAuth struct{}
+
+func (privateAuth) Code() byte { return 0x80 }
+
+func (privateAuth) Authenticate(context.Context, net.Conn) (string, error) {
+	return "private", nil
+}
+
+func TestAuthMethodPreference(t *testing.T) {
+	userPass := UserPassAuth{Authenticator: func(context.Context, string, string) bool { return true }}
+	tests := []struct {
+		name    string
+		methods []AuthMethod
+		offered []byte
+		want    byte
+	}{
+		{"server preference wins", []AuthMethod{userPass, NoAuth{}}, []byte{byte(noAuth), byte(userPassAuth)}, byte(userPassAuth)},
+		{"falls back to the next method", []AuthMethod{userPass, NoAuth{}}, []byte{byte(noAuth)}, byte(noAuth)},
+		{"reversed preference", []AuthMethod{NoAuth{}, userPass}, []byte{byte(userPassAuth), byte(noAuth)}, byte(noAuth)},
+		{"private method", []AuthMethod{privateAuth{}, NoAuth{}}, []byte{byte(noAuth), 0x80}, 0x80},
+		{"no common method", []AuthMethod{userPass}, []byte{byte(noAuth)}, byte(noAcceptable)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithAuthMethods(tt.methods...))
+			go func() {
+				_ = s.ServeConn(server)
+			}()
+
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			greeting := append([]byte{socks5Version, byte(len(tt.offered))}, tt.offered...)
+			if _, err := client.Write(greeting); err != nil {
+				t.Fatal(err)
+			}
+			reply := make([]byte, 2)
+			if _, err := io.ReadFull(client, reply); err != nil {
+				t.Fatal(err)
+			}
+			if reply[1] != tt.want {
+				t.Fatalf("selected method %#x, want %#x", reply[1], tt.want)
+			}
+		})
+	}
+}
+
+func FuzzServeConnHandshake(f *testing.F) {
+	f.Add([]byte{socks5Version, 0})
+	f.Add([]byte{socks5Version, 1, 0})
+	f.Add([]byte{socks5Version, 1, 0, socks5Version, 1, 0, ipv4Address, 127, 0, 0, 1, 0, 80})
+	f.Add([]byte{socks5Version, 1, 2, userPassVersion, 1, 'u', 1, 'p'})
+
+	refuse := func(context.Context, string, string) (net.Conn, error) {
+		return nil, errors.New("dial refused")
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		client, server := net.Pipe()
+		defer client.Close()
+		s := NewServer(
+			WithLogger(statute.DefaultLogger{}),
+			WithProxyDial(refuse),
+			WithDisableUDP(),
+			WithHandshakeTimeout(time.Second),
+		)
+		served := make(chan struct{})
+		go func() {
+			defer close(served)
+			_ = s.ServeConn(server)
+		}()
+		// replies are discarded so the server never blocks writing them
+		go func() {
+			_, _ = io.Copy(io.Discard, client)
+		}()
+		_, _ = client.Write(data)
+		_ = client.Close()
+		within(t, "ServeConn", func() {
+			<-served
+		})
+	})
+}
+
+// failingPacketConn is a target socket failing its reads or writes, like one
+// receiving an ICMP port unreachable
+type failingPacketConn struct {
+	net.PacketConn
+	failRead, failWrite bool
+}
+
+func (c *failingPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	if c.failRead {
+		return 0, nil, syscall.ECONNREFUSED
+	}
+	return c.PacketConn.ReadFrom(b)
+}
+
+func (c *failingPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if c.failWrite {
+		return 0, syscall.ECONNREFUSED
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func TestAssociateFailedTargetKeepsSession(t *testing.T) {
+	tests := []struct {
+		name                string
+		failRead, failWrite bool
+	}{
+		{"read fails", true, false},
+		{"write fails", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			echo, unreachable := udpEcho(t), udpEcho(t)
+			dial := statute.DefaultProxyPacketDial()
+			var dials atomic.Int64
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				WithProxyPacketDial(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+					conn, err := dial(ctx, network, address)
+					if err != nil || address != unreachable {
+						return conn, err
+					}
+					dials.Add(1)
+					return &failingPacketConn{PacketConn: conn, failRead: tt.failRead, failWrite: tt.failWrite}, nil
+				}),
+			)
+			client := newUDPClient(t, serve(t, s))
+
+			if got := roundTrip(t, client, "before", echo); got != "before" {
+				t.Fatalf("echoed %q, want %q", got, "before")
+			}
+			for i := 0; i < 2; i++ {
+				if _, err := client.WriteTo([]byte("lost"), unreachable); err != nil {
+					t.Fatal(err)
+				}
+				expectNoReply(t, client, 100*time.Millisecond)
+				// the other target still gets its replies
+				if got := roundTrip(t, client, "after", echo); got != "after" {
+					t.Fatalf("echoed %q, want %q", got, "after")
+				}
+			}
+			// the failed target was dropped, so it was dialed again
+			if got := dials.Load(); got != 2 {
+				t.Fatalf("unreachable target dialed %d times, want 2", got)
+			}
+		})
+	}
+}
+
+func TestAssociateTargetsOfBothFamilies(t *testing.T) {
+	echo4, echo6 := udpEcho(t), udpEchoOn(t, "[::1]:0")
+	dial := statute.DefaultProxyPacketDial()
+	networks := make(chan string, 2)
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithProxyPacketDial(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+			networks <- network + " " + address
+			return dial(ctx, network, address)
+		}),
+	)
+	// the control connection is IPv4
+	client := newUDPClient(t, serve(t, s))
+
+	for _, target := range []string{echo4, echo6} {
+		if got := roundTrip(t, client, "ping "+target, target); got != "ping "+target {
+			t.Fatalf("echoed %q, want %q", got, "ping "+target)
+		}
+	}
+	// each target socket is of the family of its target
+	for _, want := range []string{"udp4 " + echo4, "udp6 " + echo6} {
+		if got := <-networks; got != want {
+			t.Fatalf("dialed %q, want %q", got, want)
+		}
+	}
+}
+
+func TestAssociateFailedFamilyKeepsOtherTargets(t *testing.T) {
+	echo4, echo6 := udpEcho(t), udpEchoOn(t, "[::1]:0")
+	dial := statute.DefaultProxyPacketDial()
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithProxyPacketDial(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+			if network == "udp6" {
+				// like a host without IPv6 connectivity
+				return nil, &net.OpError{Op: "listen", Net: network, Err: syscall.EAFNOSUPPORT}
+			}
+			return dial(ctx, network, address)
+		}),
+	)
+	client := newUDPClient(t, serve(t, s))
+
+	if got := roundTrip(t, client, "before", echo4); got != "before" {
+		t.Fatalf("echoed %q, want %q", got, "before")
+	}
+	if _, err := client.WriteTo([]byte("lost"), echo6); err != nil {
+		t.Fatal(err)
+	}
+	expectNoReply(t, client, 100*time.Millisecond)
+	// the session and the IPv4 target survive the failed IPv6 one
+	if got := roundTrip(t, client, "after", echo4); got != "after" {
+		t.Fatalf("echoed %q, want %q", got, "after")
+	}
+}
+
+// tcpEcho starts a loopback TCP server sending everything back, it returns
+// its address
+func tcpEcho(t testing.TB) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// dialServer connects to the server at addr, the connection is closed at
+// the end of the test and fails its reads and writes after five seconds
+func dialServer(t testing.TB, addr string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+// sendRequest negotiates no authentication on conn and sends a request of
+// command for dest, a host:port address, it returns the reply code and the
+// bound address of the reply
+func sendRequest(t testing.TB, conn net.Conn, command Command, dest string) (reply, *address) {
+	t.Helper()
+	if _, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)}); err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	if _, err := io.ReadFull(conn, method); err != nil {
+		t.Fatal(err)
+	}
+	if authMethod(method[1]) != noAuth {
+		t.Fatalf("method %#x, want no authentication", method[1])
+	}
+	return sendCommand(t, conn, command, dest)
+}
+
+// sendCommand sends a request of command for dest on conn, once negotiated,
+// it returns the reply code and the bound address of the reply
+func sendCommand(t testing.TB, conn net.Conn, command Command, dest string) (reply, *address) {
+	t.Helper()
+	request := bytes.NewBuffer([]byte{socks5Version, byte(command), 0})
+	if err := writeAddrWithStr(request, dest); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(request.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	bind, err := readAddr(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply(header[1]), bind
+}
+
+func TestConnectReplyCodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    reply
+	}{
+		{"denied by ACL", []ServerOption{WithACL(func(context.Context, string, string, int) bool { return false })}, ruleFailure},
+		{"denied port", []ServerOption{WithDeniedPorts([]int{25})}, ruleFailure},
+		{"rewrite failed", []ServerOption{WithDestinationRewriter(func(context.Context, string, string, int) (string, int, error) {
+			return "", 0, errors.New("no route")
+		})}, ruleFailure},
+		{"dial timed out", []ServerOption{WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: timeoutError{}}
+		})}, ttlExpired},
+		{"dial refused", []ServerOption{WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+		})}, connectionRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dialServer(t, serve(t, s))
+			if code, _ := sendRequest(t, conn, ConnectCommand, "192.0.2.1:25"); code != tt.want {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), tt.want, byte(tt.want))
+			}
+		})
+	}
+}
+
+func TestDisableUDP(t *testing.T) {
+	var listened, handled atomic.Int32
+	listen := WithProxyListenPacket(func(ctx context.Context, network, address string) (net.PacketConn, error) {
+		listened.Add(1)
+		return net.ListenPacket(network, address)
+	})
+	tests := []struct {
+		name    string
+		options []ServerOption
+	}{
+		{"embedded handler", nil},
+		{"user handler", []ServerOption{WithAssociateHandle(func(*statute.ProxyRequest) error {
+			handled.Add(1)
+			return nil
+		})}},
+		{"denied by ACL", []ServerOption{WithACL(func(context.Context, string, string, int) bool { return false })}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := append([]ServerOption{WithLogger(statute.DefaultLogger{}), WithDisableUDP(), listen}, tt.options...)
+			conn := dialServer(t, serve(t, NewServer(options...)))
+			if code, _ := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0"); code != commandNotSupported {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), commandNotSupported, byte(commandNotSupported))
+			}
+		})
+	}
+	if n := listened.Load(); n != 0 {
+		t.Fatalf("%d UDP sockets opened, want none", n)
+	}
+	if n := handled.Load(); n != 0 {
+		t.Fatalf("associate handler called %d times, want never", n)
+	}
+
+	// CONNECT is not affected
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithDisableUDP())
+	conn := dialServer(t, serve(t, s))
+	if code, _ := sendRequest(t, conn, ConnectCommand, tcpEcho(t)); code != successReply {
+		t.Fatalf("CONNECT reply %v (%#x), want success", code, byte(code))
+	}
+}
+
+func TestConnectPortLists(t *testing.T) {
+	target := tcpEcho(t)
+	_, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	tests := []struct {
+		name    string
+		options []ServerOption
+		want    reply
+	}{
+		{"no lists", nil, successReply},
+		{"allowed port", []ServerOption{WithAllowedPorts([]int{port})}, successReply},
+		{"port not allowed", []ServerOption{WithAllowedPorts([]int{port + 1})}, ruleFailure},
+		{"denied port", []ServerOption{WithDeniedPorts([]int{port})}, ruleFailure},
+		{"denied over allowed", []ServerOption{WithAllowedPorts([]int{port}), WithDeniedPorts([]int{port})}, ruleFailure},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dialServer(t, serve(t, s))
+			if code, _ := sendRequest(t, conn, ConnectCommand, target); code != tt.want {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), tt.want, byte(tt.want))
+			}
+		})
+	}
+}
+
+func TestDestinationRewriterUpdatesRequest(t *testing.T) {
+	requests := make(chan *statute.ProxyRequest, 1)
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithDestinationRewriter(func(_ context.Context, _ string, host string, port int) (string, int, error) {
+			return "sandbox." + host, port + 1, nil
+		}),
+		WithConnectHandle(func(req *statute.ProxyRequest) error {
+			requests <- req
+			return errors.New("not tunnelled")
+		}),
+	)
+	conn := dialServer(t, serve(t, s))
+	sendRequest(t, conn, ConnectCommand, "example.com:443")
+
+	select {
+	case req := <-requests:
+		if req.Destination != "sandbox.example.com:444" || req.DestHost != "sandbox.example.com" || req.DestPort != 444 {
+			t.Fatalf("handler got %s (%s, %d), want the rewritten destination", req.Destination, req.DestHost, req.DestPort)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler not called")
+	}
+}
+
+func TestAssociateForwardAddressFailure(t *testing.T) {
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithPacketForwardAddress(func(context.Context, string, net.PacketConn, net.Conn) (net.IP, int, error) {
+			return nil, 0, errors.New("no public address")
+		}),
+	)
+	conn := dialServer(t, serve(t, s))
+	if code, _ := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0"); code != serverFailure {
+		t.Fatalf("reply %v (%#x), want %v", code, byte(code), serverFailure)
+	}
+	// the control connection is closed after the failure
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after the failure = %v, want EOF", err)
+	}
+}
+
+func TestPacketForwardAddress(t *testing.T) {
+	// by default the reply carries the local address of the relay socket
+	conn := dialServer(t, serve(t, NewServer(WithLogger(statute.DefaultLogger{}))))
+	code, bind := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0")
+	if code != successReply || !bind.IP.Equal(net.IPv4(127, 0, 0, 1)) || bind.Port == 0 {
+		t.Fatalf("reply %v with %v, want success with the loopback relay address", code, bind)
+	}
+
+	// the hook sees the relay socket and control connection, its result is
+	// sent as is, such as the external endpoint of a relay behind NAT
+	relayPorts := make(chan int, 1)
+	s := NewServer(
+		WithLogger(statute.DefaultLogger{}),
+		WithPacketForwardAddress(func(_ context.Context, _ string, packet net.PacketConn, control net.Conn) (net.IP, int, error) {
+			if control == nil {
+				return nil, 0, errors.New("no control connection")
+			}
+			relayPorts <- packet.LocalAddr().(*net.UDPAddr).Port
+			return net.IPv4(203, 0, 113, 5), 40000, nil
+		}),
+	)
+	conn = dialServer(t, serve(t, s))
+	code, bind = sendRequest(t, conn, AssociateCommand, "0.0.0.0:0")
+	if code != successReply || !bind.IP.Equal(net.IPv4(203, 0, 113, 5)) || bind.Port != 40000 {
+		t.Fatalf("reply %v with %v, want success with 203.0.113.5:40000", code, bind)
+	}
+	if port := <-relayPorts; port == 0 {
+		t.Fatal("the hook got an unbound relay socket")
+	}
+}
+
+// stringAddr is a net.Addr of a custom transport
+type stringAddr string
+
+func (a stringAddr) Network() string { return "custom" }
+func (a stringAddr) String() string  { return string(a) }
+
+// localAddrConn and localAddrPacketConn report addr as their local address
+type localAddrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c localAddrConn) LocalAddr() net.Addr { return c.addr }
+
+type localAddrPacketConn struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (c localAddrPacketConn) LocalAddr() net.Addr { return c.addr }
+
+func TestDefaultReplyPacketForwardAddress(t *testing.T) {
+	tests := []struct {
+		name     string
+		packet   net.Addr
+		control  net.Addr
+		wantIP   net.IP
+		wantPort int
+		wantErr  bool
+	}{
+		{"net addresses", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5353}, &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1080}, net.IPv4(192, 0, 2, 1), 5353, false},
+		{"custom IPv4", stringAddr("0.0.0.0:5353"), stringAddr("192.0.2.1:1080"), net.IPv4(192, 0, 2, 1), 5353, false},
+		{"custom IPv6", stringAddr("[::]:5353"), stringAddr("[2001:db8::1]:1080"), net.ParseIP("2001:db8::1"), 5353, false},
+		{"custom mapped IPv4", stringAddr("[::]:5353"), stringAddr("[::ffff:192.0.2.1]:1080"), net.IPv4(192, 0, 2, 1), 5353, false},
+		{"unparsable relay", stringAddr("relay"), stringAddr("192.0.2.1:1080"), nil, 0, true},
+		{"unparsable control", stringAddr("0.0.0.0:5353"), stringAddr("pipe"), nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, port, err := defaultReplyPacketForwardAddress(context.Background(), "0.0.0.0:0",
+				localAddrPacketConn{addr: tt.packet}, localAddrConn{addr: tt.control})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %v:%d, want an error", ip, port)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ip.Equal(tt.wantIP) || port != tt.wantPort {
+				t.Fatalf("got %v:%d, want %v:%d", ip, port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}
+
+func TestPacketForwardHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		wantName string
+		wantIP   net.IP
+	}{
+		{"domain name", "relay.example.com", "relay.example.com", nil},
+		{"IPv4", "192.0.2.7", "", net.IPv4(192, 0, 2, 7)},
+		{"IPv6", "2001:db8::7", "", net.ParseIP("2001:db8::7")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				// the host takes precedence over the address
+				WithPacketForwardAddress(func(context.Context, string, net.PacketConn, net.Conn) (net.IP, int, error) {
+					return net.IPv4(192, 0, 2, 1), 1, nil
+				}),
+				WithPacketForwardHost(func(context.Context, string, net.PacketConn, net.Conn) (string, int, error) {
+					return tt.host, 5353, nil
+				}),
+			)
+			conn := dialServer(t, serve(t, s))
+			code, bind := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0")
+			if code != successReply {
+				t.Fatalf("reply %v (%#x), want success", code, byte(code))
+			}
+			if bind.Name != tt.wantName || !bind.IP.Equal(tt.wantIP) || bind.Port != 5353 {
+				t.Fatalf("bound address %+v, want name %q, IP %v and port 5353", bind, tt.wantName, tt.wantIP)
+			}
+		})
+	}
+}
+
+func TestLenientParsing(t *testing.T) {
+	target := tcpEcho(t)
+	tests := []struct {
+		name    string
+		lenient bool
+		// greeting is the version of the greeting, version the one of the
+		// command header
+		greeting, version byte
+		wantReply         bool
+	}{
+		{"strict", false, socks5Version, 0, false},
+		{"lenient", true, socks5Version, 0, true},
+		{"lenient bad greeting", true, 4, socks5Version, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(WithLogger(statute.DefaultLogger{}), WithLenientParsing(tt.lenient))
+			conn := dialServer(t, serve(t, s))
+			request := bytes.NewBuffer([]byte{tt.greeting, 1, byte(noAuth), tt.version, byte(ConnectCommand), 0})
+			if err := writeAddrWithStr(request, target); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := conn.Write(request.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.wantReply {
+				// the connection is closed, after at most the method reply,
+				// possibly reset as the request was not read in full
+				n, err := io.Copy(io.Discard, conn)
+				if n > 2 || errors.Is(err, os.ErrDeadlineExceeded) {
+					t.Fatalf("read %d bytes and %v, want the connection closed without a reply", n, err)
+				}
+				return
+			}
+			reply := make([]byte, 2+3)
+			if _, err := io.ReadFull(conn, reply); err != nil {
+				t.Fatal(err)
+			}
+			if code := reply[3]; code != byte(successReply) {
+				t.Fatalf("reply %#x, want success", code)
+			}
+		})
+	}
+}
+
+func TestPreConnectVeto(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want reply
+	}{
+		{"denied", fmt.Errorf("blocked: %w", statute.ErrRequestDenied), ruleFailure},
+		{"refused", syscall.ECONNREFUSED, connectionRefused},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var dialed atomic.Bool
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				WithPreConnect(func(context.Context, *statute.ProxyRequest) error { return tt.err }),
+				WithProxyDial(func(context.Context, string, string) (net.Conn, error) {
+					dialed.Store(true)
+					return nil, errors.New("not dialed")
+				}),
+			)
+			conn := dialServer(t, serve(t, s))
+			if code, _ := sendRequest(t, conn, ConnectCommand, "192.0.2.1:443"); code != tt.want {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), tt.want, byte(tt.want))
+			}
+			if dialed.Load() {
+				t.Fatal("vetoed request was dialed")
+			}
+		})
+	}
+}
+
+func TestPreConnectRewrite(t *testing.T) {
+	echo := tcpEcho(t)
+	echoHost, echoPortStr, _ := net.SplitHostPort(echo)
+	echoPort, _ := strconv.Atoi(echoPortStr)
+	redirect := func(_ context.Context, req *statute.ProxyRequest) error {
+		if req.DestHost != "192.0.2.1" || req.DestPort != 443 {
+			return fmt.Errorf("unexpected destination %s", req.Destination)
+		}
+		req.DestHost, req.DestPort = echoHost, int32(echoPort)
+		return nil
+	}
+
+	t.Run("embedded", func(t *testing.T) {
+		s := NewServer(WithLogger(statute.DefaultLogger{}), WithPreConnect(redirect))
+		conn := dialServer(t, serve(t, s))
+		if code, _ := sendRequest(t, conn, ConnectCommand, "192.0.2.1:443"); code != successReply {
+			t.Fatalf("reply %v, want %v", code, successReply)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(conn, got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != "ping" {
+			t.Fatalf("echoed %q, want %q", got, "ping")
+		}
+	})
+	t.Run("handler", func(t *testing.T) {
+		requests := make(chan *statute.ProxyRequest, 1)
+		s := NewServer(WithLogger(statute.DefaultLogger{}), WithPreConnect(redirect), WithConnectHandle(func(req *statute.ProxyRequest) error {
+			requests <- req
+			return errors.New("not tunnelled")
+		}))
+		conn := dialServer(t, serve(t, s))
+		sendRequest(t, conn, ConnectCommand, "192.0.2.1:443")
+		select {
+		case req := <-requests:
+			if req.Destination != echo {
+				t.Fatalf("handler got %s, want %s", req.Destination, echo)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("handler not called")
+		}
+	})
+}
+
+func TestCloseOnHandlerError(t *testing.T) {
+	refuse := func(req *statute.ProxyRequest) error {
+		return syscall.ECONNREFUSED
+	}
+	replyThenFail := func(req *statute.ProxyRequest) error {
+		if err := req.Reply(nil, nil); err != nil {
+			return err
+		}
+		return errors.New("upstream lost")
+	}
+	tests := []struct {
+		name      string
+		options   []ServerOption
+		want      reply
+		wantClose bool
+	}{
+		{"error before the reply", []ServerOption{WithDeferConnectReply(), WithCloseOnHandlerError(), WithConnectHandle(refuse)}, connectionRefused, true},
+		{"error after the reply", []ServerOption{WithDeferConnectReply(), WithCloseOnHandlerError(), WithConnectHandle(replyThenFail)}, successReply, true},
+		{"left to the caller", []ServerOption{WithConnectHandle(refuse)}, successReply, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(append([]ServerOption{WithLogger(statute.DefaultLogger{})}, tt.options...)...)
+			conn := dialServer(t, serve(t, s))
+			if code, _ := sendRequest(t, conn, ConnectCommand, "192.0.2.1:443"); code != tt.want {
+				t.Fatalf("reply %v (%#x), want %v (%#x)", code, byte(code), tt.want, byte(tt.want))
+			}
+			_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			_, err := conn.Read(make([]byte, 1))
+			if tt.wantClose && !errors.Is(err, io.EOF) {
+				t.Fatalf("read after the handler failed = %v, want EOF", err)
+			}
+			if !tt.wantClose && !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Fatalf("read after the handler failed = %v, want the connection left open", err)
+			}
+		})
+	}
+}
+
+// countingConn is a net.Conn reading from r and discarding writes, it counts
+// the reads, each of which is a system call on a real connection
+type countingConn struct {
+	r     io.Reader
+	reads int
+}
+
+func (c *countingConn) Read(p []byte) (int, error) {
+	c.reads++
+	return c.r.Read(p)
+}
+
+func (c *countingConn) Write(p []byte) (int, error)      { return len(p), nil }
+func (c *countingConn) Close() error                     { return nil }
+func (c *countingConn) LocalAddr() net.Addr              { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *countingConn) RemoteAddr() net.Addr             { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (c *countingConn) SetDeadline(time.Time) error      { return nil }
+func (c *countingConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *countingConn) SetWriteDeadline(time.Time) error { return nil }
+
+// pipelinedConnect is a greeting, a CONNECT request and the first payload
+// sent by a client at once
+func pipelinedConnect(t testing.TB, payload string) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0})
+	if err := writeAddrWithStr(buf, "192.0.2.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString(payload)
+	return buf.Bytes()
+}
+
+func TestHandshakeKeepsPipelinedBytes(t *testing.T) {
+	conn := &countingConn{r: bytes.NewReader(pipelinedConnect(t, "payload"))}
+	var received []byte
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(func(req *statute.ProxyRequest) error {
+		var err error
+		received, err = io.ReadAll(req.Conn)
+		return err
+	}))
+	if err := s.ServeConn(conn); err != nil {
+		t.Fatal(err)
+	}
+	if string(received) != "payload" {
+		t.Fatalf("handler read %q, want %q", received, "payload")
+	}
+	// one read for everything the client sent and one for its EOF
+	if conn.reads > 2 {
+		t.Fatalf("%d reads of the connection, want at most 2", conn.reads)
+	}
+}
+
+// BenchmarkHandshake parses a pipelined greeting and CONNECT request, the
+// buffered case is ServeConn and the unbuffered one the same parsers reading
+// the connection directly, reads/op counts the reads of the connection
+func BenchmarkHandshake(b *testing.B) {
+	data := pipelinedConnect(b, "")
+	discard := func(*statute.ProxyRequest) error { return nil }
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(discard))
+
+	b.Run("buffered", func(b *testing.B) {
+		b.ReportAllocs()
+		reads := 0
+		for i := 0; i < b.N; i++ {
+			conn := &countingConn{r: bytes.NewReader(data)}
+			if err := s.ServeConn(conn); err != nil {
+				b.Fatal(err)
+			}
+			reads += conn.reads
+		}
+		b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+	})
+	b.Run("unbuffered", func(b *testing.B) {
+		b.ReportAllocs()
+		reads := 0
+		for i := 0; i < b.N; i++ {
+			conn := &countingConn{r: bytes.NewReader(data)}
+			if _, err := readByte(conn); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := readBytes(conn); err != nil {
+				b.Fatal(err)
+			}
+			var header [3]byte
+			if _, err := io.ReadFull(conn, header[:]); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := readAddr(conn); err != nil {
+				b.Fatal(err)
+			}
+			reads += conn.reads
+		}
+		b.ReportMetric(float64(reads)/float64(b.N), "reads/op")
+	})
+}
+
+func TestServeConnRecoversHandlerPanic(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(func(*statute.ProxyRequest) error {
+		panic("broken handler")
+	}))
+	served := make(chan error, 1)
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	request := bytes.NewBuffer([]byte{socks5Version, 1, byte(noAuth), socks5Version, byte(ConnectCommand), 0})
+	if err := writeAddrWithStr(request, "192.0.2.1:80"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = client.Write(request.Bytes())
+	}()
+	// the connection is closed once the panic is recovered
+	if _, err := io.Copy(io.Discard, client); err != nil {
+		t.Fatalf("reading until close = %v", err)
+	}
+	within(t, "ServeConn", func() {
+		if err := <-served; !errors.Is(err, statute.ErrHandlerPanic) {
+			t.Errorf("ServeConn() = %v, want %v", err, statute.ErrHandlerPanic)
+		}
+	})
+}
+
+func TestReplyTimeout(t *testing.T) {
+	if got := NewServer().ReplyTimeout; got != statute.DefaultReplyTimeout {
+		t.Fatalf("default ReplyTimeout = %v, want %v", got, statute.DefaultReplyTimeout)
+	}
+
+	tests := []struct {
+		name string
+		// client sends its handshake up to the reply it never reads
+		client func(conn net.Conn) error
+	}{
+		{
+			name: "method selection",
+			client: func(conn net.Conn) error {
+				_, err := conn.Write([]byte{socks5Version, 1, byte(noAuth)})
+				return err
+			},
+		},
+		{
+			name: "authentication status",
+			client: func(conn net.Conn) error {
+				if _, err := conn.Write([]byte{socks5Version, 1, byte(userPassAuth)}); err != nil {
+					return err
+				}
+				if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+					return err
+				}
+				_, err := conn.Write([]byte("\x01\x05alice\x06secret"))
+				return err
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				WithReplyTimeout(50*time.Millisecond),
+				WithAuthMethods(NoAuth{}, UserPassAuth{Authenticator: func(_ context.Context, username, password string) bool {
+					return username == "alice" && password == "secret"
+				}}),
+			)
+			served := make(chan error, 1)
+			go func() {
+				served <- s.ServeConn(server)
+			}()
+			_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+			if err := tt.client(client); err != nil {
+				t.Fatal(err)
+			}
+			within(t, "ServeConn", func() {
+				if err := <-served; !errors.Is(err, statute.ErrReplyTimeout) {
+					t.Errorf("ServeConn() = %v, want %v", err, statute.ErrReplyTimeout)
+				}
+			})
+		})
+	}
+}
+
+func TestMaxConnectionLifetime(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithMaxConnectionLifetime(300*time.Millisecond))
+	served := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		served <- s.ServeConn(server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if code, _ := sendRequest(t, client, ConnectCommand, tcpEcho(t)); code != successReply {
+		t.Fatalf("reply %v, want %v", code, successReply)
+	}
+	// the tunnel stays busy, only its lifetime ends it
+	buf := make([]byte, 4)
+	for {
+		if _, err := client.Write([]byte("ping")); err != nil {
+			break
+		}
+		if _, err := io.ReadFull(client, buf); err != nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if lifetime := time.Since(start); lifetime < 300*time.Millisecond || lifetime > 2*time.Second {
+		t.Fatalf("tunnel closed after %v, want about 300ms", lifetime)
+	}
+	within(t, "ServeConn", func() {
+		if err := <-served; !errors.Is(err, statute.ErrMaxLifetime) {
+			t.Errorf("ServeConn() = %v, want %v", err, statute.ErrMaxLifetime)
+		}
+	})
+}
+
+func TestContextDoneUnblocksHandler(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	handlerDone := make(chan error, 1)
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithConnectHandle(func(req *statute.ProxyRequest) error {
+		// a handler copying without watching the context
+		_, err := io.Copy(io.Discard, req.Conn)
+		handlerDone <- err
+		return err
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_ = s.ServeConnContext(ctx, server)
+	}()
+
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if code, _ := sendRequest(t, client, ConnectCommand, "192.0.2.1:443"); code != successReply {
+		t.Fatalf("reply %v, want %v", code, successReply)
+	}
+	cancel()
+	select {
+	case <-handlerDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler still copying after the context was done")
+	}
+}
+
+func TestMiddlewareWrapsEmbeddedHandler(t *testing.T) {
+	calls := make(chan string, 4)
+	record := func(name string) statute.Middleware {
+		return func(next statute.UserConnectHandler) statute.UserConnectHandler {
+			return func(req *statute.ProxyRequest) error {
+				calls <- name
+				return next(req)
+			}
+		}
+	}
+	s := NewServer(WithLogger(statute.DefaultLogger{}), WithMiddleware(record("outer"), record("inner")))
+	conn := dialServer(t, serve(t, s))
+	if code, _ := sendRequest(t, conn, ConnectCommand, tcpEcho(t)); code != successReply {
+		t.Fatalf("reply %v, want %v", code, successReply)
+	}
+	// the embedded handler tunnels the request once the middlewares ran
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	if first, second := <-calls, <-calls; first != "outer" || second != "inner" {
+		t.Fatalf("middlewares ran as %s, %s, want outer, inner", first, second)
+	}
+}
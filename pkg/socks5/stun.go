@@ -0,0 +1,182 @@
+package socks5
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+	"time"
+)
+
+// STUN binding request and response, RFC 5389
+const (
+	stunBindingRequest  = 0x0001
+	stunBindingResponse = 0x0101
+	stunMagicCookie     = 0x2112A442
+	stunHeaderLength    = 20
+
+	stunAttrMappedAddress    = 0x0001
+	stunAttrXORMappedAddress = 0x0020
+)
+
+const (
+	// stunAttempts bounds the binding requests sent per discovery
+	stunAttempts = 3
+	// stunAttemptTimeout is how long a binding request waits for the response
+	stunAttemptTimeout = 500 * time.Millisecond
+)
+
+var errSTUNNoMappedAddress = errors.New("stun: response has no mapped address")
+
+// STUNForwardAddress returns a PacketForwardAddress discovering the external
+// address of the relay socket with a STUN binding request to stunServer, a
+// host:port such as stun.l.google.com:19302. Behind NAT the mapped address
+// is what clients must send their datagrams to. The discovery runs on the
+// relay socket before the UDP ASSOCIATE reply is sent, it fails if the STUN
+// server does not answer any of a few attempts.
+func STUNForwardAddress(stunServer string) statute.PacketForwardAddress {
+	return func(ctx context.Context, destinationAddr string, packet net.PacketConn, _ net.Conn) (net.IP, int, error) {
+		server, err := net.ResolveUDPAddr("udp", stunServer)
+		if err != nil {
+			return nil, 0, fmt.Errorf("resolve STUN server %s: %w", stunServer, err)
+		}
+		ip, port, err := stunBinding(ctx, packet, server)
+		if err != nil {
+			return nil, 0, fmt.Errorf("discover relay address of %s with %s: %w", destinationAddr, stunServer, err)
+		}
+		return ip, port, nil
+	}
+}
+
+// stunBinding sends binding requests to server on packet until one is
+// answered and returns the mapped address, datagrams of other senders are
+// dropped
+func stunBinding(ctx context.Context, packet net.PacketConn, server *net.UDPAddr) (net.IP, int, error) {
+	defer func() {
+		_ = packet.SetReadDeadline(time.Time{})
+	}()
+
+	request := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(request[0:], stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	if _, err := rand.Read(request[8:stunHeaderLength]); err != nil {
+		return nil, 0, err
+	}
+	transactionID := request[8:stunHeaderLength]
+
+	buf := make([]byte, 1500)
+	var lastErr error
+	for attempt := 0; attempt < stunAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return nil, 0, err
+		}
+		if _, err := packet.WriteTo(request, server); err != nil {
+			return nil, 0, err
+		}
+		deadline := time.Now().Add(stunAttemptTimeout)
+		if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+			deadline = d
+		}
+		_ = packet.SetReadDeadline(deadline)
+
+		for {
+			n, addr, err := packet.ReadFrom(buf)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			if udpAddr, ok := addr.(*net.UDPAddr); !ok || !udpAddr.IP.Equal(server.IP) || udpAddr.Port != server.Port {
+				continue
+			}
+			ip, port, err := parseSTUNResponse(buf[:n], transactionID)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			return ip, port, nil
+		}
+	}
+	return nil, 0, lastErr
+}
+
+// parseSTUNResponse returns the mapped address of a binding response to the
+// request with transactionID, XOR-MAPPED-ADDRESS is preferred
+func parseSTUNResponse(msg, transactionID []byte) (net.IP, int, error) {
+	if len(msg) < stunHeaderLength ||
+		binary.BigEndian.Uint16(msg[0:]) != stunBindingResponse ||
+		binary.BigEndian.Uint32(msg[4:]) != stunMagicCookie ||
+		!bytes.Equal(msg[8:stunHeaderLength], transactionID) {
+		return nil, 0, errors.New("stun: not a binding response to the request")
+	}
+	length := int(binary.BigEndian.Uint16(msg[2:]))
+	if stunHeaderLength+length > len(msg) {
+		return nil, 0, errors.New("stun: truncated response")
+	}
+	attrs := msg[stunHeaderLength : stunHeaderLength+length]
+
+	var mappedIP net.IP
+	var mappedPort int
+	for len(attrs) >= 4 {
+		attrType := binary.BigEndian.Uint16(attrs[0:])
+		attrLength := int(binary.BigEndian.Uint16(attrs[2:]))
+		if 4+attrLength > len(attrs) {
+			return nil, 0, errors.New("stun: truncated attribute")
+		}
+		value := attrs[4 : 4+attrLength]
+		switch attrType {
+		case stunAttrXORMappedAddress:
+			ip, port, err := parseSTUNAddress(value)
+			if err != nil {
+				return nil, 0, err
+			}
+			port ^= stunMagicCookie >> 16
+			key := msg[4:stunHeaderLength]
+			for i := range ip {
+				ip[i] ^= key[i]
+			}
+			return ip, port, nil
+		case stunAttrMappedAddress:
+			ip, port, err := parseSTUNAddress(value)
+			if err != nil {
+				return nil, 0, err
+			}
+			mappedIP, mappedPort = ip, port
+		}
+		// attributes are padded to 4 bytes
+		next := 4 + (attrLength+3)&^3
+		if next > len(attrs) {
+			break
+		}
+		attrs = attrs[next:]
+	}
+	if mappedIP == nil {
+		return nil, 0, errSTUNNoMappedAddress
+	}
+	return mappedIP, mappedPort, nil
+}
+
+// parseSTUNAddress parses the value of a (XOR-)MAPPED-ADDRESS attribute, the
+// returned ip is a copy
+func parseSTUNAddress(value []byte) (net.IP, int, error) {
+	if len(value) < 4 {
+		return nil, 0, errors.New("stun: truncated address")
+	}
+	port := int(binary.BigEndian.Uint16(value[2:]))
+	var size int
+	switch value[1] {
+	case 0x01:
+		size = net.IPv4len
+	case 0x02:
+		size = net.IPv6len
+	default:
+		return nil, 0, fmt.Errorf("stun: unknown address family %d", value[1])
+	}
+	if len(value) < 4+size {
+		return nil, 0, errors.New("stun: truncated address")
+	}
+	return append(net.IP(nil), value[4:4+size]...), port, nil
+}
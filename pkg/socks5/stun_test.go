@@ -0,0 +1,128 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/bepass-org/proxy/pkg/statute"
+	"net"
+	"testing"
+)
+
+// stunResponse returns a binding response to request mapping to ip and
+// port, with an XOR-MAPPED-ADDRESS attribute if xor is set and a
+// MAPPED-ADDRESS one otherwise
+func stunResponse(request []byte, ip net.IP, port int, xor bool) []byte {
+	value := binary.BigEndian.AppendUint16([]byte{0, 0x01}, uint16(port))
+	value = append(value, ip.To4()...)
+	attrType := uint16(stunAttrMappedAddress)
+	if xor {
+		attrType = stunAttrXORMappedAddress
+		binary.BigEndian.PutUint16(value[2:], uint16(port)^stunMagicCookie>>16)
+		for i := 0; i < net.IPv4len; i++ {
+			value[4+i] ^= request[4+i]
+		}
+	}
+	msg := binary.BigEndian.AppendUint16(nil, stunBindingResponse)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(4+len(value)))
+	msg = append(msg, request[4:stunHeaderLength]...)
+	msg = binary.BigEndian.AppendUint16(msg, attrType)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(value)))
+	return append(msg, value...)
+}
+
+// stunResponder starts a loopback STUN server answering binding requests
+// with ip and port as the mapped address, it returns its address
+func stunResponder(t testing.TB, ip net.IP, port int, xor bool) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if n < stunHeaderLength || binary.BigEndian.Uint16(buf) != stunBindingRequest {
+				continue
+			}
+			_, _ = conn.WriteTo(stunResponse(buf[:n], ip, port, xor), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestSTUNForwardAddress(t *testing.T) {
+	mapped := net.IPv4(203, 0, 113, 5)
+	tests := []struct {
+		name string
+		xor  bool
+	}{
+		{"XOR-MAPPED-ADDRESS", true},
+		{"MAPPED-ADDRESS", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewServer(
+				WithLogger(statute.DefaultLogger{}),
+				WithPacketForwardAddress(STUNForwardAddress(stunResponder(t, mapped, 4242, tt.xor))),
+			)
+			conn := dialServer(t, serve(t, s))
+			code, bind := sendRequest(t, conn, AssociateCommand, "0.0.0.0:0")
+			if code != successReply {
+				t.Fatalf("reply %v, want %v", code, successReply)
+			}
+			// the reply carries the address discovered through the NAT
+			if !bind.IP.Equal(mapped) || bind.Port != 4242 {
+				t.Fatalf("relay address %v, want %v:4242", bind, mapped)
+			}
+		})
+	}
+}
+
+func TestParseSTUNResponse(t *testing.T) {
+	request := make([]byte, stunHeaderLength)
+	binary.BigEndian.PutUint16(request, stunBindingRequest)
+	binary.BigEndian.PutUint32(request[4:], stunMagicCookie)
+	copy(request[8:], "transaction!")
+	transactionID := request[8:stunHeaderLength]
+	response := stunResponse(request, net.IPv4(203, 0, 113, 5), 4242, true)
+
+	otherTransaction := append([]byte(nil), response...)
+	otherTransaction[8] ^= 0xff
+	noAddress := append([]byte(nil), response[:stunHeaderLength]...)
+	binary.BigEndian.PutUint16(noAddress[2:], 0)
+
+	tests := []struct {
+		name    string
+		msg     []byte
+		wantErr bool
+	}{
+		{"valid", response, false},
+		{"other transaction", otherTransaction, true},
+		{"truncated", response[:len(response)-2], true},
+		{"no mapped address", noAddress, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip, port, err := parseSTUNResponse(tt.msg, transactionID)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parseSTUNResponse() = %v:%d, want an error", ip, port)
+				}
+				return
+			}
+			if err != nil || !ip.Equal(net.IPv4(203, 0, 113, 5)) || port != 4242 {
+				t.Fatalf("parseSTUNResponse() = %v:%d, %v, want 203.0.113.5:4242", ip, port, err)
+			}
+		})
+	}
+	if _, _, err := parseSTUNResponse(noAddress, transactionID); !errors.Is(err, errSTUNNoMappedAddress) {
+		t.Fatalf("parseSTUNResponse() without an address = %v, want %v", err, errSTUNNoMappedAddress)
+	}
+}
@@ -0,0 +1,261 @@
+package statute
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// AccessLogApache writes entries similar to the Common Log Format
+	// client - user [time] "COMMAND destination protocol" status sent received duration auth=method/result
+	AccessLogApache = "apache"
+	// AccessLogJSON writes one json object per entry
+	AccessLogJSON = "json"
+)
+
+// Authentication methods recorded in the access log
+const (
+	AuthMethodNone     = "none"
+	AuthMethodUserPass = "userpass"
+	AuthMethodGSSAPI   = "gssapi"
+	AuthMethodIdent    = "ident"
+	AuthMethodBasic    = "basic"
+)
+
+// AccessLog writes one record per proxied connection once it is closed
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+}
+
+// NewAccessLog creates an AccessLog writing to w, unknown formats fall back
+// to AccessLogApache
+func NewAccessLog(w io.Writer, format string) *AccessLog {
+	if format != AccessLogJSON {
+		format = AccessLogApache
+	}
+	return &AccessLog{
+		w:      w,
+		format: format,
+	}
+}
+
+// AccessConn is a net.Conn recording the details of a proxied connection for
+// the access log
+type AccessConn struct {
+	net.Conn
+	start       time.Time
+	protocol    string
+	command     string
+	destination string
+	user        string
+	authMethod  string
+	authUser    string
+	authOK      bool
+	status      int
+	bytesIn     atomic.Int64
+	bytesOut    atomic.Int64
+	mu          sync.Mutex
+}
+
+// NewAccessConn wraps conn to record a connection of protocol
+func NewAccessConn(conn net.Conn, protocol string) *AccessConn {
+	return &AccessConn{
+		Conn:     conn,
+		start:    time.Now(),
+		protocol: protocol,
+	}
+}
+
+func (c *AccessConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.bytesIn.Add(int64(n))
+	return n, err
+}
+
+func (c *AccessConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.bytesOut.Add(int64(n))
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *AccessConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// CloseWrite
+func (c *AccessConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// WriteTo lets the wrapped connection copy to w, see WriteTo. The bytes are
+// counted once the copy ends.
+func (c *AccessConn) WriteTo(w io.Writer) (int64, error) {
+	n, err := WriteTo(c.Conn, w)
+	c.bytesIn.Add(n)
+	return n, err
+}
+
+// ReadFrom lets the wrapped connection copy from r, see ReadFrom. The bytes
+// are counted once the copy ends.
+func (c *AccessConn) ReadFrom(r io.Reader) (int64, error) {
+	n, err := ReadFrom(c.Conn, r)
+	c.bytesOut.Add(n)
+	return n, err
+}
+
+// findAccessConn looks for an AccessConn in w, unwrapping connections that
+// expose the connection they wrap through NetConn
+func findAccessConn(w io.Writer) *AccessConn {
+	for {
+		switch c := w.(type) {
+		case *AccessConn:
+			return c
+		case interface{ NetConn() net.Conn }:
+			w = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// RecordAccessRequest stores the request details on w if it is or wraps an
+// AccessConn
+func RecordAccessRequest(w io.Writer, command, destination, user string) {
+	c := findAccessConn(w)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.command = command
+	c.destination = destination
+	c.user = user
+	c.mu.Unlock()
+}
+
+// RecordAccessAuth stores the authentication method, the user it claimed and
+// whether it succeeded on w if it is or wraps an AccessConn
+func RecordAccessAuth(w io.Writer, method, user string, ok bool) {
+	c := findAccessConn(w)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.authMethod = method
+	c.authUser = user
+	c.authOK = ok
+	c.mu.Unlock()
+}
+
+// RecordAccessStatus stores the reply status on w if it is or wraps an
+// AccessConn
+func RecordAccessStatus(w io.Writer, status int) {
+	c := findAccessConn(w)
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.status = status
+	c.mu.Unlock()
+}
+
+type accessEntry struct {
+	Time        time.Time `json:"time"`
+	Client      string    `json:"client"`
+	User        string    `json:"user,omitempty"`
+	AuthMethod  string    `json:"auth_method,omitempty"`
+	AuthUser    string    `json:"auth_user,omitempty"`
+	AuthOK      *bool     `json:"auth_ok,omitempty"`
+	Protocol    string    `json:"protocol"`
+	Command     string    `json:"command"`
+	Destination string    `json:"destination"`
+	Status      int       `json:"status"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	Duration    int64     `json:"duration_ms"`
+}
+
+// Log writes the record of c
+func (l *AccessLog) Log(c *AccessConn) error {
+	c.mu.Lock()
+	entry := accessEntry{
+		Time:        c.start,
+		Protocol:    c.protocol,
+		Command:     c.command,
+		Destination: c.destination,
+		User:        c.user,
+		AuthMethod:  c.authMethod,
+		AuthUser:    c.authUser,
+		Status:      c.status,
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		Duration:    time.Since(c.start).Milliseconds(),
+	}
+	if c.authMethod != "" {
+		authOK := c.authOK
+		entry.AuthOK = &authOK
+	}
+	c.mu.Unlock()
+	if addr := c.RemoteAddr(); addr != nil {
+		entry.Client = addr.String()
+	}
+
+	var line []byte
+	if l.format == AccessLogJSON {
+		b, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(b, '\n')
+	} else {
+		// the user and the destination come from the client
+		user := escapeLogItem(entry.User)
+		if user == "" {
+			user = "-"
+		}
+		line = []byte(fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d %d %dms\n",
+			entry.Client, user, entry.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			escapeLogItem(entry.Command), escapeLogItem(entry.Destination), entry.Protocol,
+			entry.Status, entry.BytesOut, entry.BytesIn, entry.Duration))
+		if entry.AuthMethod != "" {
+			result := "failure"
+			if *entry.AuthOK {
+				result = "success"
+			}
+			line = append(line[:len(line)-1], fmt.Sprintf(" auth=%s/%s\n", entry.AuthMethod, result)...)
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(line)
+	return err
+}
+
+// escapeLogItem escapes s for the apache format like Apache does, quotes and
+// backslashes are escaped with a backslash, spaces, control characters and
+// non-ASCII bytes as \xHH, so s can't split or forge records
+func escapeLogItem(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c <= ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, "\\x%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,110 @@
+package statute
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+// accessRecord writes the record of a connection with the request details
+// and the credentials a client sent to a new AccessLog of format
+func accessRecord(t testing.TB, format, user, destination string) string {
+	t.Helper()
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		_, _ = client.Read(make([]byte, 5))
+	}()
+
+	conn := NewAccessConn(server, "socks5")
+	RecordAccessAuth(conn, AuthMethodUserPass, user, true)
+	RecordAccessRequest(conn, "CONNECT", destination, user)
+	RecordAccessStatus(conn, 0)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := NewAccessLog(&buf, format).Log(conn); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        string
+		destination string
+		// apache is the record between the time and the duration
+		apache string
+	}{
+		{
+			name:        "plain",
+			user:        "alice",
+			destination: "example.com:443",
+			apache:      `"CONNECT example.com:443 socks5" 0 5 0 `,
+		},
+		{
+			name:        "anonymous",
+			destination: "example.com:443",
+			apache:      `"CONNECT example.com:443 socks5" 0 5 0 `,
+		},
+		{
+			name:        "forged record",
+			user:        "bob\npipe - admin",
+			destination: "evil.com\" 200 \\\x00\xff:80",
+			apache:      `"CONNECT evil.com\"\x20200\x20\\\x00\xff:80 socks5" 0 5 0 `,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			line := accessRecord(t, AccessLogApache, tt.user, tt.destination)
+			if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+				t.Fatalf("apache record %q is not one line", line)
+			}
+			user := escapeLogItem(tt.user)
+			if user == "" {
+				user = "-"
+			}
+			if prefix := "pipe - " + user + " ["; !strings.HasPrefix(line, prefix) {
+				t.Fatalf("apache record %q, want prefix %q", line, prefix)
+			}
+			if !strings.Contains(line, "] "+tt.apache) || !strings.HasSuffix(line, "ms auth=userpass/success\n") {
+				t.Fatalf("apache record %q, want %q and the authentication", line, tt.apache)
+			}
+
+			line = accessRecord(t, AccessLogJSON, tt.user, tt.destination)
+			if strings.Count(line, "\n") != 1 || !strings.HasSuffix(line, "\n") {
+				t.Fatalf("json record %q is not one line", line)
+			}
+			var entry accessEntry
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatal(err)
+			}
+			if entry.User != strings.ToValidUTF8(tt.user, "�") || entry.Destination != strings.ToValidUTF8(tt.destination, "�") || entry.BytesOut != 5 {
+				t.Fatalf("json record %+v, want user %q, destination %q and 5 bytes out", entry, tt.user, tt.destination)
+			}
+		})
+	}
+}
+
+func TestEscapeLogItem(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"alice", "alice"},
+		{"a b", `a\x20b`},
+		{"line\nbreak\r", `line\x0abreak\x0d`},
+		{`"quoted" \ `, `\"quoted\"\x20\\\x20`},
+		{"caf\xc3\xa9\x7f", `caf\xc3\xa9\x7f`},
+	}
+	for _, tt := range tests {
+		if got := escapeLogItem(tt.in); got != tt.want {
+			t.Errorf("escapeLogItem(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package statute
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+type connIDKey struct{}
+
+var lastConnID atomic.Uint64
+
+// NewConnID returns a new process wide unique, monotonically increasing
+// connection id
+func NewConnID() uint64 {
+	return lastConnID.Add(1)
+}
+
+// WithConnID returns a copy of ctx carrying the connection id
+func WithConnID(ctx context.Context, id uint64) context.Context {
+	return context.WithValue(ctx, connIDKey{}, id)
+}
+
+// ConnID returns the connection id carried by ctx, it reports false if ctx
+// has none
+func ConnID(ctx context.Context) (uint64, bool) {
+	id, ok := ctx.Value(connIDKey{}).(uint64)
+	return id, ok
+}
+
+// connLogger prefixes every line with a connection id
+type connLogger struct {
+	prefix string
+	logger Logger
+}
+
+func (l connLogger) Debug(v ...interface{}) {
+	l.logger.Debug(append([]interface{}{l.prefix}, v...)...)
+}
+
+func (l connLogger) Error(v ...interface{}) {
+	l.logger.Error(append([]interface{}{l.prefix}, v...)...)
+}
+
+// ConnLogger returns a Logger prefixing the lines of logger with the
+// connection id carried by ctx, or adding it as the "conn" field when logger
+// supports fields. logger is returned as is if ctx has none.
+func ConnLogger(ctx context.Context, logger Logger) Logger {
+	id, ok := ConnID(ctx)
+	if !ok {
+		return logger
+	}
+	if fieldLogger, ok := withField(logger, "conn", id); ok {
+		return fieldLogger
+	}
+	return connLogger{
+		prefix: fmt.Sprintf("[conn %d]", id),
+		logger: logger,
+	}
+}
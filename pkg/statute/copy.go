@@ -0,0 +1,67 @@
+package statute
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// deadlineReader and deadlineWriter are implemented by net.Conn
+type deadlineReader interface {
+	SetReadDeadline(t time.Time) error
+}
+
+type deadlineWriter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// CloseOnDone closes c once ctx is done, the returned stop function undoes
+// it like the one of context.AfterFunc. The servers use it so that the
+// connection of a ProxyRequest is closed when its Context is done.
+func CloseOnDone(ctx context.Context, c io.Closer) (stop func() bool) {
+	return context.AfterFunc(ctx, func() {
+		_ = c.Close()
+	})
+}
+
+// CopyWithContext copies from src to dst like io.Copy until EOF, an error or
+// ctx is done, in which case context.Cause(ctx) is returned. A pending read
+// of src or write of dst is interrupted by expiring its deadline when it
+// supports one, such as a net.Conn, the deadline stays expired afterwards.
+// Other readers are only checked for ctx between reads.
+func CopyWithContext(ctx context.Context, dst io.Writer, src io.Reader) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, context.Cause(ctx)
+	}
+	stop := context.AfterFunc(ctx, func() {
+		now := time.Now()
+		if r, ok := src.(deadlineReader); ok {
+			_ = r.SetReadDeadline(now)
+		}
+		if w, ok := dst.(deadlineWriter); ok {
+			_ = w.SetWriteDeadline(now)
+		}
+	})
+
+	buf := defaultBytesPool.Get()
+	defer defaultBytesPool.Put(buf)
+	n, err := io.CopyBuffer(dst, &ctxReader{ctx: ctx, r: src}, buf)
+	if !stop() {
+		return n, context.Cause(ctx)
+	}
+	return n, err
+}
+
+// ctxReader fails reads once ctx is done, it also hides the io.WriterTo of
+// r so io.CopyBuffer reads through it
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r *ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, context.Cause(r.ctx)
+	}
+	return r.r.Read(p)
+}
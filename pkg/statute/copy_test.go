@@ -0,0 +1,78 @@
+package statute
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCopyWithContext(t *testing.T) {
+	src, peer := net.Pipe()
+	defer src.Close()
+	defer peer.Close()
+	errStop := errors.New("stopped")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	var dst bytes.Buffer
+	type copyResult struct {
+		n   int64
+		err error
+	}
+	done := make(chan copyResult, 1)
+	go func() {
+		n, err := CopyWithContext(ctx, &dst, src)
+		done <- copyResult{n, err}
+	}()
+
+	if _, err := peer.Write([]byte("partial")); err != nil {
+		t.Fatal(err)
+	}
+	// the copy is blocked reading src when ctx is cancelled
+	cancel(errStop)
+	select {
+	case r := <-done:
+		if !errors.Is(r.err, errStop) {
+			t.Fatalf("CopyWithContext() = %v, want %v", r.err, errStop)
+		}
+		if r.n != int64(len("partial")) || dst.String() != "partial" {
+			t.Fatalf("CopyWithContext() copied %d bytes %q, want %q", r.n, dst.String(), "partial")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("CopyWithContext did not return after cancel")
+	}
+
+	// a done context copies nothing
+	if n, err := CopyWithContext(ctx, io.Discard, bytes.NewReader([]byte("data"))); n != 0 || !errors.Is(err, errStop) {
+		t.Fatalf("CopyWithContext() = %d, %v with a done context, want 0, %v", n, err, errStop)
+	}
+}
+
+func TestCloseOnDone(t *testing.T) {
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	CloseOnDone(ctx, conn)
+	cancel()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("read after cancel = %v, want %v", err, io.ErrClosedPipe)
+	}
+
+	// a stopped CloseOnDone leaves the connection open
+	conn, peer = net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	ctx, cancel = context.WithCancel(context.Background())
+	CloseOnDone(ctx, conn)()
+	cancel()
+	go func() {
+		_, _ = peer.Write([]byte("x"))
+	}()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after stop = %v, want the connection open", err)
+	}
+}
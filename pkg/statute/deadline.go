@@ -0,0 +1,55 @@
+package statute
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// ErrReplyTimeout is wrapped by the error of a reply the client did not
+// accept within the reply timeout of the server
+var ErrReplyTimeout = errors.New("reply write timed out")
+
+// DefaultReplyTimeout is the reply timeout of new socks5, socks4 and http
+// servers. Reply writes used to have no deadline, a client that doesn't read
+// its reply for this long now has its connection ended.
+const DefaultReplyTimeout = 10 * time.Second
+
+// HandshakeDeadline bounds the reads of conn to timeout from now, so a client
+// stalling or trickling its handshake one byte at a time can't hold the
+// connection. The returned function lifts the deadline once the handshake is
+// read. A zero timeout sets no deadline.
+func HandshakeDeadline(conn net.Conn, timeout time.Duration) (clear func()) {
+	if timeout <= 0 {
+		return func() {}
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	return func() {
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+// ReplyDeadline bounds the writes to w, when it is a connection, to timeout
+// from now, so a client whose receive buffer is full can't block the server
+// writing a reply. The returned function lifts the deadline and wraps the
+// error of the writes with ErrReplyTimeout if they timed out. A zero timeout
+// sets no deadline.
+func ReplyDeadline(w io.Writer, timeout time.Duration) (done func(err error) error) {
+	conn, ok := w.(interface{ SetWriteDeadline(time.Time) error })
+	if timeout <= 0 || !ok {
+		return func(err error) error {
+			return err
+		}
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(timeout))
+	return func(err error) error {
+		_ = conn.SetWriteDeadline(time.Time{})
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("%w: %w", ErrReplyTimeout, err)
+		}
+		return err
+	}
+}
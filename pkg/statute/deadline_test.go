@@ -0,0 +1,45 @@
+package statute
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestReplyDeadline(t *testing.T) {
+	// nothing reads the other end, the write blocks
+	conn, stalled := net.Pipe()
+	defer conn.Close()
+	defer stalled.Close()
+
+	done := ReplyDeadline(conn, 50*time.Millisecond)
+	start := time.Now()
+	_, err := conn.Write([]byte("reply"))
+	err = done(err)
+	if !errors.Is(err, ErrReplyTimeout) || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("write error %v, want %v", err, ErrReplyTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("write returned after %v", elapsed)
+	}
+
+	// the deadline is lifted once done
+	go func() {
+		_, _ = stalled.Read(make([]byte, 5))
+	}()
+	if _, err := conn.Write([]byte("later")); err != nil {
+		t.Fatalf("write after done = %v, want the deadline lifted", err)
+	}
+
+	// zero disables the deadline, other errors and writers are left alone
+	errOther := errors.New("other")
+	if err := ReplyDeadline(conn, 0)(errOther); err != errOther {
+		t.Fatalf("done(%v) = %v", errOther, err)
+	}
+	if err := ReplyDeadline(&bytes.Buffer{}, time.Second)(nil); err != nil {
+		t.Fatalf("done(nil) for a buffer = %v", err)
+	}
+}
@@ -0,0 +1,77 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// ErrorPhase is the stage of serving a connection an error occurred in
+type ErrorPhase string
+
+const (
+	// PhaseHandshake covers reading, validating and authorizing the request
+	PhaseHandshake ErrorPhase = "handshake"
+	// PhaseAuth covers authenticating the client
+	PhaseAuth ErrorPhase = "auth"
+	// PhaseDial covers establishing the upstream connection
+	PhaseDial ErrorPhase = "dial"
+	// PhaseTunnel covers relaying data, including user handlers
+	PhaseTunnel ErrorPhase = "tunnel"
+)
+
+// ErrorInfo describes an error serving a connection
+type ErrorInfo struct {
+	Phase       ErrorPhase
+	Protocol    string
+	ClientAddr  net.Addr
+	Destination string
+	Err         error
+}
+
+// ErrorHandler observes the errors serving connections, it is used for
+// socks5, socks4 and http. Servers with an ErrorHandler leave logging these
+// errors to it.
+type ErrorHandler func(ctx context.Context, info ErrorInfo)
+
+// PhaseError annotates an error with the phase and destination it occurred
+// at, its message is the one of Err
+type PhaseError struct {
+	Phase       ErrorPhase
+	Destination string
+	Err         error
+}
+
+func (e *PhaseError) Error() string { return e.Err.Error() }
+
+func (e *PhaseError) Unwrap() error { return e.Err }
+
+// WithPhase annotates err with phase and destination, it returns nil if err
+// is nil
+func WithPhase(phase ErrorPhase, destination string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &PhaseError{Phase: phase, Destination: destination, Err: err}
+}
+
+// ReportError passes err to handler with the details of conn, errors without
+// a phase are reported as PhaseHandshake. Benign close errors are not
+// reported.
+func ReportError(ctx context.Context, handler ErrorHandler, protocol string, conn net.Conn, err error) {
+	if handler == nil || err == nil || IsBenignCloseError(err) {
+		return
+	}
+	info := ErrorInfo{
+		Phase:      PhaseHandshake,
+		Protocol:   protocol,
+		ClientAddr: conn.RemoteAddr(),
+		Err:        err,
+	}
+	var phaseErr *PhaseError
+	if errors.As(err, &phaseErr) {
+		info.Phase = phaseErr.Phase
+		info.Destination = phaseErr.Destination
+	}
+	handler(ctx, info)
+}
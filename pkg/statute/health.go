@@ -0,0 +1,91 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// UpstreamHealthCache remembers the recent dial failures by address so dials
+// to a known-dead upstream fail at once rather than after the dial timeout,
+// see HealthCacheProxyDial. It is safe for concurrent use.
+type UpstreamHealthCache struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	failures map[string]dialFailure
+}
+
+type dialFailure struct {
+	err     error
+	expires time.Time
+}
+
+// NewUpstreamHealthCache creates an UpstreamHealthCache remembering dial
+// failures for ttl
+func NewUpstreamHealthCache(ttl time.Duration) *UpstreamHealthCache {
+	return &UpstreamHealthCache{
+		ttl:      ttl,
+		failures: make(map[string]dialFailure),
+	}
+}
+
+// Failure returns the error of the last failed dial to address if it failed
+// within the ttl, or nil
+func (c *UpstreamHealthCache) Failure(network, address string) error {
+	key := network + " " + address
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	failure, ok := c.failures[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(failure.expires) {
+		delete(c.failures, key)
+		return nil
+	}
+	return failure.err
+}
+
+// record remembers err as the failure of the last dial to address, a nil err
+// forgets it
+func (c *UpstreamHealthCache) record(network, address string, err error) {
+	key := network + " " + address
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err == nil {
+		delete(c.failures, key)
+		return
+	}
+	// drop the expired failures now and then so the map stays bounded
+	if len(c.failures) >= 1024 {
+		now := time.Now()
+		for k, failure := range c.failures {
+			if now.After(failure.expires) {
+				delete(c.failures, k)
+			}
+		}
+	}
+	c.failures[key] = dialFailure{err: err, expires: time.Now().Add(c.ttl)}
+}
+
+// HealthCacheProxyDial returns a dial function failing at once with the
+// remembered error while cache holds a recent failure to the address, the
+// error wraps the one of the failed dial so it maps to the same reply.
+// Failures caused by the cancellation of the dial context are not remembered.
+func HealthCacheProxyDial(cache *UpstreamHealthCache, dial ProxyDialFunc) ProxyDialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if err := cache.Failure(network, address); err != nil {
+			return nil, fmt.Errorf("upstream %s recently failed: %w", address, err)
+		}
+		conn, err := dial(ctx, network, address)
+		if err != nil && ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+			return nil, err
+		}
+		cache.record(network, address, err)
+		return conn, err
+	}
+}
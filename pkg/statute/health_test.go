@@ -0,0 +1,65 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestHealthCacheProxyDial(t *testing.T) {
+	const ttl = 100 * time.Millisecond
+	var dials int
+	var dialErr error = syscall.ECONNREFUSED
+	dial := HealthCacheProxyDial(NewUpstreamHealthCache(ttl), func(context.Context, string, string) (net.Conn, error) {
+		dials++
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	})
+
+	if _, err := dial(context.Background(), "tcp", "192.0.2.1:80"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("first dial = %v, want %v", err, syscall.ECONNREFUSED)
+	}
+	// the failure is remembered and keeps its cause, so it maps to the same
+	// reply
+	if _, err := dial(context.Background(), "tcp", "192.0.2.1:80"); !errors.Is(err, syscall.ECONNREFUSED) || dials != 1 {
+		t.Fatalf("second dial = %v after %d dials, want %v without dialing", err, dials, syscall.ECONNREFUSED)
+	}
+	// other addresses are not affected
+	if _, err := dial(context.Background(), "tcp", "192.0.2.2:80"); dials != 2 {
+		t.Fatalf("dial to another address = %v without dialing", err)
+	}
+
+	// the failure expires after the ttl
+	time.Sleep(ttl + 50*time.Millisecond)
+	dialErr = nil
+	conn, err := dial(context.Background(), "tcp", "192.0.2.1:80")
+	if err != nil || dials != 3 {
+		t.Fatalf("dial after the ttl = %v after %d dials, want a new dial", err, dials)
+	}
+	_ = conn.Close()
+}
+
+func TestHealthCacheIgnoresCancelledDials(t *testing.T) {
+	var dials int
+	dial := HealthCacheProxyDial(NewUpstreamHealthCache(time.Minute), func(ctx context.Context, _, _ string) (net.Conn, error) {
+		dials++
+		return nil, ctx.Err()
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := dial(ctx, "tcp", "192.0.2.1:80"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("dial = %v, want %v", err, context.Canceled)
+	}
+	// the upstream is not to blame, the next dial goes through
+	_, _ = dial(context.Background(), "tcp", "192.0.2.1:80")
+	if dials != 2 {
+		t.Fatalf("dialed %d times, want 2", dials)
+	}
+}
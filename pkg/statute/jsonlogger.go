@@ -0,0 +1,108 @@
+package statute
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FieldLogger is a Logger which can attach structured fields to its lines
+type FieldLogger interface {
+	Logger
+	// With returns a logger adding key with value to every line
+	With(key string, value interface{}) Logger
+}
+
+// WithField returns a logger adding key with value to the lines of logger
+// when it supports fields, including a SyncLogger wrapping a FieldLogger,
+// otherwise logger is returned as is
+func WithField(logger Logger, key string, value interface{}) Logger {
+	if fieldLogger, ok := withField(logger, key, value); ok {
+		return fieldLogger
+	}
+	return logger
+}
+
+// withField is WithField, it reports false if logger does not support fields
+func withField(logger Logger, key string, value interface{}) (Logger, bool) {
+	switch l := logger.(type) {
+	case FieldLogger:
+		return l.With(key, value), true
+	case *SyncLogger:
+		if fieldLogger, ok := l.logger.(FieldLogger); ok {
+			return &SyncLogger{mu: l.mu, logger: fieldLogger.With(key, value)}, true
+		}
+	case connLogger:
+		if fieldLogger, ok := withField(l.logger, key, value); ok {
+			return connLogger{prefix: l.prefix, logger: fieldLogger}, true
+		}
+	}
+	return nil, false
+}
+
+// JSONLogger writes every line as a json object, such as
+//
+//	{"level":"debug","ts":"2006-01-02T15:04:05.999Z","msg":"...","fields":{"conn":1}}
+//
+// It is safe for concurrent use, loggers derived with With share its writer.
+type JSONLogger struct {
+	out    *jsonOutput
+	fields map[string]interface{}
+}
+
+type jsonOutput struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type jsonLine struct {
+	Level  string                 `json:"level"`
+	Time   time.Time              `json:"ts"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields,omitempty"`
+}
+
+// NewJSONLogger creates a JSONLogger writing to w
+func NewJSONLogger(w io.Writer) *JSONLogger {
+	return &JSONLogger{out: &jsonOutput{w: w}}
+}
+
+func (l *JSONLogger) Debug(v ...interface{}) {
+	l.write("debug", v)
+}
+
+func (l *JSONLogger) Error(v ...interface{}) {
+	l.write("error", v)
+}
+
+// With returns a logger adding key with value to every line, values which
+// can't be encoded as json are written as strings
+func (l *JSONLogger) With(key string, value interface{}) Logger {
+	fields := make(map[string]interface{}, len(l.fields)+1)
+	for k, v := range l.fields {
+		fields[k] = v
+	}
+	if _, err := json.Marshal(value); err != nil {
+		value = fmt.Sprint(value)
+	}
+	fields[key] = value
+	return &JSONLogger{out: l.out, fields: fields}
+}
+
+func (l *JSONLogger) write(level string, v []interface{}) {
+	line, err := json.Marshal(jsonLine{
+		Level:  level,
+		Time:   time.Now().UTC(),
+		Msg:    strings.TrimSuffix(fmt.Sprintln(v...), "\n"),
+		Fields: l.fields,
+	})
+	if err != nil {
+		return
+	}
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+	_, _ = l.out.w.Write(append(line, '\n'))
+}
@@ -0,0 +1,77 @@
+package statute
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// decodedLine is a line written by JSONLogger
+type decodedLine struct {
+	Level  string                 `json:"level"`
+	Time   time.Time              `json:"ts"`
+	Msg    string                 `json:"msg"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// decodeLines decodes the json lines of out, it fails the test on an
+// invalid one
+func decodeLines(t testing.TB, out *bytes.Buffer) []decodedLine {
+	t.Helper()
+	var lines []decodedLine
+	scanner := bufio.NewScanner(out)
+	for scanner.Scan() {
+		var line decodedLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("invalid json line %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func TestJSONLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewJSONLogger(&out)
+	withDest := WithField(logger, "destination", "example.com:443")
+	start := time.Now().Add(-time.Second)
+
+	logger.Debug("plain", 1)
+	withDest.Error("dial failed")
+	// values json can't encode are written as strings
+	WithField(withDest, "bad", complex(1, 2)).Debug("odd field")
+	// the connection id of ConnLogger is a field, not a prefix
+	ConnLogger(WithConnID(context.Background(), 7), NewSyncLogger(logger)).Debug("served")
+
+	lines := decodeLines(t, &out)
+	if len(lines) != 4 {
+		t.Fatalf("%d lines, want 4", len(lines))
+	}
+	tests := []struct {
+		level, msg string
+		fields     map[string]interface{}
+	}{
+		{"debug", "plain 1", nil},
+		{"error", "dial failed", map[string]interface{}{"destination": "example.com:443"}},
+		{"debug", "odd field", map[string]interface{}{"destination": "example.com:443", "bad": "(1+2i)"}},
+		{"debug", "served", map[string]interface{}{"conn": float64(7)}},
+	}
+	for i, tt := range tests {
+		line := lines[i]
+		if line.Level != tt.level || line.Msg != tt.msg || line.Time.Before(start) {
+			t.Errorf("line %d = %+v, want level %q and msg %q", i, line, tt.level, tt.msg)
+		}
+		if len(line.Fields) != len(tt.fields) {
+			t.Errorf("line %d fields %v, want %v", i, line.Fields, tt.fields)
+			continue
+		}
+		for key, want := range tt.fields {
+			if got := line.Fields[key]; got != want {
+				t.Errorf("line %d field %s = %v, want %v", i, key, line.Fields[key], want)
+			}
+		}
+	}
+}
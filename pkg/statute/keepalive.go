@@ -0,0 +1,39 @@
+package statute
+
+import (
+	"net"
+	"time"
+)
+
+// SetTCPKeepAlive enables TCP keepalive probes every interval on the
+// *net.TCPConn conn is or wraps, unwrapping connections that expose the
+// connection they wrap through NetConn. The probes keep idle connections
+// alive through NAT and firewalls dropping silent flows. Other connections
+// and a zero interval are left alone.
+func SetTCPKeepAlive(conn net.Conn, interval time.Duration) error {
+	if interval <= 0 {
+		return nil
+	}
+	tcpConn, ok := unwrapTCPConn(conn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(interval)
+}
+
+// unwrapTCPConn returns the *net.TCPConn conn is or wraps
+func unwrapTCPConn(conn net.Conn) (*net.TCPConn, bool) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			return c, true
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,117 @@
+//go:build linux
+
+package statute
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// keepAlive returns whether keepalive is enabled on conn and the idle time
+// in seconds before the first probe. Only the idle time is checked since
+// SetKeepAlivePeriod no longer sets the interval between later probes on
+// recent Go releases.
+func keepAlive(t testing.TB, conn *net.TCPConn) (bool, int) {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var enabled, idle int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if enabled, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_KEEPALIVE); sockErr != nil {
+			return
+		}
+		idle, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return enabled != 0, idle
+}
+
+// wrappedConn wraps a connection and exposes it through NetConn
+type wrappedConn struct {
+	net.Conn
+}
+
+func (c wrappedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// noKeepAlivePair returns both ends of a loopback TCP connection with
+// keepalive disabled
+func noKeepAlivePair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	client, server := tcpPair(t)
+	for _, conn := range []*net.TCPConn{client, server} {
+		if err := conn.SetKeepAlive(false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return client, server
+}
+
+func TestSetTCPKeepAlive(t *testing.T) {
+	conn, _ := noKeepAlivePair(t)
+
+	// a zero interval leaves the socket alone
+	if err := SetTCPKeepAlive(conn, 0); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, _ := keepAlive(t, conn); enabled {
+		t.Fatal("keepalive enabled with a zero interval")
+	}
+
+	// the TCP connection is found through NetConn
+	if err := SetTCPKeepAlive(wrappedConn{wrappedConn{conn}}, 7*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if enabled, idle := keepAlive(t, conn); !enabled || idle != 7 {
+		t.Fatalf("keepalive %v after %ds, want enabled after 7s", enabled, idle)
+	}
+
+	// other connections are left alone
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := SetTCPKeepAlive(client, time.Second); err != nil {
+		t.Fatalf("SetTCPKeepAlive(pipe) = %v, want nil", err)
+	}
+}
+
+func TestRelayKeepAliveInterval(t *testing.T) {
+	client, a := noKeepAlivePair(t)
+	b, target := noKeepAlivePair(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _, _ = Relay(ctx, a, b, RelayOptions{KeepAliveInterval: 9 * time.Second})
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// the probes are enabled before anything is relayed
+	if _, err := client.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := target.Read(make([]byte, 1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range []*net.TCPConn{a, b} {
+		if enabled, idle := keepAlive(t, conn); !enabled || idle != 9 {
+			t.Fatalf("keepalive %v after %ds, want enabled after 9s", enabled, idle)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package statute
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Middleware wraps a UserConnectHandler to add behavior around it, such as
+// logging, metrics or access checks. It may return without calling next to
+// reject a request.
+type Middleware func(next UserConnectHandler) UserConnectHandler
+
+// Chain composes middlewares into one, the first one is the outermost and
+// sees a request first
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next UserConnectHandler) UserConnectHandler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// TimingMiddleware logs the destination and duration of every request at
+// debug level once its handler returns
+func TimingMiddleware(logger Logger) Middleware {
+	return func(next UserConnectHandler) UserConnectHandler {
+		return func(req *ProxyRequest) error {
+			start := time.Now()
+			err := next(req)
+			ConnLogger(req.Context, logger).Debug(fmt.Sprintf("%s %s took %s", req.Network, req.Destination, time.Since(start)))
+			return err
+		}
+	}
+}
+
+// RecoverMiddleware turns a panic of the handler into an error wrapping
+// ErrHandlerPanic, the panic is logged with its stack trace
+func RecoverMiddleware(logger Logger) Middleware {
+	return func(next UserConnectHandler) UserConnectHandler {
+		return func(req *ProxyRequest) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					ConnLogger(req.Context, logger).Error(fmt.Sprintf("panic handling %s: %v\n%s", req.Destination, r, debug.Stack()))
+					err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+				}
+			}()
+			return next(req)
+		}
+	}
+}
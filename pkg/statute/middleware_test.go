@@ -0,0 +1,74 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+// tracingMiddleware records its name around the handler it wraps in calls
+func tracingMiddleware(name string, calls *[]string) Middleware {
+	return func(next UserConnectHandler) UserConnectHandler {
+		return func(req *ProxyRequest) error {
+			*calls = append(*calls, name+" in")
+			err := next(req)
+			*calls = append(*calls, name+" out")
+			return err
+		}
+	}
+}
+
+func TestChainOrder(t *testing.T) {
+	var calls []string
+	handler := func(*ProxyRequest) error {
+		calls = append(calls, "handler")
+		return nil
+	}
+	chain := Chain(tracingMiddleware("a", &calls), tracingMiddleware("b", &calls), tracingMiddleware("c", &calls))
+	if err := chain(handler)(&ProxyRequest{Context: context.Background()}); err != nil {
+		t.Fatal(err)
+	}
+	want := "a in, b in, c in, handler, c out, b out, a out"
+	if got := strings.Join(calls, ", "); got != want {
+		t.Fatalf("calls %q, want %q", got, want)
+	}
+
+	// a middleware returning early rejects the request
+	calls = nil
+	errDenied := errors.New("denied")
+	deny := func(UserConnectHandler) UserConnectHandler {
+		return func(*ProxyRequest) error { return errDenied }
+	}
+	err := Chain(tracingMiddleware("a", &calls), deny, tracingMiddleware("c", &calls))(handler)(&ProxyRequest{Context: context.Background()})
+	if !errors.Is(err, errDenied) || strings.Join(calls, ", ") != "a in, a out" {
+		t.Fatalf("rejected request = %v with calls %q", err, calls)
+	}
+}
+
+func TestRecoverMiddleware(t *testing.T) {
+	logger := newRecordingLogger()
+	handler := RecoverMiddleware(logger)(func(*ProxyRequest) error {
+		panic("broken handler")
+	})
+	err := handler(&ProxyRequest{Context: context.Background(), Destination: "example.com:443"})
+	if !errors.Is(err, ErrHandlerPanic) {
+		t.Fatalf("handler() = %v, want %v", err, ErrHandlerPanic)
+	}
+	if len(*logger.lines) != 1 || !strings.Contains((*logger.lines)[0], "broken handler") {
+		t.Fatalf("logged %q, want the panic", *logger.lines)
+	}
+}
+
+func TestTimingMiddleware(t *testing.T) {
+	logger := newRecordingLogger()
+	errFailed := errors.New("failed")
+	handler := TimingMiddleware(logger)(func(*ProxyRequest) error { return errFailed })
+	err := handler(&ProxyRequest{Context: WithConnID(context.Background(), 3), Network: "tcp", Destination: "example.com:443"})
+	if !errors.Is(err, errFailed) {
+		t.Fatalf("handler() = %v, want the error of the handler", err)
+	}
+	if len(*logger.lines) != 1 || !strings.HasPrefix((*logger.lines)[0], "conn=3 tcp example.com:443 took ") {
+		t.Fatalf("logged %q, want the timing of the request", *logger.lines)
+	}
+}
@@ -0,0 +1,45 @@
+package statute
+
+import "context"
+
+type connPolicyKey struct{}
+
+// ConnPolicy overrides settings of the socks5, socks4 and http servers for
+// the connections whose context carries it, such as the connections of one
+// listener. Nil fields keep the settings of the server.
+type ConnPolicy struct {
+	// Authenticator replaces the username/password authenticator, socks4
+	// has none
+	Authenticator UserPassAuthenticator
+	// ACL replaces the ACL
+	ACL ACL
+}
+
+// WithConnPolicy returns a copy of ctx carrying policy
+func WithConnPolicy(ctx context.Context, policy *ConnPolicy) context.Context {
+	return context.WithValue(ctx, connPolicyKey{}, policy)
+}
+
+// ConnPolicyFromContext returns the policy carried by ctx or nil
+func ConnPolicyFromContext(ctx context.Context) *ConnPolicy {
+	policy, _ := ctx.Value(connPolicyKey{}).(*ConnPolicy)
+	return policy
+}
+
+// PolicyACL returns the ACL of the policy carried by ctx, or acl if it has
+// none
+func PolicyACL(ctx context.Context, acl ACL) ACL {
+	if policy := ConnPolicyFromContext(ctx); policy != nil && policy.ACL != nil {
+		return policy.ACL
+	}
+	return acl
+}
+
+// PolicyAuthenticator returns the Authenticator of the policy carried by
+// ctx, or authenticator if it has none
+func PolicyAuthenticator(ctx context.Context, authenticator UserPassAuthenticator) UserPassAuthenticator {
+	if policy := ConnPolicyFromContext(ctx); policy != nil && policy.Authenticator != nil {
+		return policy.Authenticator
+	}
+	return authenticator
+}
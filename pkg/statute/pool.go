@@ -0,0 +1,48 @@
+package statute
+
+import "sync"
+
+// DefaultBufferSize is the size of the buffers handed out by the default
+// BytesPool
+const DefaultBufferSize = 32 * 1024
+
+var defaultBytesPool = NewBytesPool(DefaultBufferSize)
+
+// bytesPool is a sync.Pool backed BytesPool of fixed size buffers. Buffers
+// are not zeroed, they are only used as scratch space by io.CopyBuffer which
+// never exposes bytes it did not read itself.
+type bytesPool struct {
+	pool sync.Pool
+	size int
+}
+
+// NewBytesPool creates a BytesPool of buffers of size bytes, DefaultBufferSize
+// if size is not positive
+func NewBytesPool(size int) BytesPool {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	p := &bytesPool{size: size}
+	p.pool.New = func() interface{} {
+		b := make([]byte, size)
+		return &b
+	}
+	return p
+}
+
+// DefaultBytesPool for BytesPool type, it is shared by all servers
+func DefaultBytesPool() BytesPool {
+	return defaultBytesPool
+}
+
+func (p *bytesPool) Get() []byte {
+	return *p.pool.Get().(*[]byte)
+}
+
+func (p *bytesPool) Put(b []byte) {
+	if cap(b) < p.size {
+		return
+	}
+	b = b[:p.size]
+	p.pool.Put(&b)
+}
@@ -0,0 +1,87 @@
+package statute
+
+import "testing"
+
+func TestBytesPoolReusesBuffers(t *testing.T) {
+	p := NewBytesPool(1024).(*bytesPool)
+	allocated := 0
+	newBuffer := p.pool.New
+	p.pool.New = func() interface{} {
+		allocated++
+		return newBuffer()
+	}
+
+	const rounds = 100
+	for i := 0; i < rounds; i++ {
+		buf := p.Get()
+		if len(buf) != 1024 {
+			t.Fatalf("Get() returned %d bytes, want 1024", len(buf))
+		}
+		p.Put(buf[:10])
+	}
+	// the race detector makes sync.Pool drop some buffers on purpose, most
+	// are still reused
+	if allocated > rounds/2 {
+		t.Fatalf("%d buffers allocated for %d rounds, want them reused", allocated, rounds)
+	}
+
+	// a buffer shorter than the pool size is not pooled
+	p.Put(make([]byte, 16))
+	for i := 0; i < 2; i++ {
+		if buf := p.Get(); len(buf) != 1024 {
+			t.Fatalf("Get() after Put of a short buffer returned %d bytes, want 1024", len(buf))
+		}
+	}
+}
+
+func TestBytesPoolSize(t *testing.T) {
+	tests := []struct {
+		size, want int
+	}{
+		{4096, 4096},
+		{1, 1},
+		{0, DefaultBufferSize},
+		{-1, DefaultBufferSize},
+	}
+	for _, tt := range tests {
+		if got := len(NewBytesPool(tt.size).Get()); got != tt.want {
+			t.Fatalf("NewBytesPool(%d).Get() returned %d bytes, want %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultBytesPoolAllocs(t *testing.T) {
+	pool := DefaultBytesPool()
+	pool.Put(pool.Get())
+	allocs := testing.AllocsPerRun(100, func() {
+		pool.Put(pool.Get())
+	})
+	// only the slice header of Put escapes, never a new buffer
+	if allocs > 1 {
+		t.Fatalf("%v allocations per Get and Put, want at most 1", allocs)
+	}
+}
+
+// BenchmarkBytesPool compares taking the copy buffers of a connection from
+// the default pool with allocating them, B/op shows the difference
+func BenchmarkBytesPool(b *testing.B) {
+	b.Run("pool", func(b *testing.B) {
+		pool := DefaultBytesPool()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			up, down := pool.Get(), pool.Get()
+			pool.Put(up)
+			pool.Put(down)
+		}
+	})
+	b.Run("make", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			up, down := make([]byte, DefaultBufferSize), make([]byte, DefaultBufferSize)
+			sink = [2][]byte{up, down}
+		}
+	})
+}
+
+// sink keeps the buffers of BenchmarkBytesPool from being optimized away
+var sink [2][]byte
@@ -0,0 +1,13 @@
+package statute
+
+import "slices"
+
+// PortAllowed reports whether port passes the allowed and denied port lists,
+// a denied port is rejected and, when allowed is not empty, so is any port
+// missing from it
+func PortAllowed(port int, allowed, denied []int) bool {
+	if slices.Contains(denied, port) {
+		return false
+	}
+	return len(allowed) == 0 || slices.Contains(allowed, port)
+}
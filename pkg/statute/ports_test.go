@@ -0,0 +1,24 @@
+package statute
+
+import "testing"
+
+func TestPortAllowed(t *testing.T) {
+	tests := []struct {
+		port            int
+		allowed, denied []int
+		want            bool
+	}{
+		{80, nil, nil, true},
+		{80, []int{80, 443}, nil, true},
+		{25, []int{80, 443}, nil, false},
+		{25, nil, []int{25}, false},
+		{80, nil, []int{25}, true},
+		// the denied list wins over the allowed one
+		{25, []int{25}, []int{25}, false},
+	}
+	for _, tt := range tests {
+		if got := PortAllowed(tt.port, tt.allowed, tt.denied); got != tt.want {
+			t.Errorf("PortAllowed(%d, %v, %v) = %v, want %v", tt.port, tt.allowed, tt.denied, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package statute
+
+import (
+	"fmt"
+	"net"
+	"runtime/debug"
+)
+
+// RecoverPanic recovers a panic while serving conn, it logs the panic with
+// its stack trace, closes conn and sets err to an error wrapping
+// ErrHandlerPanic. It must be deferred directly:
+//
+//	defer statute.RecoverPanic(logger, conn, &err)
+func RecoverPanic(logger Logger, conn net.Conn, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.Error(fmt.Sprintf("panic serving %s: %v\n%s", conn.RemoteAddr(), r, debug.Stack()))
+	_ = conn.Close()
+	*err = fmt.Errorf("%w: %v", ErrHandlerPanic, r)
+}
@@ -0,0 +1,159 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIdleTimeout is returned by Relay when nothing was copied in either
+// direction for RelayOptions.IdleTimeout
+var ErrIdleTimeout = errors.New("relay idle timeout")
+
+// ErrMaxLifetime is returned by Relay when the connection reached its maximum
+// lifetime, see WithMaxLifetime
+var ErrMaxLifetime = errors.New("connection reached its maximum lifetime")
+
+// ErrByteLimitExceeded is returned by Relay when the bytes copied in both
+// directions together reached RelayOptions.ByteLimit
+var ErrByteLimitExceeded = errors.New("connection byte limit exceeded")
+
+// RelayOptions configures Relay, the zero value is ready to use
+type RelayOptions struct {
+	// BytesPool provides the copy buffers, DefaultBytesPool is used when it
+	// is nil
+	BytesPool BytesPool
+	// IdleTimeout closes the relay when nothing was copied in either
+	// direction for this long, zero means no timeout
+	IdleTimeout time.Duration
+	// ByteLimit closes the relay once the bytes copied in both directions
+	// together reach it, the write crossing it is cut at the limit. Zero
+	// means no limit.
+	ByteLimit int64
+	// KeepAliveInterval enables TCP keepalive probes at this interval on
+	// both connections, see SetTCPKeepAlive. Zero leaves them unchanged.
+	KeepAliveInterval time.Duration
+}
+
+// Relay copies data between a and b in both directions until both are done,
+// either fails or ctx is done, then closes both connections. When one
+// direction reaches EOF the write side of its peer is closed and the other
+// direction keeps flowing. It returns the bytes copied from a to b and from b
+// to a.
+//
+// Every read is written out at once, the buffers only bound how much is
+// copied per read so small writes of interactive protocols are not delayed.
+// A direction between two connections that are or wrap a *net.TCPConn, with
+// every wrapper implementing io.WriterTo and io.ReaderFrom, see WriteTo and
+// ReadFrom, is copied by the kernel instead, with splice on linux, unless
+// IdleTimeout or ByteLimit is set.
+func Relay(ctx context.Context, a, b net.Conn, opts RelayOptions) (upBytes, downBytes int64, err error) {
+	for _, conn := range []net.Conn{a, b} {
+		if err := SetTCPKeepAlive(conn, opts.KeepAliveInterval); err != nil {
+			_ = a.Close()
+			_ = b.Close()
+			return 0, 0, err
+		}
+	}
+
+	bytesPool := opts.BytesPool
+	if bytesPool == nil {
+		bytesPool = DefaultBytesPool()
+	}
+	upBuf := bytesPool.Get()
+	downBuf := bytesPool.Get()
+	defer func() {
+		bytesPool.Put(upBuf)
+		bytesPool.Put(downBuf)
+	}()
+
+	return relay(ctx, a, b, upBuf, downBuf, opts)
+}
+
+// activityTracker records the last time data was copied by a relay
+type activityTracker struct {
+	last atomic.Int64
+}
+
+func newActivityTracker() *activityTracker {
+	t := &activityTracker{}
+	t.touch()
+	return t
+}
+
+func (t *activityTracker) touch() {
+	t.last.Store(time.Now().UnixNano())
+}
+
+// writer wraps w to record activity on every write
+func (t *activityTracker) writer(w io.Writer) io.Writer {
+	return &activityWriter{w: w, tracker: t}
+}
+
+// watch calls expire once no activity was recorded for timeout, it returns
+// early when ctx is done
+func (t *activityTracker) watch(ctx context.Context, timeout time.Duration, expire func()) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			idle := time.Since(time.Unix(0, t.last.Load()))
+			if idle >= timeout {
+				expire()
+				return
+			}
+			timer.Reset(timeout - idle)
+		}
+	}
+}
+
+type activityWriter struct {
+	w       io.Writer
+	tracker *activityTracker
+}
+
+func (w *activityWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.tracker.touch()
+	return n, err
+}
+
+// byteLimitWriter wraps w to count the bytes written into a counter shared
+// with the other direction, the write reaching limit is cut there and
+// calls exceed
+type byteLimitWriter struct {
+	w      io.Writer
+	total  *atomic.Int64
+	limit  int64
+	exceed func()
+}
+
+func (w *byteLimitWriter) Write(p []byte) (int, error) {
+	total := w.total.Add(int64(len(p)))
+	if total <= w.limit {
+		return w.w.Write(p)
+	}
+	allowed := max(int64(len(p))-(total-w.limit), 0)
+	n, err := w.w.Write(p[:allowed])
+	if err == nil {
+		err = ErrByteLimitExceeded
+	}
+	w.exceed()
+	return n, err
+}
+
+// WithMaxLifetime returns a context which is done with cause ErrMaxLifetime
+// once lifetime elapsed, Relay and the servers end connections served with
+// it then. A zero lifetime returns ctx unchanged.
+func WithMaxLifetime(ctx context.Context, lifetime time.Duration) (context.Context, context.CancelFunc) {
+	if lifetime <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, lifetime, ErrMaxLifetime)
+}
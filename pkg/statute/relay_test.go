@@ -0,0 +1,209 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingPool is a BytesPool counting the buffers taken and returned
+type countingPool struct {
+	BytesPool
+	gets, puts atomic.Int64
+}
+
+func (p *countingPool) Get() []byte {
+	p.gets.Add(1)
+	return p.BytesPool.Get()
+}
+
+func (p *countingPool) Put(b []byte) {
+	p.puts.Add(1)
+	p.BytesPool.Put(b)
+}
+
+// relayResult is what Relay returned
+type relayResult struct {
+	up, down int64
+	err      error
+}
+
+// startRelay relays between the proxy ends of two pipes, it returns the
+// client and target ends and the result of Relay
+func startRelay(ctx context.Context, opts RelayOptions) (client, target net.Conn, result <-chan relayResult) {
+	client, proxyClient := net.Pipe()
+	proxyTarget, target := net.Pipe()
+	done := make(chan relayResult, 1)
+	go func() {
+		up, down, err := Relay(ctx, proxyClient, proxyTarget, opts)
+		done <- relayResult{up, down, err}
+	}()
+	return client, target, done
+}
+
+// waitRelay returns the result of Relay, it fails the test when Relay does
+// not return in time
+func waitRelay(t testing.TB, result <-chan relayResult) relayResult {
+	t.Helper()
+	select {
+	case r := <-result:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return")
+		return relayResult{}
+	}
+}
+
+func TestRelayCopiesBothWays(t *testing.T) {
+	pool := &countingPool{BytesPool: NewBytesPool(0)}
+	client, target, result := startRelay(context.Background(), RelayOptions{BytesPool: pool})
+	defer client.Close()
+	defer target.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = target.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		_, _ = client.Write([]byte("request"))
+	}()
+	request := make([]byte, len("request"))
+	if _, err := io.ReadFull(target, request); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_, _ = target.Write([]byte("the response"))
+	}()
+	response := make([]byte, len("the response"))
+	if _, err := io.ReadFull(client, response); err != nil {
+		t.Fatal(err)
+	}
+	// pipes can't half-close, closing one end ends both directions
+	_ = client.Close()
+
+	r := waitRelay(t, result)
+	if r.up != int64(len(request)) || r.down != int64(len(response)) {
+		t.Fatalf("Relay() copied %d up and %d down, want %d and %d", r.up, r.down, len(request), len(response))
+	}
+	if _, err := target.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("target read after Relay = %v, want EOF", err)
+	}
+	if gets, puts := pool.gets.Load(), pool.puts.Load(); gets != 2 || puts != 2 {
+		t.Fatalf("Relay took %d and returned %d buffers, want one per direction", gets, puts)
+	}
+}
+
+func TestRelayEndsWithContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	client, target, result := startRelay(ctx, RelayOptions{})
+	defer client.Close()
+	defer target.Close()
+
+	cancel()
+	// a plain cancellation is a normal end, not an error
+	if r := waitRelay(t, result); r.err != nil && !IsBenignCloseError(r.err) {
+		t.Fatalf("Relay() = %v after cancel", r.err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("client read after cancel = %v, want EOF", err)
+	}
+}
+
+func TestRelayIdleTimeout(t *testing.T) {
+	client, target, result := startRelay(context.Background(), RelayOptions{IdleTimeout: 100 * time.Millisecond})
+	defer client.Close()
+	defer target.Close()
+	go func() {
+		_, _ = io.Copy(io.Discard, target)
+	}()
+
+	// activity keeps the relay open past the timeout
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := client.Write([]byte("x")); err != nil {
+			t.Fatalf("write %d: %v", i, err)
+		}
+	}
+	start := time.Now()
+	if r := waitRelay(t, result); !errors.Is(r.err, ErrIdleTimeout) {
+		t.Fatalf("Relay() = %v, want %v", r.err, ErrIdleTimeout)
+	}
+	if idle := time.Since(start); idle > time.Second {
+		t.Fatalf("Relay returned after %v idle, want about 100ms", idle)
+	}
+}
+
+func TestRelayByteLimit(t *testing.T) {
+	client, target, result := startRelay(context.Background(), RelayOptions{ByteLimit: 10})
+	defer client.Close()
+	defer target.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = target.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		_, _ = client.Write([]byte("abcdef"))
+	}()
+	if _, err := io.ReadFull(target, make([]byte, 6)); err != nil {
+		t.Fatal(err)
+	}
+	// both directions count towards the limit, the response crosses it
+	go func() {
+		_, _ = target.Write([]byte("0123456789"))
+	}()
+	got, _ := io.ReadAll(client)
+	if string(got) != "0123" {
+		t.Fatalf("client read %q, want the response cut at the limit %q", got, "0123")
+	}
+
+	r := waitRelay(t, result)
+	if !errors.Is(r.err, ErrByteLimitExceeded) {
+		t.Fatalf("Relay() = %v, want %v", r.err, ErrByteLimitExceeded)
+	}
+	if r.up != 6 || r.down != 4 {
+		t.Fatalf("Relay() copied %d up and %d down, want 6 and 4", r.up, r.down)
+	}
+	// both connections are closed
+	if _, err := target.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("target read after the limit = %v, want EOF", err)
+	}
+}
+
+func TestRelayChunkSize(t *testing.T) {
+	client, target, result := startRelay(context.Background(), RelayOptions{BytesPool: NewBytesPool(4)})
+	defer target.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	_ = target.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// a single byte is written out without waiting for more
+	go func() {
+		_, _ = client.Write([]byte("x"))
+	}()
+	b := make([]byte, 16)
+	if n, err := target.Read(b); err != nil || string(b[:n]) != "x" {
+		t.Fatalf("read %q, %v, want %q", b[:n], err, "x")
+	}
+
+	// a larger write is relayed in chunks of the buffer size
+	go func() {
+		_, _ = client.Write([]byte("0123456789"))
+	}()
+	var got []byte
+	for len(got) < 10 {
+		n, err := target.Read(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n > 4 {
+			t.Fatalf("read %d bytes at once, want at most the 4 byte buffer", n)
+		}
+		got = append(got, b[:n]...)
+	}
+	if string(got) != "0123456789" {
+		t.Fatalf("relayed %q, want %q", got, "0123456789")
+	}
+	_ = client.Close()
+	waitRelay(t, result)
+}
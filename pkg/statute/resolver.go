@@ -0,0 +1,196 @@
+package statute
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Resolver looks up the IP addresses of a host, *net.Resolver implements it
+type Resolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+// TTLResolver is a Resolver which also reports how long the addresses it
+// returns are valid, CachingResolver honors it
+type TTLResolver interface {
+	Resolver
+	LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error)
+}
+
+const (
+	// DefaultResolverCacheSize is the number of hosts CachingResolver keeps
+	// when its size is not positive
+	DefaultResolverCacheSize = 1024
+	// DefaultNegativeTTL is how long failed lookups are cached
+	DefaultNegativeTTL = 5 * time.Second
+)
+
+// CachingResolver caches the lookups of a Resolver in a bounded LRU cache.
+// Entries live for the TTL reported by a TTLResolver clamped to the minimum
+// and maximum TTL, or for the minimum TTL when the resolver reports none.
+// Failed lookups are cached briefly, see SetNegativeTTL. It is safe for
+// concurrent use.
+type CachingResolver struct {
+	resolver    Resolver
+	size        int
+	minTTL      time.Duration
+	maxTTL      time.Duration
+	negativeTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type resolverEntry struct {
+	key     string
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+// NewCachingResolver caches the lookups of resolver, net.DefaultResolver if
+// nil, keeping up to size hosts
+func NewCachingResolver(resolver Resolver, size int, minTTL, maxTTL time.Duration) *CachingResolver {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	if size <= 0 {
+		size = DefaultResolverCacheSize
+	}
+	if maxTTL < minTTL {
+		maxTTL = minTTL
+	}
+	return &CachingResolver{
+		resolver:    resolver,
+		size:        size,
+		minTTL:      minTTL,
+		maxTTL:      maxTTL,
+		negativeTTL: DefaultNegativeTTL,
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+// SetNegativeTTL sets how long failed lookups are cached, zero disables
+// caching them
+func (r *CachingResolver) SetNegativeTTL(ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.negativeTTL = ttl
+}
+
+// LookupIP returns the cached addresses of host or looks them up
+func (r *CachingResolver) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	key := network + "/" + host
+	if entry := r.get(key); entry != nil {
+		return entry.ips, entry.err
+	}
+
+	var (
+		ips []net.IP
+		ttl = r.minTTL
+		err error
+	)
+	if ttlResolver, ok := r.resolver.(TTLResolver); ok {
+		ips, ttl, err = ttlResolver.LookupIPTTL(ctx, network, host)
+		ttl = min(max(ttl, r.minTTL), r.maxTTL)
+	} else {
+		ips, err = r.resolver.LookupIP(ctx, network, host)
+	}
+	if err != nil {
+		// cancellations say nothing about the host
+		if ctx.Err() == nil {
+			r.put(key, nil, err, 0)
+		}
+		return nil, err
+	}
+	r.put(key, ips, nil, ttl)
+	return ips, nil
+}
+
+// get returns the unexpired entry of key or nil
+func (r *CachingResolver) get(key string) *resolverEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	elem, ok := r.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*resolverEntry)
+	if time.Now().After(entry.expires) {
+		r.lru.Remove(elem)
+		delete(r.entries, key)
+		return nil
+	}
+	r.lru.MoveToFront(elem)
+	return entry
+}
+
+// put caches a lookup for ttl, or for the negative TTL if err is set
+func (r *CachingResolver) put(key string, ips []net.IP, err error, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		ttl = r.negativeTTL
+	}
+	if ttl <= 0 {
+		return
+	}
+
+	entry := &resolverEntry{key: key, ips: ips, err: err, expires: time.Now().Add(ttl)}
+	if elem, ok := r.entries[key]; ok {
+		elem.Value = entry
+		r.lru.MoveToFront(elem)
+		return
+	}
+	r.entries[key] = r.lru.PushFront(entry)
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*resolverEntry).key)
+	}
+}
+
+// ResolvingProxyDial resolves host names with resolver before dialing with
+// dial, the addresses are tried in order until one connects
+func ResolvingProxyDial(resolver Resolver, dial ProxyDialFunc) ProxyDialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(address)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, address)
+		}
+
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4", "udp4":
+			ipNetwork = "ip4"
+		case "tcp6", "udp6":
+			ipNetwork = "ip6"
+		}
+		ips, err := resolver.LookupIP(ctx, ipNetwork, host)
+		if err != nil {
+			return nil, err
+		}
+		if len(ips) == 0 {
+			return nil, errors.New("no addresses found for " + host)
+		}
+
+		var dialErr error
+		for _, ip := range ips {
+			conn, err := dial(ctx, network, net.JoinHostPort(ip.String(), port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+			if ctx.Err() != nil {
+				break
+			}
+		}
+		return nil, dialErr
+	}
+}
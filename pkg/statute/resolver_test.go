@@ -0,0 +1,196 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingResolver answers every host with 192.0.2.1, or with err, and
+// counts the lookups of every host. A positive ttl makes it a TTLResolver.
+type countingResolver struct {
+	ttl time.Duration
+	err error
+
+	mu      sync.Mutex
+	lookups map[string]int
+}
+
+func newCountingResolver(ttl time.Duration, err error) *countingResolver {
+	return &countingResolver{ttl: ttl, err: err, lookups: make(map[string]int)}
+}
+
+func (r *countingResolver) LookupIP(_ context.Context, _, host string) ([]net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups[host]++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+}
+
+func (r *countingResolver) count(host string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookups[host]
+}
+
+// ttlResolver is a countingResolver reporting its ttl
+type ttlResolver struct {
+	*countingResolver
+}
+
+func (r ttlResolver) LookupIPTTL(ctx context.Context, network, host string) ([]net.IP, time.Duration, error) {
+	ips, err := r.LookupIP(ctx, network, host)
+	return ips, r.ttl, err
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		resolver func() (Resolver, *countingResolver)
+		minTTL   time.Duration
+		maxTTL   time.Duration
+		// lifetime is how long the entry is expected to live
+		lifetime time.Duration
+	}{
+		{"no TTL uses the minimum", func() (Resolver, *countingResolver) {
+			r := newCountingResolver(0, nil)
+			return r, r
+		}, 100 * time.Millisecond, time.Hour, 100 * time.Millisecond},
+		{"reported TTL", func() (Resolver, *countingResolver) {
+			r := newCountingResolver(100*time.Millisecond, nil)
+			return ttlResolver{r}, r
+		}, time.Millisecond, time.Hour, 100 * time.Millisecond},
+		{"TTL raised to the minimum", func() (Resolver, *countingResolver) {
+			r := newCountingResolver(time.Millisecond, nil)
+			return ttlResolver{r}, r
+		}, 100 * time.Millisecond, time.Hour, 100 * time.Millisecond},
+		{"TTL lowered to the maximum", func() (Resolver, *countingResolver) {
+			r := newCountingResolver(time.Hour, nil)
+			return ttlResolver{r}, r
+		}, time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resolver, counter := tt.resolver()
+			cache := NewCachingResolver(resolver, 0, tt.minTTL, tt.maxTTL)
+			for i := 0; i < 3; i++ {
+				ips, err := cache.LookupIP(context.Background(), "ip", "example.com")
+				if err != nil || len(ips) != 1 {
+					t.Fatalf("lookup %d = %v, %v", i, ips, err)
+				}
+			}
+			if n := counter.count("example.com"); n != 1 {
+				t.Fatalf("%d lookups while cached, want 1", n)
+			}
+			time.Sleep(tt.lifetime + 50*time.Millisecond)
+			_, _ = cache.LookupIP(context.Background(), "ip", "example.com")
+			if n := counter.count("example.com"); n != 2 {
+				t.Fatalf("%d lookups after expiry, want 2", n)
+			}
+		})
+	}
+}
+
+func TestCachingResolverEviction(t *testing.T) {
+	resolver := newCountingResolver(0, nil)
+	cache := NewCachingResolver(resolver, 2, time.Hour, time.Hour)
+	for _, host := range []string{"a.example", "b.example", "a.example", "c.example", "a.example", "b.example"} {
+		if _, err := cache.LookupIP(context.Background(), "ip", host); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// b was the least recently used when c was added
+	want := map[string]int{"a.example": 1, "b.example": 2, "c.example": 1}
+	for host, n := range want {
+		if got := resolver.count(host); got != n {
+			t.Fatalf("%d lookups of %s, want %d", got, host, n)
+		}
+	}
+
+	// the network is part of the key
+	if _, err := cache.LookupIP(context.Background(), "ip4", "a.example"); err != nil {
+		t.Fatal(err)
+	}
+	if got := resolver.count("a.example"); got != 2 {
+		t.Fatalf("%d lookups of a.example, want 2", got)
+	}
+}
+
+func TestCachingResolverNegativeTTL(t *testing.T) {
+	errNotFound := &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}
+	resolver := newCountingResolver(0, errNotFound)
+	cache := NewCachingResolver(resolver, 0, time.Hour, time.Hour)
+	for i := 0; i < 2; i++ {
+		if _, err := cache.LookupIP(context.Background(), "ip", "example.invalid"); err != errNotFound {
+			t.Fatalf("lookup %d error %v, want %v", i, err, errNotFound)
+		}
+	}
+	if n := resolver.count("example.invalid"); n != 1 {
+		t.Fatalf("%d lookups, want the failure cached", n)
+	}
+
+	// a cancelled lookup is not cached
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, _ = cache.LookupIP(ctx, "ip", "cancelled.example")
+	_, _ = cache.LookupIP(context.Background(), "ip", "cancelled.example")
+	if n := resolver.count("cancelled.example"); n != 2 {
+		t.Fatalf("%d lookups, want the cancelled one not cached", n)
+	}
+
+	cache.SetNegativeTTL(0)
+	for i := 0; i < 2; i++ {
+		_, _ = cache.LookupIP(context.Background(), "ip", "uncached.example")
+	}
+	if n := resolver.count("uncached.example"); n != 2 {
+		t.Fatalf("%d lookups, want failures not cached", n)
+	}
+}
+
+// resolverFunc is a Resolver calling itself
+type resolverFunc func(ctx context.Context, network, host string) ([]net.IP, error)
+
+func (f resolverFunc) LookupIP(ctx context.Context, network, host string) ([]net.IP, error) {
+	return f(ctx, network, host)
+}
+
+func TestResolvingProxyDial(t *testing.T) {
+	resolver := resolverFunc(func(context.Context, string, string) ([]net.IP, error) {
+		return []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(192, 0, 2, 2)}, nil
+	})
+	var dialed []string
+	dial := ResolvingProxyDial(resolver, func(_ context.Context, _, address string) (net.Conn, error) {
+		dialed = append(dialed, address)
+		if address == "192.0.2.1:80" {
+			return nil, errors.New("unreachable")
+		}
+		client, server := net.Pipe()
+		_ = server.Close()
+		return client, nil
+	})
+	conn, err := dial(context.Background(), "tcp", "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if len(dialed) != 2 || dialed[0] != "192.0.2.1:80" || dialed[1] != "192.0.2.2:80" {
+		t.Fatalf("dialed %v, want both addresses in order", dialed)
+	}
+
+	// IP addresses are dialed as they are
+	dialed = nil
+	conn, err = dial(context.Background(), "tcp", "192.0.2.2:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if len(dialed) != 1 || dialed[0] != "192.0.2.2:80" {
+		t.Fatalf("dialed %v, want only 192.0.2.2:80", dialed)
+	}
+}
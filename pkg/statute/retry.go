@@ -0,0 +1,55 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// RetryProxyDial retries dial up to attempts times in total while it fails
+// with a transient error, such as a refused connection or a timeout. The
+// wait before the second attempt is backoff and doubles for every further
+// attempt. Other errors, like an unreachable host or a failed name lookup,
+// are returned at once.
+func RetryProxyDial(attempts int, backoff time.Duration, dial ProxyDialFunc) ProxyDialFunc {
+	if attempts <= 1 {
+		return dial
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		wait := backoff
+		for attempt := 1; ; attempt++ {
+			conn, err := dial(ctx, network, address)
+			if err == nil || attempt == attempts || !isTransientDialError(err) {
+				return conn, err
+			}
+
+			timer := time.NewTimer(wait)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, err
+			case <-timer.C:
+			}
+			wait *= 2
+		}
+	}
+}
+
+// isTransientDialError reports whether a dial failing with err may succeed
+// when retried
+func isTransientDialError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return false
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,101 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryProxyDial(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	timedOut := &net.OpError{Op: "dial", Net: "tcp", Err: os.ErrDeadlineExceeded}
+	notFound := &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}}
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}
+
+	tests := []struct {
+		name         string
+		errs         []error
+		wantAttempts int
+		wantErr      error
+	}{
+		{"first attempt", nil, 1, nil},
+		{"refused then accepted", []error{refused, refused}, 3, nil},
+		{"timeout then accepted", []error{timedOut}, 2, nil},
+		{"always refused", []error{refused, refused, refused, refused}, 3, refused},
+		{"name not found", []error{notFound}, 1, notFound},
+		{"network unreachable", []error{unreachable}, 1, unreachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			attempts := 0
+			dial := RetryProxyDial(3, time.Millisecond, func(context.Context, string, string) (net.Conn, error) {
+				attempts++
+				if attempts <= len(tt.errs) {
+					return nil, tt.errs[attempts-1]
+				}
+				client, server := net.Pipe()
+				_ = server.Close()
+				return client, nil
+			})
+			conn, err := dial(context.Background(), "tcp", "192.0.2.1:80")
+			if conn != nil {
+				_ = conn.Close()
+			}
+			if err != tt.wantErr {
+				t.Fatalf("error %v, want %v", err, tt.wantErr)
+			}
+			if attempts != tt.wantAttempts {
+				t.Fatalf("%d attempts, want %d", attempts, tt.wantAttempts)
+			}
+		})
+	}
+}
+
+func TestRetryProxyDialBackoff(t *testing.T) {
+	var times []time.Time
+	dial := RetryProxyDial(4, 20*time.Millisecond, func(context.Context, string, string) (net.Conn, error) {
+		times = append(times, time.Now())
+		return nil, syscall.ECONNREFUSED
+	})
+	if _, err := dial(context.Background(), "tcp", "192.0.2.1:80"); !errors.Is(err, syscall.ECONNREFUSED) {
+		t.Fatalf("error %v, want connection refused", err)
+	}
+	if len(times) != 4 {
+		t.Fatalf("%d attempts, want 4", len(times))
+	}
+	// the waits are 20ms, 40ms and 80ms
+	for i, want := range []time.Duration{20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond} {
+		if got := times[i+1].Sub(times[i]); got < want {
+			t.Fatalf("wait %d was %v, want at least %v", i+1, got, want)
+		}
+	}
+
+	// a cancelled context ends the wait with the last dial error
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	dial = RetryProxyDial(3, time.Hour, func(context.Context, string, string) (net.Conn, error) {
+		attempts++
+		cancel()
+		return nil, syscall.ECONNREFUSED
+	})
+	done := make(chan error, 1)
+	go func() {
+		_, err := dial(ctx, "tcp", "192.0.2.1:80")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if !errors.Is(err, syscall.ECONNREFUSED) {
+			t.Fatalf("error %v, want connection refused", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("dial still waiting after the context was cancelled")
+	}
+	if attempts != 1 {
+		t.Fatalf("%d attempts, want 1", attempts)
+	}
+}
@@ -0,0 +1,141 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+var errEmptyPattern = errors.New("empty route pattern")
+
+// routeRule is a single pattern to handler mapping of a Router
+type routeRule struct {
+	// suffix matches hosts ending with it, set for "*.example.com" patterns
+	suffix string
+	// host matches the exact destination host
+	host string
+	// network matches the resolved destination ip, set for CIDR patterns
+	network *net.IPNet
+	// any matches every destination, set for the "*" pattern
+	any     bool
+	handler UserConnectHandler
+}
+
+func (r *routeRule) matchHost(host string) bool {
+	switch {
+	case r.any:
+		return true
+	case r.suffix != "":
+		return strings.HasSuffix(host, r.suffix)
+	case r.host != "":
+		return host == r.host
+	}
+	return false
+}
+
+// Router selects a UserConnectHandler based on the destination of a request.
+// Rules are evaluated in the order they were added and the first match wins.
+// Supported patterns are exact host names ("example.com"), suffix globs
+// ("*.internal"), CIDRs ("10.0.0.0/8") which are matched against the
+// resolved destination ip, and "*" which matches everything.
+type Router struct {
+	// Default is used when no rule matches the destination
+	Default UserConnectHandler
+	// Resolver is used to resolve destination host names for CIDR rules,
+	// net.DefaultResolver if nil
+	Resolver Resolver
+
+	mu    sync.RWMutex
+	rules []*routeRule
+}
+
+// NewRouter creates a Router that falls back to defaultHandler when no rule
+// matches, defaultHandler may be nil
+func NewRouter(defaultHandler UserConnectHandler) *Router {
+	return &Router{
+		Default:  defaultHandler,
+		Resolver: net.DefaultResolver,
+	}
+}
+
+// Handle registers handler for the destinations matching pattern
+func (r *Router) Handle(pattern string, handler UserConnectHandler) error {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "" {
+		return errEmptyPattern
+	}
+
+	rule := &routeRule{handler: handler}
+	switch {
+	case pattern == "*":
+		rule.any = true
+	case strings.Contains(pattern, "/"):
+		_, network, err := net.ParseCIDR(pattern)
+		if err != nil {
+			return err
+		}
+		rule.network = network
+	case strings.HasPrefix(pattern, "*."):
+		rule.suffix = pattern[1:]
+	default:
+		rule.host = strings.TrimSuffix(pattern, ".")
+	}
+
+	r.mu.Lock()
+	r.rules = append(r.rules, rule)
+	r.mu.Unlock()
+	return nil
+}
+
+// Route returns the handler of the first rule matching the destination of
+// req, or Default if nothing matches
+func (r *Router) Route(ctx context.Context, req *ProxyRequest) UserConnectHandler {
+	host := strings.TrimSuffix(strings.ToLower(req.DestHost), ".")
+
+	// rules are only ever appended, so the slice taken under the lock stays
+	// valid and a slow lookup doesn't block Handle
+	r.mu.RLock()
+	rules := r.rules
+	r.mu.RUnlock()
+
+	var ips []net.IP
+	resolved := false
+	for _, rule := range rules {
+		if rule.network == nil {
+			if rule.matchHost(host) {
+				return rule.handler
+			}
+			continue
+		}
+
+		// resolve lazily, only once a CIDR rule has to be evaluated
+		if !resolved {
+			ips = r.resolve(ctx, host)
+			resolved = true
+		}
+		for _, ip := range ips {
+			if rule.network.Contains(ip) {
+				return rule.handler
+			}
+		}
+	}
+	return r.Default
+}
+
+func (r *Router) resolve(ctx context.Context, host string) []net.IP {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}
+	}
+
+	var resolver Resolver = net.DefaultResolver
+	if r.Resolver != nil {
+		resolver = r.Resolver
+	}
+	ips, err := resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil
+	}
+	return ips
+}
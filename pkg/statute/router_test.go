@@ -0,0 +1,165 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// namedHandler returns a handler failing with name, so the handler a Router
+// picks can be told apart
+func namedHandler(name string) UserConnectHandler {
+	return func(*ProxyRequest) error {
+		return errors.New(name)
+	}
+}
+
+// handlerName returns the name of a namedHandler, or "" for nil
+func handlerName(handler UserConnectHandler) string {
+	if handler == nil {
+		return ""
+	}
+	return handler(nil).Error()
+}
+
+func TestRouterRoute(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		lookups []string
+	)
+	router := NewRouter(namedHandler("default"))
+	router.Resolver = resolverFunc(func(_ context.Context, _, host string) ([]net.IP, error) {
+		mu.Lock()
+		lookups = append(lookups, host)
+		mu.Unlock()
+		switch host {
+		case "app.corp":
+			return []net.IP{net.IPv4(192, 0, 2, 1), net.IPv4(10, 0, 0, 5)}, nil
+		case "public.corp":
+			return []net.IP{net.IPv4(192, 0, 2, 1)}, nil
+		}
+		return nil, errors.New("no such host")
+	})
+	for _, rule := range []struct{ pattern, name string }{
+		{"*.internal", "internal"},
+		// shadowed by the rule above
+		{"db.internal", "db"},
+		{"Example.com.", "exact"},
+		{"10.0.0.0/8", "private"},
+		{"2001:db8::/32", "documentation"},
+	} {
+		if err := router.Handle(rule.pattern, namedHandler(rule.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		host string
+		want string
+		// lookup is whether the host is resolved for the CIDR rules
+		lookup bool
+	}{
+		{"db.internal", "internal", false},
+		{"a.b.internal", "internal", false},
+		{"internal", "default", true},
+		{"EXAMPLE.COM.", "exact", false},
+		{"www.example.com", "default", true},
+		{"10.1.2.3", "private", false},
+		{"2001:db8::1", "documentation", false},
+		{"app.corp", "private", true},
+		{"public.corp", "default", true},
+		{"missing.corp", "default", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			mu.Lock()
+			lookups = nil
+			mu.Unlock()
+			got := handlerName(router.Route(context.Background(), &ProxyRequest{DestHost: tt.host}))
+			if got != tt.want {
+				t.Fatalf("Route(%q) = %q, want %q", tt.host, got, tt.want)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if (len(lookups) != 0) != tt.lookup || len(lookups) > 1 {
+				t.Fatalf("lookups %v, want a single one: %v", lookups, tt.lookup)
+			}
+		})
+	}
+}
+
+func TestRouterDefault(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback UserConnectHandler
+		patterns []string
+		want     string
+	}{
+		{"no rules", namedHandler("default"), nil, "default"},
+		{"no rules nor default", nil, nil, ""},
+		{"any", namedHandler("default"), []string{"*"}, "any"},
+		{"no match", nil, []string{"*.internal"}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := NewRouter(tt.fallback)
+			for _, pattern := range tt.patterns {
+				if err := router.Handle(pattern, namedHandler("any")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := handlerName(router.Route(context.Background(), &ProxyRequest{DestHost: "example.com"}))
+			if got != tt.want {
+				t.Fatalf("Route() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouterHandleInvalidPattern(t *testing.T) {
+	router := NewRouter(nil)
+	if err := router.Handle("  ", namedHandler("empty")); !errors.Is(err, errEmptyPattern) {
+		t.Fatalf("Handle(empty) = %v, want %v", err, errEmptyPattern)
+	}
+	if err := router.Handle("10.0.0.0/33", namedHandler("cidr")); err == nil {
+		t.Fatal("Handle(invalid CIDR) succeeded")
+	}
+}
+
+func TestRouterSlowLookupDoesNotBlockHandle(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	router := NewRouter(nil)
+	router.Resolver = resolverFunc(func(context.Context, string, string) ([]net.IP, error) {
+		close(started)
+		<-release
+		return []net.IP{net.IPv4(10, 0, 0, 1)}, nil
+	})
+	if err := router.Handle("10.0.0.0/8", namedHandler("private")); err != nil {
+		t.Fatal(err)
+	}
+
+	routed := make(chan UserConnectHandler, 1)
+	go func() {
+		routed <- router.Route(context.Background(), &ProxyRequest{DestHost: "slow.example"})
+	}()
+	<-started
+	handled := make(chan error, 1)
+	go func() {
+		handled <- router.Handle("*", namedHandler("any"))
+	}()
+	select {
+	case err := <-handled:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handle blocked by a lookup in progress")
+	}
+	close(release)
+	if got := handlerName(<-routed); got != "private" {
+		t.Fatalf("Route() = %q, want %q", got, "private")
+	}
+}
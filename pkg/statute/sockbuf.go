@@ -0,0 +1,44 @@
+package statute
+
+import (
+	"context"
+	"net"
+)
+
+// SetSocketBuffers sets the SO_RCVBUF and SO_SNDBUF sizes of conn when it is
+// a *net.TCPConn, other connections are left alone. Sizes that are not
+// positive are not set. The kernel may clamp the sizes, on Linux to
+// net.core.rmem_max and net.core.wmem_max, and doubles them for bookkeeping.
+func SetSocketBuffers(conn net.Conn, readSize, writeSize int) error {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if readSize > 0 {
+		if err := tcpConn.SetReadBuffer(readSize); err != nil {
+			return err
+		}
+	}
+	if writeSize > 0 {
+		if err := tcpConn.SetWriteBuffer(writeSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SocketBufferProxyDial sets the socket buffer sizes of the connections dial
+// returns, see SetSocketBuffers
+func SocketBufferProxyDial(readSize, writeSize int, dial ProxyDialFunc) ProxyDialFunc {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if err := SetSocketBuffers(conn, readSize, writeSize); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
@@ -0,0 +1,78 @@
+//go:build linux
+
+package statute
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+)
+
+// socketBuffers returns the SO_RCVBUF and SO_SNDBUF sizes of conn
+func socketBuffers(t testing.TB, conn *net.TCPConn) (int, int) {
+	t.Helper()
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var readSize, writeSize int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		readSize, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if sockErr == nil {
+			writeSize, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockErr != nil {
+		t.Fatal(sockErr)
+	}
+	return readSize, writeSize
+}
+
+func TestSocketBufferProxyDial(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// small sizes, below any sysctl limit, which Linux doubles
+	conn, err := SocketBufferProxyDial(8192, 16384, DefaultProxyDial())(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readSize, writeSize := socketBuffers(t, conn.(*net.TCPConn))
+	if readSize != 2*8192 || writeSize != 2*16384 {
+		t.Fatalf("buffers = %d, %d, want %d, %d", readSize, writeSize, 2*8192, 2*16384)
+	}
+
+	// a size which is not positive keeps the system default
+	plain, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer plain.Close()
+	defaultRead, _ := socketBuffers(t, plain.(*net.TCPConn))
+	conn, err = SocketBufferProxyDial(0, 8192, DefaultProxyDial())(context.Background(), "tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	readSize, writeSize = socketBuffers(t, conn.(*net.TCPConn))
+	if readSize != defaultRead || writeSize != 2*8192 {
+		t.Fatalf("buffers = %d, %d, want %d, %d", readSize, writeSize, defaultRead, 2*8192)
+	}
+
+	// other connections are left alone
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	if err := SetSocketBuffers(client, 8192, 8192); err != nil {
+		t.Fatalf("SetSocketBuffers(pipe) = %v, want nil", err)
+	}
+}
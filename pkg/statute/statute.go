@@ -2,11 +2,26 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"sync"
 )
 
+// ErrHandlerRequired is returned when a request is denied because no user
+// handler is set and the embedded handlers are disabled
+var ErrHandlerRequired = errors.New("request denied, no user handler is set")
+
+// ErrRequestDenied can be returned, or wrapped, by hooks such as
+// PreConnectFunc to reject a request as not allowed by the rules of the
+// server, socks5 answers it with the connection not allowed reply
+var ErrRequestDenied = errors.New("request denied")
+
+// ErrHandlerPanic is wrapped by the error returned when serving a connection
+// panicked, such as in a user handler
+var ErrHandlerPanic = errors.New("handler panicked")
+
 type Logger interface {
 	Debug(v ...interface{})
 	Error(v ...interface{})
@@ -22,6 +37,34 @@ func (l DefaultLogger) Error(v ...interface{}) {
 	fmt.Println(v...)
 }
 
+// SyncLogger wraps a Logger and serializes its calls so lines logged from
+// many goroutines don't interleave
+type SyncLogger struct {
+	// mu is shared with the loggers derived by WithField
+	mu     *sync.Mutex
+	logger Logger
+}
+
+// NewSyncLogger wraps logger with a SyncLogger, a SyncLogger is returned as is
+func NewSyncLogger(logger Logger) *SyncLogger {
+	if l, ok := logger.(*SyncLogger); ok {
+		return l
+	}
+	return &SyncLogger{mu: &sync.Mutex{}, logger: logger}
+}
+
+func (l *SyncLogger) Debug(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger.Debug(v...)
+}
+
+func (l *SyncLogger) Error(v ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logger.Error(v...)
+}
+
 type ProxyRequest struct {
 	Conn        net.Conn
 	Reader      io.Reader
@@ -30,6 +73,25 @@ type ProxyRequest struct {
 	Destination string
 	DestHost    string
 	DestPort    int32
+	// ClientAddr is the address of the client as seen by the accepted
+	// connection, it stays correct when Conn is wrapped by the server
+	ClientAddr net.Addr
+	// Context is the context of the connection, see ConnID. Conn is closed
+	// once it is done, for example when a mixed Proxy forcibly shuts down,
+	// so handlers blocked copying from or to Conn return, see also
+	// CopyWithContext
+	Context context.Context
+	// ConnID identifies the connection in logs, zero if it has none
+	ConnID uint64
+	// Reply sends the reply of a socks CONNECT request whose server defers
+	// it, see the DeferConnectReply option of socks5 and socks4. bindAddr is
+	// reported to the client as the bound address, usually the local address
+	// of the upstream connection, and a non-nil err sends a failure reply.
+	// Handlers call it once they have dialed and before writing to Conn,
+	// only the first call has an effect and the server replies on return
+	// of the handler if it was not called. It is nil when the success reply
+	// is sent before the handler runs.
+	Reply func(bindAddr net.Addr, err error) error
 }
 
 // UserConnectHandler is used for socks5, socks4 and http
@@ -38,6 +100,29 @@ type UserConnectHandler func(request *ProxyRequest) error
 // UserAssociateHandler is used for socks5
 type UserAssociateHandler func(request *ProxyRequest) error
 
+// ACL reports whether a request to host:port over network is allowed, it is
+// used for socks5, socks4 and http, and for every datagram relayed by socks5
+type ACL func(ctx context.Context, network string, host string, port int) bool
+
+// UserPassAuthenticator reports whether username and password are valid
+// credentials
+type UserPassAuthenticator func(ctx context.Context, username, password string) bool
+
+// CredentialChecker reports whether username and password are valid
+// credentials, an error means they could not be checked, for example because
+// the backing store is unreachable, and is treated as a rejection
+type CredentialChecker func(ctx context.Context, username, password string) (bool, error)
+
+// DestinationRewriter rewrites the destination host and port of a request
+// before it is dialed or handed to a handler, returning an error rejects the
+// request. It is used for socks5, socks4 and http
+type DestinationRewriter func(ctx context.Context, network string, host string, port int) (string, int, error)
+
+// PreConnectFunc runs before a CONNECT request is dialed or handed to a
+// handler, it may change DestHost and DestPort of req to redirect the request
+// or return an error to reject it. It is used for socks5
+type PreConnectFunc func(ctx context.Context, req *ProxyRequest) error
+
 // ProxyDialFunc is used for socks5, socks4 and http
 type ProxyDialFunc func(ctx context.Context, network string, address string) (net.Conn, error)
 
@@ -47,6 +132,16 @@ func DefaultProxyDial() ProxyDialFunc {
 	return dialer.DialContext
 }
 
+// LocalAddrProxyDial for ProxyDialFunc type, it dials from localAddr, or like
+// DefaultProxyDial if localAddr is nil
+func LocalAddrProxyDial(localAddr *net.TCPAddr) ProxyDialFunc {
+	if localAddr == nil {
+		return DefaultProxyDial()
+	}
+	dialer := net.Dialer{LocalAddr: localAddr}
+	return dialer.DialContext
+}
+
 // ProxyListenPacket specifies the optional proxyListenPacket function for
 // establishing the transport connection.
 type ProxyListenPacket func(ctx context.Context, network string, address string) (net.PacketConn, error)
@@ -57,10 +152,54 @@ func DefaultProxyListenPacket() ProxyListenPacket {
 	return listener.ListenPacket
 }
 
-// PacketForwardAddress specifies the packet forwarding address
+// ProxyPacketDialFunc specifies the optional function for creating the
+// packet connection used to exchange datagrams with address. The socks5
+// server passes udp4 or udp6 as network, the family of address.
+type ProxyPacketDialFunc func(ctx context.Context, network string, address string) (net.PacketConn, error)
+
+// DefaultProxyPacketDial for ProxyPacketDialFunc type, it listens on an
+// ephemeral port of all interfaces
+func DefaultProxyPacketDial() ProxyPacketDialFunc {
+	var listener net.ListenConfig
+	return func(ctx context.Context, network string, _ string) (net.PacketConn, error) {
+		return listener.ListenPacket(ctx, network, "")
+	}
+}
+
+// LocalAddrProxyPacketDial for ProxyPacketDialFunc type, it listens on an
+// ephemeral port of the IP of localAddr, or like DefaultProxyPacketDial if
+// localAddr is nil or its IP is a wildcard. The port of localAddr is ignored
+// since every association needs a socket of its own. For a udp4 or udp6
+// network localAddr only applies when it is of that family, other networks
+// listen like DefaultProxyPacketDial so targets of the other family stay
+// reachable.
+func LocalAddrProxyPacketDial(localAddr *net.UDPAddr) ProxyPacketDialFunc {
+	if localAddr == nil || localAddr.IP == nil || localAddr.IP.IsUnspecified() {
+		return DefaultProxyPacketDial()
+	}
+	var listener net.ListenConfig
+	address := (&net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone}).String()
+	isIPv4 := localAddr.IP.To4() != nil
+	return func(ctx context.Context, network string, _ string) (net.PacketConn, error) {
+		if (network == "udp4" && !isIPv4) || (network == "udp6" && isIPv4) {
+			return listener.ListenPacket(ctx, network, "")
+		}
+		return listener.ListenPacket(ctx, network, address)
+	}
+}
+
+// PacketForwardAddress specifies the packet forwarding address, the returned
+// ip and port are sent as BND.ADDR and BND.PORT of the UDP ASSOCIATE reply so
+// they must be reachable by the client. Behind NAT return the externally
+// reachable endpoint of the relay socket rather than its local address.
 type PacketForwardAddress func(ctx context.Context, destinationAddr string,
 	packet net.PacketConn, conn net.Conn) (net.IP, int, error)
 
+// PacketForwardHost is like PacketForwardAddress but returns a host, which
+// is sent as a DOMAINNAME (ATYP 3) bound address unless it is an IP
+type PacketForwardHost func(ctx context.Context, destinationAddr string,
+	packet net.PacketConn, conn net.Conn) (string, int, error)
+
 // BytesPool is an interface for getting and returning temporary
 // bytes for use by io.CopyBuffer.
 type BytesPool interface {
@@ -0,0 +1,106 @@
+package statute
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestLocalAddrProxyPacketDial(t *testing.T) {
+	// the port must not be reused by every association
+	dial := LocalAddrProxyPacketDial(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 40053})
+	seen := make(map[int]bool)
+	for i := 0; i < 2; i++ {
+		conn, err := dial(context.Background(), "udp4", "127.0.0.1:53")
+		if err != nil {
+			t.Fatalf("dial %d: %v", i, err)
+		}
+		defer conn.Close()
+		local := conn.LocalAddr().(*net.UDPAddr)
+		if !local.IP.Equal(net.IPv4(127, 0, 0, 1)) {
+			t.Fatalf("dial %d bound to %v, want 127.0.0.1", i, local)
+		}
+		if local.Port == 40053 || seen[local.Port] {
+			t.Fatalf("dial %d bound to port %d, want a fresh ephemeral port", i, local.Port)
+		}
+		seen[local.Port] = true
+	}
+
+	// an IPv6 target gets an IPv6 socket despite the IPv4 local address
+	conn, err := dial(context.Background(), "udp6", "[::1]:53")
+	if err != nil {
+		t.Skipf("no IPv6: %v", err)
+	}
+	defer conn.Close()
+	if local := conn.LocalAddr().(*net.UDPAddr); local.IP.To4() != nil {
+		t.Fatalf("udp6 dial bound to %v, want an IPv6 address", local)
+	}
+}
+
+// recordingLogger is a FieldLogger which is not safe for concurrent use, it
+// counts the calls that overlap another one
+type recordingLogger struct {
+	prefix   string
+	lines    *[]string
+	busy     *atomic.Int32
+	overlaps *atomic.Int32
+}
+
+func newRecordingLogger() recordingLogger {
+	return recordingLogger{lines: new([]string), busy: new(atomic.Int32), overlaps: new(atomic.Int32)}
+}
+
+func (l recordingLogger) record(v ...interface{}) {
+	if l.busy.Add(1) != 1 {
+		l.overlaps.Add(1)
+	}
+	*l.lines = append(*l.lines, l.prefix+fmt.Sprint(v...))
+	l.busy.Add(-1)
+}
+
+func (l recordingLogger) Debug(v ...interface{}) { l.record(v...) }
+func (l recordingLogger) Error(v ...interface{}) { l.record(v...) }
+
+func (l recordingLogger) With(key string, value interface{}) Logger {
+	l.prefix += fmt.Sprintf("%s=%v ", key, value)
+	return l
+}
+
+func TestSyncLoggerConcurrent(t *testing.T) {
+	const goroutines, lines = 64, 100
+	tests := []struct {
+		name   string
+		logger func(shared *SyncLogger, i int) Logger
+	}{
+		{"shared", func(shared *SyncLogger, i int) Logger { return shared }},
+		{"rewrapped", func(shared *SyncLogger, i int) Logger { return NewSyncLogger(shared) }},
+		{"fields", func(shared *SyncLogger, i int) Logger { return WithField(shared, "goroutine", i) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recorder := newRecordingLogger()
+			shared := NewSyncLogger(recorder)
+			var wg sync.WaitGroup
+			for i := 0; i < goroutines; i++ {
+				wg.Add(1)
+				go func(logger Logger) {
+					defer wg.Done()
+					for j := 0; j < lines; j++ {
+						logger.Debug("debug ", j)
+						logger.Error("error ", j)
+					}
+				}(tt.logger(shared, i))
+			}
+			wg.Wait()
+			if n := recorder.overlaps.Load(); n != 0 {
+				t.Fatalf("%d calls overlapped", n)
+			}
+			if got, want := len(*recorder.lines), goroutines*lines*2; got != want {
+				t.Fatalf("recorded %d lines, want %d", got, want)
+			}
+		})
+	}
+}
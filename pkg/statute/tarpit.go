@@ -0,0 +1,24 @@
+package statute
+
+import (
+	"context"
+	"time"
+)
+
+// AuthFailureDelay waits for delay before a failed authentication is
+// answered, which slows down credential brute-forcing without delaying
+// legitimate users. It returns the cause of ctx if ctx is done first, the
+// failure should then not be answered. A zero delay returns at once.
+func AuthFailureDelay(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-timer.C:
+		return nil
+	}
+}
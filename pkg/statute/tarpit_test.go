@@ -0,0 +1,37 @@
+package statute
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthFailureDelay(t *testing.T) {
+	start := time.Now()
+	if err := AuthFailureDelay(context.Background(), 0); err != nil || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("AuthFailureDelay(0) = %v after %v, want nil at once", err, time.Since(start))
+	}
+
+	start = time.Now()
+	if err := AuthFailureDelay(context.Background(), 100*time.Millisecond); err != nil {
+		t.Fatalf("AuthFailureDelay() = %v", err)
+	}
+	if waited := time.Since(start); waited < 100*time.Millisecond {
+		t.Fatalf("AuthFailureDelay() returned after %v, want 100ms", waited)
+	}
+
+	// the context aborts the delay with its cause
+	errGone := errors.New("client gone")
+	ctx, cancel := context.WithCancelCause(context.Background())
+	time.AfterFunc(50*time.Millisecond, func() {
+		cancel(errGone)
+	})
+	start = time.Now()
+	if err := AuthFailureDelay(ctx, time.Minute); !errors.Is(err, errGone) {
+		t.Fatalf("AuthFailureDelay() = %v, want %v", err, errGone)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Fatalf("AuthFailureDelay() returned after %v, want at the cancellation", waited)
+	}
+}
@@ -0,0 +1,43 @@
+package statute
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+)
+
+// TLSDialFunc returns a dial function wrapping the connections of base in a
+// TLS client using a copy of cfg. Unless cfg sets a ServerName, the host of
+// the dialed address is used for SNI and certificate verification, so the
+// address should carry the destination host name rather than an IP: wrap a
+// resolving dial function, such as ResolvingProxyDial, instead of being
+// wrapped by one. The handshake completes before the connection is returned.
+func TLSDialFunc(base ProxyDialFunc, cfg *tls.Config) ProxyDialFunc {
+	if base == nil {
+		base = DefaultProxyDial()
+	}
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := base(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		config := cfg.Clone()
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if config.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				host = address
+			}
+			config.ServerName = host
+		}
+		tlsConn := tls.Client(conn, config)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,74 @@
+package statute
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTLSDialFunc(t *testing.T) {
+	serverNames := make(chan string, 4)
+	srv := httptest.NewUnstartedServer(http.NotFoundHandler())
+	srv.TLS = &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverNames <- hello.ServerName
+			return nil, nil
+		},
+	}
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// base reaches the test server whatever host is dialed, the certificate
+	// of which is valid for example.com and 127.0.0.1
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	base := func(ctx context.Context, network, address string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	tests := []struct {
+		name       string
+		serverName string
+		host       string
+		wantSNI    string
+		wantErr    bool
+	}{
+		{name: "host name", host: "example.com", wantSNI: "example.com"},
+		{name: "config server name", serverName: "example.com", host: "127.0.0.1", wantSNI: "example.com"},
+		{name: "certificate mismatch", host: "wrong.example.org", wantSNI: "wrong.example.org", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &tls.Config{RootCAs: roots, ServerName: tt.serverName}
+			conn, err := TLSDialFunc(base, cfg)(context.Background(), "tcp", net.JoinHostPort(tt.host, port))
+			if tt.wantErr {
+				if err == nil {
+					conn.Close()
+					t.Fatal("dial succeeded, want a verification error")
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				conn.Close()
+				if _, ok := conn.(*tls.Conn); !ok {
+					t.Fatalf("dial returned %T, want a *tls.Conn", conn)
+				}
+			}
+			if got := <-serverNames; got != tt.wantSNI {
+				t.Fatalf("SNI = %q, want %q", got, tt.wantSNI)
+			}
+			if cfg.ServerName != tt.serverName {
+				t.Fatalf("config ServerName changed to %q", cfg.ServerName)
+			}
+		})
+	}
+}
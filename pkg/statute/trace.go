@@ -0,0 +1,151 @@
+package statute
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+type connTraceKey struct{}
+
+// ConnTrace is a set of hooks called while the socks5, socks4 and http
+// servers serve a connection whose context carries it, see WithConnTrace.
+// Any hook may be nil. They run on the goroutine serving the connection,
+// except FirstByte which runs on the one reading the upstream, and must not
+// block.
+type ConnTrace struct {
+	// HandshakeStart is called when the server starts reading the handshake
+	// or request of the client
+	HandshakeStart func()
+	// AuthDone is called once the client authenticated, or failed to, with
+	// method, one of the AuthMethod constants, and the claimed username
+	AuthDone func(method, username string, ok bool)
+	// DialStart is called before an embedded handler dials the destination,
+	// user handlers dial on their own and do not trigger it
+	DialStart func(network, address string)
+	// DialDone is called once the dial of DialStart completed
+	DialDone func(network, address string, err error)
+	// FirstByte is called when the first byte is read from the connection
+	// of DialDone. Setting it makes relays copy through a wrapper, so the
+	// kernel no longer copies between two TCP connections.
+	FirstByte func()
+	// Close is called once the server is done with the connection, err is
+	// the error serving it returned
+	Close func(err error)
+}
+
+// WithConnTrace returns a copy of ctx carrying trace, the connections served
+// with it call its hooks. A mixed Proxy adds it with its WithConnTrace
+// option, other servers take it from the context set by their WithContext
+// option or passed to ServeConnContext.
+func WithConnTrace(ctx context.Context, trace *ConnTrace) context.Context {
+	return context.WithValue(ctx, connTraceKey{}, trace)
+}
+
+// ContextConnTrace returns the trace carried by ctx or nil
+func ContextConnTrace(ctx context.Context) *ConnTrace {
+	trace, _ := ctx.Value(connTraceKey{}).(*ConnTrace)
+	return trace
+}
+
+// TraceHandshakeStart calls the HandshakeStart hook of the trace carried by
+// ctx, if any
+func TraceHandshakeStart(ctx context.Context) {
+	if trace := ContextConnTrace(ctx); trace != nil && trace.HandshakeStart != nil {
+		trace.HandshakeStart()
+	}
+}
+
+// TraceAuthDone calls the AuthDone hook of the trace carried by ctx, if any
+func TraceAuthDone(ctx context.Context, method, username string, ok bool) {
+	if trace := ContextConnTrace(ctx); trace != nil && trace.AuthDone != nil {
+		trace.AuthDone(method, username, ok)
+	}
+}
+
+// TraceClose calls the Close hook of the trace carried by ctx, if any
+func TraceClose(ctx context.Context, err error) {
+	if trace := ContextConnTrace(ctx); trace != nil && trace.Close != nil {
+		trace.Close(err)
+	}
+}
+
+// TraceDial dials address with dial, calling the DialStart, DialDone and
+// FirstByte hooks of the trace carried by ctx, if any
+func TraceDial(ctx context.Context, dial ProxyDialFunc, network, address string) (net.Conn, error) {
+	trace := ContextConnTrace(ctx)
+	if trace == nil {
+		return dial(ctx, network, address)
+	}
+	if trace.DialStart != nil {
+		trace.DialStart(network, address)
+	}
+	conn, err := dial(ctx, network, address)
+	if trace.DialDone != nil {
+		trace.DialDone(network, address, err)
+	}
+	if err != nil || trace.FirstByte == nil {
+		return conn, err
+	}
+	return &firstByteConn{Conn: conn, firstByte: trace.FirstByte}, nil
+}
+
+// firstByteConn calls firstByte on its first successful read
+type firstByteConn struct {
+	net.Conn
+	once      sync.Once
+	seen      atomic.Bool
+	firstByte func()
+}
+
+func (c *firstByteConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.once.Do(c.firstByte)
+		c.seen.Store(true)
+	}
+	return n, err
+}
+
+// NetConn returns the wrapped connection
+func (c *firstByteConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// CloseWrite shuts down the writing side of the wrapped connection, see
+// CloseWrite
+func (c *firstByteConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+// WriteTo reads up to the first byte itself so firstByte is called, then
+// lets the wrapped connection copy the rest, see WriteTo
+func (c *firstByteConn) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	for !c.seen.Load() {
+		var b [1]byte
+		n, err := c.Read(b[:])
+		if n > 0 {
+			m, werr := w.Write(b[:n])
+			written += int64(m)
+			if werr != nil {
+				return written, werr
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	n, err := WriteTo(c.Conn, w)
+	return written + n, err
+}
+
+// ReadFrom lets the wrapped connection copy from r, see ReadFrom
+func (c *firstByteConn) ReadFrom(r io.Reader) (int64, error) {
+	return ReadFrom(c.Conn, r)
+}
@@ -2,12 +2,16 @@ package statute
 
 import (
 	"context"
+	"errors"
 	"io"
 	"net"
 	"os"
 	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 )
 
 // isClosedConnError reports whether err is an error from use of a closed
@@ -36,6 +40,22 @@ func isClosedConnError(err error) bool {
 	return false
 }
 
+// IsBenignCloseError reports whether err is caused by the normal termination
+// of a connection, such errors are not worth logging
+func IsBenignCloseError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	return isClosedConnError(err)
+}
+
 func errno(v error) uintptr {
 	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Uintptr {
 		return uintptr(rv.Uint())
@@ -43,26 +63,178 @@ func errno(v error) uintptr {
 	return 0
 }
 
+// closeWriter is implemented by connections supporting half-close, such as
+// *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
 // Tunnel create tunnels for two io.ReadWriteCloser
+// When one direction reaches EOF the write side of its peer is closed and the
+// other direction keeps flowing, the tunnel is torn down once both directions
+// are done or either of them fails.
 func Tunnel(ctx context.Context, c1, c2 io.ReadWriteCloser, buf1, buf2 []byte) error {
-	ctx, cancel := context.WithCancel(ctx)
-	var errs tunnelErr
+	_, _, err := relay(ctx, c2, c1, buf1, buf2, RelayOptions{})
+	return err
+}
+
+// relay copies a to b with upBuf and b to a with downBuf until both
+// directions are done, either fails, ctx is done, nothing was copied for the
+// idle timeout or the byte limit is reached, opts.BytesPool is not used
+func relay(ctx context.Context, a, b io.ReadWriteCloser, upBuf, downBuf []byte, opts RelayOptions) (int64, int64, error) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var (
+		up, down int64
+		errs     tunnelErr
+		wg       sync.WaitGroup
+		activity *activityTracker
+	)
+	dstA, dstB := io.Writer(a), io.Writer(b)
+	if opts.IdleTimeout > 0 {
+		activity = newActivityTracker()
+		dstA = activity.writer(dstA)
+		dstB = activity.writer(dstB)
+	}
+	if opts.ByteLimit > 0 {
+		var total atomic.Int64
+		exceed := func() {
+			cancel(ErrByteLimitExceeded)
+		}
+		dstA = &byteLimitWriter{w: dstA, total: &total, limit: opts.ByteLimit, exceed: exceed}
+		dstB = &byteLimitWriter{w: dstB, total: &total, limit: opts.ByteLimit, exceed: exceed}
+	}
+
+	wg.Add(2)
 	go func() {
-		_, errs[0] = io.CopyBuffer(c1, c2, buf1)
-		cancel()
+		defer wg.Done()
+		up, errs[0] = copyConn(dstB, a, upBuf)
+		if errs[0] != nil || !halfClose(b) {
+			cancel(nil)
+		}
 	}()
 	go func() {
-		_, errs[1] = io.CopyBuffer(c2, c1, buf2)
-		cancel()
+		defer wg.Done()
+		down, errs[1] = copyConn(dstA, b, downBuf)
+		if errs[1] != nil || !halfClose(a) {
+			cancel(nil)
+		}
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
 	}()
-	<-ctx.Done()
-	errs[2] = c1.Close()
-	errs[3] = c2.Close()
-	errs[4] = ctx.Err()
+	if activity != nil {
+		go activity.watch(ctx, opts.IdleTimeout, func() {
+			cancel(ErrIdleTimeout)
+		})
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+	errs[2] = b.Close()
+	errs[3] = a.Close()
+	// closing the connections unblocks any pending copy
+	<-done
+	errs[4] = context.Cause(ctx)
 	if errs[4] == context.Canceled {
 		errs[4] = nil
 	}
-	return errs.FirstError()
+	if errs[4] == ErrIdleTimeout || errs[4] == ErrMaxLifetime || errs[4] == ErrByteLimitExceeded {
+		// report the limit rather than the errors it caused
+		return up, down, errs[4]
+	}
+	return up, down, errs.FirstError()
+}
+
+// copyConn copies src to dst. When both are connections wrapping a
+// *net.TCPConn through wrappers forwarding io.WriterTo and io.ReaderFrom, it
+// uses io.Copy so the kernel copies the data, with splice on linux, while the
+// wrappers still see the bytes and drain what they buffered. Otherwise buf is
+// used, io.CopyBuffer would ignore it for a src implementing io.WriterTo,
+// such as a *net.TCPConn relayed to a wrapped connection, and allocate its
+// own.
+func copyConn(dst io.Writer, src io.Reader, buf []byte) (int64, error) {
+	if canSplice(dst, src) {
+		return io.Copy(dst, src)
+	}
+	return io.CopyBuffer(writerOnly{dst}, readerOnly{src}, buf)
+}
+
+// canSplice reports whether copyConn lets the kernel copy src to dst
+func canSplice(dst io.Writer, src io.Reader) bool {
+	dstConn, ok := dst.(net.Conn)
+	if !ok {
+		return false
+	}
+	srcConn, ok := src.(net.Conn)
+	if !ok {
+		return false
+	}
+	if _, ok := dst.(io.ReaderFrom); !ok {
+		return false
+	}
+	if _, ok := src.(io.WriterTo); !ok {
+		return false
+	}
+	if _, ok := unwrapTCPConn(dstConn); !ok {
+		return false
+	}
+	_, ok = unwrapTCPConn(srcConn)
+	return ok
+}
+
+// WriteTo copies src to w with the io.WriterTo of src if it has one, for
+// connection wrappers implementing io.WriterTo by forwarding to the
+// connection they wrap
+func WriteTo(src io.Reader, w io.Writer) (int64, error) {
+	if wt, ok := src.(io.WriterTo); ok {
+		return wt.WriteTo(w)
+	}
+	return io.Copy(w, readerOnly{src})
+}
+
+// ReadFrom copies r to dst with the io.ReaderFrom of dst if it has one, for
+// connection wrappers implementing io.ReaderFrom by forwarding to the
+// connection they wrap
+func ReadFrom(dst io.Writer, r io.Reader) (int64, error) {
+	if rf, ok := dst.(io.ReaderFrom); ok {
+		return rf.ReadFrom(r)
+	}
+	return io.Copy(writerOnly{dst}, r)
+}
+
+// readerOnly and writerOnly hide the io.WriterTo and io.ReaderFrom of the
+// wrapped reader and writer
+type readerOnly struct {
+	io.Reader
+}
+
+type writerOnly struct {
+	io.Writer
+}
+
+// CloseWrite closes the write side of w if it supports half-close, such as
+// a *net.TCPConn or a wrapper delegating to one. Otherwise w is left open
+// and errors.ErrUnsupported is returned, so the caller can fall back to
+// closing the whole connection.
+func CloseWrite(w io.Writer) error {
+	cw, ok := w.(closeWriter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+// halfClose closes the write side of c, it reports false if c does not
+// support half-close
+func halfClose(c io.ReadWriteCloser) bool {
+	return CloseWrite(c) == nil
 }
 
 type tunnelErr [5]error
@@ -70,7 +242,7 @@ type tunnelErr [5]error
 func (t tunnelErr) FirstError() error {
 	for _, err := range t {
 		if err != nil {
-			if isClosedConnError(err) {
+			if IsBenignCloseError(err) {
 				return nil
 			}
 			return err
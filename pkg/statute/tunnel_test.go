@@ -0,0 +1,292 @@
+package statute
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tcpPair returns the two ends of a loopback TCP connection
+func tcpPair(t testing.TB) (*net.TCPConn, *net.TCPConn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, ok := <-accepted
+	if !ok {
+		t.Fatal("accept failed")
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client.(*net.TCPConn), server.(*net.TCPConn)
+}
+
+// noHalfCloseConn hides the CloseWrite of the wrapped connection
+type noHalfCloseConn struct {
+	net.Conn
+}
+
+func TestRelayHalfClose(t *testing.T) {
+	tests := []struct {
+		name string
+		wrap func(net.Conn) net.Conn
+	}{
+		{"tcp", func(c net.Conn) net.Conn { return c }},
+		{"wrapped", func(c net.Conn) net.Conn { return NewAccessConn(c, "test") }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, proxyClient := tcpPair(t)
+			proxyTarget, target := tcpPair(t)
+
+			relayed := make(chan error, 1)
+			go func() {
+				_, _, err := Relay(context.Background(), tt.wrap(proxyClient), tt.wrap(proxyTarget), RelayOptions{})
+				relayed <- err
+			}()
+
+			// the target answers once the request is complete
+			go func() {
+				request, _ := io.ReadAll(target)
+				_, _ = target.Write(append([]byte("response to "), request...))
+				_ = target.Close()
+			}()
+
+			if _, err := client.Write([]byte("request")); err != nil {
+				t.Fatal(err)
+			}
+			if err := client.CloseWrite(); err != nil {
+				t.Fatal(err)
+			}
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			response, err := io.ReadAll(client)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(response), "response to request"; got != want {
+				t.Fatalf("response = %q, want %q", got, want)
+			}
+			select {
+			case err := <-relayed:
+				if err != nil {
+					t.Fatalf("Relay() = %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Relay did not return")
+			}
+		})
+	}
+}
+
+func TestRelayWithoutHalfCloseEndsBothDirections(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyTarget, target := tcpPair(t)
+
+	relayed := make(chan error, 1)
+	go func() {
+		_, _, err := Relay(context.Background(), noHalfCloseConn{proxyClient}, noHalfCloseConn{proxyTarget}, RelayOptions{})
+		relayed <- err
+	}()
+
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-relayed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Relay did not return after EOF on a connection without half-close")
+	}
+	_ = target.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := target.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("target read = %v, want EOF", err)
+	}
+}
+
+func TestCloseWrite(t *testing.T) {
+	client, server := tcpPair(t)
+	if err := CloseWrite(NewAccessConn(client, "test")); err != nil {
+		t.Fatalf("CloseWrite(wrapped tcp) = %v", err)
+	}
+	_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := server.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+		t.Fatalf("read after CloseWrite = %v, want EOF", err)
+	}
+	// the read side stays open
+	if _, err := server.Write([]byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("read after CloseWrite = %v", err)
+	}
+
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+	if err := CloseWrite(NewAccessConn(a, "test")); !errors.Is(err, errors.ErrUnsupported) {
+		t.Fatalf("CloseWrite(pipe) = %v, want %v", err, errors.ErrUnsupported)
+	}
+	// an unsupported half-close leaves the connection open
+	go func() {
+		_, _ = a.Write([]byte("x"))
+	}()
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != nil {
+		t.Fatalf("pipe closed by CloseWrite: %v", err)
+	}
+}
+
+// plainConn hides the io.WriterTo and io.ReaderFrom of the wrapped connection
+type plainConn struct {
+	net.Conn
+}
+
+func (c plainConn) CloseWrite() error {
+	return CloseWrite(c.Conn)
+}
+
+func TestCanSplice(t *testing.T) {
+	client, server := tcpPair(t)
+	a, b := net.Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	tests := []struct {
+		name string
+		dst  io.Writer
+		src  io.Reader
+		want bool
+	}{
+		{"tcp", client, server, true},
+		{"wrapped", NewAccessConn(client, "test"), NewAccessConn(&firstByteConn{Conn: server, firstByte: func() {}}, "test"), true},
+		{"wrapper without WriteTo", client, plainConn{server}, false},
+		{"wrapper without ReadFrom", plainConn{client}, server, false},
+		{"not tcp", NewAccessConn(a, "test"), NewAccessConn(b, "test"), false},
+		{"not a connection", &activityWriter{w: client, tracker: newActivityTracker()}, server, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canSplice(tt.dst, tt.src); got != tt.want {
+				t.Fatalf("canSplice() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRelayWrappedCountsAndFirstByte(t *testing.T) {
+	client, proxyClient := tcpPair(t)
+	proxyTarget, target := tcpPair(t)
+
+	var firstByte atomic.Bool
+	a := NewAccessConn(proxyClient, "test")
+	b := &firstByteConn{Conn: proxyTarget, firstByte: func() { firstByte.Store(true) }}
+	relayed := make(chan struct{})
+	var up, down int64
+	go func() {
+		defer close(relayed)
+		up, down, _ = Relay(context.Background(), a, b, RelayOptions{})
+	}()
+	go func() {
+		request, _ := io.ReadAll(target)
+		_, _ = target.Write(request)
+		_ = target.Close()
+	}()
+
+	payload := bytes.Repeat([]byte("x"), 1<<20)
+	go func() {
+		_, _ = client.Write(payload)
+		_ = client.CloseWrite()
+	}()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-relayed
+	if !bytes.Equal(echoed, payload) {
+		t.Fatalf("echoed %d bytes, want %d", len(echoed), len(payload))
+	}
+	if up != int64(len(payload)) || down != int64(len(payload)) {
+		t.Fatalf("Relay() copied %d up and %d down, want %d", up, down, len(payload))
+	}
+	if got := a.bytesIn.Load(); got != int64(len(payload)) {
+		t.Fatalf("access log counted %d bytes in, want %d", got, len(payload))
+	}
+	if got := a.bytesOut.Load(); got != int64(len(payload)) {
+		t.Fatalf("access log counted %d bytes out, want %d", got, len(payload))
+	}
+	if !firstByte.Load() {
+		t.Fatal("firstByte hook not called")
+	}
+}
+
+// BenchmarkRelay streams through Relay between wrapped connections, the
+// splice case takes the kernel copy of copyConn and the buffer case the
+// pooled buffers
+func BenchmarkRelay(b *testing.B) {
+	const chunk = 64 << 10
+	tests := []struct {
+		name   string
+		wrap   func(net.Conn) net.Conn
+		splice bool
+	}{
+		{"splice", func(c net.Conn) net.Conn { return NewAccessConn(c, "test") }, true},
+		{"buffer", func(c net.Conn) net.Conn { return plainConn{NewAccessConn(c, "test")} }, false},
+	}
+	for _, tt := range tests {
+		b.Run(tt.name, func(b *testing.B) {
+			client, proxyClient := tcpPair(b)
+			proxyTarget, target := tcpPair(b)
+			src, dst := tt.wrap(proxyClient), tt.wrap(proxyTarget)
+			if got := canSplice(dst, src); got != tt.splice {
+				b.Fatalf("canSplice() = %v, want %v", got, tt.splice)
+			}
+			go func() {
+				_, _, _ = Relay(context.Background(), src, dst, RelayOptions{})
+			}()
+			go func() {
+				buf := make([]byte, chunk)
+				for i := 0; i < b.N; i++ {
+					if _, err := client.Write(buf); err != nil {
+						return
+					}
+				}
+				_ = client.CloseWrite()
+			}()
+
+			b.SetBytes(chunk)
+			b.ReportAllocs()
+			b.ResetTimer()
+			n, err := io.Copy(io.Discard, target)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if n != int64(b.N)*chunk {
+				b.Fatalf("received %d bytes, want %d", n, int64(b.N)*chunk)
+			}
+		})
+	}
+}